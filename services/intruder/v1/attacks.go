@@ -18,7 +18,7 @@ type AttackResult struct {
 	Log         string `json:"log,omitempty"`
 }
 
-func GetChainedToken(services []string, target string) (string, error) {
+func (h handler) GetChainedToken(services []string, target string) (string, error) {
 	if len(services) == 0 {
 		return "", nil
 	}
@@ -26,18 +26,18 @@ func GetChainedToken(services []string, target string) (string, error) {
 	for i := 0; i < len(services)-1; i += 1 {
 		tgt := fmt.Sprintf("%s/leaks/id-token", services[i+1])
 		var err error
-		idToken, err = GetServiceIdToken(services[i], tgt, idToken)
+		idToken, err = h.GetServiceIdToken(services[i], tgt, idToken)
 		if err != nil {
 			return "", fmt.Errorf("could not get token from %s for %s: %s", services[i], tgt, err)
 		}
 	}
 	last := services[len(services)-1]
-	return GetServiceIdToken(last, target, idToken)
+	return h.GetServiceIdToken(last, target, idToken)
 }
 
-func GetServiceIdToken(service, target, token string) (string, error) {
+func (h handler) GetServiceIdToken(service, target, token string) (string, error) {
 	url := service + "/leaks/id-token?url=" + target
-	resp, err := GetWithAuth(url, token)
+	resp, err := h.client.GetWithAuth(url, token)
 	if err != nil {
 		return "", err
 	}
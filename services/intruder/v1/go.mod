@@ -3,8 +3,8 @@ module intruder
 go 1.13
 
 require (
-	cloud.google.com/go/firestore v1.3.0
 	github.com/HayoVanLoon/go-commons v0.0.0-20200710114328-604283f9ff70
-	github.com/HayoVanLoon/metadataemu v0.0.0-20200814182556-f36ceb1d1dc5
-	golang.org/x/tools v0.0.0-20200814172026-c4923e618c08 // indirect
+	lkcommon v0.0.0
 )
+
+replace lkcommon => ../../lkcommon/v1
@@ -2,10 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"github.com/HayoVanLoon/go-commons/logjson"
 	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"lkcommon/trace"
 	"log"
 	"net/http"
 	"os"
@@ -33,33 +44,41 @@ const (
 	printService   = "print-service"
 )
 
-var services = []AttackInfo{
-	{Component: websiteService, Number: 0, Url: websiteServiceScheme},
-	{Component: orderService, Number: 100, Url: orderServiceScheme},
-	{Component: paymentService, Number: 200, Url: paymentServiceScheme},
-	{Component: numberService, Number: 300, Url: numberServiceScheme},
-	{Component: printService, Number: 400, Url: printServiceScheme},
+func services(cfg *config.Config) []AttackInfo {
+	return []AttackInfo{
+		{Component: websiteService, Number: 0, Url: cfg.WebsiteService},
+		{Component: orderService, Number: 100, Url: cfg.OrderService},
+		{Component: paymentService, Number: 200, Url: cfg.PaymentService},
+		{Component: numberService, Number: 300, Url: cfg.NumberService},
+		{Component: printService, Number: 400, Url: cfg.PrintService},
+	}
 }
 
-var routes = map[string][]string{
-	websiteService: {},
-	orderService:   {websiteServiceScheme},
-	paymentService: {websiteServiceScheme},
-	numberService:  {websiteServiceScheme, orderServiceScheme},
-	printService:   {websiteServiceScheme, orderServiceScheme},
+// routes lists per component the services to chain tokens through.
+func routes(cfg *config.Config) map[string][]string {
+	return map[string][]string{
+		websiteService: {},
+		orderService:   {cfg.WebsiteService},
+		paymentService: {cfg.WebsiteService},
+		numberService:  {cfg.WebsiteService, cfg.OrderService},
+		printService:   {cfg.WebsiteService, cfg.OrderService},
+	}
 }
 
 type handler struct {
+	cfg       *config.Config
+	client    *auth.ServiceClient
+	routes    map[string][]string
 	lastCheck time.Time
 	attacks   map[int]AttackInfo
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	logjson.Info(fmt.Sprintf("incoming call from %s: %s", GetIdentification(r), r.URL.Path))
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("incoming call from %s: %s", auth.GetIdentification(r), r.URL.Path))
 
 	if h.lastCheck.Add(60 * time.Second).Before(time.Now()) {
-		h.attacks = discoverAttacks()
+		h.attacks = h.discoverAttacks(r.Context())
 	}
 	if len(r.URL.Path) >= 8 && r.URL.Path[:8] == "/attacks" {
 		h.handleAttacks(w, r)
@@ -70,34 +89,34 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func discoverAttacks() map[int]AttackInfo {
+func (h *handler) discoverAttacks(ctx context.Context) map[int]AttackInfo {
 	atks := make(map[int]AttackInfo)
-	for _, info := range services {
+	for _, info := range services(h.cfg) {
 		target := info.Url + "/attacks"
-		route := routes[info.Component]
-		idToken, err := GetChainedToken(route, target)
+		route := h.routes[info.Component]
+		idToken, err := h.GetChainedToken(route, target)
 		if err != nil {
-			logjson.Error(fmt.Sprintf("could not fetch attack list from %s: %s", info.Url, err))
+			logctx.Error(ctx, fmt.Sprintf("could not fetch attack list from %s: %s", info.Url, err))
 			continue
 		}
-		resp, err := GetWithAuth(target, idToken)
+		resp, err := h.client.GetWithAuth(target, idToken)
 		if err != nil {
-			logjson.Error(fmt.Sprintf("could not fetch attack list from %s: %s", info.Url, err))
+			logctx.Error(ctx, fmt.Sprintf("could not fetch attack list from %s: %s", info.Url, err))
 			continue
 		}
 		if resp.StatusCode != http.StatusOK {
-			logjson.Error(fmt.Sprintf("could not fetch attack list from %s: status %v", info.Url, resp.StatusCode))
+			logctx.Error(ctx, fmt.Sprintf("could not fetch attack list from %s: status %v", info.Url, resp.StatusCode))
 			continue
 		}
 		bs, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			logjson.Error(fmt.Sprintf("could decode attack list response from %s: %s", info.Component, err))
+			logctx.Error(ctx, fmt.Sprintf("could decode attack list response from %s: %s", info.Component, err))
 			continue
 		}
 		for _, a := range strings.Split(string(bs), ",") {
 			an, err := strconv.Atoi(a)
 			if err != nil {
-				logjson.Error(fmt.Sprintf("not a number: %s", a))
+				logctx.Error(ctx, fmt.Sprintf("not a number: %s", a))
 				continue
 			}
 			atks[info.Number+an] = AttackInfo{
@@ -111,74 +130,168 @@ func discoverAttacks() map[int]AttackInfo {
 }
 
 func (h handler) handleTests(w http.ResponseWriter, r *http.Request) {
-	o := Order{
-		Customer: "test-customer",
-		Name:     "test",
-		Quantity: 42,
+	customerId, err := h.createCustomer()
+	if err != nil {
+		msg := fmt.Sprintf("failed to create customer: %s", err)
+		logctx.Info(r.Context(), msg)
+		_, _ = w.Write([]byte(msg))
+		return
+	}
+	o := model.Order{
+		Customer: customerId,
+		Items:    []model.LineItem{{Sku: "shoes", Quantity: 42}},
 	}
 	bs, _ := json.Marshal(o)
-	or, err := http.Post(websiteServiceScheme+"/orders", "application/json", bytes.NewReader(bs))
+	orderKey := newIdempotencyKey()
+	or, err := postIdempotent(h.cfg.WebsiteService+"/orders", bs, orderKey)
 	if err != nil {
 		msg := fmt.Sprintf("failed to create order: %s", err)
-		logjson.Info(msg)
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
-	} else if or.StatusCode != http.StatusOK {
-		msg := fmt.Sprintf("failed to create order: %v", or.StatusCode)
-		logjson.Info(msg)
+	}
+	defer or.Body.Close()
+	if or.StatusCode != http.StatusOK {
+		msg := fmt.Sprintf("failed to create order: %s", apierror.FromResponse(or))
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
 	bs, err = ioutil.ReadAll(or.Body)
 	if err != nil {
 		msg := fmt.Sprintf("failed to read order creation result: %s", err)
-		logjson.Info(msg)
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
-	o2 := &Order{}
+	o2 := &model.Order{}
 	err = json.Unmarshal(bs, o2)
 	if err != nil {
 		msg := fmt.Sprintf("failed to parse order creation result: %s", err)
-		logjson.Info(msg)
+		logctx.Info(r.Context(), msg)
+		_, _ = w.Write([]byte(msg))
+		return
+	}
+	if o2.OrderNumber == "" {
+		msg := "failed to create order: no order number"
+		logctx.Info(r.Context(), msg)
+		_, _ = w.Write([]byte(msg))
+		return
+	}
+	if n, err := h.retryOrder(o, orderKey); err != nil || n != o2.OrderNumber {
+		msg := fmt.Sprintf("retried order creation did not return order %s: %q, %v", o2.OrderNumber, n, err)
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
-	p := Payment{
+	p := model.Payment{
 		OrderNumber: o2.OrderNumber,
 	}
 	bs, _ = json.Marshal(p)
-	pr, err := http.Post(websiteServiceScheme+"/payments", "application/json", bytes.NewReader(bs))
+	pr, err := postIdempotent(h.cfg.WebsiteService+"/payments", bs, newIdempotencyKey())
 	if err != nil {
 		msg := fmt.Sprintf("failed to create payment at payment service: %s", err)
-		logjson.Info(msg)
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
+	defer pr.Body.Close()
 	if pr.StatusCode != http.StatusOK {
-		msg := fmt.Sprintf("failed to create payment, got %v", pr.StatusCode)
-		logjson.Info(msg)
+		msg := fmt.Sprintf("failed to create payment: %s", apierror.FromResponse(pr))
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
 	bs, err = ioutil.ReadAll(pr.Body)
 	if err != nil {
 		msg := fmt.Sprintf("failed to read response from payment creation call: %s", err)
-		logjson.Info(msg)
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
-	p2 := &Payment{}
+	p2 := &model.Payment{}
 	err = json.Unmarshal(bs, p2)
 	if err != nil {
 		msg := fmt.Sprintf("failed to parse response from payment creation call: %s", err)
-		logjson.Info(msg)
+		logctx.Info(r.Context(), msg)
+		_, _ = w.Write([]byte(msg))
+		return
+	}
+	if p2.OrderNumber != o2.OrderNumber || p2.PaymentNumber == "" {
+		msg := fmt.Sprintf("payment %q does not refer to order %q", p2.PaymentNumber, o2.OrderNumber)
+		logctx.Info(r.Context(), msg)
 		_, _ = w.Write([]byte(msg))
 		return
 	}
 	_, _ = w.Write([]byte("Success"))
 }
 
+// createCustomer creates the customer that test orders are placed by and
+// returns its id.
+func (h handler) createCustomer() (string, error) {
+	c := model.Customer{
+		Name:           "Test Customer",
+		Email:          "test@example.com",
+		BillingAddress: model.Address{Street: "Teststraat 1", PostalCode: "1234 AB", City: "Teststad", Country: "NL"},
+	}
+	bs, _ := json.Marshal(c)
+	resp, err := postIdempotent(h.cfg.WebsiteService+"/customers", bs, newIdempotencyKey())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", apierror.FromResponse(resp)
+	}
+	c2 := model.Customer{}
+	if err := json.NewDecoder(resp.Body).Decode(&c2); err != nil {
+		return "", err
+	}
+	if c2.Id == "" {
+		return "", errors.New("no customer id")
+	}
+	return c2.Id, nil
+}
+
+// retryOrder repeats an order creation with the same idempotency key and
+// returns the order number of the response, which should be unchanged.
+func (h handler) retryOrder(o model.Order, key string) (string, error) {
+	bs, _ := json.Marshal(o)
+	resp, err := postIdempotent(h.cfg.WebsiteService+"/orders", bs, key)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", apierror.FromResponse(resp)
+	}
+	o2 := model.Order{}
+	if err := json.NewDecoder(resp.Body).Decode(&o2); err != nil {
+		return "", err
+	}
+	return o2.OrderNumber, nil
+}
+
+func postIdempotent(url string, body []byte, key string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	req.Header.Set(httpx.IdempotencyKeyHeader, key)
+	return http.DefaultClient.Do(req)
+}
+
+func newIdempotencyKey() string {
+	bs := make([]byte, 16)
+	_, _ = rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+var attacksLaunched = metrics.NewCounter("intruder_attacks_total",
+	"Attacks launched, by attack, target component and result (success, fail or error).",
+	"attack", "component", "result")
+
 func (h handler) handleAttacks(w http.ResponseWriter, r *http.Request) {
 	sum := AttackSummary{}
 	if r.URL.Path == "/attacks" {
@@ -186,7 +299,7 @@ func (h handler) handleAttacks(w http.ResponseWriter, r *http.Request) {
 			h.listAttacks(w, r)
 			return
 		}
-		if filterOutMethod([]string{"GET", "POST"}, w, r) {
+		if httpx.FilterOutMethod([]string{"GET", "POST"}, w, r) {
 			return
 		}
 		for atk := range h.attacks {
@@ -197,19 +310,19 @@ func (h handler) handleAttacks(w http.ResponseWriter, r *http.Request) {
 			sum.AttackResults = append(sum.AttackResults, *res)
 		}
 	} else {
-		if filterOutMethod([]string{"POST"}, w, r) {
+		if httpx.FilterOutMethod([]string{"POST"}, w, r) {
 			return
 		}
 		raw := r.URL.Path[len("/attacks/"):]
 		attack, err := strconv.Atoi(raw)
 		if err != nil {
-			w.WriteHeader(http.StatusBadRequest)
-			_, _ = w.Write([]byte(fmt.Sprintf("invalid attack name ", raw)))
+			httpx.BadRequest(w, fmt.Sprintf("invalid attack name %s", raw))
 			return
 		}
 		a, err := h.launchAttack(attack)
 		if err != nil {
-			log.Printf("attack %v failed with error: %s", attack, err)
+			logctx.Warn(r.Context(), fmt.Sprintf("attack %v failed with error: %s", attack, err))
+			a = &AttackResult{Explanation: fmt.Sprintf("error on attack %v: %s", attack, err)}
 		}
 		sum.AttackResults = []AttackResult{*a}
 	}
@@ -217,24 +330,38 @@ func (h handler) handleAttacks(w http.ResponseWriter, r *http.Request) {
 		sum.Score += r.Points
 	}
 
-	OkJson(w, sum)
+	httpx.OkJson(w, sum)
 }
 
 func (h handler) listAttacks(w http.ResponseWriter, _ *http.Request) {
-	OkJson(w, h.attacks)
+	httpx.OkJson(w, h.attacks)
 }
 
+// launchAttack runs an attack and counts its outcome. An attack succeeds
+// when it scores points.
 func (h handler) launchAttack(attack int) (*AttackResult, error) {
+	a, err := h.runAttack(attack)
+	result := "error"
+	if err == nil && a.Points > 0 {
+		result = "success"
+	} else if err == nil {
+		result = "fail"
+	}
+	attacksLaunched.Inc(strconv.Itoa(attack), h.attacks[attack].Component, result)
+	return a, err
+}
+
+func (h handler) runAttack(attack int) (*AttackResult, error) {
 	info, ok := h.attacks[attack]
 	if !ok {
 		return nil, fmt.Errorf("unknown attack %v", attack)
 	}
-	route := routes[info.Component]
-	idToken, err := GetChainedToken(route, info.Url)
+	route := h.routes[info.Component]
+	idToken, err := h.GetChainedToken(route, info.Url)
 	if err != nil {
 		return nil, fmt.Errorf("could not fetch proper token: %s", err)
 	}
-	resp, err := GetWithAuth(info.Url, idToken)
+	resp, err := h.client.GetWithAuth(info.Url, idToken)
 	if err != nil {
 		return nil, fmt.Errorf("could not initiate attack: %s", err)
 	}
@@ -251,22 +378,40 @@ func (h handler) launchAttack(attack int) (*AttackResult, error) {
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate("WEBSITE_SERVICE")
 	}
-
-	if websiteServiceScheme == "" {
-		log.Fatal("WEBSITE_SERVICE not set")
+	if err != nil {
+		log.Fatalf("could not load configuration: %s", err)
 	}
+	logctx.Configure(cfg.LogLevel, cfg.Gcp().ProjectId)
+	logctx.Info(context.Background(), "configuration: "+cfg.String())
+
+	client := auth.NewServiceClient(cfg.Gcp().Metadata())
 
 	h := &handler{
+		cfg:       cfg,
+		client:    client,
+		routes:    routes(cfg),
 		lastCheck: time.Now(),
-		attacks:   discoverAttacks(),
 	}
+	h.attacks = h.discoverAttacks(context.Background())
 
-	logjson.Info(fmt.Sprintf("fetched %v attacks", len(h.attacks)))
+	logctx.Info(context.Background(), fmt.Sprintf("fetched %v attacks", len(h.attacks)))
 
 	http.Handle("/", h)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	http.HandleFunc("/readyz", httpx.HandleReady(auth.ServiceCheck(client.Client, "website", cfg.WebsiteService)))
+	http.Handle("/metrics", metrics.Handler())
+
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.Gcp())
+	if err != nil {
+		log.Fatalf("could not create trace exporter: %s", err)
+	}
+	trace.SetExporter(exporter)
+
+	verifier := auth.ConfigVerifier(cfg, "")
+	if err := httpx.ListenAndServe(":"+cfg.Port, trace.Middleware(metrics.Middleware(http.DefaultServeMux, httpx.WithRequestId(auth.Middleware(verifier, http.DefaultServeMux))))); err != nil {
+		log.Fatal(err)
+	}
 }
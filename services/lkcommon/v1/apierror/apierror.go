@@ -0,0 +1,159 @@
+// Package apierror defines the error model shared by all service responses.
+//
+// Errors are returned as JSON in the form
+//
+//	{"error": {"code": "NOT_FOUND", "message": "...", "details": [...], "requestId": "..."}}
+//
+// so that clients can pass them on without losing information.
+package apierror
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+type Code string
+
+const (
+	InvalidArgument    Code = "INVALID_ARGUMENT"
+	Unauthenticated    Code = "UNAUTHENTICATED"
+	PermissionDenied   Code = "PERMISSION_DENIED"
+	NotFound           Code = "NOT_FOUND"
+	MethodNotAllowed   Code = "METHOD_NOT_ALLOWED"
+	Conflict           Code = "CONFLICT"
+	FailedPrecondition Code = "FAILED_PRECONDITION"
+	Unprocessable      Code = "UNPROCESSABLE"
+	TooLarge           Code = "TOO_LARGE"
+	Internal           Code = "INTERNAL"
+	Unavailable        Code = "UNAVAILABLE"
+	DeadlineExceeded   Code = "DEADLINE_EXCEEDED"
+)
+
+var statuses = map[Code]int{
+	InvalidArgument:    http.StatusBadRequest,
+	Unauthenticated:    http.StatusUnauthorized,
+	PermissionDenied:   http.StatusForbidden,
+	NotFound:           http.StatusNotFound,
+	MethodNotAllowed:   http.StatusMethodNotAllowed,
+	Conflict:           http.StatusConflict,
+	FailedPrecondition: http.StatusPreconditionFailed,
+	TooLarge:           http.StatusRequestEntityTooLarge,
+	Unprocessable:      http.StatusUnprocessableEntity,
+	Internal:           http.StatusInternalServerError,
+	Unavailable:        http.StatusServiceUnavailable,
+	DeadlineExceeded:   http.StatusGatewayTimeout,
+}
+
+// Status returns the HTTP status code matching the error code.
+func (c Code) Status() int {
+	if s, ok := statuses[c]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+// CodeFor returns the error code for an HTTP status code.
+func CodeFor(status int) Code {
+	for c, s := range statuses {
+		if s == status {
+			return c
+		}
+	}
+	if status >= 400 && status < 500 {
+		return InvalidArgument
+	}
+	return Internal
+}
+
+// FieldViolation describes a problem with a single request field.
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+type Error struct {
+	Code      Code             `json:"code"`
+	Message   string           `json:"message"`
+	Details   []FieldViolation `json:"details,omitempty"`
+	RequestId string           `json:"requestId,omitempty"`
+}
+
+func New(code Code, msg string) *Error {
+	return &Error{Code: code, Message: msg}
+}
+
+func Newf(code Code, format string, a ...interface{}) *Error {
+	return New(code, fmt.Sprintf(format, a...))
+}
+
+func (e *Error) Error() string {
+	if e.RequestId == "" {
+		return fmt.Sprintf("%s: %s", e.Code, e.Message)
+	}
+	return fmt.Sprintf("%s: %s (request %s)", e.Code, e.Message, e.RequestId)
+}
+
+func (e *Error) Status() int {
+	return e.Code.Status()
+}
+
+// WithDetails adds field violations to the error.
+func (e *Error) WithDetails(vs ...FieldViolation) *Error {
+	e.Details = append(e.Details, vs...)
+	return e
+}
+
+// MarshalJSON wraps the error in its envelope.
+func (e *Error) MarshalJSON() ([]byte, error) {
+	type plain Error
+	return json.Marshal(map[string]*plain{"error": (*plain)(e)})
+}
+
+// UnmarshalJSON reads an error from its envelope.
+func (e *Error) UnmarshalJSON(bs []byte) error {
+	type plain Error
+	env := map[string]*plain{}
+	if err := json.Unmarshal(bs, &env); err != nil {
+		return err
+	}
+	p, ok := env["error"]
+	if !ok || p == nil || p.Code == "" {
+		return fmt.Errorf("not an error response")
+	}
+	*e = Error(*p)
+	return nil
+}
+
+// As returns the first *Error in err's chain, so that errors wrapped with
+// %w are found as well.
+func As(err error) (*Error, bool) {
+	var e *Error
+	if errors.As(err, &e) {
+		return e, true
+	}
+	return nil, false
+}
+
+// FromResponse builds an error from an unsuccessful response, reading (but
+// not closing) its body. Errors in the shared format are returned as-is;
+// anything else is converted based on the status code.
+func FromResponse(resp *http.Response) *Error {
+	bs, _ := ioutil.ReadAll(resp.Body)
+	e := &Error{}
+	if err := json.Unmarshal(bs, e); err == nil {
+		return e
+	}
+	msg := strings.TrimSpace(string(bs))
+	if msg == "" || strings.HasPrefix(msg, "{") {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return &Error{
+		Code:      CodeFor(resp.StatusCode),
+		Message:   msg,
+		RequestId: resp.Header.Get("x-request-id"),
+	}
+}
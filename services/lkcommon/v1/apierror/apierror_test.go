@@ -0,0 +1,34 @@
+package apierror
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestAs(t *testing.T) {
+	e := New(NotFound, "no such order")
+	tests := []struct {
+		name string
+		err  error
+		ok   bool
+	}{
+		{"error", e, true},
+		{"wrapped", fmt.Errorf("could not read order: %w", e), true},
+		{"wrapped twice", fmt.Errorf("request failed: %w", fmt.Errorf("could not read order: %w", e)), true},
+		{"formatted", fmt.Errorf("could not read order: %s", e), false},
+		{"other", errors.New("no such order"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := As(tt.err)
+			if ok != tt.ok {
+				t.Fatalf("expected %v, got %v", tt.ok, ok)
+			}
+			if ok && got != e {
+				t.Errorf("expected %v, got %v", e, got)
+			}
+		})
+	}
+}
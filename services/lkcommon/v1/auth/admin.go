@@ -0,0 +1,52 @@
+package auth
+
+import (
+	"lkcommon/apierror"
+	"lkcommon/httpx"
+	"net/http"
+)
+
+// RequireIdentity only passes on requests from the given identity: the
+// verified email or the subject of the caller's ID token. An empty identity
+// rejects all requests. The request must have passed through Middleware.
+func RequireIdentity(identity string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if identity == "" {
+			httpx.WriteError(w, apierror.New(apierror.PermissionDenied, "no admin identity configured"))
+			return
+		}
+		c, ok := ClaimsFromContext(r.Context())
+		if !ok {
+			httpx.WriteError(w, apierror.New(apierror.Unauthenticated, "identity token required"))
+			return
+		}
+		if !c.Is(identity) {
+			httpx.WriteError(w, apierror.New(apierror.PermissionDenied, "not allowed"))
+			return
+		}
+		next(w, r)
+	}
+}
+
+// VerifiedIdentity returns the verified email or, without one, the subject
+// of the caller's ID token, or "" without a token. Unlike
+// GetIdentification it never falls back to request headers, so it can be
+// used to decide who owns what. The request must have passed through
+// Middleware.
+func VerifiedIdentity(r *http.Request) string {
+	c, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		return ""
+	}
+	if c.EmailVerified && c.Email != "" {
+		return c.Email
+	}
+	return c.Subject
+}
+
+// HasIdentity reports whether the caller's ID token is that of identity,
+// by verified email or subject. An empty identity matches no caller.
+func HasIdentity(r *http.Request, identity string) bool {
+	c, ok := ClaimsFromContext(r.Context())
+	return ok && identity != "" && c.Is(identity)
+}
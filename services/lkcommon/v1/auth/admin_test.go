@@ -0,0 +1,39 @@
+package auth
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVerifiedIdentity(t *testing.T) {
+	tests := []struct {
+		name     string
+		claims   *Claims
+		identity string
+		admin    bool
+	}{
+		{"no token", nil, "", false},
+		{"verified email", &Claims{Subject: "1", Email: "admin@example.com", EmailVerified: true}, "admin@example.com", true},
+		{"unverified email", &Claims{Subject: "1", Email: "admin@example.com"}, "1", false},
+		{"subject", &Claims{Subject: "admin@example.com"}, "admin@example.com", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/", nil)
+			r.Header.Set("X-Forwarded-For", "admin@example.com")
+			if tt.claims != nil {
+				r = r.WithContext(WithClaims(r.Context(), tt.claims))
+			}
+			if id := VerifiedIdentity(r); id != tt.identity {
+				t.Errorf("expected identity %q, got %q", tt.identity, id)
+			}
+			if admin := HasIdentity(r, "admin@example.com"); admin != tt.admin {
+				t.Errorf("expected admin %v, got %v", tt.admin, admin)
+			}
+			if HasIdentity(r, "") {
+				t.Errorf("expected empty identity to match no caller")
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+// Package auth handles OpenID Connect identity tokens, both for identifying
+// callers and for authenticating outgoing service-to-service calls.
+package auth
+
+import (
+	"context"
+	"fmt"
+	"github.com/HayoVanLoon/metadataemu"
+	"io"
+	"io/ioutil"
+	"lkcommon/httpx"
+	"net/http"
+	"net/url"
+)
+
+// A ServiceClient calls other services using identity tokens from the
+// metadata server. Tokens are requested for the target service rather than
+// the full url, so they can be reused across calls.
+type ServiceClient struct {
+	*httpx.Client
+	metadata metadataemu.Client
+	tokens   *TokenCache
+}
+
+func NewServiceClient(metadata metadataemu.Client) *ServiceClient {
+	c := &ServiceClient{metadata: metadata}
+	c.tokens = NewTokenCache(c.fetchIdToken, defaultRefreshAhead)
+	c.Client = httpx.NewClient(func(_ context.Context, target string) (string, error) {
+		return c.GetIdToken(serviceUrl(target))
+	})
+	return c
+}
+
+// GetIdToken returns an ID token for the target audience. Tokens are
+// cached until shortly before they expire.
+func (c *ServiceClient) GetIdToken(target string) (string, error) {
+	return c.tokens.Get(target)
+}
+
+// IdTokenStats reports the use of the ID token cache.
+func (c *ServiceClient) IdTokenStats() TokenCacheStats {
+	return c.tokens.Stats()
+}
+
+func (c *ServiceClient) fetchIdToken(target string) (string, error) {
+	path := fmt.Sprintf("%s?audience=%s", metadataemu.EndPointIdToken, url.QueryEscape(target))
+	return c.metadata.Get(path)
+}
+
+func serviceUrl(target string) string {
+	u, err := url.Parse(target)
+	if err != nil || u.Host == "" {
+		return target
+	}
+	return u.Scheme + "://" + u.Host
+}
+
+// ServiceCheck creates a readiness check that calls the health endpoint
+// of the service at baseUrl.
+func ServiceCheck(client *httpx.Client, name, baseUrl string) httpx.Check {
+	return httpx.Check{Name: name, Check: func(ctx context.Context) error {
+		if baseUrl == "" {
+			return fmt.Errorf("no url configured")
+		}
+		resp, err := client.Get(ctx, baseUrl+"/healthz")
+		if err != nil {
+			return err
+		}
+		defer httpx.DrainAndClose(resp)
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status code %v", resp.StatusCode)
+		}
+		return nil
+	}}
+}
+
+func (c *ServiceClient) HeadWithAuth(url string) (*http.Response, error) {
+	return c.DoWithAuth(http.MethodHead, url, nil, "", "")
+}
+
+func (c *ServiceClient) GetWithAuth(url, token string) (*http.Response, error) {
+	return c.DoWithAuth(http.MethodGet, url, nil, "", token)
+}
+
+func (c *ServiceClient) PostJsonWithAuth(url string, body io.Reader, token string) (*http.Response, error) {
+	return c.DoWithAuth(http.MethodPost, url, body, "application/json", token)
+}
+
+// DoWithAuth performs a request with an identity token. When idToken is
+// empty, a token for the target's service, its scheme and host, is fetched
+// from the metadata server.
+// Prefer the methods of the embedded client, which take a context.
+func (c *ServiceClient) DoWithAuth(method, url string, body io.Reader, contentType, idToken string) (*http.Response, error) {
+	var bs []byte
+	if body != nil {
+		var err error
+		if bs, err = ioutil.ReadAll(body); err != nil {
+			return nil, fmt.Errorf("error reading request body: %s", err)
+		}
+	}
+	h := http.Header{}
+	if idToken != "" {
+		h.Set("Authorization", fmt.Sprintf("Bearer %s", idToken))
+	}
+	if contentType != "" {
+		h.Set("content-type", contentType)
+	}
+	return c.Do(context.Background(), method, url, bs, h)
+}
+
+// GetIdentification returns the best available identification of the
+// caller: the token email, the token subject or the caller's IP address.
+func GetIdentification(r *http.Request) string {
+	email, _ := GetOpenIdEmail(r)
+	if email != "" {
+		return email
+	}
+	sub, _ := GetOpenIdSub(r)
+	if sub != "" {
+		return sub
+	}
+	return httpx.GetIp(r)
+}
+
+func GetOpenIdSub(r *http.Request) (string, error) {
+	return GetOpenIdString(r, "sub")
+}
+
+func GetOpenIdEmail(r *http.Request) (string, error) {
+	return GetOpenIdString(r, "email")
+}
+
+// GetOpenIdString returns a claim from the caller's verified ID token. The
+// request must have passed through Middleware.
+func GetOpenIdString(r *http.Request, field string) (string, error) {
+	c, ok := ClaimsFromContext(r.Context())
+	if !ok {
+		return "", fmt.Errorf("no verified identity token")
+	}
+	return c.String(field)
+}
@@ -0,0 +1,159 @@
+package auth
+
+import (
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GoogleJwksUrl is where Google publishes the keys signing its ID tokens.
+const GoogleJwksUrl = "https://www.googleapis.com/oauth2/v3/certs"
+
+const defaultKeysTtl = time.Hour
+
+// Minimum time between two refreshes triggered by an unknown key id.
+const minRefreshInterval = time.Minute
+
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+type jwks struct {
+	Keys []jwk `json:"keys"`
+}
+
+// A KeySet holds the public keys from a JSON Web Key Set. Keys are loaded
+// lazily and reloaded once they expire or when an unknown key id is
+// encountered.
+type KeySet struct {
+	fetch func() ([]byte, time.Duration, error)
+
+	mux       sync.Mutex
+	keys      map[string]*rsa.PublicKey
+	expires   time.Time
+	lastFetch time.Time
+}
+
+// NewRemoteKeySet creates a key set that is fetched from the url. The
+// response's max-age determines how long keys are cached.
+func NewRemoteKeySet(url string) *KeySet {
+	client := &http.Client{Timeout: 10 * time.Second}
+	return &KeySet{fetch: func() ([]byte, time.Duration, error) {
+		resp, err := client.Get(url)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error fetching keys from %s: %s", url, err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			return nil, 0, fmt.Errorf("unexpected status code %v fetching keys from %s", resp.StatusCode, url)
+		}
+		bs, err := ioutil.ReadAll(resp.Body)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading keys from %s: %s", url, err)
+		}
+		return bs, maxAge(resp.Header.Get("cache-control")), nil
+	}}
+}
+
+// NewFileKeySet creates a key set that is read from a local file.
+func NewFileKeySet(path string) *KeySet {
+	return &KeySet{fetch: func() ([]byte, time.Duration, error) {
+		bs, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error reading keys from %s: %s", path, err)
+		}
+		return bs, defaultKeysTtl, nil
+	}}
+}
+
+func maxAge(cacheControl string) time.Duration {
+	for _, d := range strings.Split(cacheControl, ",") {
+		d = strings.TrimSpace(d)
+		if strings.HasPrefix(d, "max-age=") {
+			if s, err := strconv.Atoi(d[len("max-age="):]); err == nil && s > 0 {
+				return time.Duration(s) * time.Second
+			}
+		}
+	}
+	return defaultKeysTtl
+}
+
+// Key returns the public key with the given key id.
+func (ks *KeySet) Key(kid string) (*rsa.PublicKey, error) {
+	ks.mux.Lock()
+	defer ks.mux.Unlock()
+
+	now := time.Now()
+	k, ok := ks.keys[kid]
+	if ok && now.Before(ks.expires) {
+		return k, nil
+	}
+	if !ok && now.Sub(ks.lastFetch) < minRefreshInterval {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	if err := ks.refresh(now); err != nil {
+		if ok {
+			// Keep using stale keys while the source is unavailable.
+			return k, nil
+		}
+		return nil, err
+	}
+	if k, ok = ks.keys[kid]; !ok {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+	return k, nil
+}
+
+func (ks *KeySet) refresh(now time.Time) error {
+	ks.lastFetch = now
+	bs, ttl, err := ks.fetch()
+	if err != nil {
+		return err
+	}
+	keys, err := parseJwks(bs)
+	if err != nil {
+		return err
+	}
+	ks.keys = keys
+	ks.expires = now.Add(ttl)
+	return nil
+}
+
+func parseJwks(bs []byte) (map[string]*rsa.PublicKey, error) {
+	set := &jwks{}
+	if err := json.Unmarshal(bs, set); err != nil {
+		return nil, fmt.Errorf("error parsing key set: %s", err)
+	}
+	keys := make(map[string]*rsa.PublicKey)
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" {
+			continue
+		}
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid modulus for key %s: %s", k.Kid, err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, fmt.Errorf("invalid exponent for key %s: %s", k.Kid, err)
+		}
+		keys[k.Kid] = &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,179 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"lkcommon/metrics"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Tokens are refreshed in the background once they come within this
+// period of expiring.
+const defaultRefreshAhead = 5 * time.Minute
+
+// Tokens are not handed out when they expire within this period.
+const minTokenValidity = 30 * time.Second
+
+var (
+	tokenCacheRequests = metrics.NewCounter("auth_id_token_cache_requests_total",
+		"ID token requests, by result: hit or miss.", "result")
+	tokenCacheFetches = metrics.NewCounter("auth_id_token_cache_fetches_total",
+		"ID token fetches, by kind: miss or refresh, and result: ok or error.", "kind", "result")
+	tokenCacheSize = metrics.NewGauge("auth_id_token_cache_audiences",
+		"Audiences with a cached ID token.")
+)
+
+type tokenEntry struct {
+	token   string
+	expires time.Time
+}
+
+type tokenCall struct {
+	done  chan struct{}
+	token string
+	err   error
+}
+
+// TokenCacheStats counts how tokens were obtained. The same counts, summed
+// over all caches, are exported as auth_id_token_cache metrics.
+type TokenCacheStats struct {
+	// Tokens served from the cache.
+	Hits uint64
+	// Requests that had to wait for a token to be fetched.
+	Misses uint64
+	// Fetches started ahead of expiry.
+	Refreshes uint64
+	// Failed fetches.
+	Errors uint64
+	// Audiences currently cached.
+	Size int
+}
+
+// A TokenCache caches ID tokens per audience until shortly before they
+// expire. Concurrent requests for the same audience share a single fetch.
+type TokenCache struct {
+	fetch        func(audience string) (string, error)
+	refreshAhead time.Duration
+
+	mux     sync.Mutex
+	entries map[string]tokenEntry
+	calls   map[string]*tokenCall
+
+	hits, misses, refreshes, errors uint64
+}
+
+func NewTokenCache(fetch func(audience string) (string, error), refreshAhead time.Duration) *TokenCache {
+	return &TokenCache{
+		fetch:        fetch,
+		refreshAhead: refreshAhead,
+		entries:      make(map[string]tokenEntry),
+		calls:        make(map[string]*tokenCall),
+	}
+}
+
+// Get returns a token for the audience.
+func (c *TokenCache) Get(audience string) (string, error) {
+	now := time.Now()
+
+	c.mux.Lock()
+	e, ok := c.entries[audience]
+	if ok && now.Add(minTokenValidity).Before(e.expires) {
+		if now.Add(c.refreshAhead).After(e.expires) {
+			if _, busy := c.calls[audience]; !busy {
+				atomic.AddUint64(&c.refreshes, 1)
+				c.start(audience, "refresh")
+			}
+		}
+		c.mux.Unlock()
+		atomic.AddUint64(&c.hits, 1)
+		tokenCacheRequests.Inc("hit")
+		return e.token, nil
+	}
+	call, busy := c.calls[audience]
+	if !busy {
+		call = c.start(audience, "miss")
+	}
+	c.mux.Unlock()
+
+	atomic.AddUint64(&c.misses, 1)
+	tokenCacheRequests.Inc("miss")
+	<-call.done
+	return call.token, call.err
+}
+
+// start fetches a token in the background, for the kind of metric label.
+// The lock must be held.
+func (c *TokenCache) start(audience, kind string) *tokenCall {
+	call := &tokenCall{done: make(chan struct{})}
+	c.calls[audience] = call
+	go func() {
+		call.token, call.err = c.fetch(audience)
+		var exp time.Time
+		if call.err == nil {
+			exp, call.err = tokenExpiry(call.token)
+		}
+
+		c.mux.Lock()
+		delete(c.calls, audience)
+		if call.err == nil {
+			if _, ok := c.entries[audience]; !ok {
+				tokenCacheSize.Add(1)
+			}
+			c.entries[audience] = tokenEntry{token: call.token, expires: exp}
+		}
+		c.mux.Unlock()
+
+		if call.err != nil {
+			atomic.AddUint64(&c.errors, 1)
+			tokenCacheFetches.Inc(kind, "error")
+		} else {
+			tokenCacheFetches.Inc(kind, "ok")
+		}
+		close(call.done)
+	}()
+	return call
+}
+
+func (c *TokenCache) Stats() TokenCacheStats {
+	c.mux.Lock()
+	size := len(c.entries)
+	c.mux.Unlock()
+	return TokenCacheStats{
+		Hits:      atomic.LoadUint64(&c.hits),
+		Misses:    atomic.LoadUint64(&c.misses),
+		Refreshes: atomic.LoadUint64(&c.refreshes),
+		Errors:    atomic.LoadUint64(&c.errors),
+		Size:      size,
+	}
+}
+
+// tokenExpiry reads the expiry time from an unverified token. An empty
+// token, as handed out by an unconfigured metadata emulator, is kept for a
+// day, after which the emulator is asked again.
+func tokenExpiry(token string) (time.Time, error) {
+	if token == "" {
+		return time.Now().Add(24 * time.Hour), nil
+	}
+	ss := strings.Split(token, ".")
+	if len(ss) < 2 {
+		return time.Time{}, fmt.Errorf("less than two parts in encoded token")
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(ss[1])
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error decoding token: %s", err)
+	}
+	c := struct {
+		Expires int64 `json:"exp"`
+	}{}
+	if err := json.Unmarshal(bs, &c); err != nil {
+		return time.Time{}, fmt.Errorf("error parsing token: %s", err)
+	}
+	if c.Expires == 0 {
+		return time.Time{}, fmt.Errorf("token has no expiry")
+	}
+	return time.Unix(c.Expires, 0), nil
+}
@@ -0,0 +1,193 @@
+package auth
+
+import (
+	"encoding/base64"
+	"fmt"
+	"lkcommon/metrics"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// unsignedToken creates a token that expires at exp; only its payload is
+// read by the cache.
+func unsignedToken(exp time.Time) string {
+	payload := fmt.Sprintf(`{"exp":%d}`, exp.Unix())
+	return "e30." + base64.RawURLEncoding.EncodeToString([]byte(payload)) + ".sig"
+}
+
+func TestTokenCacheGet(t *testing.T) {
+	tests := []struct {
+		name      string
+		validFor  time.Duration
+		fetches   uint64
+		refreshes uint64
+	}{
+		{name: "fresh", validFor: time.Hour, fetches: 1},
+		{name: "refreshed ahead", validFor: 2 * time.Minute, fetches: 2, refreshes: 1},
+		{name: "nearly expired", validFor: 10 * time.Second, fetches: 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches uint64
+			c := NewTokenCache(func(aud string) (string, error) {
+				atomic.AddUint64(&fetches, 1)
+				return unsignedToken(time.Now().Add(tt.validFor)), nil
+			}, defaultRefreshAhead)
+
+			if _, err := c.Get("https://a"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if _, err := c.Get("https://a"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			// Let a background refresh finish.
+			for i := 0; i < 100 && atomic.LoadUint64(&fetches) < tt.fetches; i += 1 {
+				time.Sleep(time.Millisecond)
+			}
+			time.Sleep(5 * time.Millisecond)
+
+			s := c.Stats()
+			if f := atomic.LoadUint64(&fetches); f != tt.fetches {
+				t.Errorf("expected %v fetches, got %v", tt.fetches, f)
+			}
+			if s.Refreshes != tt.refreshes {
+				t.Errorf("expected %v refreshes, got %v", tt.refreshes, s.Refreshes)
+			}
+			if s.Hits+s.Misses != 2 || s.Size != 1 {
+				t.Errorf("expected two requests for one audience, got %+v", s)
+			}
+		})
+	}
+}
+
+func TestTokenCacheSharesFetches(t *testing.T) {
+	var fetches uint64
+	release := make(chan struct{})
+	c := NewTokenCache(func(aud string) (string, error) {
+		atomic.AddUint64(&fetches, 1)
+		<-release
+		return unsignedToken(time.Now().Add(time.Hour)), nil
+	}, defaultRefreshAhead)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := c.Get("https://a"); err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if fetches != 1 {
+		t.Errorf("expected concurrent requests to share one fetch, got %v", fetches)
+	}
+	if s := c.Stats(); s.Misses != 10 {
+		t.Errorf("expected 10 misses, got %+v", s)
+	}
+}
+
+func TestTokenCacheErrors(t *testing.T) {
+	var fetches uint64
+	c := NewTokenCache(func(aud string) (string, error) {
+		if atomic.AddUint64(&fetches, 1) == 1 {
+			return "", fmt.Errorf("metadata server unavailable")
+		}
+		return unsignedToken(time.Now().Add(time.Hour)), nil
+	}, defaultRefreshAhead)
+
+	if _, err := c.Get("https://a"); err == nil {
+		t.Fatalf("expected error from failing fetch")
+	}
+	if _, err := c.Get("https://a"); err != nil {
+		t.Fatalf("expected failures not to be cached, got %s", err)
+	}
+	if s := c.Stats(); s.Errors != 1 || s.Size != 1 {
+		t.Errorf("expected one error and one cached token, got %+v", s)
+	}
+}
+
+// metricValue returns the scraped value of the series, or 0.
+func metricValue(series string) float64 {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, l := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(l, series+" ") {
+			v, _ := strconv.ParseFloat(strings.TrimPrefix(l, series+" "), 64)
+			return v
+		}
+	}
+	return 0
+}
+
+func TestTokenCacheMetrics(t *testing.T) {
+	series := []string{
+		`auth_id_token_cache_requests_total{result="hit"}`,
+		`auth_id_token_cache_requests_total{result="miss"}`,
+		`auth_id_token_cache_fetches_total{kind="miss",result="ok"}`,
+		`auth_id_token_cache_fetches_total{kind="miss",result="error"}`,
+		`auth_id_token_cache_audiences`,
+	}
+	before := map[string]float64{}
+	for _, s := range series {
+		before[s] = metricValue(s)
+	}
+
+	c := NewTokenCache(func(aud string) (string, error) {
+		if aud == "https://broken" {
+			return "", fmt.Errorf("no token")
+		}
+		return unsignedToken(time.Now().Add(time.Hour)), nil
+	}, defaultRefreshAhead)
+	_, _ = c.Get("https://a")
+	_, _ = c.Get("https://a")
+	_, _ = c.Get("https://broken")
+
+	expected := []float64{1, 2, 1, 1, 1}
+	for i, s := range series {
+		if d := metricValue(s) - before[s]; d != expected[i] {
+			t.Errorf("%s: expected %v more, got %v", s, expected[i], d)
+		}
+	}
+}
+
+func TestTokenExpiry(t *testing.T) {
+	exp := time.Unix(1600000000, 0)
+	tests := []struct {
+		name  string
+		token string
+		want  time.Time
+		err   bool
+	}{
+		{name: "expiry", token: unsignedToken(exp), want: exp},
+		{name: "one part", token: "abc", err: true},
+		{name: "not base64", token: "e30.!!!.sig", err: true},
+		{name: "not json", token: "e30." + base64.RawURLEncoding.EncodeToString([]byte("exp")) + ".sig", err: true},
+		{name: "no expiry", token: "e30.e30.sig", err: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tokenExpiry(tt.token)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if !tt.err && !got.Equal(tt.want) {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	if got, err := tokenExpiry(""); err != nil || got.Before(time.Now().Add(time.Hour)) || got.After(time.Now().Add(24*time.Hour)) {
+		t.Errorf("expected empty token to stay valid for a day, got %s, %v", got, err)
+	}
+}
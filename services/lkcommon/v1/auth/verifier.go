@@ -0,0 +1,306 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+var googleIssuers = []string{"https://accounts.google.com", "accounts.google.com"}
+
+// Allowed clock skew when checking token times.
+const leeway = 30 * time.Second
+
+// Claims are the verified claims of an OpenID Connect ID token.
+type Claims struct {
+	Issuer        string   `json:"iss"`
+	Subject       string   `json:"sub"`
+	Audience      Audience `json:"aud"`
+	Email         string   `json:"email"`
+	EmailVerified bool     `json:"email_verified"`
+	IssuedAt      int64    `json:"iat"`
+	NotBefore     int64    `json:"nbf"`
+	Expires       int64    `json:"exp"`
+
+	raw map[string]interface{}
+}
+
+// Audience is the token audience, which may be a single string or a list.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err == nil {
+		*a = Audience{s}
+		return nil
+	}
+	var ss []string
+	if err := json.Unmarshal(bs, &ss); err != nil {
+		return fmt.Errorf("invalid audience: %s", bs)
+	}
+	*a = ss
+	return nil
+}
+
+// String returns the claim as a string, if it is one.
+func (c *Claims) String(field string) (string, error) {
+	v, ok := c.raw[field]
+	if !ok {
+		return "", nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return "", fmt.Errorf("%s is not a string value: %v", field, v)
+	}
+	return s, nil
+}
+
+// Is reports whether the token identifies identity, by verified email or
+// subject.
+func (c *Claims) Is(identity string) bool {
+	return (c.EmailVerified && c.Email == identity) || c.Subject == identity
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// A Verifier checks the signature, issuer, audience and validity period of
+// ID tokens.
+type Verifier struct {
+	keys     *KeySet
+	audience string
+	issuers  []string
+}
+
+// NewVerifier creates a verifier for tokens signed with keys from the key
+// set. The token audience should be the url of the receiving service; when
+// it is empty, the host the request was sent to is used. When no issuers
+// are given, any issuer is accepted.
+func NewVerifier(keys *KeySet, audience string, issuers ...string) *Verifier {
+	return &Verifier{
+		keys:     keys,
+		audience: audience,
+		issuers:  issuers,
+	}
+}
+
+// NewGoogleVerifier creates a verifier for tokens issued by Google, as
+// on Google Cloud.
+func NewGoogleVerifier(audience string) *Verifier {
+	return NewVerifier(NewRemoteKeySet(GoogleJwksUrl), audience, googleIssuers...)
+}
+
+// NewLocalVerifier creates a verifier for tokens signed with the keys in a
+// key set file or url, for running outside of Google Cloud. An empty issuer
+// accepts any issuer.
+func NewLocalVerifier(jwks, issuer, audience string) *Verifier {
+	var keys *KeySet
+	if strings.HasPrefix(jwks, "http://") || strings.HasPrefix(jwks, "https://") {
+		keys = NewRemoteKeySet(jwks)
+	} else {
+		keys = NewFileKeySet(jwks)
+	}
+	if issuer == "" {
+		return NewVerifier(keys, audience)
+	}
+	return NewVerifier(keys, audience, issuer)
+}
+
+// ConfigVerifier creates a verifier for ID tokens sent to the audience. On
+// Google Cloud tokens are checked against Google's keys. Locally, LOCAL_JWKS
+// should point to a key set file or url; without it no verifier is returned
+// and callers remain unidentified.
+func ConfigVerifier(cfg *config.Config, audience string) *Verifier {
+	if !cfg.IsLocal() {
+		return NewGoogleVerifier(audience)
+	}
+	if cfg.LocalJwks == "" {
+		return nil
+	}
+	return NewLocalVerifier(cfg.LocalJwks, cfg.LocalTokenIssuer, audience)
+}
+
+// Verify parses the token and returns its claims if it is valid for the
+// verifier's audience.
+func (v *Verifier) Verify(token string) (*Claims, error) {
+	return v.verify(token, v.audience)
+}
+
+func (v *Verifier) verify(token, audience string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, fmt.Errorf("token does not consist of three parts")
+	}
+
+	bs, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token header: %s", err)
+	}
+	h := &jwtHeader{}
+	if err := json.Unmarshal(bs, h); err != nil {
+		return nil, fmt.Errorf("error parsing token header: %s", err)
+	}
+	if h.Alg != "RS256" {
+		return nil, fmt.Errorf("unsupported signing algorithm %s", h.Alg)
+	}
+	key, err := v.keys.Key(h.Kid)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token signature: %s", err)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], sig); err != nil {
+		return nil, fmt.Errorf("invalid token signature")
+	}
+
+	bs, err = base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("error decoding token payload: %s", err)
+	}
+	c := &Claims{}
+	if err := json.Unmarshal(bs, c); err != nil {
+		return nil, fmt.Errorf("error parsing token payload: %s", err)
+	}
+	if err := json.Unmarshal(bs, &c.raw); err != nil {
+		return nil, fmt.Errorf("error parsing token payload: %s", err)
+	}
+
+	if err := v.check(c, audience, time.Now()); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (v *Verifier) check(c *Claims, audience string, now time.Time) error {
+	if len(v.issuers) > 0 && !contains(v.issuers, c.Issuer) {
+		return fmt.Errorf("unexpected issuer %s", c.Issuer)
+	}
+	if !forService(c.Audience, audience) {
+		return fmt.Errorf("unexpected audience %v", c.Audience)
+	}
+	if c.Expires == 0 || now.Add(-leeway).After(time.Unix(c.Expires, 0)) {
+		return fmt.Errorf("token has expired")
+	}
+	if c.NotBefore != 0 && now.Add(leeway).Before(time.Unix(c.NotBefore, 0)) {
+		return fmt.Errorf("token is not valid yet")
+	}
+	if c.IssuedAt != 0 && now.Add(leeway).Before(time.Unix(c.IssuedAt, 0)) {
+		return fmt.Errorf("token was issued in the future")
+	}
+	return nil
+}
+
+// forService reports whether the token audience is the service url. The
+// ServiceClient requests tokens for the scheme and host of the target, so
+// audiences are compared without case in those and without a trailing
+// slash; an audience with a path, query or fragment designates something
+// else. A service given as //host, without scheme, matches either scheme.
+func forService(aud Audience, service string) bool {
+	s, ok := parseAudience(service)
+	if !ok {
+		return false
+	}
+	for _, x := range aud {
+		a, ok := parseAudience(x)
+		if ok && a.Scheme != "" && a.Host == s.Host && (s.Scheme == "" || a.Scheme == s.Scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseAudience parses a service url, with scheme and host in lower case.
+func parseAudience(s string) (*url.URL, bool) {
+	u, err := url.Parse(s)
+	if err != nil || u.Host == "" || u.User != nil {
+		return nil, false
+	}
+	if (u.Path != "" && u.Path != "/") || u.RawQuery != "" || u.Fragment != "" || u.ForceQuery {
+		return nil, false
+	}
+	u.Scheme, u.Host = strings.ToLower(u.Scheme), strings.ToLower(u.Host)
+	return u, true
+}
+
+func contains(ss []string, s string) bool {
+	for _, x := range ss {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+type claimsKey struct{}
+
+// WithClaims returns a copy of the context carrying the verified claims.
+func WithClaims(ctx context.Context, c *Claims) context.Context {
+	return context.WithValue(ctx, claimsKey{}, c)
+}
+
+// ClaimsFromContext returns the verified claims of the request's caller.
+func ClaimsFromContext(ctx context.Context) (*Claims, bool) {
+	c, ok := ctx.Value(claimsKey{}).(*Claims)
+	return c, ok
+}
+
+// Middleware verifies the bearer token of incoming requests and makes its
+// claims available through the request context. Requests carrying an
+// invalid token are rejected; requests without one are passed on
+// unidentified, leaving access control to Cloud Run. A nil verifier
+// disables verification.
+func Middleware(v *Verifier, next http.Handler) http.Handler {
+	if v == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := bearerToken(r)
+		if err != nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		audience := v.audience
+		if audience == "" {
+			audience = "//" + r.Host
+		}
+		c, err := v.verify(token, audience)
+		if err != nil {
+			logctx.Warn(r.Context(), fmt.Sprintf("rejected token from %s: %s", httpx.GetIp(r), err))
+			httpx.WriteError(w, apierror.New(apierror.Unauthenticated, "invalid identity token"))
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithClaims(r.Context(), c)))
+	})
+}
+
+func bearerToken(r *http.Request) (string, error) {
+	auth := r.Header.Get("Authorization")
+	if auth == "" {
+		return "", fmt.Errorf("no authorization header")
+	}
+	if len(auth) < 7 || strings.ToLower(auth[0:7]) != "bearer " {
+		return "", fmt.Errorf("no bearer token")
+	}
+	token := strings.TrimSpace(auth[7:])
+	if token == "" {
+		return "", fmt.Errorf("empty bearer token")
+	}
+	return token, nil
+}
@@ -0,0 +1,276 @@
+package auth
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testKey struct {
+	sync.Once
+	key *rsa.PrivateKey
+}
+
+// signingKey returns a key shared by the tests, as generating keys is slow.
+func signingKey(t *testing.T) *rsa.PrivateKey {
+	testKey.Do(func() {
+		var err error
+		if testKey.key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			t.Fatalf("could not generate key: %s", err)
+		}
+	})
+	return testKey.key
+}
+
+// writeJwks writes a key set holding the public key to a file.
+func writeJwks(t *testing.T, kid string, key *rsa.PublicKey) string {
+	set := jwks{Keys: []jwk{{
+		Kid: kid,
+		Kty: "RSA",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}}}
+	bs, _ := json.Marshal(set)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	if err := ioutil.WriteFile(path, bs, 0600); err != nil {
+		t.Fatalf("could not write key set: %s", err)
+	}
+	return path
+}
+
+// sign creates an RS256 token for the claims.
+func sign(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	enc := func(v interface{}) string {
+		bs, _ := json.Marshal(v)
+		return base64.RawURLEncoding.EncodeToString(bs)
+	}
+	unsigned := enc(jwtHeader{Alg: "RS256", Kid: kid}) + "." + enc(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("could not sign token: %s", err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestVerifierVerify(t *testing.T) {
+	key := signingKey(t)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("could not generate key: %s", err)
+	}
+	v := NewLocalVerifier(writeJwks(t, "k1", &key.PublicKey), "local", "https://orders.example.com")
+
+	now := time.Now().Unix()
+	claims := func(change func(c map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":   "local",
+			"aud":   "https://orders.example.com",
+			"sub":   "1234",
+			"email": "alice@example.com",
+			"iat":   now,
+			"exp":   now + 3600,
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		err   string
+	}{
+		{name: "valid", token: sign(t, key, "k1", claims(nil))},
+		{name: "audience list", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["aud"] = []string{"https://other.example.com", "https://orders.example.com"}
+		}))},
+		{name: "within leeway", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["exp"] = now - 10
+		}))},
+		{name: "unknown key", token: sign(t, key, "k2", claims(nil)), err: "unknown key id"},
+		{name: "other key", token: sign(t, other, "k1", claims(nil)), err: "invalid token signature"},
+		{name: "other issuer", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["iss"] = "https://accounts.google.com"
+		})), err: "unexpected issuer"},
+		{name: "other audience", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["aud"] = "https://payments.example.com"
+		})), err: "unexpected audience"},
+		{name: "expired", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["exp"] = now - 3600
+		})), err: "expired"},
+		{name: "no expiry", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			delete(c, "exp")
+		})), err: "expired"},
+		{name: "not yet valid", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["nbf"] = now + 3600
+		})), err: "not valid yet"},
+		{name: "issued in the future", token: sign(t, key, "k1", claims(func(c map[string]interface{}) {
+			c["iat"] = now + 3600
+		})), err: "issued in the future"},
+		{name: "two parts", token: "a.b", err: "three parts"},
+		{name: "unsigned", token: base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + ".e30.", err: "unsupported signing algorithm"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := v.Verify(tt.token)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+				if email, _ := c.String("email"); email != "alice@example.com" {
+					t.Errorf("expected email alice@example.com, got %q", email)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifierTamperedPayload(t *testing.T) {
+	key := signingKey(t)
+	v := NewLocalVerifier(writeJwks(t, "k1", &key.PublicKey), "", "https://orders.example.com")
+
+	token := sign(t, key, "k1", map[string]interface{}{
+		"aud": "https://orders.example.com",
+		"sub": "alice",
+		"exp": time.Now().Unix() + 3600,
+	})
+	parts := strings.Split(token, ".")
+	bs, _ := json.Marshal(map[string]interface{}{
+		"aud": "https://orders.example.com",
+		"sub": "admin",
+		"exp": time.Now().Unix() + 3600,
+	})
+	parts[1] = base64.RawURLEncoding.EncodeToString(bs)
+	if _, err := v.Verify(strings.Join(parts, ".")); err == nil {
+		t.Errorf("expected tampered token to be rejected")
+	}
+}
+
+func TestForService(t *testing.T) {
+	tests := []struct {
+		aud     Audience
+		service string
+		want    bool
+	}{
+		{Audience{"https://orders.example.com"}, "https://orders.example.com", true},
+		{Audience{"https://orders.example.com/orders"}, "https://orders.example.com", false},
+		{Audience{"https://orders.example.com/"}, "https://orders.example.com", true},
+		{Audience{"HTTPS://Orders.Example.com"}, "https://orders.example.com/", true},
+		{Audience{"https://orders.example.com?x=1"}, "https://orders.example.com", false},
+		{Audience{"http://orders.example.com"}, "https://orders.example.com", false},
+		{Audience{"https://orders.example.com:8443"}, "https://orders.example.com", false},
+		{Audience{"https://orders.example.com.evil.com"}, "https://orders.example.com", false},
+		{Audience{"https://orders.example.com"}, "//orders.example.com", true},
+		{Audience{"https://orders.example.com/orders"}, "//orders.example.com", false},
+		{Audience{"//orders.example.com"}, "//orders.example.com", false},
+		{Audience{"https://payments.example.com"}, "https://orders.example.com", false},
+		{Audience{"https://payments.example.com", "https://orders.example.com"}, "https://orders.example.com", true},
+		{Audience{}, "https://orders.example.com", false},
+		{Audience{"https://orders.example.com"}, "", false},
+		{Audience{"orders"}, "https://orders.example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%v for %s", tt.aud, tt.service), func(t *testing.T) {
+			if got := forService(tt.aud, tt.service); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestAudienceUnmarshal(t *testing.T) {
+	tests := []struct {
+		json string
+		want Audience
+		err  bool
+	}{
+		{`"https://a"`, Audience{"https://a"}, false},
+		{`["https://a","https://b"]`, Audience{"https://a", "https://b"}, false},
+		{`42`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var a Audience
+			err := json.Unmarshal([]byte(tt.json), &a)
+			if (err != nil) != tt.err {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if fmt.Sprint(a) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, a)
+			}
+		})
+	}
+}
+
+func TestKeySet(t *testing.T) {
+	key := signingKey(t)
+	good, err := ioutil.ReadFile(writeJwks(t, "k1", &key.PublicKey))
+	if err != nil {
+		t.Fatalf("could not read key set: %s", err)
+	}
+
+	fetches := 0
+	var fail bool
+	ks := &KeySet{fetch: func() ([]byte, time.Duration, error) {
+		fetches += 1
+		if fail {
+			return nil, 0, fmt.Errorf("unavailable")
+		}
+		return good, time.Millisecond, nil
+	}}
+
+	if _, err := ks.Key("k1"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := ks.Key("k2"); err == nil || fetches != 1 {
+		t.Errorf("expected unknown key without refetching, got %v after %v fetches", err, fetches)
+	}
+
+	time.Sleep(2 * time.Millisecond)
+	fail = true
+	if k, err := ks.Key("k1"); err != nil || k.N.Cmp(key.N) != 0 {
+		t.Errorf("expected stale key while the source is unavailable, got %v", err)
+	}
+	if fetches != 2 {
+		t.Errorf("expected expired keys to be refetched, got %v fetches", fetches)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	tests := []struct {
+		header string
+		want   time.Duration
+	}{
+		{"public, max-age=300, must-revalidate", 300 * time.Second},
+		{"max-age=60", time.Minute},
+		{"no-cache", defaultKeysTtl},
+		{"max-age=0", defaultKeysTtl},
+		{"max-age=soon", defaultKeysTtl},
+		{"", defaultKeysTtl},
+	}
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := maxAge(tt.header); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+}
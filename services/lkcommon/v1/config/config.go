@@ -0,0 +1,350 @@
+// Package config loads the service configuration. Settings come from, in
+// increasing order of precedence: defaults, an optional YAML file, the
+// environment and command line flags.
+package config
+
+import (
+	"flag"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"lkcommon/gcp"
+	"lkcommon/model"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Config holds the settings of a service. Each field names its YAML key,
+// environment variable and flag. Secret fields are redacted when printed.
+type Config struct {
+	Port string `yaml:"port" env:"PORT" flag:"port" usage:"port to listen on"`
+
+	WebsiteService string `yaml:"website_service" env:"WEBSITE_SERVICE" flag:"website-service" usage:"url of the website"`
+	OrderService   string `yaml:"order_service" env:"ORDER_SERVICE" flag:"order-service" usage:"url of the order service"`
+	PaymentService string `yaml:"payment_service" env:"PAYMENT_SERVICE" flag:"payment-service" usage:"url of the payment service"`
+	NumberService  string `yaml:"number_service" env:"NUMBER_SERVICE" flag:"number-service" usage:"url of the number service"`
+	PrintService   string `yaml:"print_service" env:"PRINT_SERVICE" flag:"print-service" usage:"url of the print service"`
+
+	LocalEnvironment  string `yaml:"local_environment" env:"LOCAL_ENVIRONMENT" flag:"local" usage:"any value to run outside of Google Cloud"`
+	LocalMetadataKey  string `yaml:"local_metadata_key" env:"LOCAL_METADATA_KEY" flag:"local-metadata-key" usage:"api key of the metadata emulator" secret:"true"`
+	LocalMetadataPort string `yaml:"local_metadata_port" env:"LOCAL_METADATA_PORT" flag:"local-metadata-port" usage:"port of the metadata emulator"`
+	LocalJwks         string `yaml:"local_jwks" env:"LOCAL_JWKS" flag:"local-jwks" usage:"key set (file or url) for verifying ID tokens locally"`
+	LocalTokenIssuer  string `yaml:"local_token_issuer" env:"LOCAL_TOKEN_ISSUER" flag:"local-token-issuer" usage:"issuer of local ID tokens"`
+
+	ProjectId      string `yaml:"project_id" env:"GOOGLE_CLOUD_PROJECT" flag:"project" usage:"Google Cloud project, instead of asking the metadata server"`
+	InvoicesBucket string `yaml:"invoices_bucket" env:"INVOICES_BUCKET" flag:"invoices-bucket" usage:"bucket for invoices"`
+	PaymentsBucket string `yaml:"payments_bucket" env:"PAYMENTS_BUCKET" flag:"payments-bucket" usage:"bucket for payments"`
+
+	StorageBackend string `yaml:"storage_backend" env:"STORAGE_BACKEND" flag:"storage-backend" usage:"memory, file, firestore or gcs"`
+	StorageDir     string `yaml:"storage_dir" env:"STORAGE_DIR" flag:"storage-dir" usage:"root directory for the file storage backend"`
+	TraceExporter  string `yaml:"trace_exporter" env:"TRACE_EXPORTER" flag:"trace-exporter" usage:"stdout, cloudtrace or none"`
+	LogLevel       string `yaml:"log_level" env:"GCP_LOG_LEVEL" flag:"log-level" usage:"minimum severity to log"`
+
+	NumberBlockSize int           `yaml:"number_block_size" env:"NUMBER_BLOCK_SIZE" flag:"number-block-size" usage:"numbers or identifiers to lease from the number service at once"`
+	NumberLeaseTime time.Duration `yaml:"number_lease_time" env:"NUMBER_LEASE_TIME" flag:"number-lease-time" usage:"time after which unused leased numbers are returned"`
+	// Set on the number service.
+	NumberReserveTimeout time.Duration `yaml:"number_reserve_timeout" env:"NUMBER_RESERVE_TIMEOUT" flag:"number-reserve-timeout" usage:"time after which uncommitted reservations are reclaimed"`
+	AdminIdentity        string        `yaml:"admin_identity" env:"ADMIN_IDENTITY" flag:"admin-identity" usage:"email or subject of the caller allowed to use admin endpoints"`
+
+	// Set on the order service.
+	SeedDemoData string `yaml:"seed_demo_data" env:"SEED_DEMO_DATA" flag:"seed-demo-data" usage:"any value to add demo products to an empty catalog"`
+
+	IdempotencyWindow time.Duration `yaml:"idempotency_window" env:"IDEMPOTENCY_WINDOW" flag:"idempotency-window" usage:"time during which responses to requests with an Idempotency-Key are replayed"`
+
+	EventPublisher   string `yaml:"event_publisher" env:"EVENT_PUBLISHER" flag:"event-publisher" usage:"memory or push"`
+	EventSubscribers string `yaml:"event_subscribers" env:"EVENT_SUBSCRIBERS" flag:"event-subscribers" usage:"comma-separated urls the push publisher delivers events to"`
+
+	// Sequence definitions for the number service. Only set in the file.
+	Sequences []model.Sequence `yaml:"sequences"`
+}
+
+// ConfigFileEnv names the environment variable that can point to a YAML
+// configuration file. The -config flag takes precedence.
+const ConfigFileEnv = "CONFIG_FILE"
+
+func defaults() *Config {
+	return &Config{
+		Port:                 "8080",
+		NumberBlockSize:      1,
+		NumberLeaseTime:      time.Minute,
+		NumberReserveTimeout: time.Minute,
+		IdempotencyWindow:    24 * time.Hour,
+		Sequences: []model.Sequence{
+			{Key: "invoice", Prefix: "INV-", Padding: 6, Reset: model.ResetYearly, Gapless: true},
+			{Key: "order", Generator: model.GeneratorUlid},
+			{Key: "payment", Generator: model.GeneratorUlid},
+			{Key: "customer", Generator: model.GeneratorUlid},
+		},
+	}
+}
+
+// Load reads the configuration from a YAML file (if any), the environment
+// and the command line arguments. It does not validate the result.
+func Load(args []string) (*Config, error) {
+	cfg := defaults()
+
+	fs := flag.NewFlagSet("service", flag.ContinueOnError)
+	path := fs.String("config", os.Getenv(ConfigFileEnv), "YAML configuration file")
+	flagValues := make(map[string]*string)
+	for _, f := range cfg.fields() {
+		flagValues[f.flag] = fs.String(f.flag, "", f.usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+
+	if *path != "" {
+		bs, err := ioutil.ReadFile(*path)
+		if err != nil {
+			return nil, fmt.Errorf("could not read configuration file: %s", err)
+		}
+		if err := yaml.UnmarshalStrict(bs, cfg); err != nil {
+			return nil, fmt.Errorf("could not parse configuration file %s: %s", *path, err)
+		}
+	}
+
+	set := make(map[string]bool)
+	fs.Visit(func(fl *flag.Flag) {
+		set[fl.Name] = true
+	})
+	for _, f := range cfg.fields() {
+		var err error
+		if set[f.flag] {
+			err = f.set(*flagValues[f.flag])
+		} else if v := os.Getenv(f.env); v != "" {
+			err = f.set(v)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %s", f.env, err)
+		}
+	}
+	return cfg, nil
+}
+
+// Validate checks the settings. The required settings are named by their
+// environment variables. All problems are reported in a single error.
+func (c *Config) Validate(required ...string) error {
+	var errs []string
+	fail := func(name, format string, a ...interface{}) {
+		errs = append(errs, name+": "+fmt.Sprintf(format, a...))
+	}
+
+	values := make(map[string]string)
+	for _, f := range c.fields() {
+		values[f.env] = f.String()
+	}
+	for _, r := range required {
+		if v, ok := values[r]; !ok {
+			fail(r, "unknown setting")
+		} else if v == "" {
+			fail(r, "required")
+		}
+	}
+	if c.NumberBlockSize < 1 || c.NumberBlockSize > 1000 {
+		fail("NUMBER_BLOCK_SIZE", "must be between 1 and 1000, got %v", c.NumberBlockSize)
+	}
+	if c.NumberLeaseTime <= 0 {
+		fail("NUMBER_LEASE_TIME", "must be positive, got %s", c.NumberLeaseTime)
+	}
+	if c.NumberReserveTimeout <= 0 {
+		fail("NUMBER_RESERVE_TIMEOUT", "must be positive, got %s", c.NumberReserveTimeout)
+	}
+	if c.IdempotencyWindow <= 0 {
+		fail("IDEMPOTENCY_WINDOW", "must be positive, got %s", c.IdempotencyWindow)
+	}
+
+	checkPort := func(name, v string) {
+		if p, err := strconv.Atoi(v); v != "" && (err != nil || p < 1 || p > 65535) {
+			fail(name, "invalid port %q", v)
+		}
+	}
+	checkPort("PORT", c.Port)
+	checkPort("LOCAL_METADATA_PORT", c.LocalMetadataPort)
+
+	services := map[string]string{
+		"WEBSITE_SERVICE": c.WebsiteService,
+		"ORDER_SERVICE":   c.OrderService,
+		"PAYMENT_SERVICE": c.PaymentService,
+		"NUMBER_SERVICE":  c.NumberService,
+		"PRINT_SERVICE":   c.PrintService,
+	}
+	for name, v := range services {
+		if v == "" {
+			continue
+		}
+		u, err := url.Parse(v)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail(name, "not an http(s) url: %q", v)
+		} else if strings.HasSuffix(v, "/") || u.RawQuery != "" {
+			fail(name, "must not end with a slash or have a query: %q", v)
+		}
+	}
+
+	keys := make(map[string]bool)
+	for _, s := range c.Sequences {
+		for _, p := range s.Validate() {
+			fail("sequences", "%s: %s", s.Key, p)
+		}
+		if keys[s.Key] {
+			fail("sequences", "%s: defined twice", s.Key)
+		}
+		keys[s.Key] = true
+	}
+
+	// The names of the store backends, event publishers and log levels.
+	oneOf(fail, "STORAGE_BACKEND", c.StorageBackend, "memory", "file", "firestore", "gcs")
+	oneOf(fail, "EVENT_PUBLISHER", c.EventPublisher, "memory", "push")
+	subscribers := c.Subscribers()
+	if c.EventPublisher == "push" && len(subscribers) == 0 {
+		fail("EVENT_SUBSCRIBERS", "required by the push publisher")
+	}
+	for _, v := range subscribers {
+		if u, err := url.Parse(v); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			fail("EVENT_SUBSCRIBERS", "not an http(s) url: %q", v)
+		}
+	}
+	oneOf(fail, "TRACE_EXPORTER", c.TraceExporter, "stdout", "cloudtrace", "none")
+	oneOf(fail, "GCP_LOG_LEVEL", c.LogLevel, "DEBUG", "INFO", "NOTICE", "WARNING", "ERROR")
+
+	if len(errs) == 0 {
+		return nil
+	}
+	sort.Strings(errs)
+	return fmt.Errorf("invalid configuration:\n  %s", strings.Join(errs, "\n  "))
+}
+
+// oneOf checks that a setting, if present, has one of the allowed values.
+func oneOf(fail func(string, string, ...interface{}), name, v string, allowed ...string) {
+	if v == "" {
+		return
+	}
+	for _, a := range allowed {
+		if v == a {
+			return
+		}
+	}
+	fail(name, "%q is not one of %s", v, strings.Join(allowed, ", "))
+}
+
+// String lists the settings that have a value, with secrets redacted.
+// Sequences are listed by key.
+func (c *Config) String() string {
+	var ps []string
+	for _, f := range c.fields() {
+		v := f.String()
+		if v == "" {
+			continue
+		}
+		if f.secret {
+			v = "[redacted]"
+		}
+		ps = append(ps, f.env+"="+v)
+	}
+	var keys []string
+	for _, s := range c.Sequences {
+		keys = append(keys, s.Key)
+	}
+	if len(keys) > 0 {
+		ps = append(ps, "sequences="+strings.Join(keys, ","))
+	}
+	return strings.Join(ps, " ")
+}
+
+// IsLocal reports whether the service runs outside of Google Cloud.
+func (c *Config) IsLocal() bool {
+	return c.LocalEnvironment != ""
+}
+
+// DemoData reports whether empty collections are filled with demo data,
+// which is always the case when running locally.
+func (c *Config) DemoData() bool {
+	return c.IsLocal() || c.SeedDemoData != ""
+}
+
+// Subscribers lists the urls in EVENT_SUBSCRIBERS.
+func (c *Config) Subscribers() []string {
+	var subscribers []string
+	for _, s := range strings.Split(c.EventSubscribers, ",") {
+		if s = strings.TrimSpace(s); s != "" {
+			subscribers = append(subscribers, s)
+		}
+	}
+	return subscribers
+}
+
+// Gcp returns the settings for reaching the metadata server and the
+// project's resources.
+func (c *Config) Gcp() gcp.Settings {
+	return gcp.Settings{
+		Local:        c.IsLocal(),
+		MetadataPort: c.LocalMetadataPort,
+		MetadataKey:  c.LocalMetadataKey,
+		Project:      c.ProjectId,
+		Invoices:     c.InvoicesBucket,
+		Payments:     c.PaymentsBucket,
+	}
+}
+
+type field struct {
+	env    string
+	flag   string
+	usage  string
+	secret bool
+	value  reflect.Value
+}
+
+// fields lists the settings that can be set through the environment, in
+// declaration order. Their values can be set through the fields.
+func (c *Config) fields() []field {
+	v := reflect.ValueOf(c).Elem()
+	t := v.Type()
+	var fs []field
+	for i := 0; i < t.NumField(); i += 1 {
+		sf := t.Field(i)
+		if sf.Tag.Get("env") == "" {
+			continue
+		}
+		fs = append(fs, field{
+			env:    sf.Tag.Get("env"),
+			flag:   sf.Tag.Get("flag"),
+			usage:  sf.Tag.Get("usage"),
+			secret: sf.Tag.Get("secret") == "true",
+			value:  v.Field(i),
+		})
+	}
+	return fs
+}
+
+// set parses a value for the field.
+func (f field) set(s string) error {
+	switch f.value.Interface().(type) {
+	case time.Duration:
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(d))
+	case int:
+		i, err := strconv.Atoi(s)
+		if err != nil {
+			return err
+		}
+		f.value.SetInt(int64(i))
+	default:
+		f.value.SetString(s)
+	}
+	return nil
+}
+
+// String formats the field's value; unset strings are empty.
+func (f field) String() string {
+	if s, ok := f.value.Interface().(string); ok {
+		return s
+	}
+	return fmt.Sprint(f.value.Interface())
+}
@@ -0,0 +1,186 @@
+package config
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatalf("could not write configuration file: %s", err)
+	}
+	return path
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeFile(t, "port: \"8081\"\norder_service: http://file\nnumber_block_size: 10\n")
+
+	tests := []struct {
+		name  string
+		env   map[string]string
+		args  []string
+		port  string
+		order string
+		block int
+	}{
+		{name: "defaults", port: "8080", block: 1},
+		{name: "file", args: []string{"-config", file}, port: "8081", order: "http://file", block: 10},
+		{name: "file from environment", env: map[string]string{ConfigFileEnv: file}, port: "8081", order: "http://file", block: 10},
+		{
+			name:  "environment over file",
+			env:   map[string]string{"ORDER_SERVICE": "http://env", "NUMBER_BLOCK_SIZE": "20"},
+			args:  []string{"-config", file},
+			port:  "8081",
+			order: "http://env",
+			block: 20,
+		},
+		{
+			name:  "flags over environment",
+			env:   map[string]string{"ORDER_SERVICE": "http://env", "PORT": "9000"},
+			args:  []string{"-config", file, "-order-service", "http://flag"},
+			port:  "9000",
+			order: "http://flag",
+			block: 10,
+		},
+		{
+			name:  "empty flag",
+			env:   map[string]string{"ORDER_SERVICE": "http://env"},
+			args:  []string{"-order-service", ""},
+			port:  "8080",
+			order: "",
+			block: 1,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := Load(tt.args)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if cfg.Port != tt.port || cfg.OrderService != tt.order || cfg.NumberBlockSize != tt.block {
+				t.Errorf("expected port %s, order service %q and block size %v, got %s, %q and %v",
+					tt.port, tt.order, tt.block, cfg.Port, cfg.OrderService, cfg.NumberBlockSize)
+			}
+		})
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		args []string
+		err  string
+	}{
+		{name: "unknown flag", args: []string{"-nope"}, err: "not defined"},
+		{name: "missing file", args: []string{"-config", "/does/not/exist.yaml"}, err: "could not read"},
+		{name: "unknown key", args: []string{"-config", writeFile(t, "prot: 8080\n")}, err: "could not parse"},
+		{name: "invalid number", env: map[string]string{"NUMBER_BLOCK_SIZE": "many"}, err: "NUMBER_BLOCK_SIZE"},
+		{name: "invalid duration", args: []string{"-number-lease-time", "1 minute"}, err: "NUMBER_LEASE_TIME"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			if _, err := Load(tt.args); err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("expected error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		change   func(c *Config)
+		required []string
+		errs     []string
+	}{
+		{name: "defaults", change: func(c *Config) {}},
+		{name: "required", change: func(c *Config) {}, required: []string{"ORDER_SERVICE", "NOPE"}, errs: []string{
+			"NOPE: unknown setting", "ORDER_SERVICE: required",
+		}},
+		{name: "urls", change: func(c *Config) {
+			c.OrderService = "orders"
+			c.NumberService = "http://numbers/"
+			c.PrintService = "https://print.example.com"
+		}, errs: []string{"ORDER_SERVICE: not an http(s) url", "NUMBER_SERVICE: must not end with a slash"}},
+		{name: "ranges", change: func(c *Config) {
+			c.Port = "70000"
+			c.NumberBlockSize = 0
+			c.NumberLeaseTime = -time.Second
+		}, errs: []string{"PORT: invalid port", "NUMBER_BLOCK_SIZE", "NUMBER_LEASE_TIME"}},
+		{name: "choices", change: func(c *Config) {
+			c.StorageBackend = "s3"
+			c.TraceExporter = "jaeger"
+			c.LogLevel = "LOUD"
+		}, errs: []string{"STORAGE_BACKEND", "TRACE_EXPORTER", "GCP_LOG_LEVEL"}},
+		{name: "push without subscribers", change: func(c *Config) {
+			c.EventPublisher = "push"
+		}, errs: []string{"EVENT_SUBSCRIBERS: required"}},
+		{name: "duplicate sequence", change: func(c *Config) {
+			c.Sequences = append(c.Sequences, c.Sequences[0])
+		}, errs: []string{"sequences: invoice: defined twice"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := defaults()
+			tt.change(c)
+			err := c.Validate(tt.required...)
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Errorf("unexpected error: %s", err)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatalf("expected errors %v", tt.errs)
+			}
+			for _, e := range tt.errs {
+				if !strings.Contains(err.Error(), e) {
+					t.Errorf("expected %q in %s", e, err)
+				}
+			}
+		})
+	}
+}
+
+func TestString(t *testing.T) {
+	c := defaults()
+	c.LocalMetadataKey = "s3cr3t"
+	s := c.String()
+	if strings.Contains(s, "s3cr3t") || !strings.Contains(s, "LOCAL_METADATA_KEY=[redacted]") {
+		t.Errorf("expected secret to be redacted, got %s", s)
+	}
+	if !strings.Contains(s, "PORT=8080") || !strings.Contains(s, "sequences=invoice,order,payment") {
+		t.Errorf("expected settings and sequence keys, got %s", s)
+	}
+}
+
+func TestDemoData(t *testing.T) {
+	tests := []struct {
+		local    string
+		seed     string
+		expected bool
+	}{
+		{"", "", false},
+		{"1", "", true},
+		{"", "1", true},
+	}
+	for _, tt := range tests {
+		c := defaults()
+		c.LocalEnvironment = tt.local
+		c.SeedDemoData = tt.seed
+		if c.DemoData() != tt.expected {
+			t.Errorf("local %q, seed %q: expected %v, got %v", tt.local, tt.seed, tt.expected, c.DemoData())
+		}
+	}
+}
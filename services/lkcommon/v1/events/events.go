@@ -0,0 +1,127 @@
+// Package events publishes domain events, such as a payment having been
+// received, to the services that act on them. Publishers are selected by
+// configuration: in memory, for subscribers in the same process, or pushed
+// over HTTP in the format of Pub/Sub push subscriptions.
+package events
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"time"
+)
+
+const (
+	PublisherMemory = "memory"
+	PublisherPush   = "push"
+)
+
+// Config selects the publisher. An empty Publisher selects the memory
+// publisher.
+type Config struct {
+	Publisher string
+	// Urls the push publisher delivers every event to.
+	Subscribers []string
+}
+
+// ConfigFrom returns the publisher settings of the service configuration.
+func ConfigFrom(cfg *config.Config) Config {
+	return Config{Publisher: cfg.EventPublisher, Subscribers: cfg.Subscribers()}
+}
+
+// Event types.
+const (
+	TypeOrderCreated    = "OrderCreated"
+	TypePaymentReceived = "PaymentReceived"
+)
+
+// A Payload is the content of an event.
+type Payload interface {
+	EventType() string
+}
+
+// OrderCreated is published when an order has been stored.
+type OrderCreated struct {
+	Order model.Order `json:"order"`
+}
+
+func (OrderCreated) EventType() string {
+	return TypeOrderCreated
+}
+
+// PaymentReceived is published when a payment has been stored and its order
+// marked paid.
+type PaymentReceived struct {
+	Payment model.Payment `json:"payment"`
+}
+
+func (PaymentReceived) EventType() string {
+	return TypePaymentReceived
+}
+
+// An Event is a published payload. Events may be delivered more than once;
+// the id is the same for every delivery.
+type Event struct {
+	Id   string
+	Type string
+	Time time.Time
+	Data json.RawMessage
+}
+
+func newEvent(p Payload) (Event, error) {
+	bs, err := json.Marshal(p)
+	if err != nil {
+		return Event{}, fmt.Errorf("error encoding %s event: %s", p.EventType(), err)
+	}
+	id := make([]byte, 16)
+	_, _ = rand.Read(id)
+	return Event{Id: hex.EncodeToString(id), Type: p.EventType(), Time: time.Now().UTC(), Data: bs}, nil
+}
+
+// Decode reads the event's data into p, which must be of the event's type.
+func (e Event) Decode(p Payload) error {
+	if p.EventType() != e.Type {
+		return fmt.Errorf("cannot decode %s event %s as %s", e.Type, e.Id, p.EventType())
+	}
+	if err := json.Unmarshal(e.Data, p); err != nil {
+		return fmt.Errorf("error decoding %s event %s: %s", e.Type, e.Id, err)
+	}
+	return nil
+}
+
+// A Handler acts on an event. An error asks for the event to be delivered
+// again later.
+type Handler func(ctx context.Context, e Event) error
+
+type Publisher interface {
+	// Publish hands the event over for delivery. It does not wait for
+	// subscribers to handle the event.
+	Publish(ctx context.Context, p Payload) error
+	// Flush waits until published events have been delivered, or the
+	// context is done.
+	Flush(ctx context.Context)
+}
+
+var published = metrics.NewCounter("events_published_total",
+	"Events published, by type and result.", "type", "result")
+
+// Open creates the configured publisher. The push publisher delivers
+// events with the client.
+func Open(cfg Config, client *httpx.Client) (Publisher, error) {
+	switch cfg.Publisher {
+	case "", PublisherMemory:
+		return NewMemoryPublisher(), nil
+	case PublisherPush:
+		if len(cfg.Subscribers) == 0 {
+			return nil, fmt.Errorf("push publisher without subscribers")
+		}
+		return NewPushPublisher(client, cfg.Subscribers), nil
+	}
+	return nil, fmt.Errorf("unknown event publisher %q", cfg.Publisher)
+}
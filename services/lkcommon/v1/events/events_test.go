@@ -0,0 +1,130 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/model"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestMemoryPublisher(t *testing.T) {
+	p := NewMemoryPublisher()
+	var got []Event
+	p.Subscribe(func(ctx context.Context, e Event) error {
+		got = append(got, e)
+		return nil
+	})
+	p.Subscribe(func(ctx context.Context, e Event) error {
+		return fmt.Errorf("failed")
+	})
+
+	if err := p.Publish(context.Background(), PaymentReceived{Payment: model.Payment{OrderNumber: "1"}}); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	if len(got) != 1 || got[0].Type != TypePaymentReceived || got[0].Id == "" {
+		t.Fatalf("expected one PaymentReceived event, got %+v", got)
+	}
+	pr := PaymentReceived{}
+	if err := got[0].Decode(&pr); err != nil || pr.Payment.OrderNumber != "1" {
+		t.Errorf("expected payment of order 1, got %+v %v", pr, err)
+	}
+	if err := got[0].Decode(&OrderCreated{}); err == nil {
+		t.Errorf("expected error decoding as %s", TypeOrderCreated)
+	}
+}
+
+func TestPushPublisher(t *testing.T) {
+	var mux sync.Mutex
+	var got []Event
+	var keys []string
+	h := PushHandler(func(ctx context.Context, e Event) error {
+		mux.Lock()
+		defer mux.Unlock()
+		got = append(got, e)
+		if len(got) == 1 {
+			return fmt.Errorf("failed")
+		}
+		return nil
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mux.Lock()
+		keys = append(keys, r.Header.Get(httpx.IdempotencyKeyHeader))
+		mux.Unlock()
+		h(w, r)
+	}))
+	defer srv.Close()
+
+	client := httpx.NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+	client.MinBackoff = time.Millisecond
+	client.MaxBackoff = 5 * time.Millisecond
+	p := NewPushPublisher(client, []string{srv.URL})
+	if err := p.Publish(context.Background(), OrderCreated{Order: model.Order{OrderNumber: "1"}}); err != nil {
+		t.Fatalf("expected no error, got %s", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	p.Flush(ctx)
+
+	mux.Lock()
+	defer mux.Unlock()
+	if len(got) != 2 {
+		t.Fatalf("expected the event to be delivered again after failing, got %v deliveries", len(got))
+	}
+	if got[0].Id != got[1].Id || keys[0] != got[0].Id || keys[1] != got[0].Id {
+		t.Errorf("expected event id %s as idempotency key of every delivery, got %v", got[0].Id, keys)
+	}
+	oc := OrderCreated{}
+	if err := got[1].Decode(&oc); err != nil || oc.Order.OrderNumber != "1" {
+		t.Errorf("expected order 1, got %+v %v", oc, err)
+	}
+}
+
+func TestPushHandler(t *testing.T) {
+	h := PushHandler(func(ctx context.Context, e Event) error {
+		return nil
+	})
+	tests := []struct {
+		name   string
+		method string
+		body   string
+		code   int
+	}{
+		{"event", http.MethodPost, `{"message": {"attributes": {"type": "OrderCreated"}, "data": "e30=", "messageId": "1"}}`, http.StatusNoContent},
+		{"no message id", http.MethodPost, `{"message": {"data": "e30="}}`, http.StatusBadRequest},
+		{"invalid json", http.MethodPost, `{`, http.StatusBadRequest},
+		{"get", http.MethodGet, ``, http.StatusMethodNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			h(w, httptest.NewRequest(tt.method, "/events", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Errorf("expected %v, got %v", tt.code, w.Code)
+			}
+		})
+	}
+}
+
+func TestConfigFrom(t *testing.T) {
+	cfg := &config.Config{EventPublisher: PublisherPush, EventSubscribers: " http://a:8084/events, ,http://b/events"}
+	expected := Config{Publisher: PublisherPush, Subscribers: []string{"http://a:8084/events", "http://b/events"}}
+	if c := ConfigFrom(cfg); !reflect.DeepEqual(c, expected) {
+		t.Errorf("expected %+v, got %+v", expected, c)
+	}
+	for _, p := range []string{PublisherMemory, PublisherPush} {
+		cfg := &config.Config{EventPublisher: p, EventSubscribers: "http://a/events", NumberBlockSize: 1, NumberLeaseTime: 1, NumberReserveTimeout: 1, IdempotencyWindow: 1}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected publisher %s to be accepted by the configuration, got %s", p, err)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/logctx"
+	"sync"
+)
+
+// MemoryPublisher delivers events to the handlers subscribed in the same
+// process, before Publish returns. Failed deliveries are logged, not
+// repeated.
+type MemoryPublisher struct {
+	mux      sync.RWMutex
+	handlers []Handler
+}
+
+func NewMemoryPublisher() *MemoryPublisher {
+	return &MemoryPublisher{}
+}
+
+func (p *MemoryPublisher) Subscribe(h Handler) {
+	p.mux.Lock()
+	defer p.mux.Unlock()
+	p.handlers = append(p.handlers, h)
+}
+
+func (p *MemoryPublisher) Publish(ctx context.Context, payload Payload) error {
+	e, err := newEvent(payload)
+	if err != nil {
+		published.Inc(payload.EventType(), "error")
+		return err
+	}
+	published.Inc(e.Type, "ok")
+	logctx.Info(ctx, fmt.Sprintf("published %s event %s", e.Type, e.Id))
+
+	p.mux.RLock()
+	hs := p.handlers
+	p.mux.RUnlock()
+	for _, h := range hs {
+		if err := h(ctx, e); err != nil {
+			logctx.Warn(ctx, fmt.Sprintf("could not handle %s event %s: %s", e.Type, e.Id, err))
+		}
+	}
+	return nil
+}
+
+func (p *MemoryPublisher) Flush(context.Context) {
+}
@@ -0,0 +1,197 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// Events waiting for delivery; Publish fails when the queue is full.
+	queueSize = 1000
+	// Concurrent deliveries.
+	workers = 4
+	// Attempts to deliver an event to a subscriber before it is dropped,
+	// each with the retries of the client.
+	maxDeliveries = 5
+	// Largest push request accepted by PushHandler.
+	maxPushSize = 1 << 20
+)
+
+var deliveries = metrics.NewCounter("event_deliveries_total",
+	"Attempts to push events to subscribers, by type and result.", "type", "result")
+
+// pushRequest is the body of a Pub/Sub push request.
+type pushRequest struct {
+	Message      pushMessage `json:"message"`
+	Subscription string      `json:"subscription"`
+}
+
+type pushMessage struct {
+	Attributes  map[string]string `json:"attributes,omitempty"`
+	Data        []byte            `json:"data"`
+	MessageId   string            `json:"messageId"`
+	PublishTime time.Time         `json:"publishTime"`
+}
+
+type delivery struct {
+	// Of the publisher; only used for logging, as delivery outlives it.
+	ctx     context.Context
+	url     string
+	event   Event
+	body    []byte
+	attempt int
+}
+
+// PushPublisher stands in for a Pub/Sub topic with push subscriptions: it
+// posts every event to the subscriber urls in the background, in the format
+// of Pub/Sub push requests. Failed deliveries are repeated with backoff and
+// eventually dropped. Events still queued when the process stops are lost.
+//
+// The event id is sent as idempotency key, so subscribers that honour those
+// handle repeated deliveries once.
+type PushPublisher struct {
+	client      *httpx.Client
+	subscribers []string
+	queue       chan *delivery
+	pending     sync.WaitGroup
+}
+
+func NewPushPublisher(client *httpx.Client, subscribers []string) *PushPublisher {
+	p := &PushPublisher{
+		client:      client,
+		subscribers: subscribers,
+		queue:       make(chan *delivery, queueSize),
+	}
+	for i := 0; i < workers; i += 1 {
+		go p.work()
+	}
+	return p
+}
+
+func (p *PushPublisher) Publish(ctx context.Context, payload Payload) error {
+	e, err := newEvent(payload)
+	if err != nil {
+		published.Inc(payload.EventType(), "error")
+		return err
+	}
+	for _, u := range p.subscribers {
+		body, _ := json.Marshal(pushRequest{
+			Message: pushMessage{
+				Attributes:  map[string]string{"type": e.Type},
+				Data:        e.Data,
+				MessageId:   e.Id,
+				PublishTime: e.Time,
+			},
+			Subscription: "push:" + u,
+		})
+		p.pending.Add(1)
+		select {
+		case p.queue <- &delivery{ctx: ctx, url: u, event: e, body: body}:
+		default:
+			p.pending.Done()
+			published.Inc(e.Type, "error")
+			return fmt.Errorf("event queue is full, %s event %s not published", e.Type, e.Id)
+		}
+	}
+	published.Inc(e.Type, "ok")
+	logctx.Info(ctx, fmt.Sprintf("published %s event %s", e.Type, e.Id))
+	return nil
+}
+
+func (p *PushPublisher) Flush(ctx context.Context) {
+	done := make(chan struct{})
+	go func() {
+		p.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		logctx.Warn(ctx, fmt.Sprintf("stopped waiting for %v queued events: %s", len(p.queue), ctx.Err()))
+	}
+}
+
+func (p *PushPublisher) work() {
+	for d := range p.queue {
+		p.deliver(d)
+	}
+}
+
+func (p *PushPublisher) deliver(d *delivery) {
+	d.attempt += 1
+	err := p.post(d)
+	if err == nil {
+		deliveries.Inc(d.event.Type, "ok")
+		p.pending.Done()
+		return
+	}
+	if d.attempt >= maxDeliveries {
+		deliveries.Inc(d.event.Type, "dropped")
+		logctx.Error(d.ctx, fmt.Sprintf("dropped %s event %s for %s after %v attempts: %s", d.event.Type, d.event.Id, d.url, d.attempt, err))
+		p.pending.Done()
+		return
+	}
+	deliveries.Inc(d.event.Type, "retry")
+	wait := time.Second << uint(d.attempt-1)
+	logctx.Warn(d.ctx, fmt.Sprintf("could not deliver %s event %s to %s, retrying in %s: %s", d.event.Type, d.event.Id, d.url, wait, err))
+	time.AfterFunc(wait, func() {
+		p.queue <- d
+	})
+}
+
+func (p *PushPublisher) post(d *delivery) error {
+	h := http.Header{}
+	h.Set("content-type", "application/json")
+	h.Set(httpx.IdempotencyKeyHeader, d.event.Id)
+	resp, err := p.client.Do(context.Background(), http.MethodPost, d.url, d.body, h)
+	if err != nil {
+		return err
+	}
+	defer httpx.DrainAndClose(resp)
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return apierror.FromResponse(resp)
+	}
+	return nil
+}
+
+// PushHandler receives events from the push publisher or a Pub/Sub push
+// subscription. It acknowledges an event once the handler succeeds; if the
+// handler fails, it asks for the event to be delivered again.
+func PushHandler(h Handler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		defer httpx.LogPanic(r.Context())
+		if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
+			return
+		}
+
+		req := pushRequest{}
+		if err := json.NewDecoder(io.LimitReader(r.Body, maxPushSize)).Decode(&req); err != nil || req.Message.MessageId == "" {
+			httpx.BadRequest(w, "invalid push request")
+			return
+		}
+		e := Event{
+			Id:   req.Message.MessageId,
+			Type: req.Message.Attributes["type"],
+			Time: req.Message.PublishTime,
+			Data: req.Message.Data,
+		}
+		logctx.Info(r.Context(), fmt.Sprintf("received %s event %s from %s", e.Type, e.Id, auth.GetIdentification(r)))
+
+		if err := h(r.Context(), e); err != nil {
+			logctx.Warn(r.Context(), fmt.Sprintf("could not handle %s event %s: %s", e.Type, e.Id, err))
+			httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not handle event"))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
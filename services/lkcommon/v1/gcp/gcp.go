@@ -0,0 +1,108 @@
+// Package gcp provides access to the Google Cloud resources used by the
+// services.
+package gcp
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/HayoVanLoon/metadataemu"
+	"sync"
+)
+
+const BaseCollection = "exercises/leekeyservices"
+
+// Settings locate the metadata server and the project's resources.
+type Settings struct {
+	// Run outside of Google Cloud, against the metadata emulator.
+	Local        bool
+	MetadataPort string
+	MetadataKey  string
+
+	// Overrides for values otherwise derived from the metadata server.
+	Project  string
+	Invoices string
+	Payments string
+}
+
+// Metadata returns a client for the metadata server, or its emulator when
+// running locally.
+func (s Settings) Metadata() metadataemu.Client {
+	return metadataemu.NewClient(s.MetadataPort, s.MetadataKey, !s.Local)
+}
+
+func (s Settings) ProjectId() string {
+	project := s.Project
+	if project == "" {
+		project, _ = s.Metadata().ProjectID()
+	}
+	return project
+}
+
+// firestoreClients holds the Firestore client of each project.
+var firestoreClients = struct {
+	sync.Mutex
+	byProject map[string]*firestore.Client
+}{byProject: make(map[string]*firestore.Client)}
+
+// GetFirestore returns the Firestore client for the project. The client is
+// created once and shared by all callers, who must not close it.
+func (s Settings) GetFirestore() (*firestore.Client, error) {
+	project := s.ProjectId()
+	if project == "" {
+		return nil, fmt.Errorf("no project id available")
+	}
+	firestoreClients.Lock()
+	defer firestoreClients.Unlock()
+	if c, ok := firestoreClients.byProject[project]; ok {
+		return c, nil
+	}
+	c, err := firestore.NewClient(context.Background(), project)
+	if err != nil {
+		return nil, err
+	}
+	firestoreClients.byProject[project] = c
+	return c, nil
+}
+
+// Bucket returns the bucket holding a kind of records, such as "orders":
+// the invoices or payments bucket, or else a bucket named after the kind.
+func (s Settings) Bucket(kind string) string {
+	switch kind {
+	case "invoices":
+		return s.InvoicesBucket()
+	case "payments":
+		return s.PaymentsBucket()
+	}
+	return s.ProjectId() + "-leekeyservices-" + kind
+}
+
+func (s Settings) InvoicesBucket() string {
+	if s.Invoices != "" {
+		return s.Invoices
+	}
+	return s.ProjectId() + "-leekeyservices-invoices"
+}
+
+func (s Settings) PaymentsBucket() string {
+	if s.Payments != "" {
+		return s.Payments
+	}
+	return s.ProjectId() + "-leekeyservices-payments"
+}
+
+// AccessToken returns an OAuth access token for the service account.
+func (s Settings) AccessToken() (string, error) {
+	t, err := s.Metadata().Get("/instance/service-accounts/default/token")
+	if err != nil {
+		return "", err
+	}
+	v := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	if err := json.Unmarshal([]byte(t), &v); err != nil {
+		return "", fmt.Errorf("error parsing access token: %s", err)
+	}
+	return v.AccessToken, nil
+}
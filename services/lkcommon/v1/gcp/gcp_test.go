@@ -0,0 +1,44 @@
+package gcp
+
+import (
+	"os"
+	"testing"
+)
+
+func TestBucket(t *testing.T) {
+	s := Settings{Project: "p", Invoices: "my-invoices"}
+	tests := []struct {
+		kind   string
+		bucket string
+	}{
+		{"invoices", "my-invoices"},
+		{"payments", "p-leekeyservices-payments"},
+		{"orders", "p-leekeyservices-orders"},
+		{"customers", "p-leekeyservices-customers"},
+	}
+	for _, tt := range tests {
+		if b := s.Bucket(tt.kind); b != tt.bucket {
+			t.Errorf("expected bucket %s for %s, got %s", tt.bucket, tt.kind, b)
+		}
+	}
+}
+
+func TestGetFirestore(t *testing.T) {
+	// The client connects lazily, so no emulator needs to run.
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		_ = os.Setenv("FIRESTORE_EMULATOR_HOST", "localhost:8086")
+		defer os.Unsetenv("FIRESTORE_EMULATOR_HOST")
+	}
+	a, err := Settings{Project: "shared"}.GetFirestore()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b, _ := Settings{Project: "shared", Invoices: "other"}.GetFirestore()
+	c, _ := Settings{Project: "other"}.GetFirestore()
+	if a != b {
+		t.Errorf("expected one client per project")
+	}
+	if a == c {
+		t.Errorf("expected a client for each project")
+	}
+}
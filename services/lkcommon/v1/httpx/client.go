@@ -0,0 +1,227 @@
+package httpx
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lkcommon/metrics"
+	"lkcommon/trace"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A TokenFunc returns an identity token for calling the audience.
+type TokenFunc func(ctx context.Context, audience string) (string, error)
+
+// A Client makes calls to other services. Every attempt gets its own
+// deadline, bounded by the deadline of the context passed in (usually that
+// of the inbound request). Idempotent calls are retried with jittered
+// exponential backoff.
+type Client struct {
+	// Transport used for requests; http.DefaultTransport when nil.
+	Transport http.RoundTripper
+	// Token provides identity tokens for requests without an
+	// Authorization header. No token is added when nil.
+	Token TokenFunc
+	// Deadline for a single attempt.
+	Timeout time.Duration
+	// Maximum number of attempts for idempotent calls.
+	MaxAttempts int
+	// Bounds for the backoff between attempts.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+func NewClient(token TokenFunc) *Client {
+	return &Client{
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+			MaxIdleConns:        100,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+			TLSHandshakeTimeout: 5 * time.Second,
+		},
+		Token:       token,
+		Timeout:     10 * time.Second,
+		MaxAttempts: 3,
+		MinBackoff:  100 * time.Millisecond,
+		MaxBackoff:  2 * time.Second,
+	}
+}
+
+func (c *Client) Get(ctx context.Context, url string) (*http.Response, error) {
+	return c.Do(ctx, http.MethodGet, url, nil, nil)
+}
+
+func (c *Client) Head(ctx context.Context, url string) (*http.Response, error) {
+	return c.Do(ctx, http.MethodHead, url, nil, nil)
+}
+
+func (c *Client) PostJson(ctx context.Context, url string, body []byte) (*http.Response, error) {
+	h := http.Header{}
+	h.Set("content-type", "application/json")
+	return c.Do(ctx, http.MethodPost, url, body, h)
+}
+
+// Do sends a request with the body and headers. The caller must close the
+// response body; DrainAndClose does so after draining it.
+func (c *Client) Do(ctx context.Context, method, url string, body []byte, header http.Header) (*http.Response, error) {
+	header = cloneHeader(header)
+	if header.Get("Authorization") == "" && c.Token != nil {
+		token, err := c.Token(ctx, url)
+		if err != nil {
+			return nil, fmt.Errorf("could not get identity token for %s: %s", url, err)
+		}
+		header.Set("Authorization", "Bearer "+token)
+	}
+	if id := RequestId(ctx); id != "" && header.Get(RequestIdHeader) == "" {
+		header.Set(RequestIdHeader, id)
+	}
+
+	attempts := 1
+	if c.MaxAttempts > 1 && idempotent(method, header) {
+		attempts = c.MaxAttempts
+	}
+	for i := 1; ; i += 1 {
+		resp, err := c.attempt(ctx, method, url, body, header, i)
+		if i == attempts || !retryable(resp, err) || ctx.Err() != nil {
+			return resp, err
+		}
+		wait := c.backoff(i, resp)
+		if resp != nil {
+			DrainAndClose(resp)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (c *Client) attempt(ctx context.Context, method, url string, body []byte, header http.Header, n int) (*http.Response, error) {
+	ctx, span := trace.StartSpan(ctx, method+" "+url, trace.KindClient)
+	span.SetAttribute("http.method", method)
+	span.SetAttribute("http.url", url)
+	span.SetAttribute("attempt", strconv.Itoa(n))
+	defer span.Finish()
+	start := time.Now()
+
+	actx, cancel := ctx, context.CancelFunc(func() {})
+	if c.Timeout > 0 {
+		actx, cancel = context.WithTimeout(ctx, c.Timeout)
+	}
+	var rdr io.Reader
+	if body != nil {
+		rdr = bytes.NewReader(body)
+	}
+	req, err := http.NewRequest(method, url, rdr)
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("error creating request: %s", err)
+	}
+	req = req.WithContext(actx)
+	for k, vs := range header {
+		req.Header[k] = vs
+	}
+	trace.Inject(ctx, req.Header)
+
+	transport := c.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	resp, err := (&http.Client{Transport: transport}).Do(req)
+	if err != nil {
+		cancel()
+		span.SetError(err)
+		metrics.ObserveClient(req.URL.Host, method, 0, start)
+		return nil, err
+	}
+	metrics.ObserveClient(req.URL.Host, method, resp.StatusCode, start)
+	span.SetAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+	if resp.StatusCode >= 500 {
+		span.SetError(fmt.Errorf("%s", resp.Status))
+	}
+	// The attempt's deadline applies until the body has been read.
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+func (c *Client) backoff(attempt int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if s, err := strconv.Atoi(resp.Header.Get("retry-after")); err == nil && s > 0 {
+			if d := time.Duration(s) * time.Second; d <= c.MaxBackoff {
+				return d
+			}
+			return c.MaxBackoff
+		}
+	}
+	max := c.MinBackoff << uint(attempt-1)
+	if max > c.MaxBackoff || max <= 0 {
+		max = c.MaxBackoff
+	}
+	if max <= c.MinBackoff {
+		return c.MinBackoff
+	}
+	return c.MinBackoff + time.Duration(rand.Int63n(int64(max-c.MinBackoff)))
+}
+
+func idempotent(method string, header http.Header) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return header.Get(IdempotencyKeyHeader) != ""
+}
+
+func retryable(resp *http.Response, err error) bool {
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+func cloneHeader(h http.Header) http.Header {
+	c := http.Header{}
+	for k, vs := range h {
+		c[k] = append([]string(nil), vs...)
+	}
+	return c
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+// IsTimeout reports whether a call failed because a deadline passed.
+func IsTimeout(err error) bool {
+	if err == context.DeadlineExceeded {
+		return true
+	}
+	e, ok := err.(interface{ Timeout() bool })
+	return ok && e.Timeout()
+}
+
+// DrainAndClose drains and closes the response body, so the connection can be
+// reused.
+func DrainAndClose(resp *http.Response) {
+	_, _ = io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	_ = resp.Body.Close()
+}
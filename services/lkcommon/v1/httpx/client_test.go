@@ -0,0 +1,166 @@
+package httpx
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testClient creates a client with short backoffs for calling test servers.
+func testClient() *Client {
+	c := NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+	c.MinBackoff = time.Millisecond
+	c.MaxBackoff = 5 * time.Millisecond
+	return c
+}
+
+func TestClientRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		key      string
+		statuses []int
+		attempts int32
+		want     int
+	}{
+		{"get succeeds", http.MethodGet, "", []int{200}, 1, 200},
+		{"get retried", http.MethodGet, "", []int{503, 502, 200}, 3, 200},
+		{"get gives up", http.MethodGet, "", []int{503, 503, 503, 200}, 3, 503},
+		{"get not found", http.MethodGet, "", []int{404, 200}, 1, 404},
+		{"get server error", http.MethodGet, "", []int{500, 200}, 1, 500},
+		{"get throttled", http.MethodGet, "", []int{429, 200}, 2, 200},
+		{"post not retried", http.MethodPost, "", []int{503, 200}, 1, 503},
+		{"post with key retried", http.MethodPost, "k1", []int{503, 200}, 2, 200},
+		{"put retried", http.MethodPut, "", []int{504, 200}, 2, 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var attempts int32
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := atomic.AddInt32(&attempts, 1)
+				if r.Header.Get("Authorization") != "Bearer token" {
+					t.Errorf("expected identity token, got %q", r.Header.Get("Authorization"))
+				}
+				if tt.key != "" && r.Header.Get(IdempotencyKeyHeader) != tt.key {
+					t.Errorf("expected idempotency key on attempt %v", n)
+				}
+				w.WriteHeader(tt.statuses[n-1])
+			}))
+			defer srv.Close()
+
+			h := http.Header{}
+			if tt.key != "" {
+				h.Set(IdempotencyKeyHeader, tt.key)
+			}
+			resp, err := testClient().Do(context.Background(), tt.method, srv.URL, []byte("{}"), h)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			DrainAndClose(resp)
+			if resp.StatusCode != tt.want {
+				t.Errorf("expected status %v, got %v", tt.want, resp.StatusCode)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("expected %v attempts, got %v", tt.attempts, attempts)
+			}
+		})
+	}
+}
+
+func TestClientKeepsAuthorization(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer own" {
+			t.Errorf("expected caller's token, got %q", r.Header.Get("Authorization"))
+		}
+	}))
+	defer srv.Close()
+
+	h := http.Header{}
+	h.Set("Authorization", "Bearer own")
+	resp, err := testClient().Do(context.Background(), http.MethodGet, srv.URL, nil, h)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	DrainAndClose(resp)
+	if h.Get(RequestIdHeader) != "" {
+		t.Errorf("expected caller's header to be left alone")
+	}
+}
+
+func TestClientAttemptTimeout(t *testing.T) {
+	var attempts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) == 1 {
+			<-r.Context().Done()
+		}
+	}))
+	defer srv.Close()
+
+	c := testClient()
+	c.Timeout = 20 * time.Millisecond
+	resp, err := c.Get(context.Background(), srv.URL)
+	if err != nil {
+		t.Fatalf("expected the second attempt to succeed, got %s", err)
+	}
+	DrainAndClose(resp)
+	if attempts != 2 {
+		t.Errorf("expected 2 attempts, got %v", attempts)
+	}
+}
+
+func TestClientContextDone(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	c := testClient()
+	c.MinBackoff = time.Second
+	c.MaxBackoff = time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := c.Get(ctx, srv.URL); !IsTimeout(err) {
+		t.Errorf("expected deadline to end the backoff, got %v", err)
+	}
+	if d := time.Since(start); d > 500*time.Millisecond {
+		t.Errorf("expected to give up at the deadline, took %s", d)
+	}
+}
+
+func TestClientBackoff(t *testing.T) {
+	c := &Client{MinBackoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+	retryAfter := func(v string) *http.Response {
+		return &http.Response{Header: http.Header{"Retry-After": []string{v}}}
+	}
+
+	tests := []struct {
+		name     string
+		attempt  int
+		resp     *http.Response
+		min, max time.Duration
+	}{
+		{"first", 1, nil, 100 * time.Millisecond, 100 * time.Millisecond},
+		{"second", 2, nil, 100 * time.Millisecond, 200 * time.Millisecond},
+		{"third", 3, nil, 100 * time.Millisecond, 400 * time.Millisecond},
+		{"capped", 10, nil, 100 * time.Millisecond, time.Second},
+		{"overflow", 80, nil, 100 * time.Millisecond, time.Second},
+		{"retry after", 1, retryAfter("1"), time.Second, time.Second},
+		{"retry after capped", 1, retryAfter("60"), time.Second, time.Second},
+		{"retry after date", 2, retryAfter("Wed, 21 Oct 2015 07:28:00 GMT"), 100 * time.Millisecond, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i := 0; i < 20; i += 1 {
+				if d := c.backoff(tt.attempt, tt.resp); d < tt.min || d > tt.max {
+					t.Fatalf("expected backoff between %s and %s, got %s", tt.min, tt.max, d)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,54 @@
+package httpx
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lkcommon/apierror"
+	"net/http"
+	"strings"
+)
+
+// DecodeJson strictly decodes a request body of at most maxSize bytes into
+// v: unknown fields, values of the wrong type and data after the JSON value
+// are rejected. Errors are *apierror.Error, with the offending field in the
+// details where known.
+func DecodeJson(r *http.Request, v interface{}, maxSize int64) error {
+	bs, err := ioutil.ReadAll(io.LimitReader(r.Body, maxSize+1))
+	if err != nil {
+		return apierror.New(apierror.InvalidArgument, "could not read request body")
+	}
+	if int64(len(bs)) > maxSize {
+		return apierror.Newf(apierror.TooLarge, "request body larger than %v bytes", maxSize)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(bs))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return decodeError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return apierror.New(apierror.InvalidArgument, "unexpected data after JSON value")
+	}
+	return nil
+}
+
+func decodeError(err error) error {
+	if te, ok := err.(*json.UnmarshalTypeError); ok {
+		return apierror.New(apierror.InvalidArgument, "invalid request").WithDetails(apierror.FieldViolation{
+			Field:       te.Field,
+			Description: fmt.Sprintf("expected %s, got %s", te.Type, te.Value),
+		})
+	}
+	// The decoder has no error type for unknown fields.
+	if msg := err.Error(); strings.HasPrefix(msg, "json: unknown field ") {
+		f := strings.Trim(strings.TrimPrefix(msg, "json: unknown field "), `"`)
+		return apierror.New(apierror.InvalidArgument, "invalid request").WithDetails(apierror.FieldViolation{
+			Field:       f,
+			Description: "unknown field",
+		})
+	}
+	return apierror.Newf(apierror.InvalidArgument, "malformed JSON: %s", err)
+}
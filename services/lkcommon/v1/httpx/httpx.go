@@ -0,0 +1,83 @@
+// Package httpx contains helpers for writing HTTP handlers.
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lkcommon/apierror"
+	"net/http"
+	"strings"
+)
+
+func HandleHealth(w http.ResponseWriter, _ *http.Request) {
+	_, _ = w.Write([]byte("OK"))
+}
+
+// LogPanic logs a panic of the handler serving the request of ctx, and
+// recovers from it. It must be deferred.
+func LogPanic(ctx context.Context) {
+	if r := recover(); r != nil {
+		logger(ctx, "ERROR", fmt.Sprintf("%s", r))
+	}
+}
+
+// WriteError writes the error as JSON. Errors other than *apierror.Error
+// are reported as internal errors without exposing their message.
+func WriteError(w http.ResponseWriter, err error) {
+	e, ok := apierror.As(err)
+	if !ok {
+		e = apierror.New(apierror.Internal, "internal error")
+	}
+	if e.RequestId == "" {
+		e.RequestId = w.Header().Get(RequestIdHeader)
+	}
+	bs, _ := json.Marshal(e)
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(e.Status())
+	_, _ = w.Write(bs)
+}
+
+func InternalServerError(w http.ResponseWriter, msg string) {
+	WriteError(w, apierror.New(apierror.Internal, msg))
+}
+
+func BadRequest(w http.ResponseWriter, msg string) {
+	WriteError(w, apierror.New(apierror.InvalidArgument, msg))
+}
+
+func NotFound(w http.ResponseWriter, msg string) {
+	WriteError(w, apierror.New(apierror.NotFound, msg))
+}
+
+// ErrorJson writes an error for the HTTP status code.
+func ErrorJson(w http.ResponseWriter, status int, msg string) {
+	WriteError(w, apierror.New(apierror.CodeFor(status), msg))
+}
+
+func OkJson(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("content-type", "application/json")
+	bs, _ := json.Marshal(v)
+	_, _ = w.Write(bs)
+}
+
+func GetIp(r *http.Request) string {
+	forw := r.Header.Get("x-forwarded-for")
+	if forw != "" {
+		return forw
+	}
+	return r.RemoteAddr
+}
+
+// FilterOutMethod writes a 405 response and returns true when the request
+// method is not in the allow list.
+func FilterOutMethod(allow []string, w http.ResponseWriter, r *http.Request) bool {
+	for _, m := range allow {
+		if r.Method == m {
+			return false
+		}
+	}
+	w.Header().Set("allow", strings.Join(allow, ","))
+	WriteError(w, apierror.Newf(apierror.MethodNotAllowed, "method %s not allowed", r.Method))
+	return true
+}
@@ -0,0 +1,24 @@
+package httpx
+
+import (
+	"context"
+)
+
+// IdempotencyKeyHeader carries a client-chosen key that makes retries of a
+// request safe: the server replays its first response.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+type idempotencyKey struct{}
+
+// WithIdempotencyKey returns a copy of the context carrying the idempotency
+// key of the inbound request.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKey{}, key)
+}
+
+// IdempotencyKey returns the idempotency key of the request the context
+// belongs to, if it had one.
+func IdempotencyKey(ctx context.Context) string {
+	k, _ := ctx.Value(idempotencyKey{}).(string)
+	return k
+}
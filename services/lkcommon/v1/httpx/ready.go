@@ -0,0 +1,81 @@
+package httpx
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CheckTimeout bounds the time a single readiness check may take.
+const CheckTimeout = 5 * time.Second
+
+// A Check verifies that a dependency of the service can be used.
+type Check struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+type CheckResult struct {
+	Name       string  `json:"name"`
+	Ok         bool    `json:"ok"`
+	Error      string  `json:"error,omitempty"`
+	DurationMs float64 `json:"durationMs"`
+}
+
+type ReadyReport struct {
+	Ready  bool          `json:"ready"`
+	Checks []CheckResult `json:"checks"`
+}
+
+// RunChecks runs the checks concurrently and reports on each.
+func RunChecks(ctx context.Context, checks []Check) ReadyReport {
+	results := make([]CheckResult, len(checks))
+	wg := sync.WaitGroup{}
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cctx, cancel := context.WithTimeout(ctx, CheckTimeout)
+			defer cancel()
+			start := time.Now()
+			err := checks[i].Check(cctx)
+			results[i] = CheckResult{
+				Name:       checks[i].Name,
+				Ok:         err == nil,
+				DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+			}
+			if err != nil {
+				results[i].Error = err.Error()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	report := ReadyReport{Ready: true, Checks: results}
+	for _, r := range results {
+		report.Ready = report.Ready && r.Ok
+	}
+	return report
+}
+
+// HandleReady creates a readiness handler. It responds with 200 when all
+// checks pass and 503 when any fails or the server is shutting down. The
+// body reports on each check.
+func HandleReady(checks ...Check) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := ReadyReport{Checks: []CheckResult{}}
+		if !ShuttingDown() {
+			report = RunChecks(r.Context(), checks)
+		}
+		status := http.StatusOK
+		if !report.Ready {
+			status = http.StatusServiceUnavailable
+		}
+		bs, _ := json.Marshal(report)
+		w.Header().Set("content-type", "application/json")
+		w.WriteHeader(status)
+		_, _ = w.Write(bs)
+	}
+}
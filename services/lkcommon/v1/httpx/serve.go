@@ -0,0 +1,80 @@
+package httpx
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/trace"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// ShutdownTimeout bounds the time spent draining requests. Cloud Run kills
+// an instance ten seconds after sending SIGTERM.
+const ShutdownTimeout = 8 * time.Second
+
+var shuttingDown int32
+
+var shutdownHooks struct {
+	sync.Mutex
+	fs []func(ctx context.Context)
+}
+
+// OnShutdown registers a function to run after the server has drained its
+// requests, before the process exits.
+func OnShutdown(f func(ctx context.Context)) {
+	shutdownHooks.Lock()
+	defer shutdownHooks.Unlock()
+	shutdownHooks.fs = append(shutdownHooks.fs, f)
+}
+
+// ShuttingDown reports whether the server has received a termination
+// signal.
+func ShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// ListenAndServe serves the handler until it receives SIGTERM or SIGINT.
+// It then stops accepting connections, waits for in-flight requests to
+// finish, runs the shutdown hooks and flushes buffered spans.
+func ListenAndServe(addr string, handler http.Handler) error {
+	srv := &http.Server{Addr: addr, Handler: handler}
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.ListenAndServe()
+	}()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(sigs)
+
+	select {
+	case err := <-errs:
+		return err
+	case sig := <-sigs:
+		logger(context.Background(), "INFO", fmt.Sprintf("received %s, draining requests", sig))
+	}
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	err := srv.Shutdown(ctx)
+	shutdownHooks.Lock()
+	for _, f := range shutdownHooks.fs {
+		f(ctx)
+	}
+	shutdownHooks.Unlock()
+	if ferr := trace.Flush(ctx); ferr != nil {
+		logger(ctx, "WARNING", fmt.Sprintf("could not flush spans: %s", ferr))
+	}
+	if err != nil {
+		return fmt.Errorf("error draining requests: %s", err)
+	}
+	logger(ctx, "INFO", "shut down")
+	return nil
+}
@@ -0,0 +1,252 @@
+// Package idempotency makes requests carrying an Idempotency-Key header
+// safe to retry. The first response to a key is stored and replayed to
+// later requests with the same key, until the replay window has passed.
+// In Firestore, a TTL policy on the Expires field deletes the stored
+// responses once it has (see terraform/main/firestore.tf).
+package idempotency
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/store"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ReplayedHeader marks replayed responses.
+const ReplayedHeader = "Idempotent-Replayed"
+
+// Longest accepted key.
+const maxKeyLength = 255
+
+// Largest request body that is read to fingerprint a request.
+const maxBodySize = 1 << 20
+
+// Time after which a request that claimed a key but never stored its
+// response, for instance because its instance stopped, no longer blocks
+// the key.
+const claimTimeout = 2 * time.Minute
+
+var replays = metrics.NewCounter("http_idempotent_replays_total",
+	"Responses replayed for requests with a known idempotency key, by path.", "path")
+
+// A response as stored for replay, or a claim on a key by the request being
+// handled. Firestore stores the fields by their Go names, so its TTL policy
+// is on Expires.
+type response struct {
+	// Set while the request that claimed the key is being handled.
+	InProgress  bool      `json:"inProgress,omitempty"`
+	Fingerprint string    `json:"fingerprint"`
+	Status      int       `json:"status"`
+	ContentType string    `json:"contentType"`
+	Body        []byte    `json:"body"`
+	Expires     time.Time `json:"expires"`
+}
+
+// Store keeps the responses of a service. Requests in progress claim their
+// key in the store, so that instances sharing it handle a key once.
+type Store struct {
+	backend store.Backend
+	window  time.Duration
+}
+
+// Open opens the store for responses of the named service.
+func Open(ctx context.Context, cfg store.Config, service string, window time.Duration) (*Store, error) {
+	b, err := store.OpenBackend(ctx, cfg, "idempotency-"+service, "idempotency-"+service+"-", store.BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	return New(b, window), nil
+}
+
+func New(b store.Backend, window time.Duration) *Store {
+	return &Store{backend: b, window: window}
+}
+
+func (s *Store) Check(ctx context.Context) error {
+	return s.backend.Check(ctx)
+}
+
+// Handler makes requests with an Idempotency-Key header idempotent. Keys are
+// scoped to the caller (see caller) and the request path, so that callers
+// cannot see each other's responses. Requests must have passed through
+// auth.Middleware. A key reused for a different request is rejected, as is
+// a request whose key is still being processed. Server errors and
+// conflicts are not stored, so the request can be retried.
+func (s *Store) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(httpx.IdempotencyKeyHeader)
+		if key == "" || r.Method == http.MethodHead || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxKeyLength {
+			httpx.BadRequest(w, fmt.Sprintf("idempotency key longer than %v characters", maxKeyLength))
+			return
+		}
+
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+		if err != nil {
+			httpx.BadRequest(w, "could not read request body")
+			return
+		}
+		if len(body) > maxBodySize {
+			httpx.WriteError(w, apierror.New(apierror.TooLarge, "request body too large"))
+			return
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		id := hash(caller(r), r.URL.Path, key)
+		fingerprint := hash(r.Method, r.URL.RawQuery, string(body))
+
+		stored, err := s.claim(r.Context(), id, fingerprint)
+		if e, ok := apierror.As(err); ok {
+			httpx.WriteError(w, e)
+			return
+		} else if err != nil {
+			logctx.Error(r.Context(), fmt.Sprintf("could not claim idempotency key %q: %s", key, err))
+			httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not check idempotency key"))
+			return
+		}
+		if stored != nil {
+			replays.Inc(r.URL.Path)
+			logctx.Info(r.Context(), fmt.Sprintf("replaying response for idempotency key %q", key))
+			w.Header().Set(ReplayedHeader, "true")
+			if stored.ContentType != "" {
+				w.Header().Set("content-type", stored.ContentType)
+			}
+			w.WriteHeader(stored.Status)
+			_, _ = w.Write(stored.Body)
+			return
+		}
+
+		rec := &recorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(httpx.WithIdempotencyKey(r.Context(), key)))
+		if rec.status >= 500 || rec.status == http.StatusConflict {
+			// Releases the key for a retry.
+			if err := s.backend.Put(r.Context(), id, response{Fingerprint: fingerprint, Expires: time.Now()}); err != nil {
+				logctx.Warn(r.Context(), fmt.Sprintf("could not release idempotency key %q, it is blocked for %s: %s", key, claimTimeout, err))
+			}
+			return
+		}
+		resp := response{
+			Fingerprint: fingerprint,
+			Status:      rec.status,
+			ContentType: rec.Header().Get("content-type"),
+			Body:        rec.body.Bytes(),
+			Expires:     time.Now().Add(s.window),
+		}
+		if err := s.backend.Put(r.Context(), id, resp); err != nil {
+			// The request succeeded; a retry would repeat it.
+			logctx.Error(r.Context(), fmt.Sprintf("could not store response for idempotency key %q: %s", key, err))
+		}
+	})
+}
+
+// caller identifies the caller for scoping keys: by the verified identity
+// token, or else by address. Of X-Forwarded-For only the last entry counts,
+// which the proxy in front of the service added; callers can put anything
+// before it.
+func caller(r *http.Request) string {
+	if id := auth.VerifiedIdentity(r); id != "" {
+		return "token:" + id
+	}
+	if fwd := r.Header.Get("X-Forwarded-For"); fwd != "" {
+		hops := strings.Split(fwd, ",")
+		return "ip:" + strings.TrimSpace(hops[len(hops)-1])
+	}
+	// The port differs between connections.
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return "ip:" + host
+	}
+	return "ip:" + r.RemoteAddr
+}
+
+// claim returns the stored response for the key, or else claims the key
+// for the request. Keys claimed by a request in progress, or used for a
+// different request, fail with an *apierror.Error.
+func (s *Store) claim(ctx context.Context, id, fingerprint string) (*response, error) {
+	now := time.Now()
+	claimed := response{InProgress: true, Fingerprint: fingerprint, Expires: now.Add(claimTimeout)}
+	stored := &response{}
+	err := s.backend.Get(ctx, id, stored)
+	if err == store.ErrNotFound {
+		err = s.backend.Create(ctx, id, claimed)
+		if err == store.ErrConflict {
+			return nil, apierror.New(apierror.Conflict, "a request with this idempotency key is in progress")
+		}
+		return nil, err
+	} else if err != nil {
+		return nil, err
+	}
+	if now.Before(stored.Expires) {
+		if stored.Fingerprint != fingerprint {
+			return nil, apierror.New(apierror.Unprocessable, "idempotency key was used for a different request")
+		}
+		if stored.InProgress {
+			return nil, apierror.New(apierror.Conflict, "a request with this idempotency key is in progress")
+		}
+		return stored, nil
+	}
+
+	// The stored response or claim has expired.
+	err = s.backend.Update(ctx, id, stored, func() error {
+		if now.Before(stored.Expires) {
+			return store.ErrConflict
+		}
+		*stored = claimed
+		return nil
+	})
+	if err == store.ErrConflict {
+		return nil, apierror.New(apierror.Conflict, "a request with this idempotency key is in progress")
+	}
+	return nil, err
+}
+
+func hash(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		_, _ = io.WriteString(h, p)
+		_, _ = h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// recorder passes a response on while keeping a copy.
+type recorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (r *recorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *recorder) Write(bs []byte) (int, error) {
+	r.body.Write(bs)
+	return r.ResponseWriter.Write(bs)
+}
+
+// Key derives the idempotency key for a call made while handling a request
+// with an idempotency key, so that retries of the request repeat the call
+// with the same key. It returns the empty string for other requests.
+func Key(ctx context.Context, call string) string {
+	k := httpx.IdempotencyKey(ctx)
+	if k == "" {
+		return ""
+	}
+	return hash(k, call)
+}
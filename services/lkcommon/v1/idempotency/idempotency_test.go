@@ -0,0 +1,248 @@
+package idempotency
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"lkcommon/auth"
+	"lkcommon/httpx"
+	"lkcommon/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type step struct {
+	method, path, key, body string
+	// Remote address of the caller, if not the default.
+	caller   string
+	status   int
+	replayed bool
+	handled  bool
+}
+
+func TestHandler(t *testing.T) {
+	post := func(key, body string, status int, replayed, handled bool) step {
+		return step{http.MethodPost, "/payments", key, body, "", status, replayed, handled}
+	}
+
+	tests := []struct {
+		name    string
+		respond int
+		steps   []step
+	}{
+		{"without key", 200, []step{
+			post("", "a", 200, false, true),
+			post("", "a", 200, false, true),
+		}},
+		{"replayed", 200, []step{
+			post("k1", "a", 200, false, true),
+			post("k1", "a", 200, true, false),
+		}},
+		{"other key", 200, []step{
+			post("k1", "a", 200, false, true),
+			post("k2", "a", 200, false, true),
+		}},
+		{"other request", 200, []step{
+			post("k1", "a", 200, false, true),
+			post("k1", "b", 422, false, false),
+		}},
+		{"other path", 200, []step{
+			post("k1", "a", 200, false, true),
+			{http.MethodPost, "/orders", "k1", "a", "", 200, false, true},
+		}},
+		{"other caller", 200, []step{
+			post("k1", "a", 200, false, true),
+			{http.MethodPost, "/payments", "k1", "a", "192.0.2.7:1234", 200, false, true},
+		}},
+		{"other connection", 200, []step{
+			{http.MethodPost, "/payments", "k1", "a", "192.0.2.7:1234", 200, false, true},
+			{http.MethodPost, "/payments", "k1", "a", "192.0.2.7:5678", 200, true, false},
+		}},
+		{"client errors replayed", 422, []step{
+			post("k1", "a", 422, false, true),
+			post("k1", "a", 422, true, false),
+		}},
+		{"server errors retried", 503, []step{
+			post("k1", "a", 503, false, true),
+			post("k1", "a", 503, false, true),
+		}},
+		{"conflicts retried", 409, []step{
+			post("k1", "a", 409, false, true),
+			post("k1", "a", 409, false, true),
+		}},
+		{"key too long", 200, []step{
+			post(strings.Repeat("k", maxKeyLength+1), "a", 400, false, false),
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handled := 0
+			h := New(store.NewMemoryBackend(), time.Hour).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handled += 1
+				w.Header().Set("content-type", "text/plain")
+				w.WriteHeader(tt.respond)
+				_, _ = fmt.Fprintf(w, "response %v", handled)
+			}))
+
+			var first string
+			for i, s := range tt.steps {
+				before := handled
+				r := httptest.NewRequest(s.method, s.path, strings.NewReader(s.body))
+				if s.caller != "" {
+					r.RemoteAddr = s.caller
+				}
+				if s.key != "" {
+					r.Header.Set(httpx.IdempotencyKeyHeader, s.key)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+
+				if w.Code != s.status {
+					t.Errorf("step %v: expected status %v, got %v", i, s.status, w.Code)
+				}
+				if got := w.Header().Get(ReplayedHeader) == "true"; got != s.replayed {
+					t.Errorf("step %v: expected replayed %v, got %v", i, s.replayed, got)
+				}
+				if got := handled > before; got != s.handled {
+					t.Errorf("step %v: expected handled %v, got %v", i, s.handled, got)
+				}
+				body, _ := ioutil.ReadAll(w.Body)
+				if i == 0 {
+					first = string(body)
+				} else if s.replayed && string(body) != first {
+					t.Errorf("step %v: expected replay of %q, got %q", i, first, body)
+				}
+			}
+		})
+	}
+}
+
+func TestHandlerExpiry(t *testing.T) {
+	handled := 0
+	h := New(store.NewMemoryBackend(), time.Millisecond).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled += 1
+	}))
+	for i := 0; i < 2; i += 1 {
+		r := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader("a"))
+		r.Header.Set(httpx.IdempotencyKeyHeader, "k1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		time.Sleep(2 * time.Millisecond)
+	}
+	if handled != 2 {
+		t.Errorf("expected request to be handled again after the window, got %v", handled)
+	}
+}
+
+func TestHandlerInProgress(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	h := New(store.NewMemoryBackend(), time.Hour).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader("a"))
+		r.Header.Set(httpx.IdempotencyKeyHeader, "k1")
+		return r
+	}
+
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), request())
+		close(done)
+	}()
+	<-started
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, request())
+	close(release)
+	<-done
+
+	if w.Code != http.StatusConflict {
+		t.Errorf("expected conflict while the first request is in progress, got %v", w.Code)
+	}
+}
+
+func TestHandlerInProgressShared(t *testing.T) {
+	b := store.NewMemoryBackend()
+	started := make(chan struct{})
+	release := make(chan struct{})
+	first := New(b, time.Hour).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+	}))
+	handled := 0
+	second := New(b, time.Hour).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handled += 1
+	}))
+	request := func() *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader("a"))
+		r.Header.Set(httpx.IdempotencyKeyHeader, "k1")
+		return r
+	}
+
+	done := make(chan struct{})
+	go func() {
+		first.ServeHTTP(httptest.NewRecorder(), request())
+		close(done)
+	}()
+	<-started
+	w := httptest.NewRecorder()
+	second.ServeHTTP(w, request())
+	if w.Code != http.StatusConflict || handled != 0 {
+		t.Errorf("expected conflict on another instance while the first request is in progress, got %v", w.Code)
+	}
+	close(release)
+	<-done
+
+	w = httptest.NewRecorder()
+	second.ServeHTTP(w, request())
+	if w.Code != http.StatusOK || w.Header().Get(ReplayedHeader) != "true" || handled != 0 {
+		t.Errorf("expected replay on another instance once the first request is done, got %v", w.Code)
+	}
+}
+
+func TestCaller(t *testing.T) {
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		subject   string
+		want      string
+	}{
+		{"remote address", "192.0.2.1:1234", "", "", "ip:192.0.2.1"},
+		{"proxied", "10.0.0.1:1234", "192.0.2.1", "", "ip:192.0.2.1"},
+		{"spoofed", "10.0.0.1:1234", "198.51.100.9, 192.0.2.1", "", "ip:192.0.2.1"},
+		{"token", "192.0.2.1:1234", "192.0.2.1", "alice@example.com", "token:alice@example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodPost, "/payments", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.subject != "" {
+				r = r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{Subject: tt.subject}))
+			}
+			if c := caller(r); c != tt.want {
+				t.Errorf("expected %q, got %q", tt.want, c)
+			}
+		})
+	}
+}
+
+func TestKey(t *testing.T) {
+	if k := Key(context.Background(), "numbers"); k != "" {
+		t.Errorf("expected no key outside idempotent requests, got %q", k)
+	}
+	ctx := httpx.WithIdempotencyKey(context.Background(), "k1")
+	if Key(ctx, "numbers") == Key(ctx, "orders") {
+		t.Errorf("expected keys to differ per call")
+	}
+	if Key(ctx, "numbers") != Key(httpx.WithIdempotencyKey(context.Background(), "k1"), "numbers") {
+		t.Errorf("expected keys to be stable across retries")
+	}
+}
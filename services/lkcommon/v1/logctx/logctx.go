@@ -0,0 +1,143 @@
+// Package logctx writes JSON log entries in the same format as logjson,
+// adding the trace and span of the request being handled so Cloud Logging
+// can group entries per trace.
+package logctx
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lkcommon/httpx"
+	"lkcommon/trace"
+	"log"
+	"sort"
+	"sync"
+)
+
+type Severity int
+
+const (
+	LevelDebug   Severity = 0
+	LevelInfo    Severity = 200
+	LevelNotice  Severity = 300
+	LevelWarning Severity = 400
+	LevelError   Severity = 500
+)
+
+var names = map[Severity]string{
+	LevelDebug:   "DEBUG",
+	LevelInfo:    "INFO",
+	LevelNotice:  "NOTICE",
+	LevelWarning: "WARNING",
+	LevelError:   "ERROR",
+}
+
+var settings struct {
+	level     Severity
+	projectId func() string
+}
+
+// Configure sets the name of the minimum severity that is logged and the
+// function providing the project that traces belong to. It is meant to be
+// called once, before anything is logged.
+func Configure(level string, projectId func() string) {
+	settings.level = LevelDebug
+	for s, n := range names {
+		if n == level {
+			settings.level = s
+		}
+	}
+	settings.projectId = projectId
+}
+
+func init() {
+	// httpx and trace cannot import this package, so they log through it.
+	httpx.SetLogger(writeNamed)
+	trace.SetLogger(writeNamed)
+}
+
+// writeNamed writes an entry with a severity given by name.
+func writeNamed(ctx context.Context, severity string, msg string) {
+	sev := LevelInfo
+	for s, n := range names {
+		if n == severity {
+			sev = s
+		}
+	}
+	write(ctx, sev, msg)
+}
+
+// LevelNames lists the names that can be used to configure the level.
+func LevelNames() []string {
+	var ns []string
+	for _, n := range names {
+		ns = append(ns, n)
+	}
+	sort.Strings(ns)
+	return ns
+}
+
+var project struct {
+	sync.Once
+	id string
+}
+
+func projectId() string {
+	project.Do(func() {
+		if settings.projectId != nil {
+			project.id = settings.projectId()
+		}
+	})
+	return project.id
+}
+
+type entry struct {
+	Message      interface{} `json:"message"`
+	Severity     string      `json:"Severity"`
+	Trace        string      `json:"logging.googleapis.com/trace,omitempty"`
+	SpanId       string      `json:"logging.googleapis.com/spanId,omitempty"`
+	TraceSampled bool        `json:"logging.googleapis.com/trace_sampled,omitempty"`
+	RequestId    string      `json:"requestId,omitempty"`
+}
+
+func write(ctx context.Context, sev Severity, v interface{}) {
+	if sev < settings.level {
+		return
+	}
+	e := entry{Message: v, Severity: names[sev], RequestId: httpx.RequestId(ctx)}
+	if s := trace.FromContext(ctx); s != nil {
+		if p := projectId(); p != "" {
+			e.Trace = fmt.Sprintf("projects/%s/traces/%s", p, s.Context.TraceId)
+		} else {
+			e.Trace = s.Context.TraceId
+		}
+		e.SpanId = s.Context.SpanId
+		e.TraceSampled = s.Context.Sampled
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		e.Message = fmt.Sprintf("%v", v)
+		bs, _ = json.Marshal(e)
+	}
+	log.Println(string(bs))
+}
+
+func Debug(ctx context.Context, v interface{}) {
+	write(ctx, LevelDebug, v)
+}
+
+func Info(ctx context.Context, v interface{}) {
+	write(ctx, LevelInfo, v)
+}
+
+func Notice(ctx context.Context, v interface{}) {
+	write(ctx, LevelNotice, v)
+}
+
+func Warn(ctx context.Context, v interface{}) {
+	write(ctx, LevelWarning, v)
+}
+
+func Error(ctx context.Context, v interface{}) {
+	write(ctx, LevelError, v)
+}
@@ -0,0 +1,110 @@
+package logctx
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/trace"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// capture returns the entries logged by f.
+func capture(f func()) []entry {
+	buf := &bytes.Buffer{}
+	log.SetOutput(buf)
+	log.SetFlags(0)
+	defer func() {
+		log.SetOutput(os.Stderr)
+		log.SetFlags(log.LstdFlags)
+	}()
+	f()
+
+	var es []entry
+	for _, l := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		e := entry{}
+		if err := json.Unmarshal([]byte(l), &e); err == nil {
+			es = append(es, e)
+		}
+	}
+	return es
+}
+
+func TestTracePropagation(t *testing.T) {
+	var downstream http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		downstream = r.Header
+	}))
+	defer srv.Close()
+	client := httpx.NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+
+	var span *trace.Span
+	h := trace.Middleware(httpx.WithRequestId(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer httpx.LogPanic(r.Context())
+		span = trace.FromContext(r.Context())
+		Info(r.Context(), "handling")
+		if resp, err := client.Get(r.Context(), srv.URL); err == nil {
+			httpx.DrainAndClose(resp)
+		}
+		panic("failed")
+	})))
+
+	es := capture(func() {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(trace.TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+		r.Header.Set(httpx.RequestIdHeader, "req-1")
+		h.ServeHTTP(httptest.NewRecorder(), r)
+	})
+
+	if len(es) < 2 {
+		t.Fatalf("expected entries of the handler and the panic, got %+v", es)
+	}
+	for _, e := range []entry{es[0], es[len(es)-1]} {
+		if e.Trace != "4bf92f3577b34da6a3ce929d0e0e4736" || e.SpanId != span.Context.SpanId || e.RequestId != "req-1" {
+			t.Errorf("expected trace, span and request id of the request, got %+v", e)
+		}
+	}
+	if es[len(es)-1].Severity != "ERROR" || es[len(es)-1].Message != "failed" {
+		t.Errorf("expected panic logged as error, got %+v", es[len(es)-1])
+	}
+
+	if downstream == nil {
+		t.Fatalf("expected downstream call")
+	}
+	sc, ok := trace.Extract(downstream)
+	if !ok || sc.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || sc.SpanId == span.Context.SpanId {
+		t.Errorf("expected client span of the trace downstream, got %+v", sc)
+	}
+	if downstream.Get(httpx.RequestIdHeader) != "req-1" {
+		t.Errorf("expected request id downstream, got %q", downstream.Get(httpx.RequestIdHeader))
+	}
+}
+
+func TestConfigure(t *testing.T) {
+	defer Configure("DEBUG", nil)
+	Configure("WARNING", nil)
+	es := capture(func() {
+		ctx, _ := trace.StartSpan(context.Background(), "test", trace.KindInternal)
+		Info(ctx, "dropped")
+		Warn(ctx, "kept")
+	})
+	if len(es) != 1 || es[0].Message != "kept" || es[0].Trace == "" {
+		t.Errorf("expected only the warning, with its trace, got %+v", es)
+	}
+}
+
+func TestLevelNames(t *testing.T) {
+	for _, n := range LevelNames() {
+		if err := (&config.Config{LogLevel: n, NumberBlockSize: 1, NumberLeaseTime: 1, NumberReserveTimeout: 1, IdempotencyWindow: 1}).Validate(); err != nil {
+			t.Errorf("expected level %s to be accepted by the configuration, got %s", n, err)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = NewCounter("http_server_requests_total",
+		"Requests handled, by route, method and status code.",
+		"route", "method", "code")
+	httpDuration = NewHistogram("http_server_request_duration_seconds",
+		"Time spent handling requests, by route and method.",
+		nil, "route", "method")
+	clientRequests = NewCounter("http_client_requests_total",
+		"Outgoing request attempts, by host, method and status code (or error).",
+		"host", "method", "code")
+	clientDuration = NewHistogram("http_client_request_duration_seconds",
+		"Time until the response headers of outgoing requests, by host and method.",
+		nil, "host", "method")
+)
+
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodConnect: true,
+	http.MethodOptions: true,
+	http.MethodTrace:   true,
+}
+
+// Middleware records request counts and latencies for next. Requests are
+// labelled with the pattern they match in routes, so that paths with ids do
+// not each get their own series. Methods other than the standard ones are
+// labelled "other", as clients can send any.
+func Middleware(routes *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		route := "other"
+		if routes != nil {
+			if _, p := routes.Handler(r); p != "" {
+				route = p
+			}
+		}
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		method := r.Method
+		if !standardMethods[method] {
+			method = "other"
+		}
+		httpRequests.Inc(route, method, strconv.Itoa(rec.status))
+		httpDuration.ObserveSince(start, route, method)
+	})
+}
+
+// ObserveClient records an outgoing request attempt. A status of 0 means
+// the attempt failed without a response.
+func ObserveClient(host, method string, status int, start time.Time) {
+	code := "error"
+	if status > 0 {
+		code = strconv.Itoa(status)
+	}
+	clientRequests.Inc(host, method, code)
+	clientDuration.ObserveSince(start, host, method)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(bs []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return rec.ResponseWriter.Write(bs)
+}
+
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
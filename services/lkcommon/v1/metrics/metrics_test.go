@@ -0,0 +1,188 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestExposition(t *testing.T) {
+	tests := []struct {
+		name   string
+		record func(reg *Registry)
+		want   string
+	}{
+		{
+			name: "counter",
+			record: func(reg *Registry) {
+				c := reg.NewCounter("orders_total", "Orders placed, by status.", "status")
+				c.Inc("paid")
+				c.Add(2, "created")
+				c.Inc("paid")
+			},
+			want: `# HELP orders_total Orders placed, by status.
+# TYPE orders_total counter
+orders_total{status="created"} 2
+orders_total{status="paid"} 2
+`,
+		},
+		{
+			name: "counter without labels",
+			record: func(reg *Registry) {
+				reg.NewCounter("events_total", "Events.").Add(0.5)
+			},
+			want: `# HELP events_total Events.
+# TYPE events_total counter
+events_total 0.5
+`,
+		},
+		{
+			name: "gauge",
+			record: func(reg *Registry) {
+				g := reg.NewGauge("pool_size", "Numbers in the pool.", "key")
+				g.Set(5, "invoice")
+				g.Add(-2, "invoice")
+				g.Add(1, "order")
+				g.Set(3, "customer")
+				g.Delete("customer")
+			},
+			want: `# HELP pool_size Numbers in the pool.
+# TYPE pool_size gauge
+pool_size{key="invoice"} 3
+pool_size{key="order"} 1
+`,
+		},
+		{
+			name: "gauge func",
+			record: func(reg *Registry) {
+				reg.NewGaugeFunc("up", "Whether the service is up.", func() float64 { return 1 })
+			},
+			want: `# HELP up Whether the service is up.
+# TYPE up gauge
+up 1
+`,
+		},
+		{
+			name: "histogram",
+			record: func(reg *Registry) {
+				h := reg.NewHistogram("latency_seconds", "Latency.", []float64{1, 0.1}, "route")
+				h.Observe(0.05, "/orders")
+				h.Observe(0.5, "/orders")
+				h.Observe(5, "/orders")
+			},
+			want: `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{route="/orders",le="0.1"} 1
+latency_seconds_bucket{route="/orders",le="1"} 2
+latency_seconds_bucket{route="/orders",le="+Inf"} 3
+latency_seconds_sum{route="/orders"} 5.55
+latency_seconds_count{route="/orders"} 3
+`,
+		},
+		{
+			name: "escaping",
+			record: func(reg *Registry) {
+				reg.NewCounter("odd_total", "Help with \\ and\nnewline.", "v").Inc("a\"b\\c\nd")
+			},
+			want: `# HELP odd_total Help with \\ and\nnewline.
+# TYPE odd_total counter
+odd_total{v="a\"b\\c\nd"} 1
+`,
+		},
+		{
+			name: "ordered by name",
+			record: func(reg *Registry) {
+				reg.NewGaugeFunc("b", "B.", func() float64 { return 2 })
+				reg.NewGaugeFunc("a", "A.", func() float64 { return 1 })
+			},
+			want: `# HELP a A.
+# TYPE a gauge
+a 1
+# HELP b B.
+# TYPE b gauge
+b 2
+`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := NewRegistry()
+			tt.record(reg)
+			buf := &bytes.Buffer{}
+			reg.WriteText(buf)
+			if buf.String() != tt.want {
+				t.Errorf("expected\n%s\ngot\n%s", tt.want, buf)
+			}
+		})
+	}
+}
+
+func TestMisuse(t *testing.T) {
+	tests := []struct {
+		name string
+		f    func(reg *Registry)
+	}{
+		{"registered twice", func(reg *Registry) {
+			reg.NewCounter("x_total", "X.")
+			reg.NewGauge("x_total", "X.")
+		}},
+		{"wrong label count", func(reg *Registry) {
+			reg.NewCounter("x_total", "X.", "a", "b").Inc("a")
+		}},
+		{"decreasing counter", func(reg *Registry) {
+			reg.NewCounter("x_total", "X.").Add(-1)
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("expected panic")
+				}
+			}()
+			tt.f(NewRegistry())
+		})
+	}
+}
+
+func TestHandler(t *testing.T) {
+	reg := NewRegistry()
+	reg.NewCounter("x_total", "X.").Inc()
+	w := httptest.NewRecorder()
+	reg.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Errorf("expected text exposition format, got %q", w.Header().Get("Content-Type"))
+	}
+	if !strings.Contains(w.Body.String(), "x_total 1\n") {
+		t.Errorf("expected counter in output, got %q", w.Body.String())
+	}
+}
+
+func TestMiddlewareRoutes(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/orders/", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	})
+	h := Middleware(mux, mux)
+
+	for _, p := range []string{"/orders/1", "/orders/2", "/unknown"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, p, nil))
+	}
+	for _, m := range []string{"FOO", "BAR"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(m, "/orders/3", nil))
+	}
+
+	buf := &bytes.Buffer{}
+	httpRequests.write(buf)
+	for _, want := range []string{
+		`http_server_requests_total{route="/orders/",method="GET",code="404"} 2`,
+		`http_server_requests_total{route="other",method="GET",code="404"} 1`,
+		`http_server_requests_total{route="/orders/",method="other",code="404"} 2`,
+	} {
+		if !strings.Contains(buf.String(), want) {
+			t.Errorf("expected %s in\n%s", want, buf)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package model
+
+import (
+	"regexp"
+	"time"
+)
+
+// A Customer is who orders are placed by and invoices are addressed to.
+type Customer struct {
+	// Generated by the number service, so that ids cannot be guessed.
+	Id             string    `json:"id"`
+	Name           string    `json:"name"`
+	Email          string    `json:"email"`
+	BillingAddress Address   `json:"billingAddress"`
+	CreatedAt      time.Time `json:"createdAt"`
+	// Verified identity of the caller that created the customer, who may
+	// change it; empty for customers created without an ID token.
+	Owner string `json:"owner,omitempty"`
+	// Deleted customers are kept for invoicing their existing orders, but
+	// cannot place new ones.
+	Deleted bool `json:"deleted"`
+}
+
+type Address struct {
+	Street     string `json:"street"`
+	PostalCode string `json:"postalCode"`
+	City       string `json:"city"`
+	// ISO 3166-1 alpha-2 code, such as NL.
+	Country string `json:"country"`
+}
+
+// BillingDetails are the customer details printed on an invoice.
+type BillingDetails struct {
+	Name    string  `json:"name"`
+	Email   string  `json:"email"`
+	Address Address `json:"address"`
+}
+
+var (
+	customerIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	countryPattern    = regexp.MustCompile(`^[A-Z]{2}$`)
+)
+
+// ValidCustomerId reports whether s can be the id of a customer.
+func ValidCustomerId(s string) bool {
+	return customerIdPattern.MatchString(s)
+}
+
+// ValidCountry reports whether s is formatted as an ISO 3166-1 alpha-2 code.
+func ValidCountry(s string) bool {
+	return countryPattern.MatchString(s)
+}
+
+// Billing returns the details to invoice the customer with.
+func (c Customer) Billing() BillingDetails {
+	return BillingDetails{Name: c.Name, Email: c.Email, Address: c.BillingAddress}
+}
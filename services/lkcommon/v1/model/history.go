@@ -0,0 +1,23 @@
+package model
+
+import "time"
+
+// An OrderChange records a write of an order in its history. Changes are
+// never altered once stored.
+type OrderChange struct {
+	OrderNumber string `json:"orderNumber"`
+	// Version of the order written; version 1 is its creation.
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Who made the change: an email address, subject or IP address.
+	Actor  string        `json:"actor"`
+	Fields []FieldChange `json:"fields"`
+}
+
+// A FieldChange holds the JSON values of an order field before and after a
+// change. Before is absent for new orders.
+type FieldChange struct {
+	Field  string      `json:"field"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
@@ -0,0 +1,132 @@
+// Package model contains the domain types exchanged between the services.
+package model
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Order struct {
+	// Id of the customer placing the order.
+	Customer string     `json:"customer"`
+	Items    []LineItem `json:"items"`
+	// Sum of the item totals, computed by the order service.
+	Total Money `json:"total"`
+	// Handed out by the number service. Order and payment numbers are ULIDs
+	// by default, so they cannot be enumerated.
+	OrderNumber string    `json:"orderNumber"`
+	Status      string    `json:"status"`
+	CreatedAt   time.Time `json:"createdAt"`
+	// Incremented by every change, to detect concurrent changes.
+	Version int `json:"version"`
+}
+
+// Order statuses. Orders go from created to paid, invoiced and fulfilled,
+// and can be cancelled until they are invoiced.
+const (
+	OrderCreated   = "created"
+	OrderPaid      = "paid"
+	OrderInvoiced  = "invoiced"
+	OrderFulfilled = "fulfilled"
+	OrderCancelled = "cancelled"
+)
+
+var orderTransitions = map[string][]string{
+	OrderCreated:  {OrderPaid, OrderCancelled},
+	OrderPaid:     {OrderInvoiced, OrderCancelled},
+	OrderInvoiced: {OrderFulfilled},
+}
+
+// CanTransition reports whether an order can go from one status to
+// another. Orders stored without a status count as created.
+func CanTransition(from, to string) bool {
+	if from == "" {
+		from = OrderCreated
+	}
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// A LineItem orders a quantity of a catalog product. Clients send the SKU and
+// quantity; the order service fills in the name and prices from the catalog.
+type LineItem struct {
+	Sku       string `json:"sku"`
+	Quantity  int    `json:"quantity"`
+	Name      string `json:"name"`
+	UnitPrice Money  `json:"unitPrice"`
+	Total     Money  `json:"total"`
+}
+
+type Payment struct {
+	OrderNumber   string `json:"orderNumber"`
+	PaymentNumber string `json:"paymentNumber"`
+}
+
+// Money is an amount in minor units: Value 1234 with 2 decimals is 12.34.
+type Money struct {
+	Value    int    `json:"value"`
+	Decimals int    `json:"decimals"`
+	Currency string `json:"currency"`
+}
+
+func NewMoney(a, b int) Money {
+	val := (a + b/100) * 100
+	val += b - b/100*100
+	return Money{
+		Value:    val,
+		Decimals: 2,
+		Currency: "bottle caps",
+	}
+}
+
+// Times returns the amount multiplied by n.
+func (m Money) Times(n int) Money {
+	m.Value *= n
+	return m
+}
+
+// Plus returns the sum of two amounts, which must be in the same currency
+// with the same number of decimals. The zero Money adds to any amount.
+func (m Money) Plus(o Money) (Money, error) {
+	if m == (Money{}) {
+		return o, nil
+	}
+	if m.Currency != o.Currency || m.Decimals != o.Decimals {
+		return Money{}, fmt.Errorf("cannot add %s to %s", o, m)
+	}
+	m.Value += o.Value
+	return m, nil
+}
+
+func (m Money) String() string {
+	sign := ""
+	v := m.Value
+	if v < 0 {
+		sign, v = "-", -v
+	}
+	if m.Decimals <= 0 {
+		return fmt.Sprintf("%s%d %s", sign, v, m.Currency)
+	}
+	s := strconv.Itoa(v)
+	if len(s) <= m.Decimals {
+		s = strings.Repeat("0", m.Decimals-len(s)+1) + s
+	}
+	return fmt.Sprintf("%s%s.%s %s", sign, s[:len(s)-m.Decimals], s[len(s)-m.Decimals:], m.Currency)
+}
+
+type Invoice struct {
+	Customer string
+	// Taken from the customer when the invoice is made.
+	BillTo      BillingDetails
+	OrderNumber string
+	Items       []LineItem
+	// Formatted by the number service, e.g. INV-2026-000123.
+	InvoiceNumber string
+	Total         Money
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCanTransition(t *testing.T) {
+	statuses := []string{"", OrderCreated, OrderPaid, OrderInvoiced, OrderFulfilled, OrderCancelled}
+	allowed := map[string]bool{
+		"->paid":              true,
+		"->cancelled":         true,
+		"created->paid":       true,
+		"created->cancelled":  true,
+		"paid->invoiced":      true,
+		"paid->cancelled":     true,
+		"invoiced->fulfilled": true,
+	}
+	for _, from := range statuses {
+		for _, to := range statuses {
+			name := from + "->" + to
+			t.Run(name, func(t *testing.T) {
+				if got := CanTransition(from, to); got != allowed[name] {
+					t.Errorf("expected %v, got %v", allowed[name], got)
+				}
+			})
+		}
+	}
+}
+
+func TestMoney(t *testing.T) {
+	eur := func(v int) Money { return Money{Value: v, Decimals: 2, Currency: "EUR"} }
+
+	formats := []struct {
+		m    Money
+		want string
+	}{
+		{eur(1234), "12.34 EUR"},
+		{eur(5), "0.05 EUR"},
+		{eur(-120), "-1.20 EUR"},
+		{eur(0), "0.00 EUR"},
+		{Money{Value: 7, Currency: "JPY"}, "7 JPY"},
+	}
+	for _, tt := range formats {
+		t.Run(tt.want, func(t *testing.T) {
+			if got := tt.m.String(); got != tt.want {
+				t.Errorf("expected %s, got %s", tt.want, got)
+			}
+		})
+	}
+
+	sums := []struct {
+		a, b Money
+		want Money
+		err  bool
+	}{
+		{eur(100), eur(250), eur(350), false},
+		{Money{}, eur(250), eur(250), false},
+		{eur(100), Money{Value: 1, Decimals: 2, Currency: "USD"}, Money{}, true},
+		{eur(100), Money{Value: 1, Decimals: 3, Currency: "EUR"}, Money{}, true},
+	}
+	for _, tt := range sums {
+		t.Run(fmt.Sprintf("%s plus %s", tt.a, tt.b), func(t *testing.T) {
+			got, err := tt.a.Plus(tt.b)
+			if (err != nil) != tt.err || got != tt.want {
+				t.Errorf("expected %s (error %v), got %s, %v", tt.want, tt.err, got, err)
+			}
+		})
+	}
+
+	if got := eur(450).Times(3); got != eur(1350) {
+		t.Errorf("expected 13.50 EUR, got %s", got)
+	}
+}
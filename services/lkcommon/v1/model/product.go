@@ -0,0 +1,27 @@
+package model
+
+import (
+	"regexp"
+)
+
+// A Product is an entry of the catalog that orders are priced from.
+type Product struct {
+	Sku       string `json:"sku"`
+	Name      string `json:"name"`
+	UnitPrice Money  `json:"unitPrice"`
+}
+
+var (
+	skuPattern      = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+)
+
+// ValidSku reports whether s can be the SKU of a product.
+func ValidSku(s string) bool {
+	return skuPattern.MatchString(s)
+}
+
+// ValidCurrency reports whether s is an ISO 4217 currency code.
+func ValidCurrency(s string) bool {
+	return currencyPattern.MatchString(s)
+}
@@ -0,0 +1,86 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const (
+	ResetNever   = ""
+	ResetYearly  = "yearly"
+	ResetMonthly = "monthly"
+
+	CheckDigitNone  = ""
+	CheckDigitMod97 = "mod97"
+
+	GeneratorCounter = ""
+	GeneratorUlid    = "ulid"
+	GeneratorUuidV7  = "uuidv7"
+	GeneratorRandom  = "random"
+)
+
+// A Sequence defines how the numbers of a range are presented. For
+// instance, prefix "INV-", padding 6 and a yearly reset give identifiers
+// like INV-2026-000123.
+//
+// A generator replaces the counter with identifiers that cannot be guessed:
+// ULIDs, version 7 UUIDs or random strings with a check character. Padding,
+// reset and check digits only apply to counters.
+type Sequence struct {
+	Key       string `json:"key" yaml:"key"`
+	Generator string `json:"generator,omitempty" yaml:"generator"`
+	Prefix    string `json:"prefix,omitempty" yaml:"prefix"`
+	// Minimum number of digits; shorter numbers are padded with zeroes.
+	Padding int `json:"padding,omitempty" yaml:"padding"`
+	// Reset restarts numbering every year or month. The period becomes part
+	// of the identifier.
+	Reset string `json:"reset,omitempty" yaml:"reset"`
+	// CheckDigit appends check digits to detect typing errors.
+	CheckDigit string `json:"checkDigit,omitempty" yaml:"check_digit"`
+	// Gapless sequences only hand out numbers through reservations, which
+	// are committed or handed out again.
+	Gapless bool `json:"gapless,omitempty" yaml:"gapless"`
+}
+
+var keyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// Counter reports whether the sequence hands out consecutive numbers.
+func (s Sequence) Counter() bool {
+	return s.Generator == GeneratorCounter
+}
+
+// ValidKey reports whether s can be used as the key of a range.
+func ValidKey(s string) bool {
+	return keyPattern.MatchString(s)
+}
+
+// Validate lists the problems with the definition, if any.
+func (s Sequence) Validate() []string {
+	var ps []string
+	if !ValidKey(s.Key) {
+		ps = append(ps, fmt.Sprintf("key %q must consist of 1 to 64 letters, digits, '-' or '_'", s.Key))
+	}
+	if len(s.Prefix) > 16 || strings.ContainsAny(s.Prefix, "/?#% ") {
+		ps = append(ps, fmt.Sprintf("prefix %q must be at most 16 characters, without '/', '?', '#', '%%' or spaces", s.Prefix))
+	}
+	if s.Padding < 0 || s.Padding > 18 {
+		ps = append(ps, fmt.Sprintf("padding must be between 0 and 18, got %v", s.Padding))
+	}
+	if s.Reset != ResetNever && s.Reset != ResetYearly && s.Reset != ResetMonthly {
+		ps = append(ps, fmt.Sprintf("reset %q must be empty, %q or %q", s.Reset, ResetYearly, ResetMonthly))
+	}
+	if s.CheckDigit != CheckDigitNone && s.CheckDigit != CheckDigitMod97 {
+		ps = append(ps, fmt.Sprintf("check digit %q must be empty or %q", s.CheckDigit, CheckDigitMod97))
+	}
+	switch s.Generator {
+	case GeneratorCounter:
+	case GeneratorUlid, GeneratorUuidV7, GeneratorRandom:
+		if s.Padding != 0 || s.Reset != ResetNever || s.CheckDigit != CheckDigitNone || s.Gapless {
+			ps = append(ps, fmt.Sprintf("padding, reset, check digit and gapless do not apply to generator %q", s.Generator))
+		}
+	default:
+		ps = append(ps, fmt.Sprintf("generator %q must be empty, %q, %q or %q", s.Generator, GeneratorUlid, GeneratorUuidV7, GeneratorRandom))
+	}
+	return ps
+}
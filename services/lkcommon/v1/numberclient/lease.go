@@ -0,0 +1,164 @@
+package numberclient
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"sync"
+	"time"
+)
+
+var (
+	leasedNumbers = metrics.NewCounter("number_client_leased_total",
+		"Numbers and identifiers leased from the number service, by key.", "key")
+	usedNumbers = metrics.NewCounter("number_client_used_total",
+		"Leased numbers and identifiers handed out, by key.", "key")
+	unusedNumbers = metrics.NewCounter("number_client_unused_total",
+		"Leased numbers returned unused after their lease expired, by key.", "key")
+)
+
+// Timeout for reporting unused numbers in the background.
+const returnTimeout = 10 * time.Second
+
+// LeasingClient hands out numbers and identifiers from blocks leased from
+// the number service, saving a round trip per number. A lease expires after
+// the lease time; its unused numbers are returned to the number service and
+// never handed out. Numbers are therefore unique but may have gaps, and are
+// only roughly ordered between instances.
+//
+// Leased identifiers are made when the block is leased: those of periodic
+// sequences have the period of that time, and generated identifiers, like
+// ULIDs, its timestamp.
+type LeasingClient struct {
+	client    *Client
+	blockSize int
+	leaseTime time.Duration
+
+	mux sync.Mutex
+	// Leases of numbers and of identifiers, by key.
+	numbers map[string]*lease
+	ids     map[string]*lease
+}
+
+type lease struct {
+	mux     sync.Mutex
+	block   Block
+	used    int
+	expires time.Time
+}
+
+// remaining returns the unused part of the lease. Generated identifiers
+// have no numbers, so nothing remains to be returned for them.
+func (l *lease) remaining() Block {
+	if l.block.Start == 0 {
+		return Block{Key: l.block.Key}
+	}
+	return Block{Key: l.block.Key, Start: l.block.Start + l.used, Count: l.block.Count - l.used}
+}
+
+// NewLeasingClient creates a client for the number service at baseUrl. A
+// block size of one disables leasing.
+func NewLeasingClient(baseUrl string, client *httpx.Client, blockSize int, leaseTime time.Duration) *LeasingClient {
+	return &LeasingClient{
+		client:    New(baseUrl, client),
+		blockSize: blockSize,
+		leaseTime: leaseTime,
+		numbers:   make(map[string]*lease),
+		ids:       make(map[string]*lease),
+	}
+}
+
+func (c *LeasingClient) GetNextNumber(ctx context.Context, key string) (int, error) {
+	if c.blockSize <= 1 {
+		return c.client.GetNextNumber(ctx, key)
+	}
+	b, i, err := c.take(ctx, c.numbers, key, c.client.GetBlock)
+	if err != nil {
+		return 0, err
+	}
+	return b.Start + i, nil
+}
+
+// GetNextId hands out the next identifier in the sequence identified by
+// key.
+func (c *LeasingClient) GetNextId(ctx context.Context, key string) (string, error) {
+	if c.blockSize <= 1 {
+		return c.client.GetNextId(ctx, key)
+	}
+	b, i, err := c.take(ctx, c.ids, key, c.client.GetIdBlock)
+	if err != nil {
+		return "", err
+	}
+	return b.Ids[i], nil
+}
+
+// take hands out the next entry of the lease for key, leasing a new block
+// with fetch when the lease is used up or has expired. It returns the block
+// and the index of the entry in it.
+func (c *LeasingClient) take(ctx context.Context, leases map[string]*lease, key string, fetch func(context.Context, string, int) (Block, error)) (Block, int, error) {
+	c.mux.Lock()
+	l, ok := leases[key]
+	if !ok {
+		l = &lease{}
+		leases[key] = l
+	}
+	c.mux.Unlock()
+
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	if l.used < l.block.Count && time.Now().After(l.expires) {
+		c.returnUnused(ctx, l.remaining())
+		l.used = l.block.Count
+	}
+	if l.used >= l.block.Count {
+		b, err := fetch(ctx, key, c.blockSize)
+		if err != nil {
+			return Block{}, 0, err
+		}
+		leasedNumbers.Add(float64(b.Count), key)
+		l.block, l.used = b, 0
+		l.expires = time.Now().Add(c.leaseTime)
+	}
+	i := l.used
+	l.used += 1
+	usedNumbers.Inc(key)
+	return l.block, i, nil
+}
+
+// returnUnused reports unused numbers in the background. The call outlives
+// the request of ctx, which is only used for logging.
+func (c *LeasingClient) returnUnused(ctx context.Context, b Block) {
+	if b.Count == 0 {
+		return
+	}
+	unusedNumbers.Add(float64(b.Count), b.Key)
+	go func() {
+		rctx, cancel := context.WithTimeout(context.Background(), returnTimeout)
+		defer cancel()
+		if err := c.client.ReturnUnused(rctx, b); err != nil {
+			logctx.Warn(ctx, fmt.Sprintf("could not return %v unused %s numbers from %v: %s", b.Count, b.Key, b.Start, err))
+		}
+	}()
+}
+
+// Release returns the unused numbers of all leases, for instance when the
+// service shuts down.
+func (c *LeasingClient) Release(ctx context.Context) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	for _, leases := range []map[string]*lease{c.numbers, c.ids} {
+		for _, l := range leases {
+			l.mux.Lock()
+			if b := l.remaining(); b.Count > 0 {
+				unusedNumbers.Add(float64(b.Count), b.Key)
+				if err := c.client.ReturnUnused(ctx, b); err != nil {
+					logctx.Warn(ctx, fmt.Sprintf("could not return %v unused %s numbers from %v: %s", b.Count, b.Key, b.Start, err))
+				}
+			}
+			l.used = l.block.Count
+			l.mux.Unlock()
+		}
+	}
+}
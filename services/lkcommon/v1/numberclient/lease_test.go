@@ -0,0 +1,152 @@
+package numberclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lkcommon/httpx"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNumbers serves blocks of numbers and identifiers like the number
+// service, and records the blocks returned unused.
+type fakeNumbers struct {
+	mux    sync.Mutex
+	next   int
+	calls  int
+	unused []Block
+	// Idempotency keys of the calls.
+	keys []string
+}
+
+func (f *fakeNumbers) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.calls += 1
+	f.keys = append(f.keys, r.Header.Get(httpx.IdempotencyKeyHeader))
+	if r.URL.Path == "/ranges/order/unused" {
+		b := Block{}
+		_ = json.NewDecoder(r.Body).Decode(&b)
+		f.unused = append(f.unused, b)
+		httpx.OkJson(w, b)
+		return
+	}
+	count, _ := strconv.Atoi(r.URL.Query().Get("count"))
+	if count == 0 {
+		f.next += 1
+		httpx.OkJson(w, Number{Key: "order", Number: f.next, Id: fmt.Sprintf("ORD-%v", f.next)})
+		return
+	}
+	b := Block{Key: "order", Start: f.next + 1, Count: count}
+	if r.URL.Path == "/ranges/order/next" {
+		for i := 0; i < count; i += 1 {
+			b.Ids = append(b.Ids, fmt.Sprintf("ORD-%v", b.Start+i))
+		}
+	}
+	f.next += count
+	httpx.OkJson(w, b)
+}
+
+func newTestLeasingClient(t *testing.T, blockSize int, leaseTime time.Duration) (*LeasingClient, *fakeNumbers) {
+	f := &fakeNumbers{}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	client := httpx.NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+	return NewLeasingClient(srv.URL, client, blockSize, leaseTime), f
+}
+
+func TestLeasingClientIds(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestLeasingClient(t, 3, time.Minute)
+
+	var ids []string
+	for i := 0; i < 4; i += 1 {
+		id, err := c.GetNextId(ctx, "order")
+		if err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+		ids = append(ids, id)
+	}
+	if fmt.Sprint(ids) != "[ORD-1 ORD-2 ORD-3 ORD-4]" {
+		t.Errorf("expected ORD-1 to ORD-4, got %v", ids)
+	}
+	if f.calls != 2 {
+		t.Errorf("expected 2 calls, got %v", f.calls)
+	}
+
+	c.Release(ctx)
+	if len(f.unused) != 1 || f.unused[0].Start != 5 || f.unused[0].Count != 2 {
+		t.Errorf("expected 5 and 6 returned, got %+v", f.unused)
+	}
+	if id, _ := c.GetNextId(ctx, "order"); id != "ORD-7" {
+		t.Errorf("expected a new block after release, got %s", id)
+	}
+}
+
+func TestLeasingClientNumbers(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestLeasingClient(t, 2, time.Millisecond)
+
+	if n, _ := c.GetNextNumber(ctx, "order"); n != 1 {
+		t.Errorf("expected 1, got %v", n)
+	}
+	time.Sleep(5 * time.Millisecond)
+	// The lease expired; its rest is returned in the background.
+	if n, _ := c.GetNextNumber(ctx, "order"); n != 3 {
+		t.Errorf("expected 3 from a new block, got %v", n)
+	}
+	deadline := time.Now().Add(time.Second)
+	for {
+		f.mux.Lock()
+		unused := f.unused
+		f.mux.Unlock()
+		if len(unused) == 1 {
+			if unused[0].Start != 2 || unused[0].Count != 1 {
+				t.Errorf("expected 2 returned, got %+v", unused[0])
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected unused numbers to be returned")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestLeasingClientDisabled(t *testing.T) {
+	ctx := context.Background()
+	c, f := newTestLeasingClient(t, 1, time.Minute)
+	for _, expected := range []string{"ORD-1", "ORD-2"} {
+		if id, err := c.GetNextId(ctx, "order"); err != nil || id != expected {
+			t.Errorf("expected %s, got %s, %v", expected, id, err)
+		}
+	}
+	if f.calls != 2 {
+		t.Errorf("expected a call per identifier, got %v", f.calls)
+	}
+}
+
+func TestLeasingClientIdempotencyKey(t *testing.T) {
+	ctx := httpx.WithIdempotencyKey(context.Background(), "request-1")
+
+	c, f := newTestLeasingClient(t, 2, time.Minute)
+	_, _ = c.GetNextId(ctx, "order")
+	_, _ = c.GetNextNumber(ctx, "order")
+	if len(f.keys) != 2 || f.keys[0] != "" || f.keys[1] != "" {
+		t.Errorf("expected block fetches without idempotency key, got %q", f.keys)
+	}
+
+	// Single identifiers belong to the request.
+	c, f = newTestLeasingClient(t, 1, time.Minute)
+	_, _ = c.GetNextId(ctx, "order")
+	if len(f.keys) != 1 || f.keys[0] == "" {
+		t.Errorf("expected idempotency key, got %q", f.keys)
+	}
+}
@@ -0,0 +1,226 @@
+// Package numberclient is the client for the number service.
+package numberclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/httpx"
+	"lkcommon/idempotency"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// A NumberSource hands out numbers from ranges identified by key.
+type NumberSource interface {
+	GetNextNumber(ctx context.Context, key string) (int, error)
+}
+
+// An IdSource hands out formatted identifiers from sequences identified by
+// key.
+type IdSource interface {
+	GetNextId(ctx context.Context, key string) (string, error)
+}
+
+// A Reserver hands out gapless identifiers: a reserved identifier is
+// either committed or cancelled, and then handed out again.
+type Reserver interface {
+	Reserve(ctx context.Context, key string) (Reservation, error)
+	Commit(ctx context.Context, res Reservation) error
+	Cancel(ctx context.Context, res Reservation) error
+}
+
+// Client calls the number service at BaseUrl.
+type Client struct {
+	BaseUrl string
+	client  *httpx.Client
+}
+
+func New(baseUrl string, client *httpx.Client) *Client {
+	return &Client{BaseUrl: baseUrl, client: client}
+}
+
+// GetNextNumber fetches the next number in the range identified by key.
+// Errors reported by the number service are returned as *apierror.Error.
+func (c *Client) GetNextNumber(ctx context.Context, key string) (int, error) {
+	u := fmt.Sprintf("%s/ranges/%s", c.BaseUrl, key)
+	r, err := c.client.Do(ctx, http.MethodGet, u, nil, header(ctx, u))
+	if err != nil {
+		return 0, apierror.Newf(apierror.Unavailable, "error calling number service: %s", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return 0, apierror.FromResponse(r)
+	}
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return 0, fmt.Errorf("error reading response body: %s", err)
+	}
+	num, err := strconv.Atoi(string(data))
+	if err != nil {
+		return 0, fmt.Errorf("invalid response content %s", data)
+	}
+	return num, nil
+}
+
+// A Number is a number handed out from a range, with the identifier
+// formatted according to the range's sequence definition.
+type Number struct {
+	Key    string `json:"key"`
+	Number int    `json:"number"`
+	Id     string `json:"id"`
+}
+
+// GetNextId fetches the next identifier in the sequence identified by key,
+// e.g. INV-2026-000123.
+func (c *Client) GetNextId(ctx context.Context, key string) (string, error) {
+	u := fmt.Sprintf("%s/ranges/%s/next", c.BaseUrl, key)
+	r, err := c.client.Do(ctx, http.MethodGet, u, nil, header(ctx, u))
+	if err != nil {
+		return "", apierror.Newf(apierror.Unavailable, "error calling number service: %s", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return "", apierror.FromResponse(r)
+	}
+	n := Number{}
+	if err := json.NewDecoder(r.Body).Decode(&n); err != nil || n.Id == "" {
+		return "", fmt.Errorf("invalid response content: %v", err)
+	}
+	return n.Id, nil
+}
+
+// A Block is a contiguous range of numbers: Start up to Start+Count. A block
+// of identifiers holds them in Ids; for sequences with a generator, Start is
+// zero as the identifiers have no number.
+type Block struct {
+	Key   string   `json:"key"`
+	Start int      `json:"start"`
+	Count int      `json:"count"`
+	Ids   []string `json:"ids,omitempty"`
+}
+
+// GetBlock reserves count consecutive numbers in the range identified by
+// key. A block outlives the request it is fetched for, so the request's
+// idempotency key is not passed on: a retried request would get the same
+// block again, while other requests are using it.
+func (c *Client) GetBlock(ctx context.Context, key string, count int) (Block, error) {
+	u := fmt.Sprintf("%s/ranges/%s?count=%v", c.BaseUrl, key, count)
+	r, err := c.client.Do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return Block{}, apierror.Newf(apierror.Unavailable, "error calling number service: %s", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return Block{}, apierror.FromResponse(r)
+	}
+	b := Block{}
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		return Block{}, fmt.Errorf("invalid response content: %s", err)
+	}
+	if b.Count != count {
+		return Block{}, fmt.Errorf("requested %v numbers, got %v", count, b.Count)
+	}
+	return b, nil
+}
+
+// GetIdBlock fetches count identifiers from the sequence identified by key
+// at once. Like GetBlock, it does not pass on the request's idempotency key.
+func (c *Client) GetIdBlock(ctx context.Context, key string, count int) (Block, error) {
+	u := fmt.Sprintf("%s/ranges/%s/next?count=%v", c.BaseUrl, key, count)
+	r, err := c.client.Do(ctx, http.MethodGet, u, nil, nil)
+	if err != nil {
+		return Block{}, apierror.Newf(apierror.Unavailable, "error calling number service: %s", err)
+	}
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return Block{}, apierror.FromResponse(r)
+	}
+	b := Block{}
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		return Block{}, fmt.Errorf("invalid response content: %s", err)
+	}
+	if b.Count != count || len(b.Ids) != count {
+		return Block{}, fmt.Errorf("requested %v identifiers, got %v", count, len(b.Ids))
+	}
+	return b, nil
+}
+
+// ReturnUnused reports numbers from a block that will never be used, so
+// the number service can account for the gap.
+func (c *Client) ReturnUnused(ctx context.Context, b Block) error {
+	bs, _ := json.Marshal(b)
+	r, err := c.client.PostJson(ctx, fmt.Sprintf("%s/ranges/%s/unused", c.BaseUrl, b.Key), bs)
+	if err != nil {
+		return apierror.Newf(apierror.Unavailable, "error calling number service: %s", err)
+	}
+	defer httpx.DrainAndClose(r)
+	if r.StatusCode != http.StatusOK {
+		return apierror.FromResponse(r)
+	}
+	return nil
+}
+
+// A Reservation holds a number for its holder until it is committed or
+// cancelled. A reservation that is neither is cancelled when it expires.
+type Reservation struct {
+	Key     string    `json:"key"`
+	Number  int       `json:"number"`
+	Id      string    `json:"id"`
+	Token   string    `json:"token"`
+	Expires time.Time `json:"expires"`
+}
+
+// Reserve reserves the next identifier in the sequence identified by key.
+// Numbers of cancelled and expired reservations are handed out again, so
+// committed numbers have no gaps.
+func (c *Client) Reserve(ctx context.Context, key string) (Reservation, error) {
+	res := Reservation{}
+	err := c.postReservation(ctx, fmt.Sprintf("%s/ranges/%s/reservations", c.BaseUrl, key), &res)
+	return res, err
+}
+
+// Commit makes a reservation final. It fails with a Conflict error when the
+// reservation has expired.
+func (c *Client) Commit(ctx context.Context, res Reservation) error {
+	return c.postReservation(ctx, fmt.Sprintf("%s/ranges/%s/reservations/%s/commit", c.BaseUrl, res.Key, res.Token), nil)
+}
+
+// Cancel releases a reservation, so its number can be handed out again.
+func (c *Client) Cancel(ctx context.Context, res Reservation) error {
+	return c.postReservation(ctx, fmt.Sprintf("%s/ranges/%s/reservations/%s/cancel", c.BaseUrl, res.Key, res.Token), nil)
+}
+
+// postReservation makes a reservation call. Reservations do not take
+// idempotency keys: a retried request must not get a reservation it
+// cancelled, and a reservation lost in a failed call simply expires.
+func (c *Client) postReservation(ctx context.Context, url string, v *Reservation) error {
+	r, err := c.client.PostJson(ctx, url, nil)
+	if err != nil {
+		return apierror.Newf(apierror.Unavailable, "error calling number service: %s", err)
+	}
+	defer httpx.DrainAndClose(r)
+	if r.StatusCode != http.StatusOK {
+		return apierror.FromResponse(r)
+	}
+	if v != nil {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil || v.Token == "" {
+			return fmt.Errorf("invalid response content: %v", err)
+		}
+	}
+	return nil
+}
+
+// header returns the headers for a call to url. While handling a request
+// with an idempotency key, the call gets a key derived from it, so that a
+// retried request gets the same numbers.
+func header(ctx context.Context, url string) http.Header {
+	h := http.Header{}
+	if k := idempotency.Key(ctx, url); k != "" {
+		h.Set(httpx.IdempotencyKeyHeader, k)
+	}
+	return h
+}
@@ -0,0 +1,96 @@
+// Package orderclient is the client for the order service.
+package orderclient
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/httpx"
+	"lkcommon/model"
+	"net/http"
+	"net/url"
+)
+
+// Transitions, as accepted by Transition.
+const (
+	Pay     = "pay"
+	Invoice = "invoice"
+	Fulfil  = "fulfil"
+	Cancel  = "cancel"
+)
+
+// Client calls the order service at BaseUrl.
+type Client struct {
+	BaseUrl string
+	client  *httpx.Client
+}
+
+func New(baseUrl string, client *httpx.Client) *Client {
+	return &Client{BaseUrl: baseUrl, client: client}
+}
+
+// GetOrder fetches an order. Errors reported by the order service, such as
+// a missing order, are returned as *apierror.Error.
+func (c *Client) GetOrder(ctx context.Context, orderNumber string) (*model.Order, error) {
+	if orderNumber == "" {
+		return nil, apierror.New(apierror.InvalidArgument, "missing order number")
+	}
+	r, err := c.client.Get(ctx, c.orderUrl(orderNumber))
+	if err != nil {
+		return nil, apierror.Newf(apierror.Unavailable, "error calling order service: %s", err)
+	}
+	return decodeOrder(r)
+}
+
+// Transition moves an order to the status the transition leads to and
+// returns the updated order. Repeating a transition has no effect. A
+// transition the order's status does not allow fails with a Conflict error.
+func (c *Client) Transition(ctx context.Context, orderNumber, transition string) (*model.Order, error) {
+	r, err := c.client.PostJson(ctx, c.orderUrl(orderNumber)+"/"+transition, nil)
+	if err != nil {
+		return nil, apierror.Newf(apierror.Unavailable, "error calling order service: %s", err)
+	}
+	return decodeOrder(r)
+}
+
+// GetCustomer fetches a customer, including deleted ones. Errors reported by
+// the order service, such as a missing customer, are returned as
+// *apierror.Error.
+func (c *Client) GetCustomer(ctx context.Context, id string) (*model.Customer, error) {
+	if id == "" {
+		return nil, apierror.New(apierror.InvalidArgument, "missing customer id")
+	}
+	r, err := c.client.Get(ctx, fmt.Sprintf("%s/customers/%s", c.BaseUrl, url.PathEscape(id)))
+	if err != nil {
+		return nil, apierror.Newf(apierror.Unavailable, "error calling order service: %s", err)
+	}
+	cu := &model.Customer{}
+	if err := decode(r, cu); err != nil {
+		return nil, err
+	}
+	return cu, nil
+}
+
+func (c *Client) orderUrl(orderNumber string) string {
+	return fmt.Sprintf("%s/orders/%s", c.BaseUrl, url.PathEscape(orderNumber))
+}
+
+func decodeOrder(r *http.Response) (*model.Order, error) {
+	o := &model.Order{}
+	if err := decode(r, o); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+func decode(r *http.Response, v interface{}) error {
+	defer r.Body.Close()
+	if r.StatusCode != http.StatusOK {
+		return apierror.FromResponse(r)
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		return fmt.Errorf("invalid response content: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,678 @@
+package store
+
+import (
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A Backend stores records by key.
+type Backend interface {
+	// Put stores the record under the key, replacing any existing record.
+	Put(ctx context.Context, key string, v interface{}) error
+	// Create stores the record under the key. It returns ErrConflict when
+	// the key is taken.
+	Create(ctx context.Context, key string, v interface{}) error
+	// CreateWith is Create, also creating the sub records in collections of
+	// the new record. Either all records are stored or none; it returns
+	// ErrConflict when any of the keys is taken.
+	CreateWith(ctx context.Context, key string, v interface{}, subs []SubRecord) error
+	// Update reads the record stored under the key into v, calls change and
+	// stores v, unless change returns an error. The record is not changed by
+	// others in between: depending on the backend, Update fails with
+	// ErrConflict or calls change again with the latest record. It returns
+	// ErrNotFound when there is no such record.
+	Update(ctx context.Context, key string, v interface{}, change func() error) error
+	// UpdateWith is Update, also creating the sub records returned by change
+	// in collections of the record. Either all records are stored or none;
+	// it returns ErrConflict when any of the sub record keys is taken.
+	UpdateWith(ctx context.Context, key string, v interface{}, change func() ([]SubRecord, error)) error
+	// Get reads the record stored under the key into v. It returns
+	// ErrNotFound when there is no such record.
+	Get(ctx context.Context, key string, v interface{}) error
+	// Keys lists the keys of all records, in lexical order.
+	Keys(ctx context.Context) ([]string, error)
+	// Sub returns the backend for a named collection of records that belong
+	// to the record under the key, such as the history of an order. Its
+	// records are not listed by Keys.
+	Sub(key, name string) Backend
+	// Check verifies that the backend can be reached.
+	Check(ctx context.Context) error
+}
+
+// A SubRecord is a record to store in a collection of another record, see
+// Backend.Sub.
+type SubRecord struct {
+	// Name is the name of the collection.
+	Name  string
+	Key   string
+	Value interface{}
+}
+
+// noChange adapts the change of Update to that of UpdateWith.
+func noChange(change func() error) func() ([]SubRecord, error) {
+	return func() ([]SubRecord, error) {
+		return nil, change()
+	}
+}
+
+type memoryBackend struct {
+	mux     sync.RWMutex
+	records map[string][]byte
+	subs    map[string]*memoryBackend
+}
+
+// NewMemoryBackend creates a backend that keeps records in memory. Records
+// are stored as JSON, so callers never share data with the backend.
+func NewMemoryBackend() Backend {
+	return newMemoryBackend()
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{records: make(map[string][]byte), subs: make(map[string]*memoryBackend)}
+}
+
+func (b *memoryBackend) Put(_ context.Context, key string, v interface{}) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %s", key, err)
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.records[key] = bs
+	return nil
+}
+
+func (b *memoryBackend) Create(ctx context.Context, key string, v interface{}) error {
+	return b.CreateWith(ctx, key, v, nil)
+}
+
+func (b *memoryBackend) CreateWith(_ context.Context, key string, v interface{}, subs []SubRecord) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %s", key, err)
+	}
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if _, ok := b.records[key]; ok {
+		return ErrConflict
+	}
+	if err := b.createSubs(key, subs); err != nil {
+		return err
+	}
+	b.records[key] = bs
+	return nil
+}
+
+func (b *memoryBackend) Update(ctx context.Context, key string, v interface{}, change func() error) error {
+	return b.UpdateWith(ctx, key, v, noChange(change))
+}
+
+func (b *memoryBackend) UpdateWith(_ context.Context, key string, v interface{}, change func() ([]SubRecord, error)) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	bs, ok := b.records[key]
+	if !ok {
+		return ErrNotFound
+	}
+	if err := json.Unmarshal(bs, v); err != nil {
+		return err
+	}
+	subs, err := change()
+	if err != nil {
+		return err
+	}
+	bs, err = json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %s", key, err)
+	}
+	if err := b.createSubs(key, subs); err != nil {
+		return err
+	}
+	b.records[key] = bs
+	return nil
+}
+
+// createSubs creates the sub records of the record under the key, all or
+// none. The caller holds the lock.
+func (b *memoryBackend) createSubs(key string, subs []SubRecord) error {
+	bss := make([][]byte, len(subs))
+	for i, sr := range subs {
+		bs, err := json.Marshal(sr.Value)
+		if err != nil {
+			return fmt.Errorf("error encoding record %s/%s/%s: %s", key, sr.Name, sr.Key, err)
+		}
+		bss[i] = bs
+	}
+	locked := make(map[*memoryBackend]bool)
+	for _, sr := range subs {
+		sb := b.sub(key, sr.Name)
+		if !locked[sb] {
+			sb.mux.Lock()
+			defer sb.mux.Unlock()
+			locked[sb] = true
+		}
+		if _, ok := sb.records[sr.Key]; ok {
+			return ErrConflict
+		}
+	}
+	for i, sr := range subs {
+		b.sub(key, sr.Name).records[sr.Key] = bss[i]
+	}
+	return nil
+}
+
+func (b *memoryBackend) Get(_ context.Context, key string, v interface{}) error {
+	b.mux.RLock()
+	bs, ok := b.records[key]
+	b.mux.RUnlock()
+	if !ok {
+		return ErrNotFound
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func (b *memoryBackend) Keys(context.Context) ([]string, error) {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	var ks []string
+	for k := range b.records {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks, nil
+}
+
+func (b *memoryBackend) Sub(key, name string) Backend {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	return b.sub(key, name)
+}
+
+// sub returns the collection of the record, creating it if need be. The
+// caller holds the lock.
+func (b *memoryBackend) sub(key, name string) *memoryBackend {
+	id := key + "/" + name
+	if _, ok := b.subs[id]; !ok {
+		b.subs[id] = newMemoryBackend()
+	}
+	return b.subs[id]
+}
+
+func (b *memoryBackend) Check(context.Context) error {
+	return nil
+}
+
+type fileBackend struct {
+	dir string
+	mux sync.Mutex
+}
+
+// NewFileBackend creates a backend that stores records as JSON files in
+// the directory.
+func NewFileBackend(dir string) (Backend, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("could not create storage directory %s: %s", dir, err)
+	}
+	return &fileBackend{dir: dir}, nil
+}
+
+func (b *fileBackend) path(key string) string {
+	return filepath.Join(b.dir, filepath.Base(key)+".json")
+}
+
+func (b *fileBackend) Put(_ context.Context, key string, v interface{}) error {
+	return b.write(key, v, os.Rename)
+}
+
+// Create links the new file into place, which fails if the key is taken.
+func (b *fileBackend) Create(_ context.Context, key string, v interface{}) error {
+	return b.write(key, v, link)
+}
+
+// CreateWith creates the sub records first and removes them again when the
+// record cannot be created.
+func (b *fileBackend) CreateWith(ctx context.Context, key string, v interface{}, subs []SubRecord) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	created, err := b.createSubs(key, subs)
+	if err != nil {
+		return err
+	}
+	if err := b.write(key, v, link); err != nil {
+		removeAll(created)
+		return err
+	}
+	return nil
+}
+
+func link(tmp, path string) error {
+	err := os.Link(tmp, path)
+	_ = os.Remove(tmp)
+	if os.IsExist(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// Update serializes updates within the process. Other processes sharing the
+// directory may overwrite the record.
+func (b *fileBackend) Update(ctx context.Context, key string, v interface{}, change func() error) error {
+	return b.UpdateWith(ctx, key, v, noChange(change))
+}
+
+// UpdateWith creates the sub records first and removes them again when the
+// record cannot be written.
+func (b *fileBackend) UpdateWith(ctx context.Context, key string, v interface{}, change func() ([]SubRecord, error)) error {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if err := b.Get(ctx, key, v); err != nil {
+		return err
+	}
+	subs, err := change()
+	if err != nil {
+		return err
+	}
+	created, err := b.createSubs(key, subs)
+	if err != nil {
+		return err
+	}
+	if err := b.write(key, v, os.Rename); err != nil {
+		removeAll(created)
+		return err
+	}
+	return nil
+}
+
+// createSubs creates the sub records of the record under the key, all or
+// none, and returns the paths of their files.
+func (b *fileBackend) createSubs(key string, subs []SubRecord) ([]string, error) {
+	var created []string
+	for _, sr := range subs {
+		sb := b.Sub(key, sr.Name).(*fileBackend)
+		if err := sb.write(sr.Key, sr.Value, link); err != nil {
+			removeAll(created)
+			return nil, err
+		}
+		created = append(created, sb.path(sr.Key))
+	}
+	return created, nil
+}
+
+func removeAll(paths []string) {
+	for _, p := range paths {
+		_ = os.Remove(p)
+	}
+}
+
+// write writes the record to a temporary file first, so readers never see
+// partial records, and then moves it into place.
+func (b *fileBackend) write(key string, v interface{}, place func(tmp, path string) error) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %s", key, err)
+	}
+	tmp, err := ioutil.TempFile(b.dir, ".tmp-")
+	if err != nil {
+		return fmt.Errorf("error creating file for %s: %s", key, err)
+	}
+	_, err = tmp.Write(bs)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error writing record %s: %s", key, err)
+	}
+	if err := place(tmp.Name(), b.path(key)); err == ErrConflict {
+		return err
+	} else if err != nil {
+		_ = os.Remove(tmp.Name())
+		return fmt.Errorf("error writing record %s: %s", key, err)
+	}
+	return nil
+}
+
+func (b *fileBackend) Get(_ context.Context, key string, v interface{}) error {
+	bs, err := ioutil.ReadFile(b.path(key))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("error reading record %s: %s", key, err)
+	}
+	return json.Unmarshal(bs, v)
+}
+
+func (b *fileBackend) Keys(context.Context) ([]string, error) {
+	fis, err := ioutil.ReadDir(b.dir)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %s", b.dir, err)
+	}
+	var ks []string
+	for _, fi := range fis {
+		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".json") {
+			ks = append(ks, strings.TrimSuffix(fi.Name(), ".json"))
+		}
+	}
+	return ks, nil
+}
+
+// Sub stores the records in a directory named after the key. A failure to
+// create it shows when the records are written.
+func (b *fileBackend) Sub(key, name string) Backend {
+	dir := filepath.Join(b.dir, filepath.Base(key), name)
+	_ = os.MkdirAll(dir, 0755)
+	return &fileBackend{dir: dir}
+}
+
+func (b *fileBackend) Check(context.Context) error {
+	if _, err := os.Stat(b.dir); err != nil {
+		return fmt.Errorf("storage directory unavailable: %s", err)
+	}
+	return nil
+}
+
+type firestoreBackend struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+}
+
+// NewFirestoreBackend creates a backend that stores records as documents
+// in the collection.
+func NewFirestoreBackend(client *firestore.Client, collection string) Backend {
+	return &firestoreBackend{client: client, collection: client.Collection(collection)}
+}
+
+func (b *firestoreBackend) Put(ctx context.Context, key string, v interface{}) error {
+	if _, err := b.collection.Doc(key).Set(ctx, v); err != nil {
+		return fmt.Errorf("error writing document %s: %s", key, err)
+	}
+	return nil
+}
+
+func (b *firestoreBackend) Create(ctx context.Context, key string, v interface{}) error {
+	_, err := b.collection.Doc(key).Create(ctx, v)
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	} else if err != nil {
+		return fmt.Errorf("error creating document %s: %s", key, err)
+	}
+	return nil
+}
+
+// CreateWith creates the documents in a transaction.
+func (b *firestoreBackend) CreateWith(ctx context.Context, key string, v interface{}, subs []SubRecord) error {
+	ref := b.collection.Doc(key)
+	err := b.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		if err := tx.Create(ref, v); err != nil {
+			return err
+		}
+		return b.createSubs(tx, ref, subs)
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	} else if err != nil {
+		return fmt.Errorf("error creating document %s: %s", key, err)
+	}
+	return nil
+}
+
+// Update runs in a transaction, which Firestore retries when the document
+// changes before it commits.
+func (b *firestoreBackend) Update(ctx context.Context, key string, v interface{}, change func() error) error {
+	return b.UpdateWith(ctx, key, v, noChange(change))
+}
+
+func (b *firestoreBackend) UpdateWith(ctx context.Context, key string, v interface{}, change func() ([]SubRecord, error)) error {
+	ref := b.collection.Doc(key)
+	err := b.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		d, err := tx.Get(ref)
+		if status.Code(err) == codes.NotFound {
+			return ErrNotFound
+		} else if err != nil {
+			return fmt.Errorf("error reading document %s: %s", key, err)
+		}
+		if err := d.DataTo(v); err != nil {
+			return fmt.Errorf("error parsing document %s: %s", key, err)
+		}
+		subs, err := change()
+		if err != nil {
+			return err
+		}
+		if err := tx.Set(ref, v); err != nil {
+			return err
+		}
+		return b.createSubs(tx, ref, subs)
+	})
+	if status.Code(err) == codes.AlreadyExists {
+		return ErrConflict
+	}
+	return err
+}
+
+// createSubs adds the creation of the sub records of the document to the
+// transaction, which fails to commit when any of them exists.
+func (b *firestoreBackend) createSubs(tx *firestore.Transaction, ref *firestore.DocumentRef, subs []SubRecord) error {
+	for _, sr := range subs {
+		if err := tx.Create(ref.Collection(sr.Name).Doc(sr.Key), sr.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *firestoreBackend) Get(ctx context.Context, key string, v interface{}) error {
+	d, err := b.collection.Doc(key).Get(ctx)
+	if status.Code(err) == codes.NotFound {
+		return ErrNotFound
+	} else if err != nil {
+		return fmt.Errorf("error reading document %s: %s", key, err)
+	}
+	if err := d.DataTo(v); err != nil {
+		return fmt.Errorf("error parsing document %s: %s", key, err)
+	}
+	return nil
+}
+
+func (b *firestoreBackend) Keys(ctx context.Context) ([]string, error) {
+	it := b.collection.DocumentRefs(ctx)
+	var ks []string
+	for {
+		d, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error listing %s: %s", b.collection.Path, err)
+		}
+		ks = append(ks, d.ID)
+	}
+	sort.Strings(ks)
+	return ks, nil
+}
+
+// Sub stores the records in a subcollection of the record's document.
+func (b *firestoreBackend) Sub(key, name string) Backend {
+	return &firestoreBackend{client: b.client, collection: b.collection.Doc(key).Collection(name)}
+}
+
+// Check reads a document that need not exist.
+func (b *firestoreBackend) Check(ctx context.Context) error {
+	_, err := b.collection.Doc("readyz").Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("could not read from %s: %s", b.collection.Path, err)
+	}
+	return nil
+}
+
+type gcsBackend struct {
+	bucket *storage.BucketHandle
+	prefix string
+}
+
+// NewGcsBackend creates a backend that stores records as JSON objects in
+// the bucket. Object names consist of the prefix followed by the key.
+func NewGcsBackend(client *storage.Client, bucket, prefix string) Backend {
+	return &gcsBackend{bucket: client.Bucket(bucket), prefix: prefix}
+}
+
+func (b *gcsBackend) Put(ctx context.Context, key string, v interface{}) error {
+	return b.write(ctx, key, v, storage.Conditions{})
+}
+
+func (b *gcsBackend) Create(ctx context.Context, key string, v interface{}) error {
+	return b.write(ctx, key, v, storage.Conditions{DoesNotExist: true})
+}
+
+// CreateWith creates the sub records first and deletes them again when the
+// record cannot be created. Readers may see the sub records in between.
+func (b *gcsBackend) CreateWith(ctx context.Context, key string, v interface{}, subs []SubRecord) error {
+	created, err := b.createSubs(ctx, key, subs)
+	if err != nil {
+		return err
+	}
+	if err := b.write(ctx, key, v, storage.Conditions{DoesNotExist: true}); err != nil {
+		b.deleteAll(ctx, created)
+		return err
+	}
+	return nil
+}
+
+// Update only writes the object if its generation is still the one read.
+func (b *gcsBackend) Update(ctx context.Context, key string, v interface{}, change func() error) error {
+	return b.UpdateWith(ctx, key, v, noChange(change))
+}
+
+// UpdateWith creates the sub records first and deletes them again when the
+// record cannot be written, like CreateWith.
+func (b *gcsBackend) UpdateWith(ctx context.Context, key string, v interface{}, change func() ([]SubRecord, error)) error {
+	gen, err := b.read(ctx, key, v)
+	if err != nil {
+		return err
+	}
+	subs, err := change()
+	if err != nil {
+		return err
+	}
+	created, err := b.createSubs(ctx, key, subs)
+	if err != nil {
+		return err
+	}
+	if err := b.write(ctx, key, v, storage.Conditions{GenerationMatch: gen}); err != nil {
+		b.deleteAll(ctx, created)
+		return err
+	}
+	return nil
+}
+
+// createSubs creates the sub records of the record under the key, all or
+// none, and returns the names of their objects.
+func (b *gcsBackend) createSubs(ctx context.Context, key string, subs []SubRecord) ([]string, error) {
+	var created []string
+	for _, sr := range subs {
+		sb := b.Sub(key, sr.Name).(*gcsBackend)
+		if err := sb.write(ctx, sr.Key, sr.Value, storage.Conditions{DoesNotExist: true}); err != nil {
+			b.deleteAll(ctx, created)
+			return nil, err
+		}
+		created = append(created, sb.prefix+sr.Key)
+	}
+	return created, nil
+}
+
+func (b *gcsBackend) deleteAll(ctx context.Context, names []string) {
+	for _, n := range names {
+		_ = b.bucket.Object(n).Delete(ctx)
+	}
+}
+
+func (b *gcsBackend) write(ctx context.Context, key string, v interface{}, conds storage.Conditions) error {
+	bs, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("error encoding record %s: %s", key, err)
+	}
+	o := b.bucket.Object(b.prefix + key)
+	if conds != (storage.Conditions{}) {
+		o = o.If(conds)
+	}
+	w := o.NewWriter(ctx)
+	w.ContentType = "application/json"
+	if _, err := w.Write(bs); err != nil {
+		_ = w.Close()
+		return fmt.Errorf("error writing object %s%s: %s", b.prefix, key, err)
+	}
+	if err := w.Close(); err != nil {
+		if e, ok := err.(*googleapi.Error); ok && e.Code == http.StatusPreconditionFailed {
+			return ErrConflict
+		}
+		return fmt.Errorf("error writing object %s%s: %s", b.prefix, key, err)
+	}
+	return nil
+}
+
+func (b *gcsBackend) Get(ctx context.Context, key string, v interface{}) error {
+	_, err := b.read(ctx, key, v)
+	return err
+}
+
+// read reads the object into v and returns its generation.
+func (b *gcsBackend) read(ctx context.Context, key string, v interface{}) (int64, error) {
+	r, err := b.bucket.Object(b.prefix + key).NewReader(ctx)
+	if err == storage.ErrObjectNotExist {
+		return 0, ErrNotFound
+	} else if err != nil {
+		return 0, fmt.Errorf("error opening object %s%s: %s", b.prefix, key, err)
+	}
+	defer r.Close()
+	bs, err := ioutil.ReadAll(r)
+	if err != nil {
+		return 0, fmt.Errorf("error reading object %s%s: %s", b.prefix, key, err)
+	}
+	return r.Attrs.Generation, json.Unmarshal(bs, v)
+}
+
+func (b *gcsBackend) Keys(ctx context.Context) ([]string, error) {
+	it := b.bucket.Objects(ctx, &storage.Query{Prefix: b.prefix, Delimiter: "/"})
+	var ks []string
+	for {
+		o, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error listing objects %s*: %s", b.prefix, err)
+		}
+		// Skips the "directories" of sub-backends.
+		if o.Name != "" {
+			ks = append(ks, strings.TrimPrefix(o.Name, b.prefix))
+		}
+	}
+	return ks, nil
+}
+
+// Sub stores the records under the prefix of the record's object name,
+// followed by the name: order-123/history/.
+func (b *gcsBackend) Sub(key, name string) Backend {
+	return &gcsBackend{bucket: b.bucket, prefix: b.prefix + key + "/" + name + "/"}
+}
+
+// Check reads the attributes of an object that need not exist. Unlike
+// reading the bucket's attributes, this only requires object permissions.
+func (b *gcsBackend) Check(ctx context.Context) error {
+	_, err := b.bucket.Object(b.prefix + "readyz").Attrs(ctx)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("could not read from bucket: %s", err)
+	}
+	return nil
+}
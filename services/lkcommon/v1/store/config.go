@@ -0,0 +1,125 @@
+package store
+
+import (
+	"cloud.google.com/go/storage"
+	"context"
+	"fmt"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"path/filepath"
+)
+
+const (
+	BackendMemory    = "memory"
+	BackendFile      = "file"
+	BackendFirestore = "firestore"
+	BackendGcs       = "gcs"
+)
+
+// Config selects the backend for a store. An empty Backend selects the
+// store's default: memory when running locally, otherwise Firestore for
+// orders and products and Cloud Storage for payments and invoices.
+type Config struct {
+	Backend string
+	// Root directory for the file backend.
+	Dir string
+	// Project and buckets for the Firestore and Cloud Storage backends. Each
+	// kind of records has its own bucket, see gcp.Settings.Bucket.
+	Gcp gcp.Settings
+}
+
+// ConfigFrom returns the storage settings of the service configuration.
+func ConfigFrom(cfg *config.Config) Config {
+	return Config{Backend: cfg.StorageBackend, Dir: cfg.StorageDir, Gcp: cfg.Gcp()}
+}
+
+func OpenOrderStore(ctx context.Context, cfg Config) (OrderStore, error) {
+	b, err := cfg.open(ctx, "orders", "order-", BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	return NewOrderStore(b), nil
+}
+
+func OpenPaymentStore(ctx context.Context, cfg Config) (PaymentStore, error) {
+	b, err := cfg.open(ctx, "payments", "payment-", BackendGcs)
+	if err != nil {
+		return nil, err
+	}
+	return NewPaymentStore(b), nil
+}
+
+func OpenInvoiceStore(ctx context.Context, cfg Config) (InvoiceStore, error) {
+	b, err := cfg.open(ctx, "invoices", "invoice-", BackendGcs)
+	if err != nil {
+		return nil, err
+	}
+	return NewInvoiceStore(b), nil
+}
+
+func OpenProductStore(ctx context.Context, cfg Config) (ProductStore, error) {
+	b, err := cfg.open(ctx, "products", "product-", BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	return NewProductStore(b), nil
+}
+
+func OpenCustomerStore(ctx context.Context, cfg Config) (CustomerStore, error) {
+	b, err := cfg.open(ctx, "customers", "customer-", BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	return NewCustomerStore(b), nil
+}
+
+// OpenBackend opens a backend for another kind of records than those of
+// the stores in this package, such as a service's own settings.
+func OpenBackend(ctx context.Context, cfg Config, kind, prefix, def string) (Backend, error) {
+	return cfg.open(ctx, kind, prefix, def)
+}
+
+// open creates the backend for a kind of records. The kind names the
+// collection or directory; the prefix is used for object names in buckets.
+func (cfg Config) open(ctx context.Context, kind, prefix, def string) (Backend, error) {
+	backend := cfg.Backend
+	if backend == "" {
+		if cfg.Gcp.Local {
+			backend = BackendMemory
+		} else {
+			backend = def
+		}
+	}
+
+	b, err := cfg.create(ctx, backend, kind, prefix)
+	if err != nil {
+		return nil, err
+	}
+	return &instrumented{backend: backend, kind: kind, next: b}, nil
+}
+
+func (cfg Config) create(ctx context.Context, backend, kind, prefix string) (Backend, error) {
+	switch backend {
+	case BackendMemory:
+		return NewMemoryBackend(), nil
+	case BackendFile:
+		dir := cfg.Dir
+		if dir == "" {
+			dir = "data"
+		}
+		return NewFileBackend(filepath.Join(dir, kind))
+	case BackendFirestore:
+		client, err := cfg.Gcp.GetFirestore()
+		if err != nil {
+			return nil, fmt.Errorf("could not get firestore client: %s", err)
+		}
+		return NewFirestoreBackend(client, gcp.BaseCollection+"/"+kind), nil
+	case BackendGcs:
+		client, err := storage.NewClient(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("could not get storage client: %s", err)
+		}
+		return NewGcsBackend(client, cfg.Gcp.Bucket(kind), prefix), nil
+	}
+	return nil, fmt.Errorf("unknown storage backend %q", backend)
+}
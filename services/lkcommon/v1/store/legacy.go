@@ -0,0 +1,50 @@
+package store
+
+import (
+	"lkcommon/model"
+	"strconv"
+)
+
+// storedOrder reads an order in either of the shapes it is stored in. The
+// first orders, still around in imported data, were a single product name
+// and quantity with an integer order number, and had neither status,
+// creation time nor version. Such orders are converted on reading and
+// stored in the current shape by the first update.
+//
+// The order number and the legacy fields shadow those of the embedded
+// order, for JSON as well as Firestore.
+type storedOrder struct {
+	model.Order
+	OrderNumber interface{} `json:"orderNumber" firestore:"OrderNumber"`
+	Name        string      `json:"name,omitempty" firestore:"Name,omitempty"`
+	Quantity    int         `json:"quantity,omitempty" firestore:"Quantity,omitempty"`
+}
+
+// order returns the stored order in the current shape.
+func (so *storedOrder) order() *model.Order {
+	o := so.Order
+	switch n := so.OrderNumber.(type) {
+	case string:
+		o.OrderNumber = n
+		return &o
+	case int64:
+		o.OrderNumber = strconv.FormatInt(n, 10)
+	case float64:
+		o.OrderNumber = strconv.FormatFloat(n, 'f', -1, 64)
+	}
+	if len(o.Items) == 0 {
+		o.Items = []model.LineItem{{Sku: so.Name, Name: so.Name, Quantity: so.Quantity}}
+	}
+	if o.Status == "" {
+		o.Status = model.OrderCreated
+	}
+	if o.Version == 0 {
+		o.Version = 1
+	}
+	return &o
+}
+
+// set replaces the stored order with o, dropping the legacy fields.
+func (so *storedOrder) set(o *model.Order) {
+	*so = storedOrder{Order: *o, OrderNumber: o.OrderNumber}
+}
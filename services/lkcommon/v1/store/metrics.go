@@ -0,0 +1,96 @@
+package store
+
+import (
+	"context"
+	"lkcommon/metrics"
+	"time"
+)
+
+var (
+	storeOps = metrics.NewCounter("store_operations_total",
+		"Storage operations, by backend, collection, operation and result.",
+		"backend", "kind", "op", "result")
+	storeDuration = metrics.NewHistogram("store_operation_duration_seconds",
+		"Time spent on storage operations, by backend, collection and operation.",
+		nil, "backend", "kind", "op")
+)
+
+// instrumented records metrics for the operations on a backend.
+type instrumented struct {
+	backend string
+	kind    string
+	next    Backend
+}
+
+func (b *instrumented) Put(ctx context.Context, key string, v interface{}) error {
+	start := time.Now()
+	err := b.next.Put(ctx, key, v)
+	b.observe("put", start, err)
+	return err
+}
+
+func (b *instrumented) Create(ctx context.Context, key string, v interface{}) error {
+	start := time.Now()
+	err := b.next.Create(ctx, key, v)
+	b.observe("create", start, err)
+	return err
+}
+
+func (b *instrumented) CreateWith(ctx context.Context, key string, v interface{}, subs []SubRecord) error {
+	start := time.Now()
+	err := b.next.CreateWith(ctx, key, v, subs)
+	b.observe("create", start, err)
+	return err
+}
+
+func (b *instrumented) Update(ctx context.Context, key string, v interface{}, change func() error) error {
+	start := time.Now()
+	err := b.next.Update(ctx, key, v, change)
+	b.observe("update", start, err)
+	return err
+}
+
+func (b *instrumented) UpdateWith(ctx context.Context, key string, v interface{}, change func() ([]SubRecord, error)) error {
+	start := time.Now()
+	err := b.next.UpdateWith(ctx, key, v, change)
+	b.observe("update", start, err)
+	return err
+}
+
+func (b *instrumented) Get(ctx context.Context, key string, v interface{}) error {
+	start := time.Now()
+	err := b.next.Get(ctx, key, v)
+	b.observe("get", start, err)
+	return err
+}
+
+func (b *instrumented) Keys(ctx context.Context) ([]string, error) {
+	start := time.Now()
+	ks, err := b.next.Keys(ctx)
+	b.observe("keys", start, err)
+	return ks, err
+}
+
+func (b *instrumented) Sub(key, name string) Backend {
+	return &instrumented{backend: b.backend, kind: b.kind + "/" + name, next: b.next.Sub(key, name)}
+}
+
+func (b *instrumented) Check(ctx context.Context) error {
+	start := time.Now()
+	err := b.next.Check(ctx)
+	b.observe("check", start, err)
+	return err
+}
+
+func (b *instrumented) observe(op string, start time.Time, err error) {
+	result := "ok"
+	if err == ErrNotFound {
+		result = "not_found"
+	} else if err == ErrConflict {
+		result = "conflict"
+	} else if err != nil {
+		result = "error"
+	}
+	storeOps.Inc(b.backend, b.kind, op, result)
+	storeDuration.ObserveSince(start, b.backend, b.kind, op)
+}
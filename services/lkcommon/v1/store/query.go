@@ -0,0 +1,231 @@
+package store
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"lkcommon/model"
+	"sort"
+	"time"
+)
+
+const (
+	OrderByCreatedAt   = "createdAt"
+	OrderByOrderNumber = "orderNumber"
+
+	DefaultPageSize = 50
+	MaxPageSize     = 200
+)
+
+// ErrInvalidQuery is returned for queries that cannot be run, such as
+// queries with a malformed page token.
+var ErrInvalidQuery = errors.New("invalid query")
+
+// An OrderQuery selects orders. Empty fields do not filter.
+type OrderQuery struct {
+	Customer string
+	Status   string
+	// Orders created at or after From and before To.
+	From time.Time
+	To   time.Time
+	// OrderByCreatedAt (the default) or OrderByOrderNumber. Orders with the
+	// same creation time are ordered by number. Filtering by date requires
+	// ordering by creation time.
+	OrderBy    string
+	Descending bool
+	// Number of orders per page; DefaultPageSize when zero.
+	PageSize int
+	// Token returned with the previous page.
+	PageToken string
+}
+
+// An OrderPage holds the orders of a page. NextPageToken is empty on the
+// last page.
+type OrderPage struct {
+	Orders        []*model.Order `json:"orders"`
+	NextPageToken string         `json:"nextPageToken,omitempty"`
+}
+
+// cursor is the position after the last order of a page.
+type cursor struct {
+	CreatedAt   time.Time `json:"c"`
+	OrderNumber string    `json:"n"`
+}
+
+// normalize validates the query and fills in defaults. It returns the
+// decoded page token, if any.
+func (q *OrderQuery) normalize() (*cursor, error) {
+	if q.OrderBy == "" {
+		q.OrderBy = OrderByCreatedAt
+	}
+	if q.OrderBy != OrderByCreatedAt && q.OrderBy != OrderByOrderNumber {
+		return nil, fmt.Errorf("%w: cannot order by %q", ErrInvalidQuery, q.OrderBy)
+	}
+	if q.OrderBy != OrderByCreatedAt && (!q.From.IsZero() || !q.To.IsZero()) {
+		return nil, fmt.Errorf("%w: filtering by date requires ordering by %s", ErrInvalidQuery, OrderByCreatedAt)
+	}
+	if q.PageSize == 0 {
+		q.PageSize = DefaultPageSize
+	}
+	if q.PageSize < 1 || q.PageSize > MaxPageSize {
+		return nil, fmt.Errorf("%w: page size must be between 1 and %v", ErrInvalidQuery, MaxPageSize)
+	}
+	if q.PageToken == "" {
+		return nil, nil
+	}
+	bs, err := base64.RawURLEncoding.DecodeString(q.PageToken)
+	c := &cursor{}
+	if err == nil {
+		err = json.Unmarshal(bs, c)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: malformed page token", ErrInvalidQuery)
+	}
+	return c, nil
+}
+
+func (q *OrderQuery) matches(o *model.Order) bool {
+	return (q.Customer == "" || o.Customer == q.Customer) &&
+		(q.Status == "" || o.Status == q.Status) &&
+		(q.From.IsZero() || !o.CreatedAt.Before(q.From)) &&
+		(q.To.IsZero() || o.CreatedAt.Before(q.To))
+}
+
+// less reports whether a comes before b in the query's order.
+func (q *OrderQuery) less(a, b cursor) bool {
+	if q.Descending {
+		a, b = b, a
+	}
+	if q.OrderBy == OrderByCreatedAt && !a.CreatedAt.Equal(b.CreatedAt) {
+		return a.CreatedAt.Before(b.CreatedAt)
+	}
+	return a.OrderNumber < b.OrderNumber
+}
+
+func cursorOf(o *model.Order) cursor {
+	return cursor{CreatedAt: o.CreatedAt, OrderNumber: o.OrderNumber}
+}
+
+func (c cursor) token() string {
+	bs, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(bs)
+}
+
+// page cuts a page from orders in query order, of which there is one more
+// than the page size if there is a next page.
+func page(q OrderQuery, orders []*model.Order) OrderPage {
+	p := OrderPage{Orders: orders}
+	if len(orders) > q.PageSize {
+		p.Orders = orders[:q.PageSize]
+		p.NextPageToken = cursorOf(p.Orders[q.PageSize-1]).token()
+	}
+	if p.Orders == nil {
+		p.Orders = []*model.Order{}
+	}
+	return p
+}
+
+// scanOrders reads every order and filters and sorts them in memory. It
+// serves backends without queries.
+func scanOrders(ctx context.Context, b Backend, q OrderQuery, after *cursor) (OrderPage, error) {
+	keys, err := b.Keys(ctx)
+	if err != nil {
+		return OrderPage{}, err
+	}
+	var orders []*model.Order
+	for _, k := range keys {
+		so := &storedOrder{}
+		if err := b.Get(ctx, k, so); err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return OrderPage{}, err
+		}
+		o := so.order()
+		if q.matches(o) && (after == nil || q.less(*after, cursorOf(o))) {
+			orders = append(orders, o)
+		}
+	}
+	sort.Slice(orders, func(i, j int) bool { return q.less(cursorOf(orders[i]), cursorOf(orders[j])) })
+	if len(orders) > q.PageSize+1 {
+		orders = orders[:q.PageSize+1]
+	}
+	return page(q, orders), nil
+}
+
+// queryOrders runs the query in Firestore. Documents are keyed by order
+// number and hold the order's fields under their Go names. Queries that
+// combine filters with ordering need composite indexes. Legacy orders lack
+// a status and creation time until they are updated, so they only show up
+// in queries that do not filter or order on those.
+func (b *firestoreBackend) queryOrders(ctx context.Context, q OrderQuery, after *cursor) (OrderPage, error) {
+	fq := b.collection.Query
+	if q.Customer != "" {
+		fq = fq.Where("Customer", "==", q.Customer)
+	}
+	if q.Status != "" {
+		fq = fq.Where("Status", "==", q.Status)
+	}
+	if !q.From.IsZero() {
+		fq = fq.Where("CreatedAt", ">=", q.From)
+	}
+	if !q.To.IsZero() {
+		fq = fq.Where("CreatedAt", "<", q.To)
+	}
+	dir := firestore.Asc
+	if q.Descending {
+		dir = firestore.Desc
+	}
+	if q.OrderBy == OrderByCreatedAt {
+		fq = fq.OrderBy("CreatedAt", dir)
+	}
+	fq = fq.OrderBy(firestore.DocumentID, dir)
+	if after != nil {
+		if q.OrderBy == OrderByCreatedAt {
+			fq = fq.StartAfter(after.CreatedAt, after.OrderNumber)
+		} else {
+			fq = fq.StartAfter(after.OrderNumber)
+		}
+	}
+
+	it := fq.Limit(q.PageSize + 1).Documents(ctx)
+	defer it.Stop()
+	var orders []*model.Order
+	for {
+		d, err := it.Next()
+		if err == iterator.Done {
+			break
+		} else if err != nil {
+			return OrderPage{}, fmt.Errorf("error querying %s: %s", b.collection.Path, err)
+		}
+		so := &storedOrder{}
+		if err := d.DataTo(so); err != nil {
+			return OrderPage{}, fmt.Errorf("error parsing document %s: %s", d.Ref.ID, err)
+		}
+		orders = append(orders, so.order())
+	}
+	return page(q, orders), nil
+}
+
+// listOrders runs the query natively where the backend supports it.
+func listOrders(ctx context.Context, b Backend, q OrderQuery) (OrderPage, error) {
+	after, err := q.normalize()
+	if err != nil {
+		return OrderPage{}, err
+	}
+	if ib, ok := b.(*instrumented); ok {
+		if fb, ok := ib.next.(*firestoreBackend); ok {
+			start := time.Now()
+			p, err := fb.queryOrders(ctx, q, after)
+			ib.observe("query", start, err)
+			return p, err
+		}
+	}
+	if fb, ok := b.(*firestoreBackend); ok {
+		return fb.queryOrders(ctx, q, after)
+	}
+	return scanOrders(ctx, b, q, after)
+}
@@ -0,0 +1,122 @@
+package store
+
+import (
+	"errors"
+	"lkcommon/model"
+	"testing"
+	"time"
+)
+
+func TestOrderQueryNormalize(t *testing.T) {
+	day := time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC)
+	token := cursor{CreatedAt: day, OrderNumber: "o1"}.token()
+
+	tests := []struct {
+		name     string
+		query    OrderQuery
+		invalid  bool
+		pageSize int
+		cursor   *cursor
+	}{
+		{name: "defaults", query: OrderQuery{}, pageSize: DefaultPageSize},
+		{name: "by number", query: OrderQuery{OrderBy: OrderByOrderNumber, PageSize: 10}, pageSize: 10},
+		{name: "unknown order", query: OrderQuery{OrderBy: "status"}, invalid: true},
+		{name: "date filter by number", query: OrderQuery{OrderBy: OrderByOrderNumber, From: day}, invalid: true},
+		{name: "page too large", query: OrderQuery{PageSize: MaxPageSize + 1}, invalid: true},
+		{name: "negative page", query: OrderQuery{PageSize: -1}, invalid: true},
+		{name: "largest page", query: OrderQuery{PageSize: MaxPageSize}, pageSize: MaxPageSize},
+		{name: "token", query: OrderQuery{PageToken: token}, pageSize: DefaultPageSize, cursor: &cursor{CreatedAt: day, OrderNumber: "o1"}},
+		{name: "not base64", query: OrderQuery{PageToken: "not a token"}, invalid: true},
+		{name: "not json", query: OrderQuery{PageToken: "bm90IGpzb24"}, invalid: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := tt.query
+			c, err := q.normalize()
+			if tt.invalid {
+				if !errors.Is(err, ErrInvalidQuery) {
+					t.Errorf("expected ErrInvalidQuery, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if q.PageSize != tt.pageSize {
+				t.Errorf("expected page size %v, got %v", tt.pageSize, q.PageSize)
+			}
+			if (c == nil) != (tt.cursor == nil) || (c != nil && (!c.CreatedAt.Equal(tt.cursor.CreatedAt) || c.OrderNumber != tt.cursor.OrderNumber)) {
+				t.Errorf("expected cursor %+v, got %+v", tt.cursor, c)
+			}
+		})
+	}
+}
+
+func TestOrderQueryLess(t *testing.T) {
+	early := cursor{CreatedAt: time.Date(2020, 8, 1, 0, 0, 0, 0, time.UTC), OrderNumber: "b"}
+	late := cursor{CreatedAt: time.Date(2020, 8, 2, 0, 0, 0, 0, time.UTC), OrderNumber: "a"}
+	sameTime := cursor{CreatedAt: early.CreatedAt, OrderNumber: "c"}
+
+	tests := []struct {
+		name  string
+		query OrderQuery
+		a, b  cursor
+		want  bool
+	}{
+		{"by time", OrderQuery{OrderBy: OrderByCreatedAt}, early, late, true},
+		{"by time reversed", OrderQuery{OrderBy: OrderByCreatedAt}, late, early, false},
+		{"same time by number", OrderQuery{OrderBy: OrderByCreatedAt}, early, sameTime, true},
+		{"descending", OrderQuery{OrderBy: OrderByCreatedAt, Descending: true}, early, late, false},
+		{"by number", OrderQuery{OrderBy: OrderByOrderNumber}, early, late, false},
+		{"by number descending", OrderQuery{OrderBy: OrderByOrderNumber, Descending: true}, early, late, true},
+		{"equal", OrderQuery{OrderBy: OrderByCreatedAt}, early, early, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.query.less(tt.a, tt.b); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestPage(t *testing.T) {
+	orders := func(ns ...string) []*model.Order {
+		var result []*model.Order
+		for _, n := range ns {
+			result = append(result, &model.Order{OrderNumber: n})
+		}
+		return result
+	}
+
+	tests := []struct {
+		name   string
+		orders []*model.Order
+		want   int
+		next   string
+	}{
+		{"empty", nil, 0, ""},
+		{"partial", orders("a"), 1, ""},
+		{"full", orders("a", "b"), 2, ""},
+		{"more", orders("a", "b", "c"), 2, "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := page(OrderQuery{PageSize: 2}, tt.orders)
+			if p.Orders == nil || len(p.Orders) != tt.want {
+				t.Fatalf("expected %v orders, got %v", tt.want, p.Orders)
+			}
+			if tt.next == "" {
+				if p.NextPageToken != "" {
+					t.Errorf("expected no next page, got %q", p.NextPageToken)
+				}
+				return
+			}
+			q := OrderQuery{PageToken: p.NextPageToken}
+			c, err := q.normalize()
+			if err != nil || c.OrderNumber != tt.next {
+				t.Errorf("expected token after %s, got %+v, %v", tt.next, c, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,299 @@
+// Package store provides storage for orders, payments, invoices, customers
+// and the product catalog. Each
+// store is backed by a Backend, which is selected by configuration: in
+// memory, on the local file system, in Firestore or in Cloud Storage.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lkcommon/model"
+)
+
+var (
+	// ErrNotFound is returned when a requested record does not exist.
+	ErrNotFound = errors.New("not found")
+	// ErrConflict is returned when a record to create exists already, or a
+	// record to update was changed by someone else.
+	ErrConflict = errors.New("conflict")
+)
+
+// OrderStore stores orders along with their history. The change c passed
+// with a write, if any, is added to the history in the same transaction as
+// the order is written, so that every version of an order has its change.
+type OrderStore interface {
+	// CreateOrder stores a new order with version 1. It returns ErrConflict
+	// when the order number is taken.
+	CreateOrder(ctx context.Context, o *model.Order, c *model.OrderChange) error
+	// UpdateOrder replaces an order, provided the stored order has the same
+	// version, and increments the version. It returns ErrConflict when the
+	// order was changed since it was read.
+	UpdateOrder(ctx context.Context, o *model.Order, c *model.OrderChange) error
+	GetOrder(ctx context.Context, orderNumber string) (*model.Order, error)
+	// ListOrders returns a page of the orders selected by the query. It
+	// returns an error wrapping ErrInvalidQuery for invalid queries.
+	ListOrders(ctx context.Context, q OrderQuery) (OrderPage, error)
+	// ListOrderChanges returns the history of an order, oldest first.
+	ListOrderChanges(ctx context.Context, orderNumber string) ([]*model.OrderChange, error)
+	// Check verifies that the underlying storage can be reached.
+	Check(ctx context.Context) error
+}
+
+type PaymentStore interface {
+	SavePayment(ctx context.Context, p *model.Payment) error
+	GetPayment(ctx context.Context, paymentNumber string) (*model.Payment, error)
+	Check(ctx context.Context) error
+}
+
+type InvoiceStore interface {
+	// CreateInvoice stores a new invoice. Invoices are never replaced: it
+	// returns ErrConflict when the invoice number is taken.
+	CreateInvoice(ctx context.Context, i *model.Invoice) error
+	GetInvoice(ctx context.Context, invoiceNumber string) (*model.Invoice, error)
+	Check(ctx context.Context) error
+}
+
+type ProductStore interface {
+	SaveProduct(ctx context.Context, p *model.Product) error
+	GetProduct(ctx context.Context, sku string) (*model.Product, error)
+	// ListProducts returns the catalog, ordered by SKU.
+	ListProducts(ctx context.Context) ([]*model.Product, error)
+	Check(ctx context.Context) error
+}
+
+type CustomerStore interface {
+	// CreateCustomer stores a new customer. It returns ErrConflict when the
+	// id is taken.
+	CreateCustomer(ctx context.Context, c *model.Customer) error
+	// UpdateCustomer applies change to the stored customer and stores the
+	// result, unless change returns an error. It returns ErrNotFound when
+	// there is no such customer.
+	UpdateCustomer(ctx context.Context, id string, change func(c *model.Customer) error) (*model.Customer, error)
+	GetCustomer(ctx context.Context, id string) (*model.Customer, error)
+	// ListCustomers returns all customers, deleted ones included, ordered by
+	// id.
+	ListCustomers(ctx context.Context) ([]*model.Customer, error)
+	Check(ctx context.Context) error
+}
+
+type orderStore struct {
+	b Backend
+}
+
+func NewOrderStore(b Backend) OrderStore {
+	return &orderStore{b: b}
+}
+
+func (s *orderStore) CreateOrder(ctx context.Context, o *model.Order, c *model.OrderChange) error {
+	o.Version = 1
+	so := &storedOrder{}
+	so.set(o)
+	return s.b.CreateWith(ctx, o.OrderNumber, so, historyRecords(o, c))
+}
+
+func (s *orderStore) UpdateOrder(ctx context.Context, o *model.Order, c *model.OrderChange) error {
+	cur := &storedOrder{}
+	err := s.b.UpdateWith(ctx, o.OrderNumber, cur, func() ([]SubRecord, error) {
+		if cur.order().Version != o.Version {
+			return nil, ErrConflict
+		}
+		next := *o
+		next.Version = o.Version + 1
+		cur.set(&next)
+		return historyRecords(&next, c), nil
+	})
+	if err == nil {
+		o.Version = cur.Version
+	}
+	return err
+}
+
+func (s *orderStore) GetOrder(ctx context.Context, orderNumber string) (*model.Order, error) {
+	so := &storedOrder{}
+	if err := s.b.Get(ctx, orderNumber, so); err != nil {
+		return nil, err
+	}
+	return so.order(), nil
+}
+
+func (s *orderStore) ListOrders(ctx context.Context, q OrderQuery) (OrderPage, error) {
+	return listOrders(ctx, s.b, q)
+}
+
+// history returns the backend holding the changes of an order, keyed by
+// zero-padded version so that keys sort in order.
+func (s *orderStore) history(orderNumber string) Backend {
+	return s.b.Sub(orderNumber, "history")
+}
+
+// historyRecords returns the change that made version o of an order, if
+// any, as a record of its history. The change is given the version of o.
+func historyRecords(o *model.Order, c *model.OrderChange) []SubRecord {
+	if c == nil {
+		return nil
+	}
+	c.OrderNumber, c.Version = o.OrderNumber, o.Version
+	return []SubRecord{{Name: "history", Key: fmt.Sprintf("%010d", c.Version), Value: c}}
+}
+
+func (s *orderStore) ListOrderChanges(ctx context.Context, orderNumber string) ([]*model.OrderChange, error) {
+	h := s.history(orderNumber)
+	keys, err := h.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cs := []*model.OrderChange{}
+	for _, k := range keys {
+		c := &model.OrderChange{}
+		if err := h.Get(ctx, k, c); err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func (s *orderStore) Check(ctx context.Context) error {
+	return s.b.Check(ctx)
+}
+
+type paymentStore struct {
+	b Backend
+}
+
+func NewPaymentStore(b Backend) PaymentStore {
+	return &paymentStore{b: b}
+}
+
+func (s *paymentStore) SavePayment(ctx context.Context, p *model.Payment) error {
+	return s.b.Put(ctx, p.PaymentNumber, p)
+}
+
+func (s *paymentStore) GetPayment(ctx context.Context, paymentNumber string) (*model.Payment, error) {
+	p := &model.Payment{}
+	if err := s.b.Get(ctx, paymentNumber, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *paymentStore) Check(ctx context.Context) error {
+	return s.b.Check(ctx)
+}
+
+type invoiceStore struct {
+	b Backend
+}
+
+func NewInvoiceStore(b Backend) InvoiceStore {
+	return &invoiceStore{b: b}
+}
+
+func (s *invoiceStore) CreateInvoice(ctx context.Context, i *model.Invoice) error {
+	return s.b.Create(ctx, i.InvoiceNumber, i)
+}
+
+func (s *invoiceStore) GetInvoice(ctx context.Context, invoiceNumber string) (*model.Invoice, error) {
+	i := &model.Invoice{}
+	if err := s.b.Get(ctx, invoiceNumber, i); err != nil {
+		return nil, err
+	}
+	return i, nil
+}
+
+func (s *invoiceStore) Check(ctx context.Context) error {
+	return s.b.Check(ctx)
+}
+
+type productStore struct {
+	b Backend
+}
+
+func NewProductStore(b Backend) ProductStore {
+	return &productStore{b: b}
+}
+
+func (s *productStore) SaveProduct(ctx context.Context, p *model.Product) error {
+	return s.b.Put(ctx, p.Sku, p)
+}
+
+func (s *productStore) GetProduct(ctx context.Context, sku string) (*model.Product, error) {
+	p := &model.Product{}
+	if err := s.b.Get(ctx, sku, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (s *productStore) ListProducts(ctx context.Context) ([]*model.Product, error) {
+	keys, err := s.b.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	ps := []*model.Product{}
+	for _, k := range keys {
+		p, err := s.GetProduct(ctx, k)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		ps = append(ps, p)
+	}
+	return ps, nil
+}
+
+func (s *productStore) Check(ctx context.Context) error {
+	return s.b.Check(ctx)
+}
+
+type customerStore struct {
+	b Backend
+}
+
+func NewCustomerStore(b Backend) CustomerStore {
+	return &customerStore{b: b}
+}
+
+func (s *customerStore) CreateCustomer(ctx context.Context, c *model.Customer) error {
+	return s.b.Create(ctx, c.Id, c)
+}
+
+func (s *customerStore) UpdateCustomer(ctx context.Context, id string, change func(c *model.Customer) error) (*model.Customer, error) {
+	c := &model.Customer{}
+	if err := s.b.Update(ctx, id, c, func() error { return change(c) }); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *customerStore) GetCustomer(ctx context.Context, id string) (*model.Customer, error) {
+	c := &model.Customer{}
+	if err := s.b.Get(ctx, id, c); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func (s *customerStore) ListCustomers(ctx context.Context) ([]*model.Customer, error) {
+	keys, err := s.b.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	cs := []*model.Customer{}
+	for _, k := range keys {
+		c, err := s.GetCustomer(ctx, k)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func (s *customerStore) Check(ctx context.Context) error {
+	return s.b.Check(ctx)
+}
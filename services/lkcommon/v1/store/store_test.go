@@ -0,0 +1,94 @@
+package store_test
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"lkcommon/config"
+	"lkcommon/store"
+	"lkcommon/store/storetest"
+	"os"
+	"testing"
+	"time"
+)
+
+// runContracts runs every store contract, each against a new, empty
+// backend.
+func runContracts(t *testing.T, open func(t *testing.T) store.Backend) {
+	t.Run("orders", func(t *testing.T) {
+		storetest.TestOrderStore(t, store.NewOrderStore(open(t)))
+	})
+	t.Run("order queries", func(t *testing.T) {
+		storetest.TestOrderQueries(t, store.NewOrderStore(open(t)))
+	})
+	t.Run("order history", func(t *testing.T) {
+		storetest.TestOrderHistory(t, store.NewOrderStore(open(t)))
+	})
+	t.Run("sub records", func(t *testing.T) {
+		storetest.TestSubRecords(t, open(t))
+	})
+	t.Run("legacy orders", func(t *testing.T) {
+		storetest.TestLegacyOrders(t, open(t))
+	})
+	t.Run("payments", func(t *testing.T) {
+		storetest.TestPaymentStore(t, store.NewPaymentStore(open(t)))
+	})
+	t.Run("invoices", func(t *testing.T) {
+		storetest.TestInvoiceStore(t, store.NewInvoiceStore(open(t)))
+	})
+	t.Run("products", func(t *testing.T) {
+		storetest.TestProductStore(t, store.NewProductStore(open(t)))
+	})
+	t.Run("customers", func(t *testing.T) {
+		storetest.TestCustomerStore(t, store.NewCustomerStore(open(t)))
+	})
+}
+
+func TestMemoryBackend(t *testing.T) {
+	runContracts(t, func(*testing.T) store.Backend {
+		return store.NewMemoryBackend()
+	})
+}
+
+func TestFileBackend(t *testing.T) {
+	runContracts(t, func(t *testing.T) store.Backend {
+		b, err := store.NewFileBackend(t.TempDir())
+		if err != nil {
+			t.Fatalf("could not create file backend: %s", err)
+		}
+		return b
+	})
+}
+
+// TestFirestoreBackend runs against the Firestore emulator, see
+// https://cloud.google.com/firestore/docs/emulator. Each contract gets its
+// own collection.
+func TestFirestoreBackend(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set")
+	}
+	client, err := firestore.NewClient(context.Background(), "storetest")
+	if err != nil {
+		t.Fatalf("could not create firestore client: %s", err)
+	}
+	defer client.Close()
+
+	run := time.Now().UnixNano()
+	n := 0
+	runContracts(t, func(*testing.T) store.Backend {
+		n += 1
+		return store.NewFirestoreBackend(client, fmt.Sprintf("storetest/%d-%d/records", run, n))
+	})
+}
+
+func TestConfigFrom(t *testing.T) {
+	for _, b := range []string{store.BackendMemory, store.BackendFile, store.BackendFirestore, store.BackendGcs} {
+		cfg := &config.Config{StorageBackend: b, StorageDir: "data", NumberBlockSize: 1, NumberLeaseTime: 1, NumberReserveTimeout: 1, IdempotencyWindow: 1}
+		if err := cfg.Validate(); err != nil {
+			t.Errorf("expected backend %s to be accepted by the configuration, got %s", b, err)
+		}
+		if c := store.ConfigFrom(cfg); c.Backend != b || c.Dir != "data" {
+			t.Errorf("expected backend %s in data, got %+v", b, c)
+		}
+	}
+}
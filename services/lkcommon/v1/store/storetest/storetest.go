@@ -0,0 +1,492 @@
+// Package storetest contains a contract suite that every store
+// implementation must satisfy.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"lkcommon/model"
+	"lkcommon/store"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestOrderStore checks the OrderStore contract. The store should be empty
+// and order numbers 1 through 100 available.
+func TestOrderStore(t *testing.T, s store.OrderStore) {
+	ctx := context.Background()
+
+	if err := s.Check(ctx); err != nil {
+		t.Errorf("expected store to be reachable, got %v", err)
+	}
+
+	if _, err := s.GetOrder(ctx, "1"); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing order, got %v", err)
+	}
+
+	o := &model.Order{Customer: "alice", Items: []model.LineItem{{Sku: "shoes", Quantity: 2}}, OrderNumber: "1"}
+	if err := s.CreateOrder(ctx, o, nil); err != nil {
+		t.Fatalf("unexpected error creating order: %s", err)
+	}
+	if o.Version != 1 {
+		t.Errorf("expected version 1, got %v", o.Version)
+	}
+	got, err := s.GetOrder(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error reading order: %s", err)
+	}
+	if !reflect.DeepEqual(got, o) {
+		t.Errorf("expected %+v, got %+v", *o, *got)
+	}
+
+	got.Items[0].Quantity = 3
+	if again, _ := s.GetOrder(ctx, "1"); again.Items[0].Quantity != 2 {
+		t.Errorf("store shares data with its callers")
+	}
+
+	dup := &model.Order{Customer: "mallory", OrderNumber: "1"}
+	if err := s.CreateOrder(ctx, dup, nil); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict for taken order number, got %v", err)
+	}
+	if got, _ := s.GetOrder(ctx, "1"); got == nil || got.Customer != "alice" {
+		t.Errorf("expected order to be kept, got %+v", got)
+	}
+
+	stale := *o
+	o.Items[0].Quantity = 5
+	if err := s.UpdateOrder(ctx, o, nil); err != nil {
+		t.Fatalf("unexpected error updating order: %s", err)
+	}
+	if got, _ := s.GetOrder(ctx, "1"); got == nil || got.Items[0].Quantity != 5 || got.Version != 2 || o.Version != 2 {
+		t.Errorf("expected updated order with version 2, got %+v", got)
+	}
+	stale.Customer = "mallory"
+	if err := s.UpdateOrder(ctx, &stale, nil); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict for stale update, got %v", err)
+	}
+	if err := s.UpdateOrder(ctx, &model.Order{OrderNumber: "missing"}, nil); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound updating missing order, got %v", err)
+	}
+
+	wg := sync.WaitGroup{}
+	for i := 2; i <= 100; i += 1 {
+		wg.Add(1)
+		go func(n int) {
+			defer wg.Done()
+			_ = s.CreateOrder(ctx, &model.Order{Customer: "bob", OrderNumber: strconv.Itoa(n)}, nil)
+			_, _ = s.GetOrder(ctx, strconv.Itoa(n))
+		}(i)
+	}
+	wg.Wait()
+	for i := 2; i <= 100; i += 1 {
+		if _, err := s.GetOrder(ctx, strconv.Itoa(i)); err != nil {
+			t.Errorf("order %v missing after concurrent writes: %v", i, err)
+		}
+	}
+
+	// Of concurrent updates of the same version, one wins.
+	var mux sync.Mutex
+	won := 0
+	for i := 0; i < 10; i += 1 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			o := &model.Order{Customer: "bob", OrderNumber: "2", Version: 1}
+			if err := s.UpdateOrder(ctx, o, nil); err == nil {
+				mux.Lock()
+				won += 1
+				mux.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if won != 1 {
+		t.Errorf("expected 1 of 10 concurrent updates to succeed, got %v", won)
+	}
+}
+
+// TestOrderQueries checks the ListOrders contract. The store should be
+// empty.
+func TestOrderQueries(t *testing.T, s store.OrderStore) {
+	ctx := context.Background()
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 10; i += 1 {
+		o := &model.Order{
+			Customer:    []string{"alice", "bob"}[i%2],
+			OrderNumber: fmt.Sprintf("o%02d", i),
+			Status:      model.OrderCreated,
+			CreatedAt:   base.Add(time.Duration(i) * time.Hour),
+		}
+		if err := s.CreateOrder(ctx, o, nil); err != nil {
+			t.Fatalf("unexpected error saving order: %s", err)
+		}
+	}
+
+	numbers := func(q store.OrderQuery) []string {
+		var ns []string
+		for {
+			p, err := s.ListOrders(ctx, q)
+			if err != nil {
+				t.Fatalf("unexpected error listing orders: %s", err)
+			}
+			for _, o := range p.Orders {
+				ns = append(ns, o.OrderNumber)
+			}
+			if p.NextPageToken == "" {
+				return ns
+			}
+			q.PageToken = p.NextPageToken
+		}
+	}
+	expect := func(name string, q store.OrderQuery, want ...string) {
+		if got := numbers(q); strings.Join(got, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: expected %v, got %v", name, want, got)
+		}
+	}
+
+	expect("all in pages", store.OrderQuery{PageSize: 3},
+		"o00", "o01", "o02", "o03", "o04", "o05", "o06", "o07", "o08", "o09")
+	expect("customer", store.OrderQuery{Customer: "bob"}, "o01", "o03", "o05", "o07", "o09")
+	expect("date range, descending", store.OrderQuery{
+		From:       base.Add(2 * time.Hour),
+		To:         base.Add(5 * time.Hour),
+		Descending: true,
+		PageSize:   2,
+	}, "o04", "o03", "o02")
+	expect("status", store.OrderQuery{Status: "fulfilled"})
+	expect("by number", store.OrderQuery{OrderBy: store.OrderByOrderNumber, Customer: "alice", Descending: true},
+		"o08", "o06", "o04", "o02", "o00")
+
+	if _, err := s.ListOrders(ctx, store.OrderQuery{PageToken: "not a token"}); !errors.Is(err, store.ErrInvalidQuery) {
+		t.Errorf("expected ErrInvalidQuery for malformed page token, got %v", err)
+	}
+}
+
+// TestOrderHistory checks the history contract of the OrderStore. The store
+// should be empty.
+func TestOrderHistory(t *testing.T, s store.OrderStore) {
+	ctx := context.Background()
+
+	if cs, err := s.ListOrderChanges(ctx, "h1"); err != nil || len(cs) != 0 {
+		t.Errorf("expected empty history for missing order, got %v, %v", cs, err)
+	}
+	change := func(actor string) *model.OrderChange {
+		return &model.OrderChange{
+			Actor:  actor,
+			Fields: []model.FieldChange{{Field: "status", Before: "created", After: "paid"}},
+		}
+	}
+
+	o := &model.Order{Customer: "alice", OrderNumber: "h1"}
+	if err := s.CreateOrder(ctx, o, change("alice@example.com")); err != nil {
+		t.Fatalf("unexpected error creating order: %s", err)
+	}
+	if cs, err := s.ListOrderChanges(ctx, "h1"); err != nil || len(cs) != 1 || cs[0].Version != 1 || cs[0].OrderNumber != "h1" {
+		t.Errorf("expected the creation in the history, got %+v, %v", cs, err)
+	}
+
+	// Versions 10 and up check that changes are listed by version rather
+	// than lexically.
+	for v := 1; v < 11; v += 1 {
+		if err := s.UpdateOrder(ctx, o, change("alice@example.com")); err != nil {
+			t.Fatalf("unexpected error updating order: %s", err)
+		}
+	}
+	stale := *o
+	stale.Version = 2
+	if err := s.UpdateOrder(ctx, &stale, change("mallory")); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict for stale update, got %v", err)
+	}
+	if err := s.UpdateOrder(ctx, o, nil); err != nil {
+		t.Fatalf("unexpected error updating order: %s", err)
+	}
+
+	cs, err := s.ListOrderChanges(ctx, "h1")
+	if err != nil {
+		t.Fatalf("unexpected error listing changes: %s", err)
+	}
+	if len(cs) != 11 {
+		t.Fatalf("expected versions 1 to 11, got %+v", cs)
+	}
+	for i, c := range cs {
+		if c.Version != i+1 || c.Actor != "alice@example.com" || len(c.Fields) != 1 || c.Fields[0].After != "paid" {
+			t.Errorf("expected change %v by alice, got %+v", i+1, c)
+		}
+	}
+
+	if cs, err := s.ListOrderChanges(ctx, "h2"); err != nil || len(cs) != 0 {
+		t.Errorf("expected no history for other order, got %v, %v", cs, err)
+	}
+	p, err := s.ListOrders(ctx, store.OrderQuery{})
+	if err != nil || len(p.Orders) != 1 {
+		t.Errorf("expected history to be left out of listings, got %+v, %v", p, err)
+	}
+}
+
+// record is a record for TestSubRecords.
+type record struct {
+	Value string
+}
+
+// TestSubRecords checks that a Backend writes records along with their sub
+// records, all or none. The backend should be empty.
+func TestSubRecords(t *testing.T, b store.Backend) {
+	ctx := context.Background()
+	sub := func(key, value string) store.SubRecord {
+		return store.SubRecord{Name: "history", Key: key, Value: record{value}}
+	}
+	get := func(b store.Backend, key string) string {
+		r := record{}
+		if err := b.Get(ctx, key, &r); err != nil {
+			return err.Error()
+		}
+		return r.Value
+	}
+
+	if err := b.CreateWith(ctx, "r1", record{"v1"}, []store.SubRecord{sub("1", "c1")}); err != nil {
+		t.Fatalf("unexpected error creating record: %s", err)
+	}
+	h := b.Sub("r1", "history")
+	if get(b, "r1") != "v1" || get(h, "1") != "c1" {
+		t.Errorf("expected record and sub record, got %q, %q", get(b, "r1"), get(h, "1"))
+	}
+	if err := b.CreateWith(ctx, "r1", record{"v2"}, []store.SubRecord{sub("2", "c2")}); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict creating taken key, got %v", err)
+	}
+	if get(h, "2") != store.ErrNotFound.Error() {
+		t.Errorf("expected no sub record of a failed create, got %q", get(h, "2"))
+	}
+
+	update := func(subs ...store.SubRecord) error {
+		r := record{}
+		return b.UpdateWith(ctx, "r1", &r, func() ([]store.SubRecord, error) {
+			r.Value += "+"
+			return subs, nil
+		})
+	}
+	if err := update(sub("2", "c2")); err != nil {
+		t.Fatalf("unexpected error updating record: %s", err)
+	}
+	if get(b, "r1") != "v1+" || get(h, "2") != "c2" {
+		t.Errorf("expected updated record and sub record, got %q, %q", get(b, "r1"), get(h, "2"))
+	}
+	if err := update(sub("3", "c3"), sub("2", "other")); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict for taken sub record key, got %v", err)
+	}
+	if get(b, "r1") != "v1+" || get(h, "2") != "c2" || get(h, "3") != store.ErrNotFound.Error() {
+		t.Errorf("expected failed update to store nothing, got %q, %q, %q", get(b, "r1"), get(h, "2"), get(h, "3"))
+	}
+
+	if ks, err := b.Keys(ctx); err != nil || !reflect.DeepEqual(ks, []string{"r1"}) {
+		t.Errorf("expected sub records to be left out of keys, got %v, %v", ks, err)
+	}
+}
+
+// legacyOrder is the shape of the first orders, as found in imported data.
+type legacyOrder struct {
+	Customer    string
+	Name        string
+	Quantity    int
+	OrderNumber int
+}
+
+// TestLegacyOrders checks that an OrderStore on the backend reads orders
+// stored in the legacy shape. The backend should be empty.
+func TestLegacyOrders(t *testing.T, b store.Backend) {
+	ctx := context.Background()
+	if err := b.Put(ctx, "1000001", legacyOrder{Customer: "alice", Name: "shoes", Quantity: 2, OrderNumber: 1000001}); err != nil {
+		t.Fatalf("unexpected error storing legacy order: %s", err)
+	}
+	s := store.NewOrderStore(b)
+
+	expected := &model.Order{
+		Customer:    "alice",
+		Items:       []model.LineItem{{Sku: "shoes", Name: "shoes", Quantity: 2}},
+		OrderNumber: "1000001",
+		Status:      model.OrderCreated,
+		Version:     1,
+	}
+	o, err := s.GetOrder(ctx, "1000001")
+	if err != nil {
+		t.Fatalf("unexpected error reading legacy order: %s", err)
+	}
+	if !reflect.DeepEqual(o, expected) {
+		t.Errorf("expected %+v, got %+v", expected, o)
+	}
+	p, err := s.ListOrders(ctx, store.OrderQuery{})
+	if err != nil || len(p.Orders) != 1 || !reflect.DeepEqual(p.Orders[0], expected) {
+		t.Errorf("expected legacy order listed, got %+v, %v", p, err)
+	}
+
+	o.Status = model.OrderCancelled
+	if err := s.UpdateOrder(ctx, o, nil); err != nil {
+		t.Fatalf("unexpected error updating legacy order: %s", err)
+	}
+	if o.Version != 2 {
+		t.Errorf("expected version 2, got %v", o.Version)
+	}
+	got, err := s.GetOrder(ctx, "1000001")
+	if err != nil || got.Status != model.OrderCancelled || got.Version != 2 || !reflect.DeepEqual(got.Items, expected.Items) {
+		t.Errorf("expected cancelled order at version 2, got %+v, %v", got, err)
+	}
+	stale := *expected
+	if err := s.UpdateOrder(ctx, &stale, nil); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict updating stale legacy order, got %v", err)
+	}
+}
+
+// TestPaymentStore checks the PaymentStore contract. The store should be
+// empty and payment number 1 available.
+func TestPaymentStore(t *testing.T, s store.PaymentStore) {
+	ctx := context.Background()
+
+	if err := s.Check(ctx); err != nil {
+		t.Errorf("expected store to be reachable, got %v", err)
+	}
+
+	if _, err := s.GetPayment(ctx, "1"); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing payment, got %v", err)
+	}
+
+	p := &model.Payment{OrderNumber: "7", PaymentNumber: "1"}
+	if err := s.SavePayment(ctx, p); err != nil {
+		t.Fatalf("unexpected error saving payment: %s", err)
+	}
+	got, err := s.GetPayment(ctx, "1")
+	if err != nil {
+		t.Fatalf("unexpected error reading payment: %s", err)
+	}
+	if *got != *p {
+		t.Errorf("expected %+v, got %+v", *p, *got)
+	}
+}
+
+// TestInvoiceStore checks the InvoiceStore contract. The store should be
+// empty and invoice number INV-1 available.
+func TestInvoiceStore(t *testing.T, s store.InvoiceStore) {
+	ctx := context.Background()
+
+	if err := s.Check(ctx); err != nil {
+		t.Errorf("expected store to be reachable, got %v", err)
+	}
+
+	if _, err := s.GetInvoice(ctx, "INV-1"); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing invoice, got %v", err)
+	}
+
+	i := &model.Invoice{Customer: "alice", OrderNumber: "1", InvoiceNumber: "INV-1", Total: model.NewMoney(12, 34)}
+	if err := s.CreateInvoice(ctx, i); err != nil {
+		t.Fatalf("unexpected error saving invoice: %s", err)
+	}
+	other := &model.Invoice{Customer: "mallory", OrderNumber: "2", InvoiceNumber: "INV-1", Total: model.NewMoney(0, 1)}
+	if err := s.CreateInvoice(ctx, other); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict for taken invoice number, got %v", err)
+	}
+	got, err := s.GetInvoice(ctx, "INV-1")
+	if err != nil {
+		t.Fatalf("unexpected error reading invoice: %s", err)
+	}
+	if !reflect.DeepEqual(got, i) {
+		t.Errorf("expected %+v, got %+v", *i, *got)
+	}
+}
+
+// TestProductStore checks the ProductStore contract. The store should be
+// empty.
+func TestProductStore(t *testing.T, s store.ProductStore) {
+	ctx := context.Background()
+
+	if err := s.Check(ctx); err != nil {
+		t.Errorf("expected store to be reachable, got %v", err)
+	}
+
+	if _, err := s.GetProduct(ctx, "shoes"); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing product, got %v", err)
+	}
+	if ps, err := s.ListProducts(ctx); err != nil || len(ps) != 0 {
+		t.Errorf("expected empty catalog, got %v, %v", ps, err)
+	}
+
+	for _, sku := range []string{"socks", "shoes"} {
+		p := &model.Product{Sku: sku, Name: sku, UnitPrice: model.Money{Value: 1250, Decimals: 2, Currency: "EUR"}}
+		if err := s.SaveProduct(ctx, p); err != nil {
+			t.Fatalf("unexpected error saving product: %s", err)
+		}
+	}
+	got, err := s.GetProduct(ctx, "shoes")
+	if err != nil {
+		t.Fatalf("unexpected error reading product: %s", err)
+	}
+	if got.UnitPrice.Value != 1250 || got.UnitPrice.Currency != "EUR" {
+		t.Errorf("expected price 12.50 EUR, got %s", got.UnitPrice)
+	}
+
+	ps, err := s.ListProducts(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing products: %s", err)
+	}
+	if len(ps) != 2 || ps[0].Sku != "shoes" || ps[1].Sku != "socks" {
+		t.Errorf("expected shoes and socks, got %+v", ps)
+	}
+}
+
+// TestCustomerStore checks the CustomerStore contract. The store should be
+// empty.
+func TestCustomerStore(t *testing.T, s store.CustomerStore) {
+	ctx := context.Background()
+
+	if err := s.Check(ctx); err != nil {
+		t.Errorf("expected store to be reachable, got %v", err)
+	}
+
+	if _, err := s.GetCustomer(ctx, "alice"); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound for missing customer, got %v", err)
+	}
+	if _, err := s.UpdateCustomer(ctx, "alice", func(*model.Customer) error { return nil }); err != store.ErrNotFound {
+		t.Errorf("expected ErrNotFound updating missing customer, got %v", err)
+	}
+
+	for _, id := range []string{"bob", "alice"} {
+		c := &model.Customer{Id: id, Name: id, BillingAddress: model.Address{City: "Utrecht", Country: "NL"}}
+		if err := s.CreateCustomer(ctx, c); err != nil {
+			t.Fatalf("unexpected error creating customer: %s", err)
+		}
+	}
+	if err := s.CreateCustomer(ctx, &model.Customer{Id: "alice", Name: "mallory"}); err != store.ErrConflict {
+		t.Errorf("expected ErrConflict for taken id, got %v", err)
+	}
+
+	got, err := s.UpdateCustomer(ctx, "alice", func(c *model.Customer) error {
+		if c.Name != "alice" {
+			t.Errorf("expected stored customer alice, got %+v", c)
+		}
+		c.Deleted = true
+		return nil
+	})
+	if err != nil || !got.Deleted {
+		t.Fatalf("expected deleted customer, got %+v, %v", got, err)
+	}
+	cancelled := errors.New("cancelled")
+	if _, err := s.UpdateCustomer(ctx, "alice", func(c *model.Customer) error {
+		c.Name = "mallory"
+		return cancelled
+	}); err != cancelled {
+		t.Errorf("expected error of change, got %v", err)
+	}
+	if got, _ := s.GetCustomer(ctx, "alice"); got == nil || got.Name != "alice" || got.BillingAddress.Country != "NL" {
+		t.Errorf("expected customer alice in NL, got %+v", got)
+	}
+
+	cs, err := s.ListCustomers(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error listing customers: %s", err)
+	}
+	if len(cs) != 2 || cs[0].Id != "alice" || cs[1].Id != "bob" {
+		t.Errorf("expected alice and bob, got %+v", cs)
+	}
+}
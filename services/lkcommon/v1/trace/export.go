@@ -0,0 +1,303 @@
+package trace
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"lkcommon/gcp"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// An Exporter receives finished spans.
+type Exporter interface {
+	Export(s *Span)
+}
+
+var exporter struct {
+	sync.RWMutex
+	e Exporter
+}
+
+func SetExporter(e Exporter) {
+	exporter.Lock()
+	defer exporter.Unlock()
+	exporter.e = e
+}
+
+func getExporter() Exporter {
+	exporter.RLock()
+	defer exporter.RUnlock()
+	if exporter.e == nil {
+		return noopExporter{}
+	}
+	return exporter.e
+}
+
+// A Flusher is an exporter that buffers spans.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Flush sends buffered spans, if the exporter buffers any. It is meant to
+// be called before the process exits.
+func Flush(ctx context.Context) error {
+	if f, ok := getExporter().(Flusher); ok {
+		return f.Flush(ctx)
+	}
+	return nil
+}
+
+type noopExporter struct{}
+
+func (noopExporter) Export(*Span) {}
+
+// NewExporter selects an exporter by name: "stdout", "cloudtrace" or
+// "none". By default spans are written to stdout when running locally and
+// sent to Cloud Trace in the project otherwise.
+func NewExporter(name string, project gcp.Settings) (Exporter, error) {
+	if name == "" {
+		if project.Local {
+			name = "stdout"
+		} else {
+			name = "cloudtrace"
+		}
+	}
+	switch name {
+	case "none":
+		return noopExporter{}, nil
+	case "stdout":
+		return NewStdoutExporter(os.Stdout), nil
+	case "cloudtrace":
+		id := project.ProjectId()
+		if id == "" {
+			return nil, fmt.Errorf("no project id available for cloud trace")
+		}
+		return NewCloudTraceExporter(id, project.AccessToken), nil
+	}
+	return nil, fmt.Errorf("unknown trace exporter %q", name)
+}
+
+type jsonSpan struct {
+	Name         string            `json:"name"`
+	Kind         Kind              `json:"kind"`
+	TraceId      string            `json:"traceId"`
+	SpanId       string            `json:"spanId"`
+	ParentSpanId string            `json:"parentSpanId,omitempty"`
+	Start        time.Time         `json:"start"`
+	End          time.Time         `json:"end"`
+	DurationMs   float64           `json:"durationMs"`
+	Attributes   map[string]string `json:"attributes,omitempty"`
+	Error        string            `json:"error,omitempty"`
+}
+
+type stdoutExporter struct {
+	mux sync.Mutex
+	w   io.Writer
+}
+
+// NewStdoutExporter writes spans as JSON lines to w.
+func NewStdoutExporter(w io.Writer) Exporter {
+	return &stdoutExporter{w: w}
+}
+
+func (e *stdoutExporter) Export(s *Span) {
+	bs, err := json.Marshal(map[string]jsonSpan{"span": {
+		Name:         s.Name,
+		Kind:         s.Kind,
+		TraceId:      s.Context.TraceId,
+		SpanId:       s.Context.SpanId,
+		ParentSpanId: s.ParentSpanId,
+		Start:        s.Start,
+		End:          s.End,
+		DurationMs:   float64(s.End.Sub(s.Start)) / float64(time.Millisecond),
+		Attributes:   s.Attributes(),
+		Error:        s.Error,
+	}})
+	if err != nil {
+		return
+	}
+	e.mux.Lock()
+	defer e.mux.Unlock()
+	_, _ = e.w.Write(append(bs, '\n'))
+}
+
+// Cloud Trace v2 span representation, see
+// https://cloud.google.com/trace/docs/reference/v2/rest/v2/projects.traces/batchWrite
+type cloudSpan struct {
+	Name         string          `json:"name"`
+	SpanId       string          `json:"spanId"`
+	ParentSpanId string          `json:"parentSpanId,omitempty"`
+	DisplayName  truncatable     `json:"displayName"`
+	StartTime    string          `json:"startTime"`
+	EndTime      string          `json:"endTime"`
+	SpanKind     Kind            `json:"spanKind"`
+	Attributes   cloudAttributes `json:"attributes"`
+	Status       *cloudStatus    `json:"status,omitempty"`
+}
+
+type truncatable struct {
+	Value string `json:"value"`
+}
+
+type cloudAttributes struct {
+	AttributeMap map[string]cloudValue `json:"attributeMap"`
+}
+
+type cloudValue struct {
+	StringValue truncatable `json:"stringValue"`
+}
+
+type cloudStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+const (
+	cloudTraceBatchSize     = 100
+	cloudTraceFlushInterval = 5 * time.Second
+)
+
+type cloudTraceExporter struct {
+	project string
+	token   func() (string, error)
+	client  *http.Client
+	spans   chan cloudSpan
+	flushes chan chan struct{}
+	failed  int
+}
+
+// NewCloudTraceExporter sends spans to Cloud Trace in batches. The token
+// function provides OAuth access tokens. Spans are dropped when the
+// exporter cannot keep up.
+func NewCloudTraceExporter(project string, token func() (string, error)) Exporter {
+	e := &cloudTraceExporter{
+		project: project,
+		token:   token,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		spans:   make(chan cloudSpan, 10*cloudTraceBatchSize),
+		flushes: make(chan chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *cloudTraceExporter) Export(s *Span) {
+	attrs := make(map[string]cloudValue)
+	for k, v := range s.Attributes() {
+		attrs[k] = cloudValue{truncatable{v}}
+	}
+	cs := cloudSpan{
+		Name:         fmt.Sprintf("projects/%s/traces/%s/spans/%s", e.project, s.Context.TraceId, s.Context.SpanId),
+		SpanId:       s.Context.SpanId,
+		ParentSpanId: s.ParentSpanId,
+		DisplayName:  truncatable{s.Name},
+		StartTime:    s.Start.UTC().Format(time.RFC3339Nano),
+		EndTime:      s.End.UTC().Format(time.RFC3339Nano),
+		SpanKind:     s.Kind,
+		Attributes:   cloudAttributes{attrs},
+	}
+	if s.Error != "" {
+		// Code 2 is UNKNOWN in google.rpc.Code.
+		cs.Status = &cloudStatus{Code: 2, Message: s.Error}
+	}
+	select {
+	case e.spans <- cs:
+	default:
+	}
+}
+
+func (e *cloudTraceExporter) run() {
+	tick := time.NewTicker(cloudTraceFlushInterval)
+	defer tick.Stop()
+	var batch []cloudSpan
+	for {
+		var done chan struct{}
+		select {
+		case s := <-e.spans:
+			batch = append(batch, s)
+			if len(batch) < cloudTraceBatchSize {
+				continue
+			}
+		case <-tick.C:
+			if len(batch) == 0 {
+				continue
+			}
+		case done = <-e.flushes:
+			// Take whatever is still queued along.
+			for n := len(e.spans); n > 0; n -= 1 {
+				batch = append(batch, <-e.spans)
+			}
+		}
+		if len(batch) > 0 {
+			e.writeBatch(batch)
+		}
+		batch = nil
+		if done != nil {
+			close(done)
+		}
+	}
+}
+
+func (e *cloudTraceExporter) writeBatch(batch []cloudSpan) {
+	for len(batch) > 0 {
+		n := len(batch)
+		if n > cloudTraceBatchSize {
+			n = cloudTraceBatchSize
+		}
+		if err := e.write(batch[:n]); err != nil {
+			// Report the first failure and every hundredth after that.
+			if e.failed%100 == 0 {
+				logger(context.Background(), "WARNING", fmt.Sprintf("could not export %v spans: %s", n, err))
+			}
+			e.failed += 1
+		}
+		batch = batch[n:]
+	}
+}
+
+// Flush writes all queued spans, giving up when the context is done.
+func (e *cloudTraceExporter) Flush(ctx context.Context) error {
+	done := make(chan struct{})
+	select {
+	case e.flushes <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (e *cloudTraceExporter) write(spans []cloudSpan) error {
+	token, err := e.token()
+	if err != nil {
+		return fmt.Errorf("could not get access token: %s", err)
+	}
+	bs, _ := json.Marshal(map[string][]cloudSpan{"spans": spans})
+	url := fmt.Sprintf("https://cloudtrace.googleapis.com/v2/projects/%s/traces:batchWrite", e.project)
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(bs))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("content-type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected status code %v: %s", resp.StatusCode, msg)
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package trace
+
+import (
+	"context"
+	"github.com/HayoVanLoon/go-commons/logjson"
+)
+
+// A Logger writes a log entry with a severity name (INFO, WARNING or ERROR)
+// for the operation of the context.
+type Logger func(ctx context.Context, severity string, msg string)
+
+// logger writes the entries of this package. Package logctx replaces it,
+// so that entries have the same format as others; trace cannot import
+// logctx, which reads the span from here.
+var logger Logger = func(_ context.Context, severity string, msg string) {
+	switch severity {
+	case "ERROR":
+		logjson.Error(msg)
+	case "WARNING":
+		logjson.Warn(msg)
+	default:
+		logjson.Info(msg)
+	}
+}
+
+// SetLogger replaces the logger of this package. It is meant to be called
+// once, before anything is logged.
+func SetLogger(l Logger) {
+	logger = l
+}
@@ -0,0 +1,282 @@
+// Package trace propagates W3C trace context (traceparent and tracestate)
+// between services and records spans for the work done on their behalf.
+package trace
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TraceParentHeader = "traceparent"
+	TraceStateHeader  = "tracestate"
+	// Header set by Google front ends, used when there is no traceparent.
+	CloudTraceHeader = "X-Cloud-Trace-Context"
+)
+
+// SpanContext identifies a span within a trace.
+type SpanContext struct {
+	TraceId string
+	SpanId  string
+	Sampled bool
+	// Vendor specific trace state, passed on unchanged.
+	State string
+}
+
+func (sc SpanContext) IsValid() bool {
+	return len(sc.TraceId) == 32 && len(sc.SpanId) == 16 &&
+		sc.TraceId != strings.Repeat("0", 32) && sc.SpanId != strings.Repeat("0", 16)
+}
+
+// TraceParent formats the span context as a traceparent header value.
+func (sc SpanContext) TraceParent() string {
+	flags := "00"
+	if sc.Sampled {
+		flags = "01"
+	}
+	return fmt.Sprintf("00-%s-%s-%s", sc.TraceId, sc.SpanId, flags)
+}
+
+// ParseTraceParent parses a traceparent header value.
+func ParseTraceParent(s string) (SpanContext, error) {
+	ps := strings.Split(strings.TrimSpace(s), "-")
+	if len(ps) < 4 || len(ps[0]) != 2 || ps[0] == "ff" {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	if ps[0] == "00" && len(ps) != 4 {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	flags, err := hex.DecodeString(ps[3])
+	if err != nil || len(flags) != 1 || !isLowerHex(ps[1]) || !isLowerHex(ps[2]) {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	sc := SpanContext{TraceId: ps[1], SpanId: ps[2], Sampled: flags[0]&1 == 1}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid traceparent %q", s)
+	}
+	return sc, nil
+}
+
+// parseCloudTrace parses an X-Cloud-Trace-Context header value, which has
+// the form TRACE_ID/SPAN_ID;o=OPTIONS with a decimal span id.
+func parseCloudTrace(s string) (SpanContext, error) {
+	i := strings.Index(s, "/")
+	if i < 0 {
+		return SpanContext{}, fmt.Errorf("invalid cloud trace context %q", s)
+	}
+	traceId, rest := strings.ToLower(s[:i]), s[i+1:]
+	opts := ""
+	if j := strings.Index(rest, ";"); j >= 0 {
+		rest, opts = rest[:j], rest[j+1:]
+	}
+	span, err := strconv.ParseUint(rest, 10, 64)
+	if err != nil || !isLowerHex(traceId) {
+		return SpanContext{}, fmt.Errorf("invalid cloud trace context %q", s)
+	}
+	sc := SpanContext{
+		TraceId: traceId,
+		SpanId:  fmt.Sprintf("%016x", span),
+		Sampled: opts == "o=1",
+	}
+	if !sc.IsValid() {
+		return SpanContext{}, fmt.Errorf("invalid cloud trace context %q", s)
+	}
+	return sc, nil
+}
+
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// Extract reads the span context of the caller from the headers.
+func Extract(h http.Header) (SpanContext, bool) {
+	if tp := h.Get(TraceParentHeader); tp != "" {
+		if sc, err := ParseTraceParent(tp); err == nil {
+			sc.State = h.Get(TraceStateHeader)
+			return sc, true
+		}
+	}
+	if ct := h.Get(CloudTraceHeader); ct != "" {
+		if sc, err := parseCloudTrace(ct); err == nil {
+			return sc, true
+		}
+	}
+	return SpanContext{}, false
+}
+
+// Inject writes the span context of the current span to the headers.
+func Inject(ctx context.Context, h http.Header) {
+	s := FromContext(ctx)
+	if s == nil {
+		return
+	}
+	h.Set(TraceParentHeader, s.Context.TraceParent())
+	if s.Context.State != "" {
+		h.Set(TraceStateHeader, s.Context.State)
+	}
+}
+
+type Kind string
+
+const (
+	KindServer   Kind = "SERVER"
+	KindClient   Kind = "CLIENT"
+	KindInternal Kind = "INTERNAL"
+)
+
+// A Span records a unit of work.
+type Span struct {
+	Name         string
+	Kind         Kind
+	Context      SpanContext
+	ParentSpanId string
+	Start        time.Time
+	End          time.Time
+	// Error message when the work failed.
+	Error string
+
+	mux        sync.Mutex
+	attributes map[string]string
+	ended      bool
+}
+
+func (s *Span) SetAttribute(key, value string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.attributes[key] = value
+}
+
+// Attributes returns a copy of the span attributes.
+func (s *Span) Attributes() map[string]string {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	as := make(map[string]string, len(s.attributes))
+	for k, v := range s.attributes {
+		as[k] = v
+	}
+	return as
+}
+
+func (s *Span) SetError(err error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.Error = err.Error()
+}
+
+// Finish ends the span and hands it to the exporter if it is sampled.
+func (s *Span) Finish() {
+	s.mux.Lock()
+	if s.ended {
+		s.mux.Unlock()
+		return
+	}
+	s.ended = true
+	s.End = time.Now()
+	s.mux.Unlock()
+
+	if s.Context.Sampled {
+		getExporter().Export(s)
+	}
+}
+
+type spanKey struct{}
+
+// FromContext returns the current span, if any.
+func FromContext(ctx context.Context) *Span {
+	s, _ := ctx.Value(spanKey{}).(*Span)
+	return s
+}
+
+// TraceId returns the id of the current trace, if any.
+func TraceId(ctx context.Context) string {
+	if s := FromContext(ctx); s != nil {
+		return s.Context.TraceId
+	}
+	return ""
+}
+
+// StartSpan starts a span as child of the current span in the context, or
+// as the root of a new trace.
+func StartSpan(ctx context.Context, name string, kind Kind) (context.Context, *Span) {
+	var parent SpanContext
+	if p := FromContext(ctx); p != nil {
+		parent = p.Context
+	}
+	return startSpan(ctx, name, kind, parent)
+}
+
+func startSpan(ctx context.Context, name string, kind Kind, parent SpanContext) (context.Context, *Span) {
+	s := &Span{
+		Name:       name,
+		Kind:       kind,
+		Start:      time.Now(),
+		attributes: make(map[string]string),
+	}
+	if parent.IsValid() {
+		s.Context = SpanContext{TraceId: parent.TraceId, SpanId: newId(8), Sampled: parent.Sampled, State: parent.State}
+		s.ParentSpanId = parent.SpanId
+	} else {
+		s.Context = SpanContext{TraceId: newId(16), SpanId: newId(8), Sampled: true}
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+func newId(n int) string {
+	bs := make([]byte, n)
+	_, _ = rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(bs []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(bs)
+}
+
+// Middleware records a server span for every request, continuing the trace
+// of the caller when it sent a trace context.
+func Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent, _ := Extract(r.Header)
+		ctx, s := startSpan(r.Context(), r.Method+" "+r.URL.Path, KindServer, parent)
+		s.SetAttribute("http.method", r.Method)
+		s.SetAttribute("http.path", r.URL.Path)
+		defer s.Finish()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		s.SetAttribute("http.status_code", strconv.Itoa(rec.status))
+		if rec.status >= 500 {
+			s.SetError(fmt.Errorf("%s", http.StatusText(rec.status)))
+		}
+	})
+}
@@ -0,0 +1,68 @@
+package trace
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string]string
+		want   SpanContext
+		ok     bool
+	}{
+		{"traceparent", map[string]string{TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", TraceStateHeader: "a=b"},
+			SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Sampled: true, State: "a=b"}, true},
+		{"not sampled", map[string]string{TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"},
+			SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7"}, true},
+		{"cloud trace", map[string]string{CloudTraceHeader: "4BF92F3577B34DA6A3CE929D0E0E4736/1;o=1"},
+			SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "0000000000000001", Sampled: true}, true},
+		{"traceparent before cloud trace", map[string]string{TraceParentHeader: "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01", CloudTraceHeader: "0af7651916cd43dd8448eb211c80319c/1;o=1"},
+			SpanContext{TraceId: "4bf92f3577b34da6a3ce929d0e0e4736", SpanId: "00f067aa0ba902b7", Sampled: true}, true},
+		{"zero trace id", map[string]string{TraceParentHeader: "00-00000000000000000000000000000000-00f067aa0ba902b7-01"}, SpanContext{}, false},
+		{"upper case", map[string]string{TraceParentHeader: "00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01"}, SpanContext{}, false},
+		{"invalid version", map[string]string{TraceParentHeader: "ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"}, SpanContext{}, false},
+		{"none", map[string]string{}, SpanContext{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			for k, v := range tt.header {
+				h.Set(k, v)
+			}
+			sc, ok := Extract(h)
+			if ok != tt.ok || sc != tt.want {
+				t.Errorf("expected %+v %v, got %+v %v", tt.want, tt.ok, sc, ok)
+			}
+		})
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	var got *Span
+	var out http.Header
+	h := Middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = FromContext(r.Context())
+		out = http.Header{}
+		Inject(r.Context(), out)
+	}))
+
+	r := httptest.NewRequest(http.MethodGet, "/orders/1", nil)
+	r.Header.Set(TraceParentHeader, "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+	r.Header.Set(TraceStateHeader, "a=b")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.Context.TraceId != "4bf92f3577b34da6a3ce929d0e0e4736" || got.ParentSpanId != "00f067aa0ba902b7" || got.Kind != KindServer {
+		t.Fatalf("expected server span continuing the caller's trace, got %+v", got)
+	}
+	want := "00-4bf92f3577b34da6a3ce929d0e0e4736-" + got.Context.SpanId + "-00"
+	if out.Get(TraceParentHeader) != want || out.Get(TraceStateHeader) != "a=b" {
+		t.Errorf("expected %s with state a=b passed on, got %v", want, out)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/orders/1", nil))
+	if got == nil || !got.Context.IsValid() || got.ParentSpanId != "" || !got.Context.Sampled {
+		t.Errorf("expected sampled root span without trace context, got %+v", got)
+	}
+}
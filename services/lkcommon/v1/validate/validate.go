@@ -0,0 +1,180 @@
+// Package validate checks decoded requests against declarative rules:
+//
+//	var orderRules = validate.Rules{
+//		"customer": {validate.Required, validate.MaxLength(100)},
+//		"items":    {validate.Count(1, 100), validate.Each(itemRules)},
+//	}
+//
+// Fields are named as in JSON. Every field is checked, so that clients learn
+// about all problems with a request at once.
+package validate
+
+import (
+	"fmt"
+	"lkcommon/apierror"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A Check examines the value of a field and returns its violations.
+type Check func(field string, v reflect.Value) []apierror.FieldViolation
+
+// Rules map the JSON names of a struct's fields to the checks on their
+// values. The checks of a field run until one fails. Fields without rules
+// are not checked.
+type Rules map[string][]Check
+
+// Validate checks v, a struct or a pointer to one, and returns every
+// violation in field order.
+func (rs Rules) Validate(v interface{}) []apierror.FieldViolation {
+	return rs.validate("", reflect.Indirect(reflect.ValueOf(v)))
+}
+
+// Check returns an Unprocessable *apierror.Error listing the violations, or
+// nil if there are none.
+func (rs Rules) Check(v interface{}) error {
+	return Error(rs.Validate(v))
+}
+
+// Error returns an Unprocessable *apierror.Error listing the violations, or
+// nil if there are none.
+func Error(vs []apierror.FieldViolation) error {
+	if len(vs) == 0 {
+		return nil
+	}
+	msg := fmt.Sprintf("%v invalid fields", len(vs))
+	if len(vs) == 1 {
+		msg = "1 invalid field"
+	}
+	return apierror.New(apierror.Unprocessable, msg).WithDetails(vs...)
+}
+
+func (rs Rules) validate(prefix string, v reflect.Value) []apierror.FieldViolation {
+	var vs []apierror.FieldViolation
+	t := v.Type()
+	for i := 0; i < t.NumField(); i += 1 {
+		name := jsonName(t.Field(i))
+		for _, c := range rs[name] {
+			if fvs := c(prefix+name, v.Field(i)); len(fvs) > 0 {
+				vs = append(vs, fvs...)
+				break
+			}
+		}
+	}
+	return vs
+}
+
+func jsonName(f reflect.StructField) string {
+	name := strings.Split(f.Tag.Get("json"), ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
+
+// simple turns a test of a value into a Check.
+func simple(test func(v reflect.Value) string) Check {
+	return func(field string, v reflect.Value) []apierror.FieldViolation {
+		if d := test(v); d != "" {
+			return []apierror.FieldViolation{{Field: field, Description: d}}
+		}
+		return nil
+	}
+}
+
+// Required rejects zero values and blank strings.
+var Required = simple(func(v reflect.Value) string {
+	if isZero(v) || v.Kind() == reflect.String && strings.TrimSpace(v.String()) == "" {
+		return "is required"
+	}
+	return ""
+})
+
+// Absent rejects fields that are set, such as fields filled in by the
+// server.
+var Absent = simple(func(v reflect.Value) string {
+	if !isZero(v) {
+		return "must not be set"
+	}
+	return ""
+})
+
+// Printable rejects strings with control characters or invalid UTF-8.
+var Printable = simple(func(v reflect.Value) string {
+	s := v.String()
+	if !utf8.ValidString(s) || strings.IndexFunc(s, unicode.IsControl) >= 0 {
+		return "must not contain control characters"
+	}
+	return ""
+})
+
+// MaxLength rejects strings of more than n characters.
+func MaxLength(n int) Check {
+	return simple(func(v reflect.Value) string {
+		if utf8.RuneCountInString(v.String()) > n {
+			return fmt.Sprintf("must be at most %v characters", n)
+		}
+		return ""
+	})
+}
+
+// Matches rejects strings for which ok returns false. The description
+// completes "must be ...".
+func Matches(ok func(string) bool, description string) Check {
+	return simple(func(v reflect.Value) string {
+		if !ok(v.String()) {
+			return "must be " + description
+		}
+		return ""
+	})
+}
+
+// Between rejects integers outside [min, max].
+func Between(min, max int64) Check {
+	return simple(func(v reflect.Value) string {
+		if i := v.Int(); i < min || i > max {
+			return fmt.Sprintf("must be between %v and %v", min, max)
+		}
+		return ""
+	})
+}
+
+// Count rejects slices with fewer than min or more than max elements.
+func Count(min, max int) Check {
+	return simple(func(v reflect.Value) string {
+		if n := v.Len(); n < min || n > max {
+			return fmt.Sprintf("must have %v to %v entries", min, max)
+		}
+		return ""
+	})
+}
+
+// Each checks every element of a slice of structs against the rules.
+func Each(rs Rules) Check {
+	return func(field string, v reflect.Value) []apierror.FieldViolation {
+		var vs []apierror.FieldViolation
+		for i := 0; i < v.Len(); i += 1 {
+			vs = append(vs, rs.validate(fmt.Sprintf("%s[%v].", field, i), reflect.Indirect(v.Index(i)))...)
+		}
+		return vs
+	}
+}
+
+// Struct checks a struct against the rules.
+func Struct(rs Rules) Check {
+	return func(field string, v reflect.Value) []apierror.FieldViolation {
+		return rs.validate(field+".", reflect.Indirect(v))
+	}
+}
+
+// isZero reports whether v is its type's zero value. Empty slices count as
+// zero.
+func isZero(v reflect.Value) bool {
+	switch v.Kind() {
+	case reflect.Slice, reflect.Map:
+		return v.Len() == 0
+	}
+	return v.IsZero()
+}
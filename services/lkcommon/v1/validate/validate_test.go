@@ -0,0 +1,111 @@
+package validate
+
+import (
+	"fmt"
+	"lkcommon/apierror"
+	"strings"
+	"testing"
+)
+
+type address struct {
+	City string `json:"city"`
+}
+
+type line struct {
+	Sku      string `json:"sku"`
+	Quantity int    `json:"quantity"`
+}
+
+type request struct {
+	Id       string   `json:"id,omitempty"`
+	Customer string   `json:"customer"`
+	Note     string   `json:"note"`
+	Items    []line   `json:"items"`
+	Address  *address `json:"address"`
+	Untagged string
+}
+
+var lineRules = Rules{
+	"sku":      {Required, Matches(func(s string) bool { return strings.ToLower(s) == s }, "lower case")},
+	"quantity": {Between(1, 10)},
+}
+
+var requestRules = Rules{
+	"id":       {Absent},
+	"customer": {Required, MaxLength(5)},
+	"note":     {Printable},
+	"items":    {Count(1, 2), Each(lineRules)},
+	"address":  {Required, Struct(Rules{"city": {Required}})},
+	"Untagged": {MaxLength(1)},
+}
+
+func valid() request {
+	return request{Customer: "alice", Items: []line{{"socks", 1}}, Address: &address{"Utrecht"}}
+}
+
+func TestRules(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(r *request)
+		want   []string
+	}{
+		{"valid", func(r *request) {}, nil},
+		{"server field", func(r *request) { r.Id = "o1" }, []string{"id: must not be set"}},
+		{"missing", func(r *request) { r.Customer = "" }, []string{"customer: is required"}},
+		{"blank", func(r *request) { r.Customer = "  " }, []string{"customer: is required"}},
+		{"first failing check only", func(r *request) { r.Customer = "      " }, []string{"customer: is required"}},
+		{"too long", func(r *request) { r.Customer = "alice!" }, []string{"customer: must be at most 5 characters"}},
+		{"characters, not bytes", func(r *request) { r.Customer = "ålîçé" }, nil},
+		{"control characters", func(r *request) { r.Note = "a\x00b" }, []string{"note: must not contain control characters"}},
+		{"invalid utf-8", func(r *request) { r.Note = "\xff" }, []string{"note: must not contain control characters"}},
+		{"no items", func(r *request) { r.Items = nil }, []string{"items: must have 1 to 2 entries"}},
+		{"too many items", func(r *request) { r.Items = []line{{"a", 1}, {"b", 1}, {"c", 1}} }, []string{"items: must have 1 to 2 entries"}},
+		{"each item", func(r *request) { r.Items = []line{{"Socks", 0}, {"", 11}} }, []string{
+			"items[0].sku: must be lower case",
+			"items[0].quantity: must be between 1 and 10",
+			"items[1].sku: is required",
+			"items[1].quantity: must be between 1 and 10",
+		}},
+		{"missing struct", func(r *request) { r.Address = nil }, []string{"address: is required"}},
+		{"nested struct", func(r *request) { r.Address.City = "" }, []string{"address.city: is required"}},
+		{"go name", func(r *request) { r.Untagged = "ab" }, []string{"Untagged: must be at most 1 characters"}},
+		{"all fields", func(r *request) { r.Id = "o1"; r.Customer = ""; r.Items = nil }, []string{
+			"id: must not be set", "customer: is required", "items: must have 1 to 2 entries",
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := valid()
+			tt.change(&r)
+			var got []string
+			for _, v := range requestRules.Validate(&r) {
+				got = append(got, v.Field+": "+v.Description)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("expected %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestError(t *testing.T) {
+	if err := Error(nil); err != nil {
+		t.Errorf("expected no error without violations, got %v", err)
+	}
+
+	tests := []struct {
+		vs  []apierror.FieldViolation
+		msg string
+	}{
+		{[]apierror.FieldViolation{{Field: "a", Description: "is required"}}, "1 invalid field"},
+		{[]apierror.FieldViolation{{Field: "a"}, {Field: "b"}}, "2 invalid fields"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.msg, func(t *testing.T) {
+			e, ok := apierror.As(Error(tt.vs))
+			if !ok || e.Code != apierror.Unprocessable || e.Message != tt.msg || len(e.Details) != len(tt.vs) {
+				t.Errorf("expected unprocessable error %q with details, got %+v", tt.msg, e)
+			}
+		})
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
+	"lkcommon/store"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Number of audit entries returned by GET /admin/audit.
+const auditListSize = 100
+
+// An auditEntry records a change made through the admin API.
+type auditEntry struct {
+	Time   time.Time   `json:"time"`
+	Actor  string      `json:"actor"`
+	Action string      `json:"action"`
+	Target string      `json:"target"`
+	Before interface{} `json:"before,omitempty"`
+	After  interface{} `json:"after,omitempty"`
+}
+
+// auditLog stores audit entries under keys that sort by time.
+type auditLog struct {
+	store store.Backend
+}
+
+func openAuditLog(ctx context.Context, cfg *config.Config) (*auditLog, error) {
+	b, err := store.OpenBackend(ctx, store.ConfigFrom(cfg), "audit", "audit-", store.BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	return &auditLog{store: b}, nil
+}
+
+// Record stores the entry and logs it. The change has been made, so a
+// failure to store the entry is only logged.
+func (a *auditLog) Record(r *http.Request, action, target string, before, after interface{}) {
+	e := auditEntry{
+		Time:   time.Now().UTC(),
+		Actor:  auth.GetIdentification(r),
+		Action: action,
+		Target: target,
+		Before: before,
+		After:  after,
+	}
+	bs, _ := json.Marshal(e)
+	logctx.Notice(r.Context(), fmt.Sprintf("audit: %s", bs))
+
+	key := e.Time.Format("20060102T150405.000000000Z") + "-" + newToken()[:8]
+	if err := a.store.Put(r.Context(), key, e); err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not store audit entry %s: %s", bs, err))
+	}
+}
+
+// Latest returns the n latest entries, newest first.
+func (a *auditLog) Latest(ctx context.Context, n int) ([]auditEntry, error) {
+	keys, err := a.store.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	es := []auditEntry{}
+	for i := len(keys) - 1; i >= 0 && len(es) < n; i -= 1 {
+		e := auditEntry{}
+		if err := a.store.Get(ctx, keys[i], &e); err != nil {
+			return nil, err
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
+
+func (a *auditLog) Check(ctx context.Context) error {
+	return a.store.Check(ctx)
+}
+
+// A counter is identified by its range key and, for sequences that reset,
+// the period: order, invoice:2026 or statement:2026-10.
+var counterPattern = regexp.MustCompile(`^([A-Za-z0-9_-]{1,64})(:\d{4}(-\d{2})?)?$`)
+
+type counterValue struct {
+	Counter string `json:"counter"`
+	Value   int    `json:"value"`
+}
+
+// handleAdmin serves the admin API, which is restricted to the configured
+// admin identity:
+//
+//	GET  /admin/counters                  the counters and their values
+//	POST /admin/counters/{counter}/floor  raise a counter to at least a value
+//	POST /admin/counters/{counter}/reset  set a counter back to zero
+//	GET  /admin/audit                     the latest changes
+//
+// Clients leasing blocks keep handing out their leased numbers after a
+// reset, until their leases expire.
+func (s *server) handleAdmin(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("admin request from %s", auth.GetIdentification(r)))
+
+	path := strings.TrimPrefix(r.URL.Path, "/admin/")
+	switch {
+	case path == "counters":
+		if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
+			return
+		}
+		s.handleListCounters(w, r)
+	case path == "audit":
+		if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
+			return
+		}
+		es, err := s.audit.Latest(r.Context(), auditListSize)
+		if err != nil {
+			logctx.Error(r.Context(), fmt.Sprintf("could not read audit log: %s", err))
+			httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not read audit log"))
+			return
+		}
+		httpx.OkJson(w, es)
+	case strings.HasPrefix(path, "counters/"):
+		if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
+			return
+		}
+		ps := strings.Split(strings.TrimPrefix(path, "counters/"), "/")
+		if len(ps) != 2 || !counterPattern.MatchString(ps[0]) {
+			httpx.NotFound(w, "not found")
+			return
+		}
+		switch ps[1] {
+		case "floor":
+			s.handleFloor(w, r, ps[0])
+		case "reset":
+			s.handleReset(w, r, ps[0])
+		default:
+			httpx.NotFound(w, "not found")
+		}
+	default:
+		httpx.NotFound(w, "not found")
+	}
+}
+
+func (s *server) handleListCounters(w http.ResponseWriter, r *http.Request) {
+	vs, err := s.counters.Values(r.Context())
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not read counters: %s", err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not read counters"))
+		return
+	}
+	cs := []counterValue{}
+	for k, v := range vs {
+		cs = append(cs, counterValue{Counter: k, Value: v})
+	}
+	sort.Slice(cs, func(i, j int) bool { return cs[i].Counter < cs[j].Counter })
+	httpx.OkJson(w, cs)
+}
+
+// handleFloor raises a counter, so that numbering continues above the given
+// value. Counters never go down this way.
+func (s *server) handleFloor(w http.ResponseWriter, r *http.Request, counter string) {
+	req := struct {
+		Value int `json:"value"`
+	}{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&req); err != nil || req.Value < 0 {
+		httpx.BadRequest(w, "expected a non-negative value")
+		return
+	}
+
+	before, err := s.counterValue(r.Context(), counter)
+	after := counterValue{Counter: counter}
+	if err == nil {
+		after.Value, err = s.counters.Raise(r.Context(), counter, req.Value)
+	}
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not raise counter %s: %s", counter, err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not raise counter"))
+		return
+	}
+
+	s.audit.Record(r, "floor", counter, before, after)
+	httpx.OkJson(w, after)
+}
+
+// handleReset sets a counter back to zero and drops its open reservations.
+func (s *server) handleReset(w http.ResponseWriter, r *http.Request, counter string) {
+	before, err := s.counterValue(r.Context(), counter)
+	if err == nil {
+		err = s.reservations.Discard(r.Context(), counter)
+	}
+	if err == nil {
+		err = s.counters.Reset(r.Context(), counter)
+	}
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not reset counter %s: %s", counter, err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not reset counter"))
+		return
+	}
+	after := counterValue{Counter: counter}
+
+	s.audit.Record(r, "reset", counter, before, after)
+	httpx.OkJson(w, after)
+}
+
+func (s *server) counterValue(ctx context.Context, counter string) (counterValue, error) {
+	vs, err := s.counters.Values(ctx)
+	if err != nil {
+		return counterValue{}, err
+	}
+	return counterValue{Counter: counter, Value: vs[counter]}, nil
+}
+
+// handlePutSequence defines a sequence. It is restricted to the admin.
+func (s *server) handlePutSequence(w http.ResponseWriter, r *http.Request, key string) {
+	seq := model.Sequence{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&seq); err != nil {
+		httpx.BadRequest(w, "invalid sequence")
+		return
+	}
+	if seq.Key == "" {
+		seq.Key = key
+	}
+	if seq.Key != key {
+		httpx.BadRequest(w, fmt.Sprintf("key %s does not match path", seq.Key))
+		return
+	}
+	if ps := seq.Validate(); len(ps) > 0 {
+		httpx.BadRequest(w, fmt.Sprintf("invalid sequence: %s", strings.Join(ps, "; ")))
+		return
+	}
+
+	var before interface{}
+	if s.sequences.Defined(key) {
+		before = s.sequences.Get(key)
+	}
+	if err := s.sequences.Put(r.Context(), seq); err != nil {
+		if _, ok := apierror.As(err); !ok {
+			logctx.Error(r.Context(), fmt.Sprintf("could not store sequence %s: %s", key, err))
+			err = apierror.New(apierror.Unavailable, "could not store sequence")
+		}
+		httpx.WriteError(w, err)
+		return
+	}
+
+	s.audit.Record(r, "define", key, before, seq)
+	httpx.OkJson(w, seq)
+}
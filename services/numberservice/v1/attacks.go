@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/HayoVanLoon/go-commons/logjson"
 	"google.golang.org/api/iterator"
 	"io/ioutil"
-	"log"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
 	"net/http"
-	"strconv"
 )
 
 type Loot struct {
@@ -24,24 +27,29 @@ type AttackResult struct {
 	Log         string `json:"log"`
 }
 
-func addAttacks() {
-	http.HandleFunc("/attacks/1", writeFirestore)
-	http.HandleFunc("/attacks/2", readFirestore)
+// attacker runs the attacks with the service's configuration and client.
+type attacker struct {
+	cfg    *config.Config
+	client *auth.ServiceClient
+}
+
+func addAttacks(cfg *config.Config, client *auth.ServiceClient) {
+	a := &attacker{cfg: cfg, client: client}
+	http.HandleFunc("/attacks/1", a.writeFirestore)
+	http.HandleFunc("/attacks/2", a.readFirestore)
 	http.HandleFunc("/attacks", listAttacks)
 }
 
 func listAttacks(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Header().Set("allow", "GET")
+	if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
 		return
 	}
 	_, _ = w.Write([]byte("1,2"))
 }
 
 func OkAttack(w http.ResponseWriter, r *http.Request, result *AttackResult) {
-	logjson.Info(fmt.Sprintf("[attack] %s successful", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s successful", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
 func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg string) {
@@ -50,11 +58,11 @@ func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg st
 	} else {
 		result.Log = msg
 	}
-	logjson.Info(fmt.Sprintf("[attack] %s failed", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s failed", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
-func GetChainedToken(services []string, target string) (string, error) {
+func (a *attacker) GetChainedToken(services []string, target string) (string, error) {
 	if len(services) == 0 {
 		return "", nil
 	}
@@ -62,18 +70,18 @@ func GetChainedToken(services []string, target string) (string, error) {
 	for i := 0; i < len(services)-1; i += 1 {
 		tgt := fmt.Sprintf("%s/leaks/id-token", services[i+1])
 		var err error
-		idToken, err = GetServiceIdToken(services[i], tgt, idToken)
+		idToken, err = a.GetServiceIdToken(services[i], tgt, idToken)
 		if err != nil {
 			return "", fmt.Errorf("could not get token from %s for %s: %s", services[i], tgt, err)
 		}
 	}
 	last := services[len(services)-1]
-	return GetServiceIdToken(last, target, idToken)
+	return a.GetServiceIdToken(last, target, idToken)
 }
 
-func GetServiceIdToken(service, target, token string) (string, error) {
+func (a *attacker) GetServiceIdToken(service, target, token string) (string, error) {
 	url := service + "/leaks/id-token?url=" + target
-	resp, err := GetWithAuth(url, token)
+	resp, err := a.client.GetWithAuth(url, token)
 	if err != nil {
 		return "", err
 	}
@@ -87,27 +95,26 @@ func GetServiceIdToken(service, target, token string) (string, error) {
 	return string(idToken), nil
 }
 
-func writeFirestore(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) writeFirestore(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "number-service updates firestore",
 	}
 
-	client, err := GetFirestore()
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not create firestore client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("could not create firestore client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	o := Order{
-		Customer:    "hacker-" + getIp(r),
-		Name:        "loot",
-		Quantity:    1234567890,
-		OrderNumber: 666,
+	o := model.Order{
+		Customer:    "hacker-" + httpx.GetIp(r),
+		Items:       []model.LineItem{{Sku: "loot", Quantity: 1234567890}},
+		OrderNumber: "666",
 	}
-	d := client.Collection(baseCollection + "/orders").Doc(strconv.Itoa(o.OrderNumber))
+	d := client.Collection(gcp.BaseCollection + "/orders").Doc(o.OrderNumber)
 	_, err = d.Create(context.Background(), o)
 	if err == nil {
 		result.Points = 1000
@@ -117,21 +124,21 @@ func writeFirestore(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func readFirestore(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) readFirestore(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "number-service reads firestore",
 	}
 
-	client, err := GetFirestore()
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not create firestore client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not create firestore client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	q := client.Collection(baseCollection + "/orders").Limit(1)
+	q := client.Collection(gcp.BaseCollection + "/orders").Limit(1)
 	di := q.Documents(context.Background())
 	d, err := di.Next()
 	if err != nil && err == iterator.Done {
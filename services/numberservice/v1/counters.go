@@ -0,0 +1,495 @@
+package main
+
+import (
+	"bufio"
+	"cloud.google.com/go/firestore"
+	"context"
+	"encoding/json"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io"
+	"io/ioutil"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"lkcommon/logctx"
+	"lkcommon/store"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// A CounterStore persists the counters behind the ranges.
+type CounterStore interface {
+	// Add increases the counter for key by n and returns the new value.
+	// Missing counters start at zero.
+	Add(ctx context.Context, key string, n int) (int, error)
+	// Raise sets the counter for key to at least v and returns its value.
+	Raise(ctx context.Context, key string, v int) (int, error)
+	// Reset sets the counter for key back to zero.
+	Reset(ctx context.Context, key string) error
+	// All returns the current value of every counter.
+	All(ctx context.Context) (map[string]int, error)
+	// Check verifies that the store can be reached.
+	Check(ctx context.Context) error
+}
+
+// OpenCounterStore opens the configured counter store: Firestore when
+// running in Google Cloud and a write-ahead log file when running locally.
+func OpenCounterStore(ctx context.Context, cfg *config.Config) (CounterStore, error) {
+	backend := cfg.StorageBackend
+	if backend == "" {
+		if cfg.IsLocal() {
+			backend = store.BackendFile
+		} else {
+			backend = store.BackendFirestore
+		}
+	}
+
+	switch backend {
+	case store.BackendMemory:
+		return newMemoryCounters(), nil
+	case store.BackendFile:
+		dir := cfg.StorageDir
+		if dir == "" {
+			dir = "data"
+		}
+		return newFileCounters(filepath.Join(dir, "counters.wal"))
+	case store.BackendFirestore:
+		client, err := cfg.Gcp().GetFirestore()
+		if err != nil {
+			return nil, fmt.Errorf("could not get firestore client: %s", err)
+		}
+		return newFirestoreCounters(client, gcp.BaseCollection+"/counters"), nil
+	}
+	return nil, fmt.Errorf("storage backend %q does not support counters", backend)
+}
+
+type memoryCounters struct {
+	mux    sync.Mutex
+	values map[string]int
+}
+
+func newMemoryCounters() *memoryCounters {
+	return &memoryCounters{values: make(map[string]int)}
+}
+
+func (s *memoryCounters) Add(_ context.Context, key string, n int) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.values[key] += n
+	return s.values[key], nil
+}
+
+func (s *memoryCounters) Raise(_ context.Context, key string, v int) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if v > s.values[key] {
+		s.values[key] = v
+	}
+	return s.values[key], nil
+}
+
+func (s *memoryCounters) Reset(_ context.Context, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	delete(s.values, key)
+	return nil
+}
+
+func (s *memoryCounters) All(context.Context) (map[string]int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	vs := make(map[string]int)
+	for k, v := range s.values {
+		vs[k] = v
+	}
+	return vs, nil
+}
+
+func (s *memoryCounters) Check(context.Context) error {
+	return nil
+}
+
+// Number of log records after which the log is compacted.
+const walCompactAfter = 10000
+
+type walRecord struct {
+	Key   string `json:"key"`
+	Value int    `json:"value"`
+}
+
+// fileCounters keeps the counters in memory and appends every change to a
+// log file, which is synced before the change is acknowledged. Records hold
+// the new value rather than the increment, so replaying them is safe. The
+// log is compacted to one record per key once it grows long.
+type fileCounters struct {
+	path    string
+	mux     sync.Mutex
+	file    *os.File
+	records int
+	values  map[string]int
+}
+
+func newFileCounters(path string) (*fileCounters, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("could not create storage directory: %s", err)
+	}
+	s := &fileCounters{path: path, values: make(map[string]int)}
+	if err := s.replay(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("could not open counter log: %s", err)
+	}
+	s.file = f
+	return s, nil
+}
+
+// replay rebuilds the counters from the log. A torn last record, left by a
+// crash during a write, was never acknowledged and is cut off.
+func (s *fileCounters) replay() error {
+	f, err := os.Open(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("could not open counter log: %s", err)
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				return os.Truncate(s.path, offset)
+			}
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("error reading counter log: %s", err)
+		}
+		rec := walRecord{}
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return fmt.Errorf("corrupt counter log record %v: %s", s.records+1, err)
+		}
+		s.values[rec.Key] = rec.Value
+		s.records += 1
+		offset += int64(len(line))
+	}
+}
+
+func (s *fileCounters) Add(ctx context.Context, key string, n int) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.set(ctx, key, s.values[key]+n)
+}
+
+func (s *fileCounters) Raise(ctx context.Context, key string, v int) (int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	if v <= s.values[key] {
+		return s.values[key], nil
+	}
+	return s.set(ctx, key, v)
+}
+
+func (s *fileCounters) Reset(ctx context.Context, key string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	_, err := s.set(ctx, key, 0)
+	return err
+}
+
+// set logs and applies a new value. The caller must hold the lock.
+func (s *fileCounters) set(ctx context.Context, key string, v int) (int, error) {
+	if err := s.append(walRecord{Key: key, Value: v}); err != nil {
+		return 0, err
+	}
+	s.values[key] = v
+
+	if s.records >= walCompactAfter {
+		if err := s.compact(); err != nil {
+			// The log is intact, only long; the next change tries again.
+			logctx.Warn(ctx, fmt.Sprintf("could not compact counter log: %s", err))
+		}
+	}
+	return v, nil
+}
+
+func (s *fileCounters) append(rec walRecord) error {
+	bs, _ := json.Marshal(rec)
+	if _, err := s.file.Write(append(bs, '\n')); err != nil {
+		return fmt.Errorf("error writing counter log: %s", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		return fmt.Errorf("error syncing counter log: %s", err)
+	}
+	s.records += 1
+	return nil
+}
+
+// compact replaces the log with one holding a record per counter.
+func (s *fileCounters) compact() error {
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".counters-*")
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for k, v := range s.values {
+		bs, _ := json.Marshal(walRecord{Key: k, Value: v})
+		_, _ = w.Write(append(bs, '\n'))
+	}
+	err = w.Flush()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), s.path)
+	}
+	if err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_ = s.file.Close()
+	s.file = f
+	s.records = len(s.values)
+	return nil
+}
+
+func (s *fileCounters) All(context.Context) (map[string]int, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	vs := make(map[string]int)
+	for k, v := range s.values {
+		vs[k] = v
+	}
+	return vs, nil
+}
+
+func (s *fileCounters) Check(context.Context) error {
+	if _, err := os.Stat(s.path); err != nil {
+		return fmt.Errorf("counter log unavailable: %s", err)
+	}
+	return nil
+}
+
+type counterDoc struct {
+	Value int
+}
+
+// firestoreCounters keeps a document per counter and increments it in a
+// transaction, so that concurrent instances never hand out the same value.
+type firestoreCounters struct {
+	client     *firestore.Client
+	collection *firestore.CollectionRef
+}
+
+func newFirestoreCounters(client *firestore.Client, collection string) *firestoreCounters {
+	return &firestoreCounters{client: client, collection: client.Collection(collection)}
+}
+
+func (s *firestoreCounters) Add(ctx context.Context, key string, n int) (int, error) {
+	v, err := s.update(ctx, key, func(v int) int { return v + n })
+	if err != nil {
+		return 0, fmt.Errorf("error incrementing counter %s: %s", key, err)
+	}
+	return v, nil
+}
+
+func (s *firestoreCounters) Raise(ctx context.Context, key string, floor int) (int, error) {
+	v, err := s.update(ctx, key, func(v int) int {
+		if floor > v {
+			return floor
+		}
+		return v
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error raising counter %s: %s", key, err)
+	}
+	return v, nil
+}
+
+func (s *firestoreCounters) Reset(ctx context.Context, key string) error {
+	if _, err := s.collection.Doc(key).Set(ctx, counterDoc{}); err != nil {
+		return fmt.Errorf("error resetting counter %s: %s", key, err)
+	}
+	return nil
+}
+
+// update applies f to the counter in a transaction and returns the result.
+func (s *firestoreCounters) update(ctx context.Context, key string, f func(int) int) (int, error) {
+	ref := s.collection.Doc(key)
+	var v int
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		c := counterDoc{}
+		d, err := tx.Get(ref)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		} else if err == nil {
+			if err := d.DataTo(&c); err != nil {
+				return err
+			}
+		}
+		v = f(c.Value)
+		return tx.Set(ref, counterDoc{Value: v})
+	})
+	return v, err
+}
+
+func (s *firestoreCounters) All(ctx context.Context) (map[string]int, error) {
+	vs := make(map[string]int)
+	it := s.collection.Documents(ctx)
+	defer it.Stop()
+	for {
+		d, err := it.Next()
+		if err == iterator.Done {
+			return vs, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("error listing counters: %s", err)
+		}
+		c := counterDoc{}
+		if err := d.DataTo(&c); err != nil {
+			return nil, fmt.Errorf("error parsing counter %s: %s", d.Ref.ID, err)
+		}
+		vs[d.Ref.ID] = c.Value
+	}
+}
+
+// Check reads a document that need not exist.
+func (s *firestoreCounters) Check(ctx context.Context) error {
+	_, err := s.collection.Doc("readyz").Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("could not read counters: %s", err)
+	}
+	return nil
+}
+
+// counterCache is a write-through cache in front of a CounterStore. Every
+// change goes to the store first; the cache serves reads of the last known
+// values and reports them in the counterValues gauge. Counters changed by
+// the admin are invalidated, so that the next read goes to the store.
+type counterCache struct {
+	store     CounterStore
+	sequences *sequences
+
+	mux    sync.Mutex
+	values map[string]int
+	// Whether values holds every counter of the store.
+	loaded bool
+}
+
+// newCounterCache creates a cache, loaded with the store's current values.
+func newCounterCache(ctx context.Context, s CounterStore, seqs *sequences) (*counterCache, error) {
+	c := &counterCache{store: s, sequences: seqs, values: make(map[string]int)}
+	if _, err := c.Values(ctx); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Next increments the counter for key and returns its new value.
+func (c *counterCache) Next(ctx context.Context, key string) (int, error) {
+	return c.NextBlock(ctx, key, 1)
+}
+
+// NextBlock advances the counter for key by count and returns the first
+// of the numbers passed.
+func (c *counterCache) NextBlock(ctx context.Context, key string, count int) (int, error) {
+	v, err := c.store.Add(ctx, key, count)
+	if err != nil {
+		return 0, err
+	}
+	c.update(key, v)
+	return v - count + 1, nil
+}
+
+// Values returns the last known value of every counter. They are read
+// from the store when the cache is not loaded, or was invalidated since.
+func (c *counterCache) Values(ctx context.Context) (map[string]int, error) {
+	c.mux.Lock()
+	loaded := c.loaded
+	c.mux.Unlock()
+	if !loaded {
+		vs, err := c.store.All(ctx)
+		if err != nil {
+			return nil, err
+		}
+		c.mux.Lock()
+		for k, v := range vs {
+			c.updateLocked(k, v)
+		}
+		c.loaded = true
+		c.mux.Unlock()
+	}
+
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	vs := make(map[string]int, len(c.values))
+	for k, v := range c.values {
+		vs[k] = v
+	}
+	return vs, nil
+}
+
+// Raise sets the counter for key to at least v, so that the next number is
+// higher, and returns the counter's value.
+func (c *counterCache) Raise(ctx context.Context, key string, v int) (int, error) {
+	v, err := c.store.Raise(ctx, key, v)
+	if err != nil {
+		return 0, err
+	}
+	c.invalidate(key, v)
+	return v, nil
+}
+
+// Reset sets the counter for key back to zero.
+func (c *counterCache) Reset(ctx context.Context, key string) error {
+	if err := c.store.Reset(ctx, key); err != nil {
+		return err
+	}
+	c.invalidate(key, 0)
+	return nil
+}
+
+// update records a value from the store. Other instances may have moved
+// the counter further along, so the cache never goes back.
+func (c *counterCache) update(key string, v int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	c.updateLocked(key, v)
+}
+
+func (c *counterCache) updateLocked(key string, v int) {
+	if cur, ok := c.values[key]; !ok || v > cur {
+		c.values[key] = v
+		c.report(key, v)
+	}
+}
+
+// invalidate drops the cached value of a counter changed by the admin, which
+// may have gone back, and reports the value it was set to.
+func (c *counterCache) invalidate(key string, v int) {
+	c.mux.Lock()
+	defer c.mux.Unlock()
+	delete(c.values, key)
+	c.loaded = false
+	c.report(key, v)
+}
+
+// report sets the gauge of a counter. Counters are labelled by sequence
+// rather than by key and period, and counters of undefined sequences
+// share a series.
+func (c *counterCache) report(key string, v int) {
+	counterValues.Set(float64(v), c.sequences.label(counterSequence(key)))
+}
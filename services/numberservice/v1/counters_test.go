@@ -0,0 +1,215 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"lkcommon/model"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCounterStores(t *testing.T) {
+	stores := []struct {
+		name string
+		open func(t *testing.T) CounterStore
+	}{
+		{"memory", func(*testing.T) CounterStore { return newMemoryCounters() }},
+		{"file", func(t *testing.T) CounterStore {
+			s, err := newFileCounters(filepath.Join(t.TempDir(), "counters.log"))
+			if err != nil {
+				t.Fatalf("could not open counters: %s", err)
+			}
+			return s
+		}},
+	}
+	for _, st := range stores {
+		t.Run(st.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := st.open(t)
+
+			if v, _ := s.Add(ctx, "a", 1); v != 1 {
+				t.Errorf("expected 1, got %v", v)
+			}
+			if v, _ := s.Add(ctx, "a", 10); v != 11 {
+				t.Errorf("expected 11, got %v", v)
+			}
+			if v, _ := s.Raise(ctx, "a", 5); v != 11 {
+				t.Errorf("expected raise below value to keep 11, got %v", v)
+			}
+			if v, _ := s.Raise(ctx, "b", 5); v != 5 {
+				t.Errorf("expected 5, got %v", v)
+			}
+			if err := s.Reset(ctx, "b"); err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			vs, err := s.All(ctx)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			// A reset counter may be dropped or kept at zero.
+			if vs["a"] != 11 || vs["b"] != 0 {
+				t.Errorf("expected a at 11 and b at 0, got %v", vs)
+			}
+		})
+	}
+}
+
+func TestFileCountersRecovery(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "counters.log")
+	s, err := newFileCounters(path)
+	if err != nil {
+		t.Fatalf("could not open counters: %s", err)
+	}
+	_, _ = s.Add(ctx, "order", 3)
+	_, _ = s.Add(ctx, "invoice:2026", 1)
+	_, _ = s.Add(ctx, "order", 1)
+	good, _ := ioutil.ReadFile(path)
+
+	// A crash while writing leaves part of a record.
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	_, _ = f.WriteString(`{"key":"order","val`)
+	_ = f.Close()
+
+	s, err = newFileCounters(path)
+	if err != nil {
+		t.Fatalf("could not reopen counters: %s", err)
+	}
+	vs, _ := s.All(ctx)
+	if expected := map[string]int{"order": 4, "invoice:2026": 1}; !reflect.DeepEqual(vs, expected) {
+		t.Errorf("expected %v, got %v", expected, vs)
+	}
+	bs, _ := ioutil.ReadFile(path)
+	if string(bs) != string(good) {
+		t.Errorf("expected torn record cut off, got %q", bs)
+	}
+
+	// Appending after recovery continues the log.
+	if v, _ := s.Add(ctx, "order", 1); v != 5 {
+		t.Errorf("expected 5, got %v", v)
+	}
+	s, err = newFileCounters(path)
+	if err != nil {
+		t.Fatalf("could not reopen counters: %s", err)
+	}
+	if vs, _ := s.All(ctx); vs["order"] != 5 {
+		t.Errorf("expected 5 after reopening, got %v", vs["order"])
+	}
+}
+
+func TestFileCountersCorrupt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "counters.log")
+	log := `{"key":"order","value":1}` + "\n" + `garbage` + "\n" + `{"key":"order","value":2}` + "\n"
+	if err := ioutil.WriteFile(path, []byte(log), 0644); err != nil {
+		t.Fatal(err)
+	}
+	_, err := newFileCounters(path)
+	if err == nil || !strings.Contains(err.Error(), "record 2") {
+		t.Errorf("expected error on record 2, got %v", err)
+	}
+	// The log is left as it was.
+	if bs, _ := ioutil.ReadFile(path); string(bs) != log {
+		t.Errorf("expected log untouched, got %q", bs)
+	}
+}
+
+func TestFileCountersCompact(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "counters.log")
+	s, err := newFileCounters(path)
+	if err != nil {
+		t.Fatalf("could not open counters: %s", err)
+	}
+	for i := 0; i < walCompactAfter; i += 1 {
+		key := "a"
+		if i%2 == 1 {
+			key = "b"
+		}
+		if _, err := s.Add(ctx, key, 1); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	if s.records != 2 {
+		t.Errorf("expected 2 records after compacting, got %v", s.records)
+	}
+	_, _ = s.Add(ctx, "a", 1)
+
+	s, err = newFileCounters(path)
+	if err != nil {
+		t.Fatalf("could not reopen counters: %s", err)
+	}
+	vs, _ := s.All(ctx)
+	if expected := map[string]int{"a": walCompactAfter/2 + 1, "b": walCompactAfter / 2}; !reflect.DeepEqual(vs, expected) {
+		t.Errorf("expected %v, got %v", expected, vs)
+	}
+	if s.records != 3 {
+		t.Errorf("expected 3 records, got %v", s.records)
+	}
+}
+
+func TestCounterCache(t *testing.T) {
+	ctx := context.Background()
+	s := newMemoryCounters()
+	c, err := newCounterCache(ctx, s, newTestSequences(model.Sequence{Key: "metered", Reset: model.ResetYearly}))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if n, _ := c.Next(ctx, "metered:2026"); n != 1 {
+		t.Errorf("expected 1, got %v", n)
+	}
+	if n, _ := c.NextBlock(ctx, "metered:2026", 10); n != 2 {
+		t.Errorf("expected block to start at 2, got %v", n)
+	}
+	if n, _ := c.Next(ctx, "metered:2026"); n != 12 {
+		t.Errorf("expected 12, got %v", n)
+	}
+	if g := scrape(`number_counter_value{key="metered"}`); g != "12" {
+		t.Errorf("expected gauge at 12, got %q", g)
+	}
+	if err := c.Reset(ctx, "metered:2026"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g := scrape(`number_counter_value{key="metered"}`); g != "0" {
+		t.Errorf("expected gauge at 0 after reset, got %q", g)
+	}
+	if n, _ := c.Next(ctx, "metered:2026"); n != 1 {
+		t.Errorf("expected 1 after reset, got %v", n)
+	}
+
+	if _, err := c.Raise(ctx, "undefined", 7); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if g := scrape(`number_counter_value{key="other"}`); g != "7" {
+		t.Errorf("expected gauge of undefined sequences at 7, got %q", g)
+	}
+	if g := scrape(`number_counter_value{key="undefined"}`); g != "" {
+		t.Errorf("expected no series for undefined sequence, got %q", g)
+	}
+
+	// Changes by other instances show once the counter is written through
+	// this one, or the cache is invalidated by an admin write.
+	if _, err := c.Values(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if _, err := s.Add(ctx, "metered:2026", 5); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if vs, _ := c.Values(ctx); vs["metered:2026"] != 1 {
+		t.Errorf("expected cached value 1, got %v", vs["metered:2026"])
+	}
+	if _, err := c.Raise(ctx, "undefined", 3); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if vs, _ := c.Values(ctx); vs["metered:2026"] != 6 || vs["undefined"] != 7 {
+		t.Errorf("expected values read from the store, got %v", vs)
+	}
+	if n, _ := c.Next(ctx, "metered:2026"); n != 7 {
+		t.Errorf("expected 7, got %v", n)
+	}
+	if vs, _ := c.Values(ctx); vs["metered:2026"] != 7 {
+		t.Errorf("expected written value 7, got %v", vs["metered:2026"])
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"lkcommon/model"
+	"time"
+)
+
+// Crockford's base32 alphabet, which leaves out I, L, O and U.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// Number of random characters in identifiers of the random generator.
+const randomLength = 16
+
+// generateId creates an identifier for a sequence with a generator.
+func generateId(seq model.Sequence, now time.Time) (string, error) {
+	var id string
+	switch seq.Generator {
+	case model.GeneratorUlid:
+		id = ulid(now)
+	case model.GeneratorUuidV7:
+		id = uuidV7(now)
+	case model.GeneratorRandom:
+		id = randomWithCheck()
+	default:
+		return "", fmt.Errorf("unknown generator %q", seq.Generator)
+	}
+	return seq.Prefix + id, nil
+}
+
+// ulid creates a ULID: a 48-bit millisecond timestamp and 80 random bits in
+// 26 characters of base32, so that identifiers sort by creation time.
+func ulid(now time.Time) string {
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs, uint64(now.UnixNano()/int64(time.Millisecond))<<16)
+	_, _ = rand.Read(bs[6:])
+
+	// 128 bits in 26 characters of 5 bits; the first holds the top 3 bits.
+	hi := binary.BigEndian.Uint64(bs[:8])
+	lo := binary.BigEndian.Uint64(bs[8:])
+	cs := make([]byte, 26)
+	for i := 25; i >= 0; i -= 1 {
+		cs[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(cs)
+}
+
+// uuidV7 creates a version 7 UUID (RFC 9562): a 48-bit millisecond
+// timestamp followed by random bits.
+func uuidV7(now time.Time) string {
+	bs := make([]byte, 16)
+	binary.BigEndian.PutUint64(bs, uint64(now.UnixNano()/int64(time.Millisecond))<<16)
+	_, _ = rand.Read(bs[6:])
+	bs[6] = bs[6]&0x0f | 0x70
+	bs[8] = bs[8]&0x3f | 0x80
+	h := hex.EncodeToString(bs)
+	return h[:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:]
+}
+
+// randomWithCheck creates 80 random bits in base32, followed by a Luhn mod
+// 32 check character that catches typing errors.
+func randomWithCheck() string {
+	bs := make([]byte, randomLength)
+	_, _ = rand.Read(bs)
+	cs := make([]byte, randomLength)
+	for i, b := range bs {
+		cs[i] = crockford[b&31]
+	}
+	return string(cs) + string(luhn32(cs))
+}
+
+// luhn32 computes the Luhn mod N check character over base32 characters.
+func luhn32(cs []byte) byte {
+	sum := 0
+	factor := 2
+	for i := len(cs) - 1; i >= 0; i -= 1 {
+		v := factor * indexOf(cs[i])
+		sum += v/32 + v%32
+		factor = 3 - factor
+	}
+	return crockford[(32-sum%32)%32]
+}
+
+func indexOf(c byte) int {
+	for i := 0; i < len(crockford); i += 1 {
+		if crockford[i] == c {
+			return i
+		}
+	}
+	return 0
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"lkcommon/model"
+	"math/big"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	ulidPattern   = regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{26}$`)
+	uuidV7Pattern = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	randomPattern = regexp.MustCompile(`^[0-9A-HJKMNP-TV-Z]{17}$`)
+)
+
+func TestGenerateId(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	tests := []struct {
+		generator string
+		pattern   *regexp.Regexp
+	}{
+		{model.GeneratorUlid, ulidPattern},
+		{model.GeneratorUuidV7, uuidV7Pattern},
+		{model.GeneratorRandom, randomPattern},
+	}
+	for _, tt := range tests {
+		t.Run(tt.generator, func(t *testing.T) {
+			id, err := generateId(model.Sequence{Key: "k", Generator: tt.generator, Prefix: "P-"}, now)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !strings.HasPrefix(id, "P-") {
+				t.Fatalf("expected prefix P-, got %s", id)
+			}
+			if !tt.pattern.MatchString(strings.TrimPrefix(id, "P-")) {
+				t.Errorf("unexpected identifier %s", id)
+			}
+		})
+	}
+
+	if _, err := generateId(model.Sequence{Key: "k", Generator: "nope"}, now); err == nil {
+		t.Error("expected error for unknown generator")
+	}
+}
+
+func TestUlid(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	id := ulid(now)
+
+	// The first 10 characters hold the timestamp in milliseconds.
+	ms := new(big.Int)
+	for i := 0; i < 10; i += 1 {
+		ms.Lsh(ms, 5)
+		ms.Or(ms, big.NewInt(int64(indexOf(id[i]))))
+	}
+	if expected := now.UnixNano() / int64(time.Millisecond); ms.Int64() != expected {
+		t.Errorf("expected timestamp %v, got %v", expected, ms.Int64())
+	}
+
+	later := ulid(now.Add(time.Millisecond))
+	if later <= id {
+		t.Errorf("expected %s to sort after %s", later, id)
+	}
+	if ulid(now) == id {
+		t.Error("expected random part to differ")
+	}
+}
+
+func TestUuidV7(t *testing.T) {
+	now := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	id := uuidV7(now)
+	if !uuidV7Pattern.MatchString(id) {
+		t.Fatalf("unexpected uuid %s", id)
+	}
+	ms, _ := new(big.Int).SetString(strings.Replace(id[:13], "-", "", -1), 16)
+	if expected := now.UnixNano() / int64(time.Millisecond); ms.Int64() != expected {
+		t.Errorf("expected timestamp %v, got %v", expected, ms.Int64())
+	}
+}
+
+// validLuhn32 checks a string ending in a Luhn mod 32 check character.
+func validLuhn32(s string) bool {
+	cs := []byte(s)
+	return luhn32(cs[:len(cs)-1]) == cs[len(cs)-1]
+}
+
+func TestLuhn32(t *testing.T) {
+	tests := []struct {
+		in       string
+		expected byte
+	}{
+		{"0", '0'},
+		{"1", 'Y'},
+		{"0000000000000001", 'Y'},
+		{"00000000000000G0", 'G'},
+	}
+	for _, tt := range tests {
+		if c := luhn32([]byte(tt.in)); c != tt.expected {
+			t.Errorf("%s: expected %c, got %c", tt.in, tt.expected, c)
+		}
+	}
+
+	for i := 0; i < 100; i += 1 {
+		id := randomWithCheck()
+		if !validLuhn32(id) {
+			t.Fatalf("invalid check character in %s", id)
+		}
+		// Any single mistyped character is caught.
+		for j := 0; j < len(id)-1; j += 1 {
+			cs := []byte(id)
+			cs[j] = crockford[(indexOf(cs[j])+1)%32]
+			if validLuhn32(string(cs)) {
+				t.Fatalf("mistyped %s not caught in %s", cs, id)
+			}
+		}
+	}
+}
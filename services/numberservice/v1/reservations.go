@@ -0,0 +1,523 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"lkcommon/apierror"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/numberclient"
+	"lkcommon/store"
+	"sync"
+	"time"
+)
+
+const (
+	reserved  = "reserved"
+	committed = "committed"
+	released  = "released"
+	// Reservations of a counter that was reset.
+	discarded = "discarded"
+)
+
+var reservationsTotal = metrics.NewCounter("number_reservations_total",
+	"Reservations by key and outcome: reserved, committed, cancelled or expired.", "key", "result")
+
+// Interval between scans for expired reservations.
+const reclaimInterval = 5 * time.Second
+
+// A reservation record is stored per number, so handing out a released
+// number again replaces its record. Committed records remain as the trail
+// of numbers handed out.
+type reservation struct {
+	numberclient.Reservation
+	// Counter the number was taken from; the key and period.
+	Counter string `json:"counter"`
+	State   string `json:"state"`
+}
+
+// open reports whether the reservation can still be committed or
+// cancelled, or its number handed out again.
+func (res *reservation) open() bool {
+	return res.State == reserved || res.State == released
+}
+
+// free reports whether the number can be handed out again: it was released,
+// or its reservation expired before now.
+func (res *reservation) free(now time.Time) bool {
+	return res.State == released || (res.State == reserved && now.After(res.Expires))
+}
+
+// A reservationStore keeps the reservations together with the counters
+// their numbers are taken from, so that taking a number and recording its
+// reservation succeed or fail together.
+type reservationStore interface {
+	// Reserve takes the lowest free number of the counter, or else the next
+	// number from the counter, and stores the reservation that create makes
+	// of it.
+	Reserve(ctx context.Context, counter string, now time.Time, create func(n int) reservation) (reservation, error)
+	// Finish moves the open reservation of key holding the token to state.
+	Finish(ctx context.Context, key, token, state string, now time.Time) error
+	// Discard drops the open reservations of a counter.
+	Discard(ctx context.Context, counter string) error
+	// Expire releases the reservations that expired before now, and
+	// returns them.
+	Expire(ctx context.Context, now time.Time) ([]reservation, error)
+	Check(ctx context.Context) error
+}
+
+// reservations implements gapless numbering: a number is reserved, then
+// committed or cancelled. Numbers of cancelled and expired reservations go
+// back to a pool and are handed out again, lowest first, before the counter
+// moves on. With counters in Firestore, the pool is kept there too, so that
+// any number of instances can share it.
+type reservations struct {
+	sequences *sequences
+	store     reservationStore
+	timeout   time.Duration
+}
+
+// openReservations keeps the reservations next to the counters: in
+// Firestore, or else in the configured backend, with the pool in memory.
+func openReservations(ctx context.Context, cfg *config.Config, counters *counterCache, seqs *sequences) (*reservations, error) {
+	s := &reservations{sequences: seqs, timeout: cfg.NumberReserveTimeout}
+	if fc, ok := counters.store.(*firestoreCounters); ok {
+		s.store = newFirestoreReservations(fc, counters, gcp.BaseCollection+"/reservations")
+		return s, nil
+	}
+
+	b, err := store.OpenBackend(ctx, store.ConfigFrom(cfg), "reservations", "reservation-", store.BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	s.store, err = newLocalReservations(ctx, counters, b)
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Reserve hands out the lowest released number of the current period, or
+// else the next number from the counter.
+func (s *reservations) Reserve(ctx context.Context, key string) (numberclient.Reservation, error) {
+	now := time.Now()
+	seq := s.sequences.Get(key)
+	p := period(seq, now)
+	counter := counterKey(key, p)
+
+	res, err := s.store.Reserve(ctx, counter, now, func(n int) reservation {
+		res := reservation{Counter: counter, State: reserved}
+		res.Key = key
+		res.Number = n
+		res.Id = formatId(seq, p, n)
+		res.Token = newToken()
+		res.Expires = now.Add(s.timeout)
+		return res
+	})
+	if err != nil {
+		return numberclient.Reservation{}, err
+	}
+	reservationsTotal.Inc(key, "reserved")
+	return res.Reservation, nil
+}
+
+// recordKey identifies the number. Keys and periods cannot contain '.'.
+func (res *reservation) recordKey() string {
+	return fmt.Sprintf("%s.%v", res.Counter, res.Number)
+}
+
+// Commit makes a reservation final. Expired reservations can no longer be
+// committed, as their number may have been handed out again.
+func (s *reservations) Commit(ctx context.Context, key, token string) error {
+	return s.finish(ctx, key, token, committed, "committed")
+}
+
+// Cancel releases a reservation. Cancelling it again has no effect, until
+// its number is handed out again.
+func (s *reservations) Cancel(ctx context.Context, key, token string) error {
+	return s.finish(ctx, key, token, released, "cancelled")
+}
+
+func (s *reservations) finish(ctx context.Context, key, token, state, result string) error {
+	err := s.store.Finish(ctx, key, token, state, time.Now())
+	if err == errUnchanged {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	reservationsTotal.Inc(key, result)
+	return nil
+}
+
+// errUnchanged reports that a reservation was in the requested state
+// already.
+var errUnchanged = errors.New("unchanged")
+
+// checkFinish verifies that res, the record holding the token, can be moved
+// to state. It returns errUnchanged when res is in that state already.
+func checkFinish(res *reservation, key, token, state string, now time.Time) error {
+	if res == nil || res.Key != key || !res.open() {
+		return apierror.Newf(apierror.NotFound, "no open reservation %s in range %s", token, key)
+	}
+	if res.State == state {
+		return errUnchanged
+	}
+	if res.State == released || now.After(res.Expires) {
+		return apierror.Newf(apierror.Conflict, "reservation %s has expired", token)
+	}
+	return nil
+}
+
+// lowestFree returns the free reservation with the lowest number, if any.
+func lowestFree(rs []*reservation, now time.Time) *reservation {
+	var low *reservation
+	for _, res := range rs {
+		if res.free(now) && (low == nil || res.Number < low.Number) {
+			low = res
+		}
+	}
+	return low
+}
+
+// countTaken records that the number of an expired reservation was handed
+// out again before it was reclaimed.
+func countTaken(taken *reservation) {
+	if taken != nil && taken.State == reserved {
+		reservationsTotal.Inc(taken.Key, "expired")
+	}
+}
+
+// Discard drops the open reservations of a counter, for instance because
+// the counter is reset. Their numbers can no longer be committed.
+func (s *reservations) Discard(ctx context.Context, counter string) error {
+	return s.store.Discard(ctx, counter)
+}
+
+// Reclaim releases expired reservations until the context is done.
+func (s *reservations) Reclaim(ctx context.Context) {
+	t := time.NewTicker(reclaimInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-t.C:
+			s.expire(ctx, now)
+		}
+	}
+}
+
+// expire releases the reservations that expired before now.
+func (s *reservations) expire(ctx context.Context, now time.Time) {
+	rs, err := s.store.Expire(ctx, now)
+	if err != nil {
+		logctx.Warn(ctx, fmt.Sprintf("could not release expired reservations: %s", err))
+	}
+	for _, res := range rs {
+		reservationsTotal.Inc(res.Key, "expired")
+		logctx.Info(ctx, fmt.Sprintf("reclaimed %s from an expired reservation", res.Id))
+	}
+}
+
+func (s *reservations) Check(ctx context.Context) error {
+	return s.store.Check(ctx)
+}
+
+func newToken() string {
+	bs := make([]byte, 16)
+	_, _ = rand.Read(bs)
+	return hex.EncodeToString(bs)
+}
+
+// localReservations keeps the pool of open reservations in memory and
+// stores every change in a backend. Only one instance may use the counters
+// and the backend.
+type localReservations struct {
+	counters *counterCache
+	store    store.Backend
+
+	mux sync.Mutex
+	// Records not yet committed, by record key.
+	open map[string]*reservation
+}
+
+// newLocalReservations loads the open reservations from the backend.
+func newLocalReservations(ctx context.Context, counters *counterCache, b store.Backend) (*localReservations, error) {
+	s := &localReservations{counters: counters, store: b, open: make(map[string]*reservation)}
+	keys, err := b.Keys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("could not list reservations: %s", err)
+	}
+	for _, k := range keys {
+		res := &reservation{}
+		if err := b.Get(ctx, k, res); err != nil {
+			return nil, fmt.Errorf("could not read reservation %s: %s", k, err)
+		}
+		if res.open() {
+			s.open[k] = res
+		}
+	}
+	return s, nil
+}
+
+func (s *localReservations) Reserve(ctx context.Context, counter string, now time.Time, create func(n int) reservation) (reservation, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var rs []*reservation
+	for _, res := range s.open {
+		if res.Counter == counter {
+			rs = append(rs, res)
+		}
+	}
+	taken := lowestFree(rs, now)
+	var n int
+	if taken != nil {
+		n = taken.Number
+	} else {
+		var err error
+		if n, err = s.counters.Next(ctx, counter); err != nil {
+			return reservation{}, err
+		}
+	}
+
+	res := create(n)
+	if err := s.store.Put(ctx, res.recordKey(), res); err != nil {
+		return reservation{}, err
+	}
+	s.open[res.recordKey()] = &res
+	countTaken(taken)
+	return res, nil
+}
+
+func (s *localReservations) Finish(ctx context.Context, key, token, state string, now time.Time) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var res *reservation
+	for _, r := range s.open {
+		if r.Token == token && r.Key == key {
+			res = r
+		}
+	}
+	if err := checkFinish(res, key, token, state, now); err != nil {
+		return err
+	}
+
+	next := *res
+	next.State = state
+	if err := s.store.Put(ctx, next.recordKey(), next); err != nil {
+		return err
+	}
+	if next.open() {
+		s.open[next.recordKey()] = &next
+	} else {
+		delete(s.open, next.recordKey())
+	}
+	return nil
+}
+
+func (s *localReservations) Discard(ctx context.Context, counter string) error {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	for k, res := range s.open {
+		if res.Counter != counter {
+			continue
+		}
+		next := *res
+		next.State = discarded
+		if err := s.store.Put(ctx, k, next); err != nil {
+			return err
+		}
+		delete(s.open, k)
+	}
+	return nil
+}
+
+func (s *localReservations) Expire(ctx context.Context, now time.Time) ([]reservation, error) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	var rs []reservation
+	for k, res := range s.open {
+		if res.State != reserved || !now.After(res.Expires) {
+			continue
+		}
+		next := *res
+		next.State = released
+		if err := s.store.Put(ctx, k, next); err != nil {
+			return rs, fmt.Errorf("could not release %s: %s", res.Id, err)
+		}
+		s.open[k] = &next
+		rs = append(rs, *res)
+	}
+	return rs, nil
+}
+
+func (s *localReservations) Check(ctx context.Context) error {
+	return s.store.Check(ctx)
+}
+
+// firestoreReservations keeps a document per number next to the counters,
+// and takes numbers in transactions that read the open reservations and the
+// counter, so that concurrent instances never hand out the same number.
+// Documents hold the fields under their Go names; selecting the open
+// reservations of a counter needs a composite index.
+type firestoreReservations struct {
+	client     *firestore.Client
+	counters   *firestore.CollectionRef
+	collection *firestore.CollectionRef
+	// Caches the counters advanced by reservations.
+	cache *counterCache
+}
+
+func newFirestoreReservations(counters *firestoreCounters, cache *counterCache, collection string) *firestoreReservations {
+	return &firestoreReservations{
+		client:     counters.client,
+		counters:   counters.collection,
+		cache:      cache,
+		collection: counters.client.Collection(collection),
+	}
+}
+
+// openQuery selects the open reservations.
+func (s *firestoreReservations) openQuery() firestore.Query {
+	return s.collection.Where("State", "in", []string{reserved, released})
+}
+
+func (s *firestoreReservations) Reserve(ctx context.Context, counter string, now time.Time, create func(n int) reservation) (reservation, error) {
+	var res reservation
+	var taken *reservation
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		rs, err := readReservations(tx.Documents(s.openQuery().Where("Counter", "==", counter)))
+		if err != nil {
+			return err
+		}
+		taken = lowestFree(rs, now)
+		var n int
+		if taken != nil {
+			n = taken.Number
+		} else {
+			ref := s.counters.Doc(counter)
+			c := counterDoc{}
+			d, err := tx.Get(ref)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			} else if err == nil {
+				if err := d.DataTo(&c); err != nil {
+					return err
+				}
+			}
+			n = c.Value + 1
+			if err := tx.Set(ref, counterDoc{Value: n}); err != nil {
+				return err
+			}
+		}
+		res = create(n)
+		return tx.Set(s.collection.Doc(res.recordKey()), res)
+	})
+	if err != nil {
+		return reservation{}, fmt.Errorf("error reserving %s number: %s", counter, err)
+	}
+	if taken == nil {
+		s.cache.update(counter, res.Number)
+	}
+	countTaken(taken)
+	return res, nil
+}
+
+func (s *firestoreReservations) Finish(ctx context.Context, key, token, state string, now time.Time) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		rs, err := readReservations(tx.Documents(s.collection.Where("Token", "==", token).Limit(1)))
+		if err != nil {
+			return err
+		}
+		var res *reservation
+		if len(rs) > 0 {
+			res = rs[0]
+		}
+		if err := checkFinish(res, key, token, state, now); err != nil {
+			return err
+		}
+		next := *res
+		next.State = state
+		return tx.Set(s.collection.Doc(next.recordKey()), next)
+	})
+}
+
+func (s *firestoreReservations) Discard(ctx context.Context, counter string) error {
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		rs, err := readReservations(tx.Documents(s.openQuery().Where("Counter", "==", counter)))
+		if err != nil {
+			return err
+		}
+		for _, res := range rs {
+			next := *res
+			next.State = discarded
+			if err := tx.Set(s.collection.Doc(next.recordKey()), next); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *firestoreReservations) Expire(ctx context.Context, now time.Time) ([]reservation, error) {
+	var expired []reservation
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		rs, err := readReservations(tx.Documents(s.collection.Where("State", "==", reserved)))
+		if err != nil {
+			return err
+		}
+		expired = nil
+		for _, res := range rs {
+			if !now.After(res.Expires) {
+				continue
+			}
+			next := *res
+			next.State = released
+			if err := tx.Set(s.collection.Doc(next.recordKey()), next); err != nil {
+				return err
+			}
+			expired = append(expired, *res)
+		}
+		return nil
+	})
+	return expired, err
+}
+
+// Check reads a document that need not exist.
+func (s *firestoreReservations) Check(ctx context.Context) error {
+	_, err := s.collection.Doc("readyz").Get(ctx)
+	if err != nil && status.Code(err) != codes.NotFound {
+		return fmt.Errorf("could not read reservations: %s", err)
+	}
+	return nil
+}
+
+// readReservations reads the documents of a query.
+func readReservations(it *firestore.DocumentIterator) ([]*reservation, error) {
+	defer it.Stop()
+	var rs []*reservation
+	for {
+		d, err := it.Next()
+		if err == iterator.Done {
+			return rs, nil
+		} else if err != nil {
+			return nil, err
+		}
+		res := &reservation{}
+		if err := d.DataTo(res); err != nil {
+			return nil, fmt.Errorf("error parsing reservation %s: %s", d.Ref.ID, err)
+		}
+		rs = append(rs, res)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"cloud.google.com/go/firestore"
+	"context"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/model"
+	"lkcommon/store"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestSequences creates sequences with fixed definitions.
+func newTestSequences(seqs ...model.Sequence) *sequences {
+	s := &sequences{
+		fixed:  make(map[string]model.Sequence),
+		store:  store.NewMemoryBackend(),
+		cached: make(map[string]model.Sequence),
+	}
+	for _, seq := range seqs {
+		s.fixed[seq.Key] = seq
+	}
+	return s
+}
+
+// newTestReservations creates reservations kept in memory, and returns
+// them with their backend and counters.
+func newTestReservations(t *testing.T, timeout time.Duration, seqs ...model.Sequence) (*reservations, store.Backend, *counterCache) {
+	ctx := context.Background()
+	s := newTestSequences(seqs...)
+	counters, err := newCounterCache(ctx, newMemoryCounters(), s)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	b := store.NewMemoryBackend()
+	local, err := newLocalReservations(ctx, counters, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return &reservations{sequences: s, store: local, timeout: timeout}, b, counters
+}
+
+func expectCode(t *testing.T, err error, code apierror.Code) {
+	t.Helper()
+	e, ok := apierror.As(err)
+	if !ok || e.Code != code {
+		t.Errorf("expected code %v, got %v", code, err)
+	}
+}
+
+func TestReservations(t *testing.T) {
+	ctx := context.Background()
+	s, b, _ := newTestReservations(t, time.Minute, model.Sequence{Key: "invoice", Prefix: "INV-", Padding: 4})
+
+	r1, err := s.Reserve(ctx, "invoice")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if r1.Number != 1 || r1.Id != "INV-0001" {
+		t.Errorf("expected INV-0001, got %v %s", r1.Number, r1.Id)
+	}
+	r2, _ := s.Reserve(ctx, "invoice")
+	r3, _ := s.Reserve(ctx, "invoice")
+
+	if err := s.Commit(ctx, "invoice", r1.Token); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.Cancel(ctx, "invoice", r3.Token); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := s.Cancel(ctx, "invoice", r3.Token); err != nil {
+		t.Errorf("expected cancelling again to succeed, got %s", err)
+	}
+	if err := s.Cancel(ctx, "invoice", r2.Token); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	// Released numbers are handed out again, lowest first.
+	r4, _ := s.Reserve(ctx, "invoice")
+	r5, _ := s.Reserve(ctx, "invoice")
+	r6, _ := s.Reserve(ctx, "invoice")
+	if r4.Number != 2 || r5.Number != 3 || r6.Number != 4 {
+		t.Errorf("expected 2, 3 and 4, got %v, %v and %v", r4.Number, r5.Number, r6.Number)
+	}
+	if r4.Token == r2.Token {
+		t.Error("expected a new token for a number handed out again")
+	}
+
+	// The old token no longer holds the number.
+	expectCode(t, s.Commit(ctx, "invoice", r2.Token), apierror.NotFound)
+	// Committed reservations are no longer open.
+	expectCode(t, s.Cancel(ctx, "invoice", r1.Token), apierror.NotFound)
+	// Tokens belong to a range.
+	expectCode(t, s.Commit(ctx, "order", r4.Token), apierror.NotFound)
+	expectCode(t, s.Commit(ctx, "invoice", "unknown"), apierror.NotFound)
+
+	rec := reservation{}
+	if err := b.Get(ctx, "invoice.1", &rec); err != nil {
+		t.Fatalf("could not read record: %s", err)
+	}
+	if rec.State != committed {
+		t.Errorf("expected %s, got %s", committed, rec.State)
+	}
+}
+
+func TestReservationsExpire(t *testing.T) {
+	ctx := context.Background()
+	s, _, _ := newTestReservations(t, time.Minute)
+
+	r1, _ := s.Reserve(ctx, "order")
+	s.expire(ctx, time.Now().Add(2*time.Minute))
+
+	expectCode(t, s.Commit(ctx, "order", r1.Token), apierror.Conflict)
+	r2, _ := s.Reserve(ctx, "order")
+	if r2.Number != r1.Number {
+		t.Errorf("expected expired number %v again, got %v", r1.Number, r2.Number)
+	}
+
+	// A reservation that timed out cannot be committed, even before it is
+	// reclaimed, and its number is handed out again.
+	s, _, _ = newTestReservations(t, -time.Second)
+	r1, _ = s.Reserve(ctx, "order")
+	expectCode(t, s.Commit(ctx, "order", r1.Token), apierror.Conflict)
+	r2, _ = s.Reserve(ctx, "order")
+	if r2.Number != r1.Number {
+		t.Errorf("expected expired number %v again, got %v", r1.Number, r2.Number)
+	}
+	expectCode(t, s.Cancel(ctx, "order", r1.Token), apierror.NotFound)
+}
+
+func TestReservationsDiscard(t *testing.T) {
+	ctx := context.Background()
+	s, b, _ := newTestReservations(t, time.Minute)
+
+	r1, _ := s.Reserve(ctx, "order")
+	r2, _ := s.Reserve(ctx, "customer")
+	if err := s.Discard(ctx, "order"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectCode(t, s.Commit(ctx, "order", r1.Token), apierror.NotFound)
+	if err := s.Commit(ctx, "customer", r2.Token); err != nil {
+		t.Errorf("expected other counters to be kept, got %s", err)
+	}
+
+	rec := reservation{}
+	_ = b.Get(ctx, "order.1", &rec)
+	if rec.State != discarded {
+		t.Errorf("expected %s, got %s", discarded, rec.State)
+	}
+}
+
+func TestReservationsPeriod(t *testing.T) {
+	ctx := context.Background()
+	s, _, counters := newTestReservations(t, time.Minute, model.Sequence{Key: "invoice", Reset: model.ResetYearly})
+
+	res, _ := s.Reserve(ctx, "invoice")
+	year := time.Now().UTC().Format("2006")
+	if res.Id != year+"-1" {
+		t.Errorf("expected %s-1, got %s", year, res.Id)
+	}
+	if vs, _ := counters.Values(ctx); vs["invoice:"+year] != 1 {
+		t.Errorf("expected counter invoice:%s at 1, got %v", year, vs)
+	}
+}
+
+func TestLocalReservationsReopen(t *testing.T) {
+	ctx := context.Background()
+	s, b, counters := newTestReservations(t, time.Minute)
+	r1, _ := s.Reserve(ctx, "order")
+	r2, _ := s.Reserve(ctx, "order")
+	_ = s.Cancel(ctx, "order", r1.Token)
+
+	// A restarted instance continues with the stored reservations.
+	local, err := newLocalReservations(ctx, counters, b)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	s.store = local
+	if err := s.Commit(ctx, "order", r2.Token); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	if r3, _ := s.Reserve(ctx, "order"); r3.Number != r1.Number {
+		t.Errorf("expected released number %v again, got %v", r1.Number, r3.Number)
+	}
+}
+
+// TestFirestoreReservations runs against the Firestore emulator. Two stores
+// stand in for two instances sharing the pool.
+func TestFirestoreReservations(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set")
+	}
+	ctx := context.Background()
+	client, err := firestore.NewClient(ctx, "numberservice")
+	if err != nil {
+		t.Fatalf("could not create firestore client: %s", err)
+	}
+	defer client.Close()
+
+	base := fmt.Sprintf("numbertest/%d", time.Now().UnixNano())
+	counters := newFirestoreCounters(client, base+"/counters")
+	newInstance := func() *reservations {
+		seqs := newTestSequences()
+		cache := &counterCache{store: counters, sequences: seqs, values: make(map[string]int)}
+		return &reservations{sequences: seqs, store: newFirestoreReservations(counters, cache, base+"/reservations"), timeout: time.Minute}
+	}
+	a, b := newInstance(), newInstance()
+
+	var mux sync.Mutex
+	numbers := map[int]string{}
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i += 1 {
+		wg.Add(1)
+		go func(s *reservations) {
+			defer wg.Done()
+			res, err := s.Reserve(ctx, "order")
+			if err != nil {
+				t.Errorf("unexpected error: %s", err)
+				return
+			}
+			mux.Lock()
+			defer mux.Unlock()
+			if _, ok := numbers[res.Number]; ok {
+				t.Errorf("number %v handed out twice", res.Number)
+			}
+			numbers[res.Number] = res.Token
+		}([]*reservations{a, b}[i%2])
+	}
+	wg.Wait()
+
+	// A number cancelled through one instance is handed out by the other.
+	if err := a.Cancel(ctx, "order", numbers[3]); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if res, _ := b.Reserve(ctx, "order"); res.Number != 3 {
+		t.Errorf("expected 3 again, got %v", res.Number)
+	}
+	if err := b.Commit(ctx, "order", numbers[4]); err != nil {
+		t.Errorf("unexpected error: %s", err)
+	}
+	expectCode(t, a.Commit(ctx, "order", numbers[3]), apierror.NotFound)
+
+	if err := a.Discard(ctx, "order"); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	expectCode(t, b.Commit(ctx, "order", numbers[5]), apierror.NotFound)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/config"
+	"lkcommon/logctx"
+	"lkcommon/model"
+	"lkcommon/store"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Interval between reloads of the stored sequence definitions.
+const refreshInterval = 10 * time.Second
+
+// sequences holds the sequence definitions. Definitions from the
+// configuration are fixed; others are defined through the API and stored.
+// Stored definitions are cached and reloaded by Refresh, so a change made
+// through another instance shows up here within refreshInterval.
+type sequences struct {
+	fixed map[string]model.Sequence
+	store store.Backend
+
+	mux    sync.RWMutex
+	cached map[string]model.Sequence
+}
+
+func openSequences(ctx context.Context, cfg *config.Config) (*sequences, error) {
+	b, err := store.OpenBackend(ctx, store.ConfigFrom(cfg), "sequences", "sequence-", store.BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	s := &sequences{
+		fixed:  make(map[string]model.Sequence),
+		store:  b,
+		cached: make(map[string]model.Sequence),
+	}
+	for _, seq := range cfg.Sequences {
+		s.fixed[seq.Key] = seq
+	}
+	if err := s.load(ctx); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// load replaces the cached definitions with the stored ones.
+func (s *sequences) load(ctx context.Context) error {
+	keys, err := s.store.Keys(ctx)
+	if err != nil {
+		return fmt.Errorf("could not list sequences: %s", err)
+	}
+	cached := make(map[string]model.Sequence)
+	for _, k := range keys {
+		seq := model.Sequence{}
+		if err := s.store.Get(ctx, k, &seq); err != nil {
+			return fmt.Errorf("could not read sequence %s: %s", k, err)
+		}
+		cached[k] = seq
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.cached = cached
+	return nil
+}
+
+// Refresh reloads the stored definitions until the context is done. When
+// reloading fails, the cached definitions are kept.
+func (s *sequences) Refresh(ctx context.Context) {
+	t := time.NewTicker(refreshInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := s.load(ctx); err != nil {
+				logctx.Warn(ctx, fmt.Sprintf("could not reload sequences: %s", err))
+			}
+		}
+	}
+}
+
+// Get returns the definition for key. Keys without a definition number
+// plainly, without prefix or padding.
+func (s *sequences) Get(key string) model.Sequence {
+	if seq, ok := s.fixed[key]; ok {
+		return seq
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	if seq, ok := s.cached[key]; ok {
+		return seq
+	}
+	return model.Sequence{Key: key}
+}
+
+// Defined reports whether key has a definition.
+func (s *sequences) Defined(key string) bool {
+	if _, ok := s.fixed[key]; ok {
+		return true
+	}
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	_, ok := s.cached[key]
+	return ok
+}
+
+// label returns key as metric label if it has a definition, or else
+// "other". Any key can be used, so only defined sequences get their own
+// series.
+func (s *sequences) label(key string) string {
+	if !s.Defined(key) {
+		return "other"
+	}
+	return key
+}
+
+// List returns all definitions, ordered by key.
+func (s *sequences) List() []model.Sequence {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	var seqs []model.Sequence
+	for _, seq := range s.fixed {
+		seqs = append(seqs, seq)
+	}
+	for k, seq := range s.cached {
+		if _, ok := s.fixed[k]; !ok {
+			seqs = append(seqs, seq)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i].Key < seqs[j].Key })
+	return seqs
+}
+
+// Put stores a definition. Definitions from the configuration cannot be
+// changed.
+func (s *sequences) Put(ctx context.Context, seq model.Sequence) error {
+	if _, ok := s.fixed[seq.Key]; ok {
+		return apierror.Newf(apierror.FailedPrecondition, "sequence %s is defined in the configuration", seq.Key)
+	}
+	if err := s.store.Put(ctx, seq.Key, seq); err != nil {
+		return err
+	}
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	s.cached[seq.Key] = seq
+	return nil
+}
+
+func (s *sequences) Check(ctx context.Context) error {
+	return s.store.Check(ctx)
+}
+
+// period returns the numbering period of the sequence at t, in UTC: the
+// year or month for sequences that reset, otherwise the empty string.
+func period(seq model.Sequence, t time.Time) string {
+	switch seq.Reset {
+	case model.ResetYearly:
+		return t.UTC().Format("2006")
+	case model.ResetMonthly:
+		return t.UTC().Format("2006-01")
+	}
+	return ""
+}
+
+// counterKey returns the key of the counter behind a period of a sequence.
+// Sequence keys cannot contain ':'.
+func counterKey(key, period string) string {
+	if period == "" {
+		return key
+	}
+	return key + ":" + period
+}
+
+// counterSequence returns the key of the sequence a counter belongs to.
+func counterSequence(counter string) string {
+	return strings.SplitN(counter, ":", 2)[0]
+}
+
+// formatId presents number n from a period of the sequence, for instance
+// INV-2026-000123, or INV-2026-000123-59 with mod 97 check digits.
+func formatId(seq model.Sequence, period string, n int) string {
+	num := strconv.Itoa(n)
+	if len(num) < seq.Padding {
+		num = strings.Repeat("0", seq.Padding-len(num)) + num
+	}
+	id := num
+	if period != "" {
+		id = period + "-" + num
+	}
+	if seq.CheckDigit == model.CheckDigitMod97 {
+		id += fmt.Sprintf("-%02d", mod97(strings.Replace(id, "-", "", -1)))
+	}
+	return seq.Prefix + id
+}
+
+// mod97 computes ISO 7064 MOD 97-10 check digits for a string of digits:
+// appending them makes the number divisible by 97 with remainder 1.
+func mod97(digits string) int {
+	n, _ := new(big.Int).SetString(digits+"00", 10)
+	r := new(big.Int).Mod(n, big.NewInt(97)).Int64()
+	return int(98 - r)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"lkcommon/model"
+	"lkcommon/store"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestPeriod(t *testing.T) {
+	// Still 2025 in New York, already 2026 in UTC.
+	ny := time.FixedZone("EST", -5*60*60)
+	now := time.Date(2025, 12, 31, 22, 0, 0, 0, ny)
+	tests := []struct {
+		reset    string
+		expected string
+	}{
+		{model.ResetNever, ""},
+		{model.ResetYearly, "2026"},
+		{model.ResetMonthly, "2026-01"},
+	}
+	for _, tt := range tests {
+		if p := period(model.Sequence{Key: "k", Reset: tt.reset}, now); p != tt.expected {
+			t.Errorf("%q: expected %q, got %q", tt.reset, tt.expected, p)
+		}
+	}
+}
+
+func TestCounterKey(t *testing.T) {
+	if k := counterKey("invoice", ""); k != "invoice" {
+		t.Errorf("expected invoice, got %s", k)
+	}
+	if k := counterKey("invoice", "2026"); k != "invoice:2026" {
+		t.Errorf("expected invoice:2026, got %s", k)
+	}
+}
+
+func TestFormatId(t *testing.T) {
+	tests := []struct {
+		name     string
+		seq      model.Sequence
+		period   string
+		n        int
+		expected string
+	}{
+		{"plain", model.Sequence{}, "", 123, "123"},
+		{"prefix", model.Sequence{Prefix: "ORD-"}, "", 7, "ORD-7"},
+		{"padding", model.Sequence{Padding: 6}, "", 123, "000123"},
+		{"longer than padding", model.Sequence{Padding: 2}, "", 1234, "1234"},
+		{"period", model.Sequence{Prefix: "INV-", Padding: 6}, "2026", 123, "INV-2026-000123"},
+		{"mod97", model.Sequence{Prefix: "INV-", Padding: 6, CheckDigit: model.CheckDigitMod97}, "2026", 123, "INV-2026-000123-38"},
+		{"mod97 leading zero", model.Sequence{CheckDigit: model.CheckDigitMod97}, "", 0, "0-98"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if id := formatId(tt.seq, tt.period, tt.n); id != tt.expected {
+				t.Errorf("expected %s, got %s", tt.expected, id)
+			}
+		})
+	}
+}
+
+func TestMod97(t *testing.T) {
+	tests := []struct {
+		digits   string
+		expected int
+	}{
+		{"0", 98},
+		{"1", 95},
+		{"123456", 76},
+		{"2026000123", 38},
+		// Far beyond 64 bits.
+		{"123456789012345678901234567890", 39},
+	}
+	for _, tt := range tests {
+		c := mod97(tt.digits)
+		if c != tt.expected {
+			t.Errorf("%s: expected %02d, got %02d", tt.digits, tt.expected, c)
+		}
+		// Appending the check digits leaves remainder 1.
+		n, _ := new(big.Int).SetString(tt.digits, 10)
+		n.Mul(n, big.NewInt(100)).Add(n, big.NewInt(int64(c)))
+		if r := new(big.Int).Mod(n, big.NewInt(97)).Int64(); r != 1 {
+			t.Errorf("%s: expected remainder 1, got %v", tt.digits, r)
+		}
+	}
+}
+
+func TestSequencesLoad(t *testing.T) {
+	ctx := context.Background()
+	b := store.NewMemoryBackend()
+	open := func() *sequences {
+		return &sequences{fixed: map[string]model.Sequence{}, store: b, cached: map[string]model.Sequence{}}
+	}
+	a, other := open(), open()
+
+	if err := a.Put(ctx, model.Sequence{Key: "invoice", Prefix: "INV-"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if other.Defined("invoice") {
+		t.Errorf("expected definition to be unknown before reloading")
+	}
+	if err := other.load(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if seq := other.Get("invoice"); seq.Prefix != "INV-" {
+		t.Errorf("expected definition from the other instance, got %+v", seq)
+	}
+
+	if err := other.Put(ctx, model.Sequence{Key: "invoice", Prefix: "R-"}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := a.load(ctx); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if seq := a.Get("invoice"); seq.Prefix != "R-" {
+		t.Errorf("expected changed definition, got %+v", seq)
+	}
+}
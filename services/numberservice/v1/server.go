@@ -1,46 +1,389 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/idempotency"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"lkcommon/numberclient"
+	"lkcommon/store"
+	"lkcommon/trace"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
-	"sync"
+	"strings"
+	"time"
 )
 
-var counters = make(map[string]int)
-var mux = sync.RWMutex{}
+type server struct {
+	cfg          *config.Config
+	counters     *counterCache
+	sequences    *sequences
+	reservations *reservations
+	audit        *auditLog
+}
+
+var (
+	counterValues = metrics.NewGauge("number_counter_value",
+		"Last number handed out, by sequence; undefined sequences share the key \"other\".", "key")
+	unusedNumbers = metrics.NewCounter("number_unused_total",
+		"Numbers handed out in blocks and returned unused, by sequence; undefined sequences share the key \"other\".", "key")
+)
+
+// Largest block that can be reserved at once.
+const maxBlockSize = 1000
 
-func handleRanges(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("request from %s", GetIdentification(r))
+func (s *server) handleRanges(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("request from %s", auth.GetIdentification(r)))
 
-	if filterOutMethod([]string{http.MethodGet}, w, r) {
+	path := r.URL.Path[len("/ranges/"):]
+	if strings.HasSuffix(path, "/unused") {
+		s.handleUnused(w, r, strings.TrimSuffix(path, "/unused"))
+		return
+	}
+	if i := strings.Index(path, "/reservations"); i > 0 {
+		s.handleReservations(w, r, path[:i], strings.TrimPrefix(path[i+len("/reservations"):], "/"))
+		return
+	}
+	if strings.HasSuffix(path, "/next") {
+		s.handleNextId(w, r, strings.TrimSuffix(path, "/next"))
 		return
 	}
 
-	key := r.URL.Path[len("/ranges/"):]
+	if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
+		return
+	}
+
+	key := path
 	if key == "" {
-		http.NotFound(w, r)
+		httpx.NotFound(w, "no range specified")
+		return
+	}
+	if !model.ValidKey(key) {
+		httpx.BadRequest(w, fmt.Sprintf("invalid range %q", key))
+		return
+	}
+	// Plain numbers are counted for every range, also for those that hand
+	// out generated identifiers through /ranges/{key}/next, so that callers
+	// of the legacy endpoint keep getting numbers.
+	if s.sequences.Get(key).Gapless {
+		httpx.WriteError(w, gaplessError(key))
+		return
+	}
+	if r.URL.Query().Get("count") != "" {
+		s.handleBlock(w, r, key)
 		return
 	}
 
-	mux.Lock()
-	defer mux.Unlock()
-	c := counters[key] + 1
-	counters[key] = c
+	c, err := s.counters.Next(r.Context(), s.counterKey(key))
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not increment counter %s: %s", key, err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not get next number"))
+		return
+	}
 
 	_, _ = w.Write([]byte(strconv.Itoa(c)))
 }
 
+// handleBlock reserves a contiguous block of numbers.
+func (s *server) handleBlock(w http.ResponseWriter, r *http.Request, key string) {
+	raw := r.URL.Query().Get("count")
+	count, err := strconv.Atoi(raw)
+	if err != nil || count < 1 || count > maxBlockSize {
+		httpx.BadRequest(w, fmt.Sprintf("count must be between 1 and %v, got %s", maxBlockSize, raw))
+		return
+	}
+
+	start, err := s.counters.NextBlock(r.Context(), s.counterKey(key), count)
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not advance counter %s by %v: %s", key, count, err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not reserve numbers"))
+		return
+	}
+
+	httpx.OkJson(w, numberclient.Block{Key: key, Start: start, Count: count})
+}
+
+// handleNextId hands out the next number of a range together with its
+// formatted identifier.
+func (s *server) handleNextId(w http.ResponseWriter, r *http.Request, key string) {
+	if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
+		return
+	}
+	if !model.ValidKey(key) {
+		httpx.BadRequest(w, fmt.Sprintf("invalid range %q", key))
+		return
+	}
+
+	seq := s.sequences.Get(key)
+	if seq.Gapless {
+		httpx.WriteError(w, gaplessError(key))
+		return
+	}
+	if r.URL.Query().Get("count") != "" {
+		s.handleIdBlock(w, r, seq)
+		return
+	}
+	if !seq.Counter() {
+		id, err := generateId(seq, time.Now())
+		if err != nil {
+			logctx.Error(r.Context(), fmt.Sprintf("could not generate %s identifier: %s", key, err))
+			httpx.InternalServerError(w, "could not generate identifier")
+			return
+		}
+		httpx.OkJson(w, numberclient.Number{Key: key, Id: id})
+		return
+	}
+
+	p := period(seq, time.Now())
+	c, err := s.counters.Next(r.Context(), counterKey(key, p))
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not increment counter %s: %s", key, err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not get next number"))
+		return
+	}
+
+	httpx.OkJson(w, numberclient.Number{Key: key, Number: c, Id: formatId(seq, p, c)})
+}
+
+// handleIdBlock hands out count identifiers at once. For counters they are
+// those of a contiguous block of numbers, which the holder returns unused
+// like any other block.
+func (s *server) handleIdBlock(w http.ResponseWriter, r *http.Request, seq model.Sequence) {
+	raw := r.URL.Query().Get("count")
+	count, err := strconv.Atoi(raw)
+	if err != nil || count < 1 || count > maxBlockSize {
+		httpx.BadRequest(w, fmt.Sprintf("count must be between 1 and %v, got %s", maxBlockSize, raw))
+		return
+	}
+
+	now := time.Now()
+	b := numberclient.Block{Key: seq.Key, Count: count, Ids: make([]string, count)}
+	if !seq.Counter() {
+		for i := range b.Ids {
+			if b.Ids[i], err = generateId(seq, now); err != nil {
+				logctx.Error(r.Context(), fmt.Sprintf("could not generate %s identifier: %s", seq.Key, err))
+				httpx.InternalServerError(w, "could not generate identifier")
+				return
+			}
+		}
+		httpx.OkJson(w, b)
+		return
+	}
+
+	p := period(seq, now)
+	b.Start, err = s.counters.NextBlock(r.Context(), counterKey(seq.Key, p), count)
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not advance counter %s by %v: %s", seq.Key, count, err))
+		httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not reserve numbers"))
+		return
+	}
+	for i := range b.Ids {
+		b.Ids[i] = formatId(seq, p, b.Start+i)
+	}
+	httpx.OkJson(w, b)
+}
+
+// handleReservations reserves numbers (POST /ranges/{key}/reservations) and
+// commits or cancels reservations (POST .../reservations/{token}/commit or
+// .../cancel).
+func (s *server) handleReservations(w http.ResponseWriter, r *http.Request, key, rest string) {
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
+		return
+	}
+	if !model.ValidKey(key) {
+		httpx.BadRequest(w, fmt.Sprintf("invalid range %q", key))
+		return
+	}
+
+	if !s.sequences.Get(key).Counter() {
+		httpx.WriteError(w, generatedError(key))
+		return
+	}
+
+	if rest == "" {
+		res, err := s.reservations.Reserve(r.Context(), key)
+		if err != nil {
+			logctx.Error(r.Context(), fmt.Sprintf("could not reserve %s number: %s", key, err))
+			httpx.WriteError(w, apierror.New(apierror.Unavailable, "could not reserve number"))
+			return
+		}
+		logctx.Info(r.Context(), fmt.Sprintf("reserved %s until %s", res.Id, res.Expires.Format(time.RFC3339)))
+		httpx.OkJson(w, res)
+		return
+	}
+
+	ps := strings.Split(rest, "/")
+	if len(ps) != 2 || (ps[1] != "commit" && ps[1] != "cancel") {
+		httpx.NotFound(w, "not found")
+		return
+	}
+	token, action := ps[0], ps[1]
+	var err error
+	if action == "commit" {
+		err = s.reservations.Commit(r.Context(), key, token)
+	} else {
+		err = s.reservations.Cancel(r.Context(), key, token)
+	}
+	if err != nil {
+		if _, ok := apierror.As(err); !ok {
+			logctx.Error(r.Context(), fmt.Sprintf("could not %s reservation %s: %s", action, token, err))
+			err = apierror.Newf(apierror.Unavailable, "could not %s reservation", action)
+		}
+		httpx.WriteError(w, err)
+		return
+	}
+	httpx.OkJson(w, struct{}{})
+}
+
+// generatedError reports that a range hands out generated identifiers, which
+// are only available through /ranges/{key}/next.
+func generatedError(key string) error {
+	return apierror.Newf(apierror.FailedPrecondition, "range %s hands out generated identifiers, use /ranges/%s/next", key, key)
+}
+
+// gaplessError reports that a range only hands out numbers through
+// reservations, so that none get lost.
+func gaplessError(key string) error {
+	return apierror.Newf(apierror.FailedPrecondition, "range %s is gapless, reserve numbers with POST /ranges/%s/reservations", key, key)
+}
+
+// counterKey returns the key of the counter for the current period of the
+// range.
+func (s *server) counterKey(key string) string {
+	return counterKey(key, period(s.sequences.Get(key), time.Now()))
+}
+
+// handleSequences lists, reads and defines sequences. Only the admin can
+// define sequences.
+func (s *server) handleSequences(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+
+	key := strings.TrimPrefix(r.URL.Path, "/sequences")
+	key = strings.TrimPrefix(key, "/")
+	if key == "" {
+		if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
+			return
+		}
+		httpx.OkJson(w, s.sequences.List())
+		return
+	}
+
+	if httpx.FilterOutMethod([]string{http.MethodGet, http.MethodPut}, w, r) {
+		return
+	}
+	if r.Method == http.MethodGet {
+		if !s.sequences.Defined(key) {
+			httpx.NotFound(w, fmt.Sprintf("no sequence %s", key))
+			return
+		}
+		httpx.OkJson(w, s.sequences.Get(key))
+		return
+	}
+
+	auth.RequireIdentity(s.cfg.AdminIdentity, func(w http.ResponseWriter, r *http.Request) {
+		s.handlePutSequence(w, r, key)
+	})(w, r)
+}
+
+// handleUnused records numbers from a block that its holder will not use.
+// They are not handed out again; the record explains the gap.
+func (s *server) handleUnused(w http.ResponseWriter, r *http.Request, key string) {
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
+		return
+	}
+
+	b := numberclient.Block{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, 1<<10)).Decode(&b); err != nil {
+		httpx.BadRequest(w, "invalid block")
+		return
+	}
+	if b.Key != key || b.Start < 1 || b.Count < 1 || b.Count > maxBlockSize {
+		httpx.BadRequest(w, fmt.Sprintf("invalid block for range %s", key))
+		return
+	}
+
+	unusedNumbers.Add(float64(b.Count), s.sequences.label(key))
+	logctx.Notice(r.Context(), fmt.Sprintf("%s returned %v unused %s numbers: %v to %v",
+		auth.GetIdentification(r), b.Count, key, b.Start, b.Start+b.Count-1))
+	httpx.OkJson(w, b)
+}
+
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate()
 	}
+	if err != nil {
+		log.Fatalf("could not load configuration: %s", err)
+	}
+	logctx.Configure(cfg.LogLevel, cfg.Gcp().ProjectId)
+	logctx.Info(context.Background(), "configuration: "+cfg.String())
+
+	client := auth.NewServiceClient(cfg.Gcp().Metadata())
+
+	counterStore, err := OpenCounterStore(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("could not open counter store: %s", err)
+	}
+	seqs, err := openSequences(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("could not load sequences: %s", err)
+	}
+	go seqs.Refresh(context.Background())
+	counters, err := newCounterCache(context.Background(), counterStore, seqs)
+	if err != nil {
+		log.Fatalf("could not load counters: %s", err)
+	}
+	reservations, err := openReservations(context.Background(), cfg, counters, seqs)
+	if err != nil {
+		log.Fatalf("could not load reservations: %s", err)
+	}
+	go reservations.Reclaim(context.Background())
+	audit, err := openAuditLog(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("could not open audit log: %s", err)
+	}
+	s := &server{cfg: cfg, counters: counters, sequences: seqs, reservations: reservations, audit: audit}
+
+	idem, err := idempotency.Open(context.Background(), store.ConfigFrom(cfg), "numbers", cfg.IdempotencyWindow)
+	if err != nil {
+		log.Fatalf("could not open idempotency store: %s", err)
+	}
+
+	addAttacks(cfg, client)
+	http.Handle("/ranges/", idem.Handler(http.HandlerFunc(s.handleRanges)))
+	http.HandleFunc("/sequences", s.handleSequences)
+	http.HandleFunc("/sequences/", s.handleSequences)
+	http.HandleFunc("/admin/", auth.RequireIdentity(cfg.AdminIdentity, s.handleAdmin))
+	http.HandleFunc("/healthz", httpx.HandleHealth)
+	http.HandleFunc("/readyz", httpx.HandleReady(
+		httpx.Check{Name: "counters", Check: counterStore.Check},
+		httpx.Check{Name: "sequences", Check: seqs.Check},
+		httpx.Check{Name: "reservations", Check: reservations.Check},
+		httpx.Check{Name: "audit", Check: audit.Check},
+		httpx.Check{Name: "idempotency", Check: idem.Check},
+	))
+	http.Handle("/metrics", metrics.Handler())
 
-	addAttacks()
-	http.HandleFunc("/ranges/", handleRanges)
-	http.HandleFunc("/healthz", handleHealth)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.Gcp())
+	if err != nil {
+		log.Fatalf("could not create trace exporter: %s", err)
+	}
+	trace.SetExporter(exporter)
+
+	verifier := auth.ConfigVerifier(cfg, cfg.NumberService)
+	if err := httpx.ListenAndServe(":"+cfg.Port, trace.Middleware(metrics.Middleware(http.DefaultServeMux, httpx.WithRequestId(auth.Middleware(verifier, http.DefaultServeMux))))); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"lkcommon/numberclient"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// scrape returns the value of a metric series, or "" if it has none.
+func scrape(series string) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, l := range strings.Split(w.Body.String(), "\n") {
+		if strings.HasPrefix(l, series+" ") {
+			return strings.TrimPrefix(l, series+" ")
+		}
+	}
+	return ""
+}
+
+func TestHandleIdBlock(t *testing.T) {
+	res, _, counters := newTestReservations(t, 0,
+		model.Sequence{Key: "invoice", Prefix: "INV-", Padding: 3},
+		model.Sequence{Key: "order", Generator: model.GeneratorUlid})
+	s := &server{counters: counters, sequences: res.sequences}
+
+	get := func(url string) (int, numberclient.Block) {
+		w := httptest.NewRecorder()
+		s.handleRanges(w, httptest.NewRequest(http.MethodGet, url, nil))
+		b := numberclient.Block{}
+		_ = json.NewDecoder(w.Body).Decode(&b)
+		return w.Code, b
+	}
+
+	code, b := get("/ranges/invoice/next?count=3")
+	if code != http.StatusOK || b.Start != 1 || b.Count != 3 || len(b.Ids) != 3 || b.Ids[0] != "INV-001" || b.Ids[2] != "INV-003" {
+		t.Errorf("expected INV-001 to INV-003, got %v %+v", code, b)
+	}
+	if _, b := get("/ranges/invoice/next?count=1"); b.Start != 4 || b.Ids[0] != "INV-004" {
+		t.Errorf("expected INV-004, got %+v", b)
+	}
+
+	code, b = get("/ranges/order/next?count=2")
+	if code != http.StatusOK || b.Start != 0 || len(b.Ids) != 2 || b.Ids[0] == b.Ids[1] {
+		t.Fatalf("expected 2 distinct identifiers, got %v %+v", code, b)
+	}
+	for _, id := range b.Ids {
+		if !regexp.MustCompile(`^[0-9A-Z]{26}$`).MatchString(id) {
+			t.Errorf("expected ULID, got %s", id)
+		}
+	}
+
+	for _, count := range []string{"0", "1001", "x"} {
+		if code, _ := get("/ranges/invoice/next?count=" + count); code != http.StatusBadRequest {
+			t.Errorf("count %s: expected %v, got %v", count, http.StatusBadRequest, code)
+		}
+	}
+}
+
+func TestHandleUnused(t *testing.T) {
+	res, _, counters := newTestReservations(t, 0, model.Sequence{Key: "invoice", Prefix: "INV-"})
+	s := &server{counters: counters, sequences: res.sequences}
+
+	for _, key := range []string{"invoice", "x1", "x2"} {
+		w := httptest.NewRecorder()
+		body := `{"key": "` + key + `", "start": 5, "count": 2}`
+		s.handleRanges(w, httptest.NewRequest(http.MethodPost, "/ranges/"+key+"/unused", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected %v, got %v: %s", http.StatusOK, w.Code, w.Body)
+		}
+	}
+	if v := scrape(`number_unused_total{key="invoice"}`); v != "2" {
+		t.Errorf("expected 2 unused invoice numbers, got %q", v)
+	}
+	if v := scrape(`number_unused_total{key="other"}`); v != "4" {
+		t.Errorf("expected 4 unused numbers of undefined sequences, got %q", v)
+	}
+	if v := scrape(`number_unused_total{key="x1"}`); v != "" {
+		t.Errorf("expected no series for undefined sequence, got %q", v)
+	}
+}
+
+func TestHandleRangesGapless(t *testing.T) {
+	res, _, counters := newTestReservations(t, 0, model.Sequence{Key: "invoice", Prefix: "INV-", Gapless: true})
+	s := &server{counters: counters, sequences: res.sequences, reservations: res}
+
+	for _, url := range []string{"/ranges/invoice", "/ranges/invoice?count=2", "/ranges/invoice/next", "/ranges/invoice/next?count=2"} {
+		w := httptest.NewRecorder()
+		s.handleRanges(w, httptest.NewRequest(http.MethodGet, url, nil))
+		if w.Code != http.StatusPreconditionFailed {
+			t.Errorf("%s: expected %v, got %v", url, http.StatusPreconditionFailed, w.Code)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.handleRanges(w, httptest.NewRequest(http.MethodPost, "/ranges/invoice/reservations", nil))
+	r := numberclient.Reservation{}
+	_ = json.NewDecoder(w.Body).Decode(&r)
+	if w.Code != http.StatusOK || r.Id != "INV-1" {
+		t.Errorf("expected reservation of INV-1, got %v %+v", w.Code, r)
+	}
+}
+
+func TestHandleRangesLegacy(t *testing.T) {
+	res, _, counters := newTestReservations(t, 0,
+		model.Sequence{Key: "order", Generator: model.GeneratorUlid},
+		model.Sequence{Key: "invoice", Prefix: "INV-"})
+	s := &server{counters: counters, sequences: res.sequences, reservations: res}
+
+	for _, key := range []string{"order", "invoice", "undefined"} {
+		for _, want := range []string{"1", "2"} {
+			w := httptest.NewRecorder()
+			s.handleRanges(w, httptest.NewRequest(http.MethodGet, "/ranges/"+key, nil))
+			if w.Code != http.StatusOK || w.Body.String() != want {
+				t.Errorf("%s: expected number %s, got %v %s", key, want, w.Code, w.Body)
+			}
+		}
+	}
+
+	w := httptest.NewRecorder()
+	s.handleRanges(w, httptest.NewRequest(http.MethodPost, "/ranges/order/reservations", nil))
+	if w.Code != http.StatusPreconditionFailed {
+		t.Errorf("expected reservations of generated identifiers to be refused, got %v", w.Code)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
+	"lkcommon/store"
+	"lkcommon/validate"
+	"net/http"
+	"strings"
+)
+
+// demoProducts fill an empty catalog when running locally, or when
+// configured to seed demo data.
+var demoProducts = []model.Product{
+	{Sku: "shoes", Name: "Shoes", UnitPrice: model.Money{Value: 4990, Decimals: 2, Currency: "EUR"}},
+	{Sku: "socks", Name: "Socks", UnitPrice: model.Money{Value: 450, Decimals: 2, Currency: "EUR"}},
+	{Sku: "laces", Name: "Laces", UnitPrice: model.Money{Value: 120, Decimals: 2, Currency: "EUR"}},
+}
+
+// seedCatalog adds the demo products to an empty catalog, so that orders
+// can be placed without setting up a catalog. Instances starting at the
+// same time may both seed; products are written with the same contents.
+func seedCatalog(ctx context.Context, products store.ProductStore) error {
+	ps, err := products.ListProducts(ctx)
+	if err != nil || len(ps) > 0 {
+		return err
+	}
+	for i := range demoProducts {
+		if err := products.SaveProduct(ctx, &demoProducts[i]); err != nil {
+			return err
+		}
+	}
+	logctx.Info(ctx, fmt.Sprintf("added %v demo products to the empty catalog", len(demoProducts)))
+	return nil
+}
+
+// handleProducts serves the catalog:
+//
+//	GET /products        all products
+//	GET /products/{sku}  a product
+//	PUT /products/{sku}  add or change a product, restricted to the admin
+//
+// Changed prices apply to orders created afterwards.
+func (s *server) handleProducts(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/products" {
+		if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
+			return
+		}
+		ps, err := s.products.ListProducts(r.Context())
+		if err != nil {
+			logctx.Error(r.Context(), fmt.Sprintf("error listing products: %s", err))
+			httpx.InternalServerError(w, "error listing products")
+			return
+		}
+		httpx.OkJson(w, ps)
+		return
+	}
+
+	if httpx.FilterOutMethod([]string{http.MethodGet, http.MethodPut}, w, r) {
+		return
+	}
+	sku := strings.TrimPrefix(r.URL.Path, "/products/")
+	if !model.ValidSku(sku) {
+		httpx.NotFound(w, "not found")
+		return
+	}
+	if r.Method == http.MethodPut {
+		auth.RequireIdentity(s.cfg.AdminIdentity, func(w http.ResponseWriter, r *http.Request) {
+			s.handlePutProduct(w, r, sku)
+		})(w, r)
+		return
+	}
+
+	p, err := s.products.GetProduct(r.Context(), sku)
+	if err == store.ErrNotFound {
+		httpx.NotFound(w, fmt.Sprintf("unknown product %s", sku))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error reading product: %s", err))
+		httpx.InternalServerError(w, "error reading product")
+		return
+	}
+	httpx.OkJson(w, p)
+}
+
+func (s *server) handlePutProduct(w http.ResponseWriter, r *http.Request, sku string) {
+	p := &model.Product{}
+	if err := httpx.DecodeJson(r, p, maxProductSize); err != nil {
+		httpx.WriteError(w, err)
+		return
+	}
+	if p.Sku == "" {
+		p.Sku = sku
+	}
+	vs := productRules.Validate(p)
+	if p.Sku != sku {
+		vs = append(vs, apierror.FieldViolation{Field: "sku", Description: fmt.Sprintf("must match the path, got %s", p.Sku)})
+	}
+	if err := validate.Error(vs); err != nil {
+		logctx.Info(r.Context(), fmt.Sprintf("invalid product: %s", err))
+		httpx.WriteError(w, err)
+		return
+	}
+
+	if err := s.products.SaveProduct(r.Context(), p); err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not save product %s: %s", sku, err))
+		httpx.InternalServerError(w, "could not save product")
+		return
+	}
+	logctx.Notice(r.Context(), fmt.Sprintf("%s set product %s to %s at %s", auth.GetIdentification(r), sku, p.Name, p.UnitPrice))
+	httpx.OkJson(w, p)
+}
+
+// priceOrder fills in the line items from the catalog and computes the
+// total. All items must be priced in the same currency. Unknown products
+// and other currencies are returned as violations of the items' fields.
+func (s *server) priceOrder(ctx context.Context, o *model.Order) ([]apierror.FieldViolation, error) {
+	var vs []apierror.FieldViolation
+	o.Total = model.Money{}
+	for i := range o.Items {
+		it := &o.Items[i]
+		field := fmt.Sprintf("items[%v].sku", i)
+		p, err := s.products.GetProduct(ctx, it.Sku)
+		if err == store.ErrNotFound {
+			vs = append(vs, apierror.FieldViolation{Field: field, Description: fmt.Sprintf("unknown product %s", it.Sku)})
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("error reading product %s: %s", it.Sku, err)
+		}
+
+		it.Name = p.Name
+		it.UnitPrice = p.UnitPrice
+		it.Total = p.UnitPrice.Times(it.Quantity)
+		if o.Total, err = o.Total.Plus(it.Total); err != nil {
+			vs = append(vs, apierror.FieldViolation{Field: field, Description: fmt.Sprintf("is priced in %s, other items in %s", p.UnitPrice.Currency, o.Total.Currency)})
+		}
+	}
+	return vs, nil
+}
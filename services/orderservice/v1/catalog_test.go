@@ -0,0 +1,55 @@
+package main
+
+import (
+	"encoding/json"
+	"lkcommon/apierror"
+	"lkcommon/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHandlePutProduct(t *testing.T) {
+	s := &server{products: store.NewProductStore(store.NewMemoryBackend())}
+	tests := []struct {
+		name   string
+		sku    string
+		body   string
+		code   int
+		fields []string
+	}{
+		{"valid", "shoes", `{"name": "Shoes", "unitPrice": {"value": 4990, "decimals": 2, "currency": "EUR"}}`, http.StatusOK, nil},
+		{"unknown field", "shoes", `{"name": "Shoes", "price": 10}`, http.StatusBadRequest, nil},
+		{"invalid fields", "shoes", `{"unitPrice": {"value": -1, "decimals": 5, "currency": "eur"}}`, http.StatusUnprocessableEntity,
+			[]string{"name", "unitPrice.value", "unitPrice.decimals", "unitPrice.currency"}},
+		{"other sku", "shoes", `{"sku": "socks", "name": "Socks", "unitPrice": {"value": 450, "decimals": 2, "currency": "EUR"}}`, http.StatusUnprocessableEntity,
+			[]string{"sku"}},
+		{"invalid sku", "a.b", `{"name": "Shoes", "unitPrice": {"value": 1, "currency": "EUR"}}`, http.StatusUnprocessableEntity,
+			[]string{"sku"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			r := httptest.NewRequest(http.MethodPut, "/products/"+tt.sku, strings.NewReader(tt.body))
+			s.handlePutProduct(w, r, tt.sku)
+			if w.Code != tt.code {
+				t.Fatalf("expected %v, got %v: %s", tt.code, w.Code, w.Body)
+			}
+			if tt.fields == nil {
+				return
+			}
+			e := &apierror.Error{}
+			if err := json.NewDecoder(w.Body).Decode(e); err != nil {
+				t.Fatalf("unexpected error decoding response: %s", err)
+			}
+			var fields []string
+			for _, v := range e.Details {
+				fields = append(fields, v.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("expected violations of %v, got %v", tt.fields, fields)
+			}
+		})
+	}
+}
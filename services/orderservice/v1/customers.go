@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
+	"lkcommon/store"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// demoCustomers fill an empty customer collection.
+var demoCustomers = []model.Customer{
+	{
+		Id:             "alice",
+		Name:           "Alice Jansen",
+		Email:          "alice@example.com",
+		BillingAddress: model.Address{Street: "Oudegracht 1", PostalCode: "3511 AA", City: "Utrecht", Country: "NL"},
+	},
+	{
+		Id:             "bob",
+		Name:           "Bob de Vries",
+		Email:          "bob@example.com",
+		BillingAddress: model.Address{Street: "Damrak 2", PostalCode: "1012 LG", City: "Amsterdam", Country: "NL"},
+	},
+}
+
+// seedCustomers adds the demo customers to an empty collection, so that
+// orders can be placed without creating customers first. It runs on every
+// start, also without demo data, since orders are only accepted from known
+// customers. A customer added by another instance starting at the same time
+// is left as it is.
+func seedCustomers(ctx context.Context, customers store.CustomerStore) error {
+	cs, err := customers.ListCustomers(ctx)
+	if err != nil || len(cs) > 0 {
+		return err
+	}
+	for i := range demoCustomers {
+		c := demoCustomers[i]
+		c.CreatedAt = time.Now().UTC()
+		if err := customers.CreateCustomer(ctx, &c); err != nil && err != store.ErrConflict {
+			return err
+		}
+	}
+	logctx.Info(ctx, fmt.Sprintf("added %v demo customers", len(demoCustomers)))
+	return nil
+}
+
+// handleCustomers serves the customers:
+//
+//	GET    /customers       the caller's customers, or all for the admin
+//	POST   /customers       add a customer, owned by the caller
+//	GET    /customers/{id}  a customer, also when deleted
+//	PUT    /customers/{id}  change a customer's name, email or address,
+//	                        restricted to its owner and the admin
+//	DELETE /customers/{id}  delete a customer, restricted to the admin
+//
+// Listing and changing customers require an ID token. Deleted customers
+// cannot place orders, but are kept for invoicing the orders they placed
+// before.
+func (s *server) handleCustomers(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/customers" {
+		if httpx.FilterOutMethod([]string{http.MethodGet, http.MethodPost}, w, r) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			s.handleCreateCustomer(w, r)
+		} else {
+			s.handleListCustomers(w, r)
+		}
+		return
+	}
+
+	if httpx.FilterOutMethod([]string{http.MethodGet, http.MethodPut, http.MethodDelete}, w, r) {
+		return
+	}
+	id := strings.TrimPrefix(r.URL.Path, "/customers/")
+	if !model.ValidCustomerId(id) {
+		httpx.NotFound(w, "not found")
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		s.handlePutCustomer(w, r, id)
+	case http.MethodDelete:
+		auth.RequireIdentity(s.cfg.AdminIdentity, func(w http.ResponseWriter, r *http.Request) {
+			s.handleDeleteCustomer(w, r, id)
+		})(w, r)
+	default:
+		s.handleGetCustomer(w, r, id)
+	}
+}
+
+func (s *server) handleListCustomers(w http.ResponseWriter, r *http.Request) {
+	caller := auth.VerifiedIdentity(r)
+	if caller == "" {
+		httpx.WriteError(w, apierror.New(apierror.Unauthenticated, "identity token required"))
+		return
+	}
+	admin := auth.HasIdentity(r, s.cfg.AdminIdentity)
+
+	cs, err := s.customers.ListCustomers(r.Context())
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error listing customers: %s", err))
+		httpx.InternalServerError(w, "error listing customers")
+		return
+	}
+	active := []*model.Customer{}
+	for _, c := range cs {
+		if !c.Deleted && (admin || c.Owner == caller) {
+			active = append(active, c)
+		}
+	}
+	httpx.OkJson(w, active)
+}
+
+func (s *server) handleCreateCustomer(w http.ResponseWriter, r *http.Request) {
+	c := &model.Customer{}
+	err := httpx.DecodeJson(r, c, maxCustomerSize)
+	if err != nil {
+		logctx.Warn(r.Context(), fmt.Sprintf("error parsing request: %s", err))
+		httpx.WriteError(w, err)
+		return
+	}
+	if err := customerRules.Check(c); err != nil {
+		logctx.Info(r.Context(), fmt.Sprintf("invalid customer: %s", err))
+		httpx.WriteError(w, err)
+		return
+	}
+
+	c.CreatedAt = time.Now().UTC()
+	c.Owner = auth.VerifiedIdentity(r)
+	c.Id, err = s.numbers.GetNextId(r.Context(), "customer")
+	if err != nil {
+		logctx.Warn(r.Context(), fmt.Sprintf("could not get customer id: %s", err))
+		httpx.WriteError(w, err)
+		return
+	}
+
+	err = s.customers.CreateCustomer(r.Context(), c)
+	if err == store.ErrConflict {
+		logctx.Error(r.Context(), fmt.Sprintf("customer id %s is taken", c.Id))
+		httpx.WriteError(w, apierror.Newf(apierror.Conflict, "customer id %s is taken", c.Id))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not save customer: %s", err))
+		httpx.InternalServerError(w, "could not save customer")
+		return
+	}
+
+	logctx.Info(r.Context(), fmt.Sprintf("created customer %s", c.Id))
+	httpx.OkJson(w, c)
+}
+
+func (s *server) handleGetCustomer(w http.ResponseWriter, r *http.Request, id string) {
+	c, err := s.customers.GetCustomer(r.Context(), id)
+	if err == store.ErrNotFound {
+		httpx.NotFound(w, fmt.Sprintf("unknown customer %s", id))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error reading customer: %s", err))
+		httpx.InternalServerError(w, "error reading customer")
+		return
+	}
+	httpx.OkJson(w, c)
+}
+
+func (s *server) handlePutCustomer(w http.ResponseWriter, r *http.Request, id string) {
+	caller := auth.VerifiedIdentity(r)
+	if caller == "" {
+		httpx.WriteError(w, apierror.New(apierror.Unauthenticated, "identity token required"))
+		return
+	}
+	admin := auth.HasIdentity(r, s.cfg.AdminIdentity)
+
+	c := &model.Customer{}
+	if err := httpx.DecodeJson(r, c, maxCustomerSize); err != nil {
+		logctx.Warn(r.Context(), fmt.Sprintf("error parsing request: %s", err))
+		httpx.WriteError(w, err)
+		return
+	}
+	if err := customerRules.Check(c); err != nil {
+		logctx.Info(r.Context(), fmt.Sprintf("invalid customer: %s", err))
+		httpx.WriteError(w, err)
+		return
+	}
+
+	s.updateCustomer(w, r, id, "changed", func(cur *model.Customer) error {
+		if !admin && cur.Owner != caller {
+			return apierror.New(apierror.PermissionDenied, "not allowed")
+		}
+		if cur.Deleted {
+			return apierror.Newf(apierror.Conflict, "customer %s is deleted", id)
+		}
+		cur.Name = c.Name
+		cur.Email = c.Email
+		cur.BillingAddress = c.BillingAddress
+		return nil
+	})
+}
+
+// handleDeleteCustomer marks a customer deleted. Deleting a customer again
+// has no effect.
+func (s *server) handleDeleteCustomer(w http.ResponseWriter, r *http.Request, id string) {
+	s.updateCustomer(w, r, id, "deleted", func(cur *model.Customer) error {
+		cur.Deleted = true
+		return nil
+	})
+}
+
+// updateCustomer applies change to a customer and responds with the result.
+// The action describes the change in the log.
+func (s *server) updateCustomer(w http.ResponseWriter, r *http.Request, id, action string, change func(c *model.Customer) error) {
+	c, err := s.customers.UpdateCustomer(r.Context(), id, change)
+	if err == store.ErrNotFound {
+		httpx.NotFound(w, fmt.Sprintf("unknown customer %s", id))
+		return
+	} else if err == store.ErrConflict {
+		logctx.Warn(r.Context(), fmt.Sprintf("customer %s changed while being %s", id, action))
+		httpx.WriteError(w, apierror.Newf(apierror.Conflict, "customer %s was changed concurrently, try again", id))
+		return
+	} else if _, ok := apierror.As(err); ok {
+		httpx.WriteError(w, err)
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not save customer %s: %s", id, err))
+		httpx.InternalServerError(w, "could not save customer")
+		return
+	}
+	logctx.Notice(r.Context(), fmt.Sprintf("%s %s customer %s", auth.GetIdentification(r), action, id))
+	httpx.OkJson(w, c)
+}
+
+// checkCustomer verifies that the customer of an order exists and has not
+// been deleted.
+func (s *server) checkCustomer(ctx context.Context, o *model.Order) ([]apierror.FieldViolation, error) {
+	c, err := s.customers.GetCustomer(ctx, o.Customer)
+	if err == store.ErrNotFound {
+		return []apierror.FieldViolation{{Field: "customer", Description: fmt.Sprintf("unknown customer %s", o.Customer)}}, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("error reading customer %s: %s", o.Customer, err)
+	}
+	if c.Deleted {
+		return []apierror.FieldViolation{{Field: "customer", Description: fmt.Sprintf("customer %s is deleted", o.Customer)}}, nil
+	}
+	return nil, nil
+}
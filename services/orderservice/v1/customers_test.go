@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/model"
+	"lkcommon/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// fakeIds hands out identifiers like a generated sequence.
+type fakeIds struct {
+	next int
+}
+
+func (f *fakeIds) GetNextId(ctx context.Context, key string) (string, error) {
+	f.next += 1
+	return fmt.Sprintf("01J%023d", f.next), nil
+}
+
+// as makes a request from the caller with the identity, or without ID
+// token if it is empty.
+func as(identity, method, url, body string) *http.Request {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	if identity == "" {
+		return r
+	}
+	return r.WithContext(auth.WithClaims(r.Context(), &auth.Claims{Subject: identity}))
+}
+
+func TestHandleCustomers(t *testing.T) {
+	s := &server{
+		cfg:       &config.Config{AdminIdentity: "admin"},
+		customers: store.NewCustomerStore(store.NewMemoryBackend()),
+		numbers:   &fakeIds{},
+	}
+	do := func(r *http.Request) (int, string) {
+		w := httptest.NewRecorder()
+		s.handleCustomers(w, r)
+		return w.Code, w.Body.String()
+	}
+	const customer = `{"name": "Carol Smit", "email": "carol@example.com", "billingAddress": {"street": "Neude 3", "city": "Utrecht", "country": "NL"}}`
+
+	code, body := do(as("carol", http.MethodPost, "/customers", customer))
+	c := &model.Customer{}
+	_ = json.Unmarshal([]byte(body), c)
+	if code != http.StatusOK || c.Owner != "carol" || !model.ValidCustomerId(c.Id) {
+		t.Fatalf("expected customer owned by carol, got %v %s", code, body)
+	}
+	if code, body := do(as("", http.MethodPost, "/customers", customer)); code != http.StatusOK || strings.Contains(body, "owner") {
+		t.Fatalf("expected customer without owner, got %v %s", code, body)
+	}
+	if code, _ := do(as("carol", http.MethodPost, "/customers", `{"name": "Carol", "email": "carol@example.com", "owner": "dave"}`)); code != http.StatusUnprocessableEntity {
+		t.Errorf("expected owner to be rejected, got %v", code)
+	}
+
+	list := func(identity string) (int, []model.Customer) {
+		code, body := do(as(identity, http.MethodGet, "/customers", ""))
+		var cs []model.Customer
+		_ = json.Unmarshal([]byte(body), &cs)
+		return code, cs
+	}
+	if code, _ := list(""); code != http.StatusUnauthorized {
+		t.Errorf("expected listing without token to be refused, got %v", code)
+	}
+	if code, cs := list("carol"); code != http.StatusOK || len(cs) != 1 || cs[0].Id != c.Id {
+		t.Errorf("expected carol's customer, got %v %+v", code, cs)
+	}
+	if code, cs := list("dave"); code != http.StatusOK || len(cs) != 0 {
+		t.Errorf("expected no customers for dave, got %v %+v", code, cs)
+	}
+	if code, cs := list("admin"); code != http.StatusOK || len(cs) != 2 {
+		t.Errorf("expected all customers for the admin, got %v %+v", code, cs)
+	}
+
+	url := "/customers/" + c.Id
+	tests := []struct {
+		name     string
+		identity string
+		method   string
+		code     int
+	}{
+		{"change without token", "", http.MethodPut, http.StatusUnauthorized},
+		{"change by other", "dave", http.MethodPut, http.StatusForbidden},
+		{"change by owner", "carol", http.MethodPut, http.StatusOK},
+		{"change by admin", "admin", http.MethodPut, http.StatusOK},
+		{"get without token", "", http.MethodGet, http.StatusOK},
+		{"delete by owner", "carol", http.MethodDelete, http.StatusForbidden},
+		{"delete by admin", "admin", http.MethodDelete, http.StatusOK},
+		{"change deleted", "carol", http.MethodPut, http.StatusConflict},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if code, body := do(as(tt.identity, tt.method, url, customer)); code != tt.code {
+				t.Errorf("expected %v, got %v: %s", tt.code, code, body)
+			}
+		})
+	}
+
+	vs, err := s.checkCustomer(context.Background(), &model.Order{Customer: c.Id})
+	if err != nil || len(vs) != 1 || vs[0].Field != "customer" {
+		t.Errorf("expected deleted customer to be rejected, got %+v %v", vs, err)
+	}
+}
+
+func TestSeedCustomers(t *testing.T) {
+	customers := store.NewCustomerStore(store.NewMemoryBackend())
+	for i := 0; i < 2; i += 1 {
+		if err := seedCustomers(context.Background(), customers); err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+	cs, err := customers.ListCustomers(context.Background())
+	if err != nil || len(cs) != len(demoCustomers) {
+		t.Errorf("expected %v demo customers, got %v %v", len(demoCustomers), len(cs), err)
+	}
+	s := &server{customers: customers}
+	if vs, err := s.checkCustomer(context.Background(), &model.Order{Customer: "alice"}); err != nil || len(vs) != 0 {
+		t.Errorf("expected orders of alice to be accepted, got %+v %v", vs, err)
+	}
+}
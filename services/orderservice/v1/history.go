@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"lkcommon/auth"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
+	"lkcommon/store"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// newChange returns the change of a write of an order by the request, to be
+// stored with the order.
+func newChange(r *http.Request, before, after *model.Order) *model.OrderChange {
+	return &model.OrderChange{
+		OrderNumber: after.OrderNumber,
+		Time:        time.Now().UTC(),
+		Actor:       auth.GetIdentification(r),
+		Fields:      diffOrders(before, after),
+	}
+}
+
+// diffOrders lists the fields that differ between two versions of an order,
+// by JSON name. The version itself is left out. A nil before is a new order.
+func diffOrders(before, after *model.Order) []model.FieldChange {
+	b, a := orderFields(before), orderFields(after)
+	var names []string
+	for n := range a {
+		names = append(names, n)
+	}
+	for n := range b {
+		if _, ok := a[n]; !ok {
+			names = append(names, n)
+		}
+	}
+	sort.Strings(names)
+
+	fs := []model.FieldChange{}
+	for _, n := range names {
+		if n != "version" && !reflect.DeepEqual(b[n], a[n]) {
+			fs = append(fs, model.FieldChange{Field: n, Before: b[n], After: a[n]})
+		}
+	}
+	return fs
+}
+
+// orderFields returns the JSON fields of an order.
+func orderFields(o *model.Order) map[string]interface{} {
+	m := map[string]interface{}{}
+	if o != nil {
+		bs, _ := json.Marshal(o)
+		_ = json.Unmarshal(bs, &m)
+	}
+	return m
+}
+
+// handleHistory lists the changes of an order, oldest first: GET
+// /orders/{orderNumber}/history.
+func (s *server) handleHistory(w http.ResponseWriter, r *http.Request) {
+	if httpx.FilterOutMethod([]string{http.MethodHead, http.MethodGet}, w, r) {
+		return
+	}
+
+	on := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orders/"), "/history")
+	if on == "" {
+		httpx.NotFound(w, "not found")
+		return
+	}
+
+	if _, err := s.orders.GetOrder(r.Context(), on); err == store.ErrNotFound {
+		httpx.NotFound(w, fmt.Sprintf("unknown order number %v", on))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error reading order: %s", err))
+		httpx.InternalServerError(w, "error reading order")
+		return
+	}
+
+	cs, err := s.orders.ListOrderChanges(r.Context(), on)
+	if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error reading history of order %s: %s", on, err))
+		httpx.InternalServerError(w, "error reading order history")
+		return
+	}
+	httpx.OkJson(w, cs)
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"lkcommon/model"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestDiffOrders(t *testing.T) {
+	created := time.Date(2026, 3, 14, 15, 9, 26, 0, time.UTC)
+	order := func(status string, version int) *model.Order {
+		return &model.Order{
+			Customer:    "alice",
+			Items:       []model.LineItem{},
+			Total:       model.Money{Value: 1250, Decimals: 2, Currency: "EUR"},
+			OrderNumber: "01J",
+			Status:      status,
+			CreatedAt:   created,
+			Version:     version,
+		}
+	}
+	moreExpensive := order(model.OrderCreated, 2)
+	moreExpensive.Total.Value = 1500
+
+	tests := []struct {
+		name     string
+		before   *model.Order
+		after    *model.Order
+		expected []string
+	}{
+		{"unchanged", order(model.OrderCreated, 1), order(model.OrderCreated, 1), []string{}},
+		{"version only", order(model.OrderCreated, 1), order(model.OrderCreated, 2), []string{}},
+		{"status", order(model.OrderCreated, 1), order(model.OrderPaid, 2), []string{"status"}},
+		{"nested", order(model.OrderCreated, 1), moreExpensive, []string{"total"}},
+		{"new order", nil, order(model.OrderCreated, 1), []string{"createdAt", "customer", "items", "orderNumber", "status", "total"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fs := diffOrders(tt.before, tt.after)
+			names := []string{}
+			for _, f := range fs {
+				names = append(names, f.Field)
+			}
+			if !reflect.DeepEqual(names, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, names)
+			}
+		})
+	}
+
+	fs := diffOrders(order(model.OrderCreated, 1), order(model.OrderPaid, 2))
+	if len(fs) != 1 || fs[0].Before != model.OrderCreated || fs[0].After != model.OrderPaid {
+		t.Errorf("expected status from %s to %s, got %v", model.OrderCreated, model.OrderPaid, fs)
+	}
+	fs = diffOrders(nil, order(model.OrderCreated, 1))
+	if fs[0].Before != nil {
+		t.Errorf("expected no value before a new order, got %v", fs[0].Before)
+	}
+}
+
+func TestHandleHistory(t *testing.T) {
+	s := newTestServer(t)
+	o := createOrder(t, s, "alice")
+	if w := do(s, as("", http.MethodPost, "/orders/"+o.OrderNumber+"/pay", "")); w.Code != http.StatusOK {
+		t.Fatalf("expected order to be paid, got %v %s", w.Code, w.Body)
+	}
+
+	w := do(s, as("", http.MethodGet, "/orders/"+o.OrderNumber+"/history", ""))
+	var cs []model.OrderChange
+	if err := json.NewDecoder(w.Body).Decode(&cs); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("expected history, got %v %v", w.Code, err)
+	}
+	if len(cs) != 2 || cs[0].Version != 1 || cs[1].Version != 2 {
+		t.Fatalf("expected changes of versions 1 and 2, got %+v", cs)
+	}
+	if len(cs[0].Fields) == 0 || cs[0].Fields[0].Before != nil {
+		t.Errorf("expected creation without values before, got %+v", cs[0])
+	}
+	// Without ID token, the caller is identified by address.
+	if cs[1].Actor != "192.0.2.1:1234" || len(cs[1].Fields) != 1 || cs[1].Fields[0].After != model.OrderPaid {
+		t.Errorf("expected payment by the caller, got %+v", cs[1])
+	}
+
+	if w := do(s, as("", http.MethodGet, "/orders/unknown/history", "")); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown order, got %v", w.Code)
+	}
+	if w := do(s, as("", http.MethodPost, "/orders/"+o.OrderNumber+"/history", "")); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("expected 405 for POST, got %v", w.Code)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"sync"
+)
+
+// keyedMutex hands out a lock per key. Locks are dropped when released, so
+// the map only holds keys in use.
+type keyedMutex struct {
+	mux   sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	users int
+}
+
+// Lock locks key and returns the function that unlocks it.
+func (m *keyedMutex) Lock(key string) func() {
+	m.mux.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*keyedLock)
+	}
+	l, ok := m.locks[key]
+	if !ok {
+		l = &keyedLock{}
+		m.locks[key] = l
+	}
+	l.users += 1
+	m.mux.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.mux.Lock()
+		l.users -= 1
+		if l.users == 0 {
+			delete(m.locks, key)
+		}
+		m.mux.Unlock()
+	}
+}
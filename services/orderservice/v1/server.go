@@ -2,153 +2,338 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
 	"fmt"
-	"google.golang.org/grpc/codes"
-	"google.golang.org/grpc/status"
-	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/events"
+	"lkcommon/httpx"
+	"lkcommon/idempotency"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"lkcommon/numberclient"
+	"lkcommon/orderclient"
+	"lkcommon/store"
+	"lkcommon/trace"
+	"lkcommon/validate"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
+	"time"
 )
 
-var cacheStorage = make(map[int]Order)
+type server struct {
+	cfg       *config.Config
+	orders    store.OrderStore
+	products  store.ProductStore
+	customers store.CustomerStore
+	numbers   numberclient.IdSource
+	events    events.Publisher
+	// Serializes status changes of an order within the instance. Versions
+	// catch concurrent changes by other instances.
+	locks keyedMutex
+}
+
+// The status each transition leads to.
+var transitions = map[string]string{
+	orderclient.Pay:     model.OrderPaid,
+	orderclient.Invoice: model.OrderInvoiced,
+	orderclient.Fulfil:  model.OrderFulfilled,
+	orderclient.Cancel:  model.OrderCancelled,
+}
 
-func handle(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("request from %s", GetIdentification(r))
+func (s *server) handle(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("request from %s", auth.GetIdentification(r)))
 
 	if r.URL.Path == "/healthz" {
-		handleHealth(w, r)
+		httpx.HandleHealth(w, r)
+	} else if r.URL.Path == "/products" || strings.HasPrefix(r.URL.Path, "/products/") {
+		s.handleProducts(w, r)
+	} else if r.URL.Path == "/customers" || strings.HasPrefix(r.URL.Path, "/customers/") {
+		s.handleCustomers(w, r)
+	} else if r.URL.Path == "/orders" && r.Method == http.MethodGet {
+		s.handleListOrders(w, r)
 	} else if r.URL.Path == "/orders" {
-		handleCreateOrder(w, r)
+		s.handleCreateOrder(w, r)
+	} else if strings.Count(r.URL.Path, "/") == 3 && strings.HasSuffix(r.URL.Path, "/history") {
+		s.handleHistory(w, r)
+	} else if strings.Count(r.URL.Path, "/") == 3 {
+		s.handleTransition(w, r)
 	} else {
-		handleGetOrder(w, r)
+		s.handleGetOrder(w, r)
 	}
 }
 
-func handleCreateOrder(w http.ResponseWriter, r *http.Request) {
-	if filterOutMethod([]string{http.MethodPost}, w, r) {
+func (s *server) handleCreateOrder(w http.ResponseWriter, r *http.Request) {
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
 		return
 	}
 
-	data, err := ioutil.ReadAll(r.Body)
+	o := &model.Order{}
+	err := httpx.DecodeJson(r, o, maxOrderSize)
 	if err != nil {
-		log.Printf("error reading request body: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+		logctx.Warn(r.Context(), fmt.Sprintf("error parsing request: %s", err))
+		httpx.WriteError(w, err)
 		return
 	}
-	o := &Order{}
-	err = json.Unmarshal(data, o)
-	if err != nil {
-		log.Printf("error parsing request: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+	if err := orderRules.Check(o); err != nil {
+		logctx.Info(r.Context(), fmt.Sprintf("invalid order: %s", err))
+		httpx.WriteError(w, err)
 		return
 	}
 
-	o.OrderNumber, err = GetNextNumber("order")
-	if err != nil {
-		log.Printf("could not get random number: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := s.checkOrder(r.Context(), o); err != nil {
+		if _, ok := apierror.As(err); !ok {
+			logctx.Error(r.Context(), fmt.Sprintf("could not check order: %s", err))
+			err = apierror.New(apierror.Unavailable, "could not check order")
+		}
+		httpx.WriteError(w, err)
 		return
 	}
 
-	err = saveOrder(o)
+	o.Status = model.OrderCreated
+	o.CreatedAt = time.Now().UTC()
+	o.OrderNumber, err = s.numbers.GetNextId(r.Context(), "order")
 	if err != nil {
-		log.Printf("could not save order: %s", err)
-		InternalServerError(w, "could not save order")
+		logctx.Warn(r.Context(), fmt.Sprintf("could not get order number: %s", err))
+		httpx.WriteError(w, err)
 		return
 	}
 
-	OkJson(w, o)
+	err = s.orders.CreateOrder(r.Context(), o, newChange(r, nil, o))
+	if err == store.ErrConflict {
+		// The number service handed out a number twice.
+		logctx.Error(r.Context(), fmt.Sprintf("order number %s is taken", o.OrderNumber))
+		httpx.WriteError(w, apierror.Newf(apierror.Conflict, "order number %s is taken", o.OrderNumber))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not save order: %s", err))
+		httpx.InternalServerError(w, "could not save order")
+		return
+	}
+
+	// A retry would find the order number taken, so the order is returned
+	// even if the event is lost.
+	if err := s.events.Publish(r.Context(), events.OrderCreated{Order: *o}); err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not publish creation of order %s: %s", o.OrderNumber, err))
+	}
+
+	httpx.OkJson(w, o)
 }
 
-func saveOrder(o *Order) error {
-	if localEnvironment != "" {
-		cacheStorage[o.OrderNumber] = *o
-	} else {
-		client, err := GetFirestore()
-		if err != nil {
-			log.Printf("could not get firestore client: %s", err)
-		} else {
-			ctx := context.Background()
-			d := client.Collection(baseCollection + "/orders").Doc(strconv.Itoa(o.OrderNumber))
-			_, err := d.Set(ctx, o)
-			if err != nil {
-				return fmt.Errorf("error creating new document: %s", err)
-			}
-		}
+// checkOrder verifies the customer of an order and prices it. Violations of
+// both are reported together.
+func (s *server) checkOrder(ctx context.Context, o *model.Order) error {
+	vs, err := s.checkCustomer(ctx, o)
+	if err != nil {
+		return err
 	}
-	return nil
+	pvs, err := s.priceOrder(ctx, o)
+	if err != nil {
+		return err
+	}
+	return validate.Error(append(vs, pvs...))
 }
 
-func handleGetOrder(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodHead && r.Method != http.MethodGet {
-		w.Header().Set("allow", "HEAD,GET")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+func (s *server) handleGetOrder(w http.ResponseWriter, r *http.Request) {
+	if httpx.FilterOutMethod([]string{http.MethodHead, http.MethodGet}, w, r) {
 		return
 	}
 
-	on, err := strconv.Atoi(r.URL.Path[len("/orders/"):])
-	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		_, _ = w.Write([]byte(fmt.Sprintf("invalid order number %v", on)))
+	on := strings.TrimPrefix(r.URL.Path, "/orders/")
+	if on == "" || strings.Contains(on, "/") {
+		httpx.BadRequest(w, fmt.Sprintf("invalid order number %q", on))
 		return
 	}
 
-	var o *Order
-	if localEnvironment != "" {
-		if cached, ok := cacheStorage[on]; ok {
-			o = &cached
-		} else {
-			w.WriteHeader(http.StatusNotFound)
-			_, _ = w.Write([]byte(fmt.Sprintf("unknown order number %v", on)))
-			return
-		}
-	} else {
-		client, err := GetFirestore()
-		if err != nil {
-			log.Printf("could not get firestore client: %s", err)
-			InternalServerError(w, "could not store order")
-			return
-		} else {
-			ctx := context.Background()
-			dr, err := client.Doc(fmt.Sprintf("%s/orders/%v", baseCollection, on)).Get(ctx)
-			if err != nil {
-				if status.Code(err) == codes.NotFound {
-					w.WriteHeader(http.StatusNotFound)
-					_, _ = w.Write([]byte(fmt.Sprintf("unknown order number %v", on)))
-					return
-				}
-				log.Printf("error reading order from firestore: %s", err)
-				InternalServerError(w, "error reading from Firestore")
-				return
-			}
-			o = &Order{}
-			err = dr.DataTo(o)
-			if err != nil {
-				log.Printf("error parsing Firestore data: %s", err)
-				InternalServerError(w, "error parsing Firestore data")
+	o, err := s.orders.GetOrder(r.Context(), on)
+	if err == store.ErrNotFound {
+		httpx.NotFound(w, fmt.Sprintf("unknown order number %v", on))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error reading order: %s", err))
+		httpx.InternalServerError(w, "error reading order")
+		return
+	}
+
+	httpx.OkJson(w, o)
+}
+
+// handleTransition changes the status of an order: POST
+// /orders/{orderNumber}/{transition}, where transition is pay, invoice,
+// fulfil or cancel. Repeating a transition has no effect.
+func (s *server) handleTransition(w http.ResponseWriter, r *http.Request) {
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
+		return
+	}
+
+	ps := strings.Split(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+	on, transition := ps[0], ps[1]
+	to, ok := transitions[transition]
+	if on == "" || !ok {
+		httpx.NotFound(w, "not found")
+		return
+	}
+
+	unlock := s.locks.Lock(on)
+	defer unlock()
+
+	o, err := s.orders.GetOrder(r.Context(), on)
+	if err == store.ErrNotFound {
+		httpx.NotFound(w, fmt.Sprintf("unknown order number %v", on))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error reading order: %s", err))
+		httpx.InternalServerError(w, "error reading order")
+		return
+	}
+	if o.Status == to {
+		httpx.OkJson(w, o)
+		return
+	}
+	if !model.CanTransition(o.Status, to) {
+		httpx.WriteError(w, apierror.Newf(apierror.Conflict, "order %s is %s and cannot become %s", on, o.Status, to))
+		return
+	}
+
+	before := *o
+	o.Status = to
+	err = s.orders.UpdateOrder(r.Context(), o, newChange(r, &before, o))
+	if err == store.ErrConflict {
+		logctx.Warn(r.Context(), fmt.Sprintf("order %s changed while becoming %s", on, to))
+		httpx.WriteError(w, apierror.Newf(apierror.Conflict, "order %s was changed concurrently, try again", on))
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not save order: %s", err))
+		httpx.InternalServerError(w, "could not save order")
+		return
+	}
+
+	logctx.Info(r.Context(), fmt.Sprintf("order %s went from %s to %s", on, before.Status, to))
+	httpx.OkJson(w, o)
+}
+
+// handleListOrders lists orders. Query parameters:
+//
+//	customer   only orders of the customer
+//	status     only orders with the status
+//	from, to   only orders created in [from, to), as RFC 3339 times
+//	orderBy    createdAt (default) or orderNumber; prefix - to descend
+//	pageSize   orders per page, 50 by default
+//	pageToken  nextPageToken of the previous page
+func (s *server) handleListOrders(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query()
+	q := store.OrderQuery{
+		Customer:  v.Get("customer"),
+		Status:    v.Get("status"),
+		OrderBy:   strings.TrimPrefix(v.Get("orderBy"), "-"),
+		PageToken: v.Get("pageToken"),
+	}
+	q.Descending = strings.HasPrefix(v.Get("orderBy"), "-")
+
+	var err error
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"from", &q.From}, {"to", &q.To}} {
+		if raw := v.Get(p.name); raw != "" {
+			if *p.t, err = time.Parse(time.RFC3339, raw); err != nil {
+				httpx.BadRequest(w, fmt.Sprintf("%s must be an RFC 3339 time, got %q", p.name, raw))
 				return
 			}
 		}
 	}
+	if raw := v.Get("pageSize"); raw != "" {
+		if q.PageSize, err = strconv.Atoi(raw); err != nil || q.PageSize < 1 {
+			httpx.BadRequest(w, fmt.Sprintf("invalid page size %q", raw))
+			return
+		}
+	}
 
-	OkJson(w, o)
+	p, err := s.orders.ListOrders(r.Context(), q)
+	if errors.Is(err, store.ErrInvalidQuery) {
+		httpx.BadRequest(w, err.Error())
+		return
+	} else if err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("error listing orders: %s", err))
+		httpx.InternalServerError(w, "error listing orders")
+		return
+	}
+
+	httpx.OkJson(w, p)
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate("NUMBER_SERVICE")
 	}
+	if err != nil {
+		log.Fatalf("could not load configuration: %s", err)
+	}
+	logctx.Configure(cfg.LogLevel, cfg.Gcp().ProjectId)
+	logctx.Info(context.Background(), "configuration: "+cfg.String())
+
+	client := auth.NewServiceClient(cfg.Gcp().Metadata())
+
+	orders, err := store.OpenOrderStore(context.Background(), store.ConfigFrom(cfg))
+	if err != nil {
+		log.Fatalf("could not open order store: %s", err)
+	}
+	products, err := store.OpenProductStore(context.Background(), store.ConfigFrom(cfg))
+	if err != nil {
+		log.Fatalf("could not open product store: %s", err)
+	}
+	customers, err := store.OpenCustomerStore(context.Background(), store.ConfigFrom(cfg))
+	if err != nil {
+		log.Fatalf("could not open customer store: %s", err)
+	}
+	if cfg.DemoData() {
+		if err := seedCatalog(context.Background(), products); err != nil {
+			log.Fatalf("could not seed product catalog: %s", err)
+		}
+	}
+	if err := seedCustomers(context.Background(), customers); err != nil {
+		log.Fatalf("could not seed customers: %s", err)
+	}
+	numbers := numberclient.NewLeasingClient(cfg.NumberService, client.Client, cfg.NumberBlockSize, cfg.NumberLeaseTime)
+	httpx.OnShutdown(numbers.Release)
+	publisher, err := events.Open(events.ConfigFrom(cfg), client.Client)
+	if err != nil {
+		log.Fatalf("could not open event publisher: %s", err)
+	}
+	httpx.OnShutdown(publisher.Flush)
+	s := &server{cfg: cfg, orders: orders, products: products, customers: customers, numbers: numbers, events: publisher}
+
+	idem, err := idempotency.Open(context.Background(), store.ConfigFrom(cfg), "orders", cfg.IdempotencyWindow)
+	if err != nil {
+		log.Fatalf("could not open idempotency store: %s", err)
+	}
+
+	addAttacks(cfg, client)
+	http.Handle("/", idem.Handler(http.HandlerFunc(s.handle)))
+	http.HandleFunc("/readyz", httpx.HandleReady(
+		httpx.Check{Name: "orders", Check: orders.Check},
+		httpx.Check{Name: "products", Check: products.Check},
+		httpx.Check{Name: "customers", Check: customers.Check},
+		httpx.Check{Name: "idempotency", Check: idem.Check},
+		auth.ServiceCheck(client.Client, "number-service", cfg.NumberService),
+	))
+	http.Handle("/metrics", metrics.Handler())
 
-	if numberServiceScheme == "" {
-		log.Fatal("NUMBER_SERVICE not set")
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.Gcp())
+	if err != nil {
+		log.Fatalf("could not create trace exporter: %s", err)
 	}
+	trace.SetExporter(exporter)
 
-	addAttacks()
-	http.HandleFunc("/", handle)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	verifier := auth.ConfigVerifier(cfg, cfg.OrderService)
+	if err := httpx.ListenAndServe(":"+cfg.Port, trace.Middleware(metrics.Middleware(http.DefaultServeMux, httpx.WithRequestId(auth.Middleware(verifier, http.DefaultServeMux))))); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"lkcommon/apierror"
+	"lkcommon/config"
+	"lkcommon/events"
+	"lkcommon/model"
+	"lkcommon/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestServer creates a server keeping everything in memory, with the
+// demo catalog and customers.
+func newTestServer(t *testing.T) *server {
+	ctx := context.Background()
+	s := &server{
+		cfg:       &config.Config{AdminIdentity: "admin"},
+		orders:    store.NewOrderStore(store.NewMemoryBackend()),
+		products:  store.NewProductStore(store.NewMemoryBackend()),
+		customers: store.NewCustomerStore(store.NewMemoryBackend()),
+		numbers:   &fakeIds{},
+		events:    events.NewMemoryPublisher(),
+	}
+	if err := seedCatalog(ctx, s.products); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := seedCustomers(ctx, s.customers); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	return s
+}
+
+// do has the server handle the request and returns the response.
+func do(s *server, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	s.handle(w, r)
+	return w
+}
+
+// createOrder creates an order of shoes for the customer.
+func createOrder(t *testing.T, s *server, customer string) *model.Order {
+	w := do(s, as("", http.MethodPost, "/orders", `{"customer": "`+customer+`", "items": [{"sku": "shoes", "quantity": 1}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected order to be created, got %v %s", w.Code, w.Body)
+	}
+	o := &model.Order{}
+	if err := json.NewDecoder(w.Body).Decode(o); err != nil {
+		t.Fatalf("unexpected error decoding order: %s", err)
+	}
+	return o
+}
+
+// sameIds hands out the same identifier every time, like a number service
+// that lost its counters.
+type sameIds struct{}
+
+func (sameIds) GetNextId(ctx context.Context, key string) (string, error) {
+	return "01J00000000000000000000001", nil
+}
+
+func TestHandleCreateOrderTaken(t *testing.T) {
+	s := newTestServer(t)
+	s.numbers = sameIds{}
+	o := createOrder(t, s, "alice")
+
+	w := do(s, as("", http.MethodPost, "/orders", `{"customer": "bob", "items": [{"sku": "socks", "quantity": 2}]}`))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for taken order number, got %v %s", w.Code, w.Body)
+	}
+	got, err := s.orders.GetOrder(context.Background(), o.OrderNumber)
+	if err != nil || got.Customer != "alice" || got.Version != 1 {
+		t.Errorf("expected order of alice to be kept, got %+v %v", got, err)
+	}
+}
+
+// racingOrders changes every order, as another instance would, right before
+// it is updated.
+type racingOrders struct {
+	store.OrderStore
+}
+
+func (s racingOrders) UpdateOrder(ctx context.Context, o *model.Order, c *model.OrderChange) error {
+	other := *o
+	other.Status = model.OrderCancelled
+	if err := s.OrderStore.UpdateOrder(ctx, &other, &model.OrderChange{Actor: "other"}); err != nil {
+		return err
+	}
+	return s.OrderStore.UpdateOrder(ctx, o, c)
+}
+
+func TestHandleTransitionConcurrent(t *testing.T) {
+	s := newTestServer(t)
+	o := createOrder(t, s, "alice")
+	orders := s.orders
+	s.orders = racingOrders{orders}
+
+	w := do(s, as("", http.MethodPost, "/orders/"+o.OrderNumber+"/pay", ""))
+	if w.Code != http.StatusConflict {
+		t.Fatalf("expected 409 for order changed concurrently, got %v %s", w.Code, w.Body)
+	}
+	got, _ := orders.GetOrder(context.Background(), o.OrderNumber)
+	if got.Status != model.OrderCancelled || got.Version != 2 {
+		t.Errorf("expected the other change to be kept, got %+v", got)
+	}
+	cs, _ := orders.ListOrderChanges(context.Background(), o.OrderNumber)
+	if len(cs) != 2 || cs[1].Actor != "other" {
+		t.Errorf("expected only the other change in the history, got %+v", cs)
+	}
+
+	// Within an instance, concurrent transitions wait for each other.
+	s.orders = orders
+	o = createOrder(t, s, "alice")
+	var wg sync.WaitGroup
+	codes := make([]int, 10)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			codes[i] = do(s, as("", http.MethodPost, "/orders/"+o.OrderNumber+"/pay", "")).Code
+		}(i)
+	}
+	wg.Wait()
+	for _, c := range codes {
+		if c != http.StatusOK {
+			t.Errorf("expected every payment to succeed, got %v", codes)
+			break
+		}
+	}
+	got, _ = orders.GetOrder(context.Background(), o.OrderNumber)
+	if got.Status != model.OrderPaid || got.Version != 2 {
+		t.Errorf("expected order paid once, got %+v", got)
+	}
+}
+
+func TestHandleCreateOrder(t *testing.T) {
+	s := newTestServer(t)
+	if _, err := s.customers.UpdateCustomer(context.Background(), "bob", func(c *model.Customer) error {
+		c.Deleted = true
+		return nil
+	}); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	tests := []struct {
+		name   string
+		body   string
+		code   int
+		fields []string
+	}{
+		{"valid", `{"customer": "alice", "items": [{"sku": "shoes", "quantity": 1}, {"sku": "socks", "quantity": 3}]}`, http.StatusOK, nil},
+		{"unknown field", `{"customer": "alice", "items": [{"sku": "shoes", "quantity": 1}], "discount": 10}`, http.StatusBadRequest, nil},
+		{"too large", `{"customer": "` + strings.Repeat("a", maxOrderSize) + `"}`, http.StatusRequestEntityTooLarge, nil},
+		{"invalid fields", `{"items": [{"sku": "shoes", "quantity": 0}, {"sku": "", "quantity": 1}], "status": "paid"}`, http.StatusUnprocessableEntity,
+			[]string{"customer", "items[0].quantity", "items[1].sku", "status"}},
+		{"no items", `{"customer": "alice", "items": []}`, http.StatusUnprocessableEntity, []string{"items"}},
+		{"unknown customer and product", `{"customer": "carol", "items": [{"sku": "hats", "quantity": 1}]}`, http.StatusUnprocessableEntity,
+			[]string{"customer", "items[0].sku"}},
+		{"deleted customer", `{"customer": "bob", "items": [{"sku": "shoes", "quantity": 1}]}`, http.StatusUnprocessableEntity, []string{"customer"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(s, as("", http.MethodPost, "/orders", tt.body))
+			if w.Code != tt.code {
+				t.Fatalf("expected %v, got %v: %s", tt.code, w.Code, w.Body)
+			}
+			if tt.fields == nil {
+				return
+			}
+			e := &apierror.Error{}
+			if err := json.NewDecoder(w.Body).Decode(e); err != nil {
+				t.Fatalf("unexpected error decoding response: %s", err)
+			}
+			var fields []string
+			for _, v := range e.Details {
+				fields = append(fields, v.Field)
+			}
+			if strings.Join(fields, ",") != strings.Join(tt.fields, ",") {
+				t.Errorf("expected violations of %v, got %v", tt.fields, fields)
+			}
+		})
+	}
+
+	o := createOrder(t, s, "alice")
+	expected := model.Money{Value: 4990, Decimals: 2, Currency: "EUR"}
+	if o.Status != model.OrderCreated || o.Version != 1 || o.Total != expected || o.Items[0].Name != "Shoes" {
+		t.Errorf("expected new order of shoes priced at %+v, got %+v", expected, o)
+	}
+}
+
+func TestHandleTransition(t *testing.T) {
+	s := newTestServer(t)
+	o := createOrder(t, s, "alice")
+	url := "/orders/" + o.OrderNumber + "/"
+
+	// The steps change the same order, one after the other.
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		code    int
+		status  string
+		version int
+	}{
+		{"invoice before paid", http.MethodPost, url + "invoice", http.StatusConflict, model.OrderCreated, 1},
+		{"pay", http.MethodPost, url + "pay", http.StatusOK, model.OrderPaid, 2},
+		{"pay again", http.MethodPost, url + "pay", http.StatusOK, model.OrderPaid, 2},
+		{"get", http.MethodGet, url + "pay", http.StatusMethodNotAllowed, model.OrderPaid, 2},
+		{"unknown transition", http.MethodPost, url + "refund", http.StatusNotFound, model.OrderPaid, 2},
+		{"invoice", http.MethodPost, url + "invoice", http.StatusOK, model.OrderInvoiced, 3},
+		{"cancel after invoiced", http.MethodPost, url + "cancel", http.StatusConflict, model.OrderInvoiced, 3},
+		{"fulfil", http.MethodPost, url + "fulfil", http.StatusOK, model.OrderFulfilled, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if w := do(s, as("", tt.method, tt.path, "")); w.Code != tt.code {
+				t.Errorf("expected %v, got %v: %s", tt.code, w.Code, w.Body)
+			}
+			got, err := s.orders.GetOrder(context.Background(), o.OrderNumber)
+			if err != nil || got.Status != tt.status || got.Version != tt.version {
+				t.Errorf("expected order %s at version %v, got %+v %v", tt.status, tt.version, got, err)
+			}
+		})
+	}
+
+	if w := do(s, as("", http.MethodPost, "/orders/unknown/pay", "")); w.Code != http.StatusNotFound {
+		t.Errorf("expected 404 for unknown order, got %v", w.Code)
+	}
+}
+
+func TestHandleListOrders(t *testing.T) {
+	s := newTestServer(t)
+	a1, b1, a2 := createOrder(t, s, "alice"), createOrder(t, s, "bob"), createOrder(t, s, "alice")
+	if w := do(s, as("", http.MethodPost, "/orders/"+b1.OrderNumber+"/pay", "")); w.Code != http.StatusOK {
+		t.Fatalf("expected order to be paid, got %v %s", w.Code, w.Body)
+	}
+	list := func(query string) (int, store.OrderPage) {
+		w := do(s, as("", http.MethodGet, "/orders?"+query, ""))
+		p := store.OrderPage{}
+		_ = json.NewDecoder(w.Body).Decode(&p)
+		return w.Code, p
+	}
+
+	tests := []struct {
+		name   string
+		query  string
+		code   int
+		orders []*model.Order
+	}{
+		{"all", "", http.StatusOK, []*model.Order{a1, b1, a2}},
+		{"customer", "customer=alice", http.StatusOK, []*model.Order{a1, a2}},
+		{"status", "status=paid", http.StatusOK, []*model.Order{b1}},
+		{"descending", "orderBy=-orderNumber", http.StatusOK, []*model.Order{a2, b1, a1}},
+		{"created before", "to=2000-01-01T00:00:00Z", http.StatusOK, []*model.Order{}},
+		{"invalid time", "from=yesterday", http.StatusBadRequest, nil},
+		{"invalid page size", "pageSize=0", http.StatusBadRequest, nil},
+		{"invalid order", "orderBy=total", http.StatusBadRequest, nil},
+		{"invalid page token", "pageToken=nonsense", http.StatusBadRequest, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, p := list(tt.query)
+			if code != tt.code {
+				t.Fatalf("expected %v, got %v", tt.code, code)
+			}
+			if tt.orders == nil {
+				return
+			}
+			var expected, got []string
+			for _, o := range tt.orders {
+				expected = append(expected, o.OrderNumber)
+			}
+			for _, o := range p.Orders {
+				got = append(got, o.OrderNumber)
+			}
+			if strings.Join(got, ",") != strings.Join(expected, ",") {
+				t.Errorf("expected orders %v, got %v", expected, got)
+			}
+		})
+	}
+
+	code, p := list("orderBy=orderNumber&pageSize=2")
+	if code != http.StatusOK || len(p.Orders) != 2 || p.NextPageToken == "" {
+		t.Fatalf("expected first page of 2 orders, got %v %+v", code, p)
+	}
+	code, p = list("orderBy=orderNumber&pageSize=2&pageToken=" + p.NextPageToken)
+	if code != http.StatusOK || len(p.Orders) != 1 || p.Orders[0].OrderNumber != a2.OrderNumber || p.NextPageToken != "" {
+		t.Errorf("expected last page with order %s, got %v %+v", a2.OrderNumber, code, p)
+	}
+}
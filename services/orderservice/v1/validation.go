@@ -0,0 +1,80 @@
+package main
+
+import (
+	"lkcommon/model"
+	"lkcommon/validate"
+	"net/mail"
+)
+
+const (
+	// Largest accepted order, in bytes of JSON.
+	maxOrderSize = 1 << 16
+	// Most line items in an order.
+	maxItems = 100
+	// Largest quantity of a line item, which keeps totals far from overflowing.
+	maxQuantity = 1000000
+	// Largest accepted customer, in bytes of JSON.
+	maxCustomerSize = 1 << 12
+	// Largest accepted product, in bytes of JSON.
+	maxProductSize = 1 << 10
+	// Highest unit price in minor units, which with maxQuantity and maxItems
+	// keeps totals far from overflowing.
+	maxUnitPrice = 100000000
+)
+
+// orderRules apply to orders as sent by clients. The number, status,
+// creation time, version and prices are filled in by the order service.
+var orderRules = validate.Rules{
+	"customer":    {validate.Required, validate.Matches(model.ValidCustomerId, "the id of a customer")},
+	"items":       {validate.Count(1, maxItems), validate.Each(itemRules)},
+	"total":       {validate.Absent},
+	"orderNumber": {validate.Absent},
+	"status":      {validate.Absent},
+	"createdAt":   {validate.Absent},
+	"version":     {validate.Absent},
+}
+
+var itemRules = validate.Rules{
+	"sku":       {validate.Required, validate.Matches(model.ValidSku, "1 to 64 letters, digits, '-' or '_'")},
+	"quantity":  {validate.Between(1, maxQuantity)},
+	"name":      {validate.Absent},
+	"unitPrice": {validate.Absent},
+	"total":     {validate.Absent},
+}
+
+// customerRules apply to customers as sent by clients. The id, creation
+// time, owner and deletion are managed by the order service.
+var customerRules = validate.Rules{
+	"id":             {validate.Absent},
+	"name":           {validate.Required, validate.MaxLength(200), validate.Printable},
+	"email":          {validate.Required, validate.MaxLength(254), validate.Matches(validEmail, "an email address such as alice@example.com")},
+	"billingAddress": {validate.Struct(addressRules)},
+	"createdAt":      {validate.Absent},
+	"owner":          {validate.Absent},
+	"deleted":        {validate.Absent},
+}
+
+var addressRules = validate.Rules{
+	"street":     {validate.Required, validate.MaxLength(200), validate.Printable},
+	"postalCode": {validate.MaxLength(20), validate.Printable},
+	"city":       {validate.Required, validate.MaxLength(100), validate.Printable},
+	"country":    {validate.Required, validate.Matches(model.ValidCountry, "an ISO 3166-1 alpha-2 code such as NL")},
+}
+
+var productRules = validate.Rules{
+	"sku":       {validate.Required, validate.Matches(model.ValidSku, "1 to 64 letters, digits, '-' or '_'")},
+	"name":      {validate.Required, validate.MaxLength(200), validate.Printable},
+	"unitPrice": {validate.Struct(moneyRules)},
+}
+
+var moneyRules = validate.Rules{
+	"value":    {validate.Between(0, maxUnitPrice)},
+	"decimals": {validate.Between(0, 4)},
+	"currency": {validate.Required, validate.Matches(model.ValidCurrency, "an ISO 4217 code such as EUR")},
+}
+
+// validEmail accepts a bare email address, without a display name.
+func validEmail(s string) bool {
+	a, err := mail.ParseAddress(s)
+	return err == nil && a.Address == s
+}
@@ -4,12 +4,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/HayoVanLoon/go-commons/logjson"
 	"google.golang.org/api/iterator"
 	"io/ioutil"
-	"log"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
 	"net/http"
-	"strconv"
 )
 
 type Loot struct {
@@ -24,26 +27,31 @@ type AttackResult struct {
 	Log         string `json:"log"`
 }
 
-func addAttacks() {
-	http.HandleFunc("/attacks/1", writeFirestore)
-	http.HandleFunc("/attacks/2", readFirestore)
-	http.HandleFunc("/attacks/3", impersonateOrderService)
-	http.HandleFunc("/leaks/id-token", leakToken)
+// attacker runs the attacks with the service's configuration and client.
+type attacker struct {
+	cfg    *config.Config
+	client *auth.ServiceClient
+}
+
+func addAttacks(cfg *config.Config, client *auth.ServiceClient) {
+	a := &attacker{cfg: cfg, client: client}
+	http.HandleFunc("/attacks/1", a.writeFirestore)
+	http.HandleFunc("/attacks/2", a.readFirestore)
+	http.HandleFunc("/attacks/3", a.impersonateOrderService)
+	http.HandleFunc("/leaks/id-token", a.leakToken)
 	http.HandleFunc("/attacks", listAttacks)
 }
 
 func listAttacks(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Header().Set("allow", "GET")
+	if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
 		return
 	}
 	_, _ = w.Write([]byte("1,2,3"))
 }
 
 func OkAttack(w http.ResponseWriter, r *http.Request, result *AttackResult) {
-	logjson.Info(fmt.Sprintf("[attack] %s successful", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s successful", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
 func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg string) {
@@ -52,11 +60,11 @@ func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg st
 	} else {
 		result.Log = msg
 	}
-	logjson.Info(fmt.Sprintf("[attack] %s failed", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s failed", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
-func GetChainedToken(services []string, target string) (string, error) {
+func (a *attacker) GetChainedToken(services []string, target string) (string, error) {
 	if len(services) == 0 {
 		return "", nil
 	}
@@ -64,18 +72,18 @@ func GetChainedToken(services []string, target string) (string, error) {
 	for i := 0; i < len(services)-1; i += 1 {
 		tgt := fmt.Sprintf("%s/leaks/id-token", services[i+1])
 		var err error
-		idToken, err = GetServiceIdToken(services[i], tgt, idToken)
+		idToken, err = a.GetServiceIdToken(services[i], tgt, idToken)
 		if err != nil {
 			return "", fmt.Errorf("could not get token from %s for %s: %s", services[i], tgt, err)
 		}
 	}
 	last := services[len(services)-1]
-	return GetServiceIdToken(last, target, idToken)
+	return a.GetServiceIdToken(last, target, idToken)
 }
 
-func GetServiceIdToken(service, target, token string) (string, error) {
+func (a *attacker) GetServiceIdToken(service, target, token string) (string, error) {
 	url := service + "/leaks/id-token?url=" + target
-	resp, err := GetWithAuth(url, token)
+	resp, err := a.client.GetWithAuth(url, token)
 	if err != nil {
 		return "", err
 	}
@@ -89,38 +97,37 @@ func GetServiceIdToken(service, target, token string) (string, error) {
 	return string(idToken), nil
 }
 
-func leakToken(w http.ResponseWriter, r *http.Request) {
+func (a *attacker) leakToken(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Query().Get("url")
-	idToken, err := GetIdToken(url)
+	idToken, err := a.client.GetIdToken(url)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not get id token: %s", err))
-		InternalServerError(w, "error in exercise code or setup")
+		logctx.Error(r.Context(), fmt.Sprintf("could not get id token: %s", err))
+		httpx.InternalServerError(w, "error in exercise code or setup")
 		return
 	}
 	_, _ = w.Write([]byte(idToken))
 }
 
-func writeFirestore(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) writeFirestore(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "payment-service writes to firestore",
 	}
 
-	client, err := GetFirestore()
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not create firestore client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not create firestore client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	o := Order{
-		Customer:    "hacker-" + getIp(r),
-		Name:        "loot",
-		Quantity:    1234567890,
-		OrderNumber: 666,
+	o := model.Order{
+		Customer:    "hacker-" + httpx.GetIp(r),
+		Items:       []model.LineItem{{Sku: "loot", Quantity: 1234567890}},
+		OrderNumber: "666",
 	}
-	d := client.Collection(baseCollection + "/orders").Doc(strconv.Itoa(o.OrderNumber))
+	d := client.Collection(gcp.BaseCollection + "/orders").Doc(o.OrderNumber)
 	_, err = d.Create(context.Background(), o)
 	if err == nil {
 		result.Points = 1000
@@ -130,25 +137,25 @@ func writeFirestore(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func readFirestore(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) readFirestore(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "payment-service reads from firestore",
 	}
 
-	client, err := GetFirestore()
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not create firestore client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not create firestore client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	q := client.Collection(baseCollection + "/orders").Limit(1)
+	q := client.Collection(gcp.BaseCollection + "/orders").Limit(1)
 	di := q.Documents(context.Background())
 	d, err := di.Next()
 	if err != nil && err != iterator.Done {
-		logjson.Info(fmt.Sprintf("[attack] error reading from firestore: %s", err))
+		logctx.Info(r.Context(), fmt.Sprintf("[attack] error reading from firestore: %s", err))
 		OkFail(w, r, result, "")
 		return
 	}
@@ -163,22 +170,22 @@ func readFirestore(w http.ResponseWriter, r *http.Request) {
 	OkAttack(w, r, result)
 }
 
-func impersonateOrderService(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) impersonateOrderService(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "payment-service abuses leaked id token from order service",
 	}
 
-	target := numberServiceScheme + "/ranges/payment"
-	idToken, err := GetServiceIdToken(orderServiceScheme, target, "")
+	target := a.cfg.NumberService + "/ranges/payment"
+	idToken, err := a.GetServiceIdToken(a.cfg.OrderService, target, "")
 	if err != nil {
-		logjson.Info(fmt.Sprintf("[attack] could not fetch leaked id token: %s", err))
+		logctx.Info(r.Context(), fmt.Sprintf("[attack] could not fetch leaked id token: %s", err))
 		OkFail(w, r, result, "")
 		return
 	}
 
-	resp, err := GetWithAuth(target, idToken)
+	resp, err := a.client.GetWithAuth(target, idToken)
 	if err == nil && resp.StatusCode == http.StatusOK {
 		result.Points = 10
 		OkAttack(w, r, result)
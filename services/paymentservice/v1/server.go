@@ -1,113 +1,168 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
 	"context"
-	"encoding/json"
 	"fmt"
-	"github.com/HayoVanLoon/go-commons/logjson"
-	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/events"
+	"lkcommon/httpx"
+	"lkcommon/idempotency"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"lkcommon/numberclient"
+	"lkcommon/orderclient"
+	"lkcommon/store"
+	"lkcommon/trace"
+	"lkcommon/validate"
 	"log"
 	"net/http"
 	"os"
 )
 
-var cacheStorage = make(map[int]Payment)
+// Largest accepted payment, in bytes of JSON.
+const maxPaymentSize = 1 << 10
 
-var paymentsBucket = getPaymentsBucket()
+// paymentRules apply to payments as sent by clients. The payment number is
+// handed out by the number service.
+var paymentRules = validate.Rules{
+	"orderNumber":   {validate.Required, validate.MaxLength(64), validate.Printable},
+	"paymentNumber": {validate.Absent},
+}
+
+type server struct {
+	cfg      *config.Config
+	payments store.PaymentStore
+	numbers  numberclient.IdSource
+	orders   *orderclient.Client
+	events   events.Publisher
+}
 
-func handleCreatePayment(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	logjson.Info(fmt.Sprintf("request from %s", GetIdentification(r)))
+func (s *server) handleCreatePayment(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("request from %s", auth.GetIdentification(r)))
 
-	if filterOutMethod([]string{http.MethodPost}, w, r) {
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
 		return
 	}
 
-	data, err := ioutil.ReadAll(r.Body)
+	p := &model.Payment{}
+	err := httpx.DecodeJson(r, p, maxPaymentSize)
 	if err != nil {
-		logjson.Warn(fmt.Sprintf("error reading request body: %s", err))
-		w.WriteHeader(http.StatusBadRequest)
+		logctx.Warn(r.Context(), fmt.Sprintf("error parsing request: %s", err))
+		httpx.WriteError(w, err)
 		return
 	}
-	p := &Payment{}
-	err = json.Unmarshal(data, p)
-	if err != nil {
-		logjson.Warn(fmt.Sprintf("error parsing request: %s", err))
-		w.WriteHeader(http.StatusBadRequest)
+	if err := paymentRules.Check(p); err != nil {
+		logctx.Info(r.Context(), fmt.Sprintf("invalid payment: %s", err))
+		httpx.WriteError(w, err)
 		return
 	}
 
-	if !orderExists(p.OrderNumber) {
-		w.WriteHeader(http.StatusNotFound)
-		msg := fmt.Sprintf(`{"message": "unknown order number %v"}`, p.OrderNumber)
-		_, _ = w.Write([]byte(msg))
+	if err := s.checkOrder(r.Context(), p.OrderNumber); err != nil {
+		logctx.Warn(r.Context(), fmt.Sprintf("could not check order %v: %s", p.OrderNumber, err))
+		httpx.WriteError(w, err)
 		return
 	}
 
-	p.PaymentNumber, err = GetNextNumber("payment")
+	p.PaymentNumber, err = s.numbers.GetNextId(r.Context(), "payment")
 	if err != nil {
-		logjson.Warn(fmt.Sprintf("could not get random number: %s", err))
-		InternalServerError(w, "could not get random number")
+		logctx.Warn(r.Context(), fmt.Sprintf("could not get payment number: %s", err))
+		httpx.WriteError(w, err)
 		return
 	}
 
-	err = savePayment(p)
+	err = s.payments.SavePayment(r.Context(), p)
 	if err != nil {
-		logjson.Warn(fmt.Sprintf("could not save payment: %s", err))
-		InternalServerError(w, "could not save payment")
+		logctx.Warn(r.Context(), fmt.Sprintf("could not save payment: %s", err))
+		httpx.InternalServerError(w, "could not save payment")
 		return
 	}
 
-	OkJson(w, p)
-}
+	// Failures are not stored for replay: a retry with the same idempotency
+	// key gets the same payment number, saves the payment again and repeats
+	// the transition.
+	if _, err := s.orders.Transition(r.Context(), p.OrderNumber, orderclient.Pay); err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not mark order %s paid by payment %s: %s", p.OrderNumber, p.PaymentNumber, err))
+		httpx.WriteError(w, err)
+		return
+	}
 
-func orderExists(o int) bool {
-	r, err := HeadWithAuth(fmt.Sprintf("%s/orders/%v", orderServiceScheme, o))
-	if err != nil {
-		return false
+	// The order is paid, so a retry would be refused. Without the event the
+	// order is not invoiced by event, but it can still be invoiced directly.
+	if err := s.events.Publish(r.Context(), events.PaymentReceived{Payment: *p}); err != nil {
+		logctx.Error(r.Context(), fmt.Sprintf("could not publish payment %s, order %s must be invoiced directly: %s", p.PaymentNumber, p.OrderNumber, err))
 	}
-	return r.StatusCode == http.StatusOK
+
+	httpx.OkJson(w, p)
 }
 
-func savePayment(p *Payment) error {
-	if localEnvironment != "" {
-		cacheStorage[p.OrderNumber] = *p
-	} else {
-		client, err := storage.NewClient(context.Background())
-		if err != nil {
-			return fmt.Errorf("could not get storage client: %s", err)
-		}
-		name := fmt.Sprintf("payment-%v", p.PaymentNumber)
-		w := client.Bucket(paymentsBucket).Object(name).NewWriter(context.Background())
-		bs, _ := json.Marshal(p)
-		_, err = w.Write(bs)
-		if err != nil {
-			return fmt.Errorf("error writing payment to bucket: %s", err)
-		}
-		err = w.Close()
-		if err != nil {
-			return fmt.Errorf("error writing to payments bucket: %s", err)
-		}
+// checkOrder verifies that the order exists and can still be paid. Paid
+// orders cannot be paid again; repeated requests get the stored response
+// from the idempotency middleware instead.
+func (s *server) checkOrder(ctx context.Context, on string) error {
+	o, err := s.orders.GetOrder(ctx, on)
+	if err != nil {
+		return err
+	}
+	if !model.CanTransition(o.Status, model.OrderPaid) {
+		return apierror.Newf(apierror.Conflict, "order %s is %s and cannot be paid", on, o.Status)
 	}
 	return nil
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate("ORDER_SERVICE", "NUMBER_SERVICE")
+	}
+	if err != nil {
+		log.Fatalf("could not load configuration: %s", err)
+	}
+	logctx.Configure(cfg.LogLevel, cfg.Gcp().ProjectId)
+	logctx.Info(context.Background(), "configuration: "+cfg.String())
+
+	client := auth.NewServiceClient(cfg.Gcp().Metadata())
+
+	payments, err := store.OpenPaymentStore(context.Background(), store.ConfigFrom(cfg))
+	if err != nil {
+		log.Fatalf("could not open payment store: %s", err)
+	}
+	numbers := numberclient.NewLeasingClient(cfg.NumberService, client.Client, cfg.NumberBlockSize, cfg.NumberLeaseTime)
+	httpx.OnShutdown(numbers.Release)
+	publisher, err := events.Open(events.ConfigFrom(cfg), client.Client)
+	if err != nil {
+		log.Fatalf("could not open event publisher: %s", err)
 	}
+	httpx.OnShutdown(publisher.Flush)
+	s := &server{cfg: cfg, payments: payments, numbers: numbers, orders: orderclient.New(cfg.OrderService, client.Client), events: publisher}
 
-	if orderServiceScheme == "" {
-		logjson.Critical("ORDER_SERVICE not set")
+	idem, err := idempotency.Open(context.Background(), store.ConfigFrom(cfg), "payments", cfg.IdempotencyWindow)
+	if err != nil {
+		log.Fatalf("could not open idempotency store: %s", err)
 	}
-	if numberServiceScheme == "" {
-		logjson.Critical("NUMBER_SERVICE not set")
+
+	addAttacks(cfg, client)
+	http.Handle("/payments", idem.Handler(http.HandlerFunc(s.handleCreatePayment)))
+	http.HandleFunc("/healthz", httpx.HandleHealth)
+	http.HandleFunc("/readyz", httpx.HandleReady(
+		httpx.Check{Name: "payments", Check: payments.Check},
+		httpx.Check{Name: "idempotency", Check: idem.Check},
+		auth.ServiceCheck(client.Client, "order-service", cfg.OrderService),
+		auth.ServiceCheck(client.Client, "number-service", cfg.NumberService),
+	))
+	http.Handle("/metrics", metrics.Handler())
+
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.Gcp())
+	if err != nil {
+		log.Fatalf("could not create trace exporter: %s", err)
 	}
+	trace.SetExporter(exporter)
 
-	addAttacks()
-	http.HandleFunc("/payments", handleCreatePayment)
-	http.HandleFunc("/healthz", handleHealth)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	verifier := auth.ConfigVerifier(cfg, cfg.PaymentService)
+	if err := httpx.ListenAndServe(":"+cfg.Port, trace.Middleware(metrics.Middleware(http.DefaultServeMux, httpx.WithRequestId(auth.Middleware(verifier, http.DefaultServeMux))))); err != nil {
+		log.Fatal(err)
+	}
 }
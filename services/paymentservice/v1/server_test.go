@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/events"
+	"lkcommon/httpx"
+	"lkcommon/model"
+	"lkcommon/orderclient"
+	"lkcommon/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeOrders serves orders like the order service and applies pay
+// transitions.
+type fakeOrders struct {
+	mux    sync.Mutex
+	orders map[string]*model.Order
+}
+
+func (f *fakeOrders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+	o, ok := f.orders[parts[0]]
+	if !ok {
+		httpx.NotFound(w, "no such order")
+		return
+	}
+	if len(parts) == 2 && parts[1] == orderclient.Pay {
+		o.Status = model.OrderPaid
+	}
+	httpx.OkJson(w, o)
+}
+
+type fakeIds struct {
+	next int
+}
+
+func (f *fakeIds) GetNextId(ctx context.Context, key string) (string, error) {
+	f.next += 1
+	return fmt.Sprintf("P-%v", f.next), nil
+}
+
+// TestHandleCreatePaymentInvalid checks requests that are rejected before
+// any other service is called.
+func TestHandleCreatePaymentInvalid(t *testing.T) {
+	s := &server{}
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"not json", `order 1`, http.StatusBadRequest},
+		{"unknown field", `{"orderNumber": "1", "amount": 10}`, http.StatusBadRequest},
+		{"trailing data", `{"orderNumber": "1"} {}`, http.StatusBadRequest},
+		{"too large", `{"orderNumber": "` + strings.Repeat("1", maxPaymentSize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"missing order number", `{}`, http.StatusUnprocessableEntity},
+		{"payment number", `{"orderNumber": "1", "paymentNumber": "P-1"}`, http.StatusUnprocessableEntity},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleCreatePayment(w, httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Errorf("expected %v, got %v: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+}
+
+func TestHandleCreatePayment(t *testing.T) {
+	orders := &fakeOrders{orders: map[string]*model.Order{
+		"1": {OrderNumber: "1", Status: model.OrderCreated},
+		"2": {OrderNumber: "2", Status: model.OrderPaid},
+		"3": {OrderNumber: "3", Status: model.OrderCancelled},
+	}}
+	srv := httptest.NewServer(orders)
+	defer srv.Close()
+	client := httpx.NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+	publisher := events.NewMemoryPublisher()
+	var paid []string
+	publisher.Subscribe(func(ctx context.Context, e events.Event) error {
+		p := events.PaymentReceived{}
+		_ = e.Decode(&p)
+		paid = append(paid, p.Payment.OrderNumber)
+		return nil
+	})
+	s := &server{
+		payments: store.NewPaymentStore(store.NewMemoryBackend()),
+		numbers:  &fakeIds{},
+		orders:   orderclient.New(srv.URL, client),
+		events:   publisher,
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"created order", `{"orderNumber": "1"}`, http.StatusOK},
+		{"paid again", `{"orderNumber": "1"}`, http.StatusConflict},
+		{"paid order", `{"orderNumber": "2"}`, http.StatusConflict},
+		{"cancelled order", `{"orderNumber": "3"}`, http.StatusConflict},
+		{"unknown order", `{"orderNumber": "4"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			s.handleCreatePayment(w, httptest.NewRequest(http.MethodPost, "/payments", strings.NewReader(tt.body)))
+			if w.Code != tt.code {
+				t.Errorf("expected %v, got %v: %s", tt.code, w.Code, w.Body)
+			}
+		})
+	}
+	if len(paid) != 1 || paid[0] != "1" {
+		t.Errorf("expected one payment of order 1, got %v", paid)
+	}
+}
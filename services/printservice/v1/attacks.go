@@ -5,11 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/HayoVanLoon/go-commons/logjson"
 	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"io/ioutil"
-	"log"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
 	"net/http"
 )
 
@@ -25,25 +29,30 @@ type AttackResult struct {
 	Log         string `json:"log"`
 }
 
-func addAttacks() {
-	http.HandleFunc("/attacks/1", readStorage)
-	http.HandleFunc("/leaks/id-token", leakToken)
-	http.HandleFunc("/leaks/data", leakData)
+// attacker runs the attacks with the service's configuration and client.
+type attacker struct {
+	cfg    *config.Config
+	client *auth.ServiceClient
+}
+
+func addAttacks(cfg *config.Config, client *auth.ServiceClient) {
+	a := &attacker{cfg: cfg, client: client}
+	http.HandleFunc("/attacks/1", a.readStorage)
+	http.HandleFunc("/leaks/id-token", a.leakToken)
+	http.HandleFunc("/leaks/data", a.leakData)
 	http.HandleFunc("/attacks", listAttacks)
 }
 
 func listAttacks(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Header().Set("allow", "GET")
+	if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
 		return
 	}
 	_, _ = w.Write([]byte("1"))
 }
 
 func OkAttack(w http.ResponseWriter, r *http.Request, result *AttackResult) {
-	logjson.Info(fmt.Sprintf("[attack] %s successful", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s successful", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
 func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg string) {
@@ -52,11 +61,11 @@ func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg st
 	} else {
 		result.Log = msg
 	}
-	logjson.Info(fmt.Sprintf("[attack] %s failed", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s failed", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
-func GetChainedToken(services []string, target string) (string, error) {
+func (a *attacker) GetChainedToken(services []string, target string) (string, error) {
 	if len(services) == 0 {
 		return "", nil
 	}
@@ -64,18 +73,18 @@ func GetChainedToken(services []string, target string) (string, error) {
 	for i := 0; i < len(services)-1; i += 1 {
 		tgt := fmt.Sprintf("%s/leaks/id-token", services[i+1])
 		var err error
-		idToken, err = GetServiceIdToken(services[i], tgt, idToken)
+		idToken, err = a.GetServiceIdToken(services[i], tgt, idToken)
 		if err != nil {
 			return "", fmt.Errorf("could not get token from %s for %s: %s", services[i], tgt, err)
 		}
 	}
 	last := services[len(services)-1]
-	return GetServiceIdToken(last, target, idToken)
+	return a.GetServiceIdToken(last, target, idToken)
 }
 
-func GetServiceIdToken(service, target, token string) (string, error) {
+func (a *attacker) GetServiceIdToken(service, target, token string) (string, error) {
 	url := service + "/leaks/id-token?url=" + target
-	resp, err := GetWithAuth(url, token)
+	resp, err := a.client.GetWithAuth(url, token)
 	if err != nil {
 		return "", err
 	}
@@ -89,9 +98,9 @@ func GetServiceIdToken(service, target, token string) (string, error) {
 	return string(idToken), nil
 }
 
-func writeStorage(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) writeStorage(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "print-service writes to payments bucket",
 	}
@@ -99,16 +108,16 @@ func writeStorage(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not create storage client: %s", err))
-		InternalServerError(w, "error in exercise code or setup")
+		logctx.Error(r.Context(), fmt.Sprintf("could not create storage client: %s", err))
+		httpx.InternalServerError(w, "error in exercise code or setup")
 		return
 	}
 
-	p := Payment{
-		PaymentNumber: 999999999,
-		OrderNumber:   666,
+	p := model.Payment{
+		PaymentNumber: "999999999",
+		OrderNumber:   "666",
 	}
-	ow := client.Bucket(getPaymentsBucket()).Object("hacker-payment").NewWriter(ctx)
+	ow := client.Bucket(a.cfg.Gcp().PaymentsBucket()).Object("hacker-payment").NewWriter(ctx)
 	bs, _ := json.Marshal(p)
 	n, err := ow.Write(bs)
 	if err != nil {
@@ -124,9 +133,9 @@ func writeStorage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func readStorage(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) readStorage(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "print-service reads from payments bucket",
 	}
@@ -134,12 +143,12 @@ func readStorage(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not create storage client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("could not create storage client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	or, err := client.Bucket(getPaymentsBucket()).Object("happy-little-file.txt").NewReader(ctx)
+	or, err := client.Bucket(a.cfg.Gcp().PaymentsBucket()).Object("happy-little-file.txt").NewReader(ctx)
 	if err != nil {
 		switch e := err.(type) {
 		case *googleapi.Error:
@@ -149,7 +158,7 @@ func readStorage(w http.ResponseWriter, r *http.Request) {
 			}
 
 		}
-		logjson.Error(fmt.Sprintf("expected file missing: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("expected file missing: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
@@ -167,9 +176,9 @@ func readStorage(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func listStorage(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) listStorage(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "payment-service explores payments bucket",
 	}
@@ -177,12 +186,12 @@ func listStorage(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
 	client, err := storage.NewClient(ctx)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not create storage client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("could not create storage client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	iter := client.Bucket(getPaymentsBucket()).Objects(ctx, &storage.Query{})
+	iter := client.Bucket(a.cfg.Gcp().PaymentsBucket()).Objects(ctx, &storage.Query{})
 	n, err := iter.Next()
 	if err != nil && err != iterator.Done {
 		OkFail(w, r, result, "")
@@ -199,29 +208,29 @@ func listStorage(w http.ResponseWriter, r *http.Request) {
 	OkAttack(w, r, result)
 }
 
-func leakToken(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
+func (a *attacker) leakToken(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
 	url := r.URL.Query().Get("url")
-	idToken, err := GetIdToken(url)
+	idToken, err := a.client.GetIdToken(url)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not get id token: %s", err))
-		InternalServerError(w, "error in exercise code or setup")
+		logctx.Error(r.Context(), fmt.Sprintf("could not get id token: %s", err))
+		httpx.InternalServerError(w, "error in exercise code or setup")
 		return
 	}
 	_, _ = w.Write([]byte(idToken))
 }
 
-func leakData(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	client, err := GetFirestore()
+func (a *attacker) leakData(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not create firestore client: %s", err))
-		InternalServerError(w, "error in exercise code or setup")
+		logctx.Error(r.Context(), fmt.Sprintf("could not create firestore client: %s", err))
+		httpx.InternalServerError(w, "error in exercise code or setup")
 		return
 	}
 
 	var data interface{}
-	q := client.Collection(baseCollection + "/secrets").Limit(1)
+	q := client.Collection(gcp.BaseCollection + "/secrets").Limit(1)
 	di := q.Documents(context.Background())
 	for {
 		d, err := di.Next()
@@ -234,5 +243,5 @@ func leakData(w http.ResponseWriter, r *http.Request) {
 		break
 	}
 
-	OkJson(w, data)
+	httpx.OkJson(w, data)
 }
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"lkcommon/apierror"
+	"lkcommon/config"
+	"lkcommon/events"
+	"lkcommon/logctx"
+	"lkcommon/model"
+	"lkcommon/orderclient"
+	"lkcommon/store"
+	"time"
+)
+
+// Time after which another delivery may take over invoicing an order, when
+// the one that claimed it has not finished.
+const claimTimeout = 2 * time.Minute
+
+// An orderInvoice records that an order is being or has been invoiced.
+type orderInvoice struct {
+	OrderNumber   string    `json:"orderNumber"`
+	InvoiceNumber string    `json:"invoiceNumber"`
+	Claimed       time.Time `json:"claimed"`
+}
+
+// orderInvoices makes sure that an order is invoiced once, however often
+// and concurrently its payment events are delivered.
+type orderInvoices struct {
+	store store.Backend
+}
+
+func openOrderInvoices(ctx context.Context, cfg *config.Config) (*orderInvoices, error) {
+	b, err := store.OpenBackend(ctx, store.ConfigFrom(cfg), "order-invoices", "order-invoice-", store.BackendFirestore)
+	if err != nil {
+		return nil, err
+	}
+	return &orderInvoices{store: b}, nil
+}
+
+// claim returns the number of the order's invoice if it has one. Otherwise
+// it claims the order for invoicing; it fails with a Conflict error while
+// another delivery holds the claim.
+func (oi *orderInvoices) claim(ctx context.Context, orderNumber string) (string, error) {
+	now := time.Now().UTC()
+	err := oi.store.Create(ctx, orderNumber, orderInvoice{OrderNumber: orderNumber, Claimed: now})
+	if err != store.ErrConflict {
+		return "", err
+	}
+
+	rec := &orderInvoice{}
+	err = oi.store.Update(ctx, orderNumber, rec, func() error {
+		if rec.InvoiceNumber != "" {
+			return nil
+		}
+		if now.Sub(rec.Claimed) < claimTimeout {
+			return apierror.Newf(apierror.Conflict, "order %s is being invoiced", orderNumber)
+		}
+		rec.Claimed = now
+		return nil
+	})
+	return rec.InvoiceNumber, err
+}
+
+// release gives up the claim on an order that is not invoiced, so that the
+// next delivery need not wait for the claim to time out.
+func (oi *orderInvoices) release(ctx context.Context, orderNumber string) error {
+	rec := &orderInvoice{}
+	return oi.store.Update(ctx, orderNumber, rec, func() error {
+		if rec.InvoiceNumber == "" {
+			rec.Claimed = time.Time{}
+		}
+		return nil
+	})
+}
+
+func (oi *orderInvoices) done(ctx context.Context, orderNumber, invoiceNumber string) error {
+	return oi.store.Put(ctx, orderNumber, orderInvoice{OrderNumber: orderNumber, InvoiceNumber: invoiceNumber, Claimed: time.Now().UTC()})
+}
+
+func (oi *orderInvoices) Check(ctx context.Context) error {
+	return oi.store.Check(ctx)
+}
+
+// handleEvent invoices orders once they are paid. Other events are
+// ignored.
+func (s *server) handleEvent(ctx context.Context, e events.Event) error {
+	if e.Type != events.TypePaymentReceived {
+		return nil
+	}
+	p := events.PaymentReceived{}
+	if err := e.Decode(&p); err != nil {
+		// Delivering it again will not help.
+		logctx.Error(ctx, err.Error())
+		return nil
+	}
+	_, err := s.invoiceOrder(ctx, p.Payment.OrderNumber)
+	if e, ok := apierror.As(err); ok && (e.Code == apierror.FailedPrecondition || e.Code == apierror.InvalidArgument || e.Code == apierror.Unprocessable) {
+		// Delivering it again will not help.
+		logctx.Warn(ctx, fmt.Sprintf("not invoicing order %s: %s", p.Payment.OrderNumber, err))
+		return nil
+	}
+	return err
+}
+
+// invoiceOrder creates the invoice for a paid order, unless it has one, and
+// marks the order invoiced. Orders that are not paid fail with a
+// FailedPrecondition error.
+func (s *server) invoiceOrder(ctx context.Context, orderNumber string) (*model.Invoice, error) {
+	invoiceNumber, err := s.orderInvoices.claim(ctx, orderNumber)
+	if err != nil {
+		return nil, err
+	}
+
+	var i *model.Invoice
+	if invoiceNumber != "" {
+		i, err = s.invoices.GetInvoice(ctx, invoiceNumber)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		i, err = s.invoiceClaimed(ctx, orderNumber)
+		if err != nil {
+			if rerr := s.orderInvoices.release(ctx, orderNumber); rerr != nil {
+				logctx.Warn(ctx, fmt.Sprintf("could not release order %s, it stays claimed for %s: %s", orderNumber, claimTimeout, rerr))
+			}
+			return nil, err
+		}
+		logctx.Info(ctx, fmt.Sprintf("invoiced order %s with %s", orderNumber, i.InvoiceNumber))
+	}
+
+	if _, err := s.orders.Transition(ctx, orderNumber, orderclient.Invoice); err != nil {
+		if e, ok := apierror.As(err); ok && e.Code == apierror.Conflict {
+			logctx.Warn(ctx, fmt.Sprintf("could not mark order %s invoiced by %s: %s", orderNumber, i.InvoiceNumber, err))
+			return i, nil
+		}
+		return nil, err
+	}
+	return i, nil
+}
+
+// invoiceClaimed invoices a paid order claimed by the caller.
+func (s *server) invoiceClaimed(ctx context.Context, orderNumber string) (*model.Invoice, error) {
+	o, err := s.orders.GetOrder(ctx, orderNumber)
+	if err != nil {
+		return nil, err
+	}
+	if o.Status != model.OrderPaid {
+		// Cancelled, or invoiced before invoicing by event.
+		return nil, apierror.Newf(apierror.FailedPrecondition, "order %s is %s", orderNumber, o.Status)
+	}
+	return s.createInvoice(ctx, o)
+}
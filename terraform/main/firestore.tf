@@ -26,3 +26,65 @@ resource "google_app_engine_application" "app" {
   location_id = var.app_region
   database_type = "CLOUD_FIRESTORE"
 }
+
+// composite indexes for listing orders (GET /orders), which filter on
+// customer and/or status and order by creation time
+locals {
+  order_index_filters = [["Customer"], ["Status"], ["Customer", "Status"]]
+  order_indexes = flatten([
+    for fs in local.order_index_filters : [
+      for o in ["ASCENDING", "DESCENDING"] : { filters = fs, order = o }
+    ]
+  ])
+}
+
+resource "google_firestore_index" "orders" {
+  depends_on = [google_app_engine_application.app]
+  count      = length(local.order_indexes)
+
+  project    = var.project
+  collection = "orders"
+
+  dynamic "fields" {
+    for_each = local.order_indexes[count.index].filters
+    content {
+      field_path = fields.value
+      order      = "ASCENDING"
+    }
+  }
+  fields {
+    field_path = "CreatedAt"
+    order      = local.order_indexes[count.index].order
+  }
+}
+
+// composite index for the number service, which takes numbers from the open
+// reservations of a counter
+resource "google_firestore_index" "reservations" {
+  depends_on = [google_app_engine_application.app]
+
+  project    = var.project
+  collection = "reservations"
+
+  fields {
+    field_path = "Counter"
+    order      = "ASCENDING"
+  }
+  fields {
+    field_path = "State"
+    order      = "ASCENDING"
+  }
+}
+
+// stored responses to requests with an idempotency key are deleted once
+// their replay window has passed
+resource "google_firestore_field" "idempotency_ttl" {
+  depends_on = [google_app_engine_application.app]
+  for_each   = toset(["invoices", "orders", "payments", "numbers"])
+
+  project    = var.project
+  collection = "idempotency-${each.value}"
+  field      = "Expires"
+
+  ttl_config {}
+}